@@ -3,48 +3,230 @@ package config
 import (
 	"errors"
 	"fmt"
-	"log"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-yaml/yaml"
 
 	_ "github.com/go-sql-driver/mysql"
+
+	"github.com/letitloose/user-app/pkg/logging"
 )
 
+// Config is the application config. Besides the yaml name, fields carry tags
+// used for validation and the JSON Schema: doc describes the setting, enum
+// lists the allowed values, range gives inclusive bounds, required marks
+// settings that may not be empty and secret masks the value when printed.
+// Settings tagged reload can be changed while the server is running, see
+// Reloader; changing any other setting needs a restart.
 type Config struct {
-	Db DBConfig
+	Server            ServerConfig
+	Db                DBConfig
+	Tracing           TracingConfig
+	Cache             CacheConfig
+	Log               LogConfig
+	RateLimit         RateLimitConfig `yaml:"rate-limit"`
+	Password          PasswordConfig
+	EmailVerification EmailVerificationConfig `yaml:"email-verification"`
+	Signup            SignupConfig
+	Invitations       InvitationConfig
+	TwoFactor         TwoFactorConfig `yaml:"two-factor"`
+	Passkeys          PasskeyConfig
+	Lockout           LockoutConfig
+	Session           SessionConfig
+	Mail              MailConfig
+	Cors              CORSConfig
+	Dev               bool `doc:"Read templates and static files from disk on every request instead of from the binary. Only useful when run from the repo root."`
+
+	fileName string
+	sources  map[string]Source
+	lines    map[string]int
+}
+
+type ServerConfig struct {
+	Address        string        `doc:"Address to listen on, as host:port or :port."`
+	RequestTimeout time.Duration `yaml:"request-timeout" range:"1s,10m" doc:"How long a request may run before it and its database queries are canceled."`
+	ExportTimeout  time.Duration `yaml:"export-timeout" range:"1m,24h" doc:"How long GET /users/export may stream before it is canceled, in place of request-timeout."`
+	PublicURL      string        `yaml:"public-url" doc:"URL users reach the app at, e.g. https://users.example.com, used for links in emails."`
 }
 
+// DBConfig says how to reach MySQL, either through the separate settings
+// or as a complete DSN, which takes precedence when set.
 type DBConfig struct {
-	Username string
-	Password string
-	Host     string
-	Port     int
-	Database string
+	Username string `doc:"Database user."`
+	Password string `secret:"true" doc:"Database password."`
+	Host     string `doc:"Database host name. Required unless dsn is set."`
+	Port     int    `range:"1,65535" doc:"Database port."`
+	Database string `doc:"Database (schema) name. Required unless dsn is set."`
+	DSN      string `yaml:"dsn" secret:"true" doc:"Complete driver connection string, e.g. user:pass@tcp(db:3306)/users?parseTime=true. Overrides the other connection settings."`
+
+	MaxOpenConns    int           `yaml:"max-open-conns" range:"0,10000" doc:"Most connections open at once, 0 for no limit."`
+	MaxIdleConns    int           `yaml:"max-idle-conns" range:"0,10000" doc:"Most idle connections kept in the pool."`
+	ConnMaxLifetime time.Duration `yaml:"conn-max-lifetime" range:"0s,24h" doc:"How long a connection may be reused, 0 for no limit."`
+	ConnMaxIdleTime time.Duration `yaml:"conn-max-idle-time" range:"0s,24h" doc:"How long a connection may sit idle before it is closed, 0 for no limit."`
+	StartupTimeout  time.Duration `yaml:"startup-timeout" range:"0s,10m" doc:"How long to keep retrying the first connection at startup."`
+	WriteRetries    int           `yaml:"write-retries" range:"0,10" doc:"How many times a write is retried after a deadlock or dropped connection."`
+	IsolationLevel  string        `yaml:"isolation-level" enum:"default,read-uncommitted,read-committed,repeatable-read,serializable" doc:"Isolation level of transactions spanning several user operations."`
+
+	Replicas             []string      `secret:"true" doc:"DSNs of read replicas. Reads are spread across them, falling back to the primary when none are healthy."`
+	ReadYourWrites       time.Duration `yaml:"read-your-writes" range:"0s,1h" doc:"How long after a user is modified their reads, and user lists, go to the primary instead of a replica."`
+	ReplicaCheckInterval time.Duration `yaml:"replica-check-interval" range:"1s,1h" doc:"How often replicas are pinged to take failed ones out of rotation and put recovered ones back."`
 }
 
-var config *Config
+// TracingConfig selects where spans are sent. Exporter is one of "none",
+// "file" (OTLP/JSON lines written to File) or "otlp" (posted to Endpoint).
+type TracingConfig struct {
+	Exporter    string `enum:"none,file,otlp" doc:"Where to send trace spans."`
+	File        string `doc:"File the file exporter appends OTLP/JSON spans to."`
+	Endpoint    string `doc:"Base URL of the OTLP/HTTP collector, e.g. http://localhost:4318."`
+	ServiceName string `yaml:"service-name" doc:"service.name reported with every span."`
+}
+
+// CacheConfig sizes the in-process cache of user lookups. The user list,
+// without passwords, can also be shared by every instance through a Redis
+// compatible server.
+type CacheConfig struct {
+	Size          int           `range:"0,1000000" doc:"Most user lookups kept in memory, 0 to turn the cache off."`
+	TTL           time.Duration `yaml:"ttl" range:"0s,24h" doc:"How long a user lookup is cached."`
+	NegativeTTL   time.Duration `yaml:"negative-ttl" range:"0s,1h" doc:"How long a lookup of a user that does not exist is cached."`
+	RedisAddress  string        `yaml:"redis-address" doc:"host:port of a Redis compatible server to share the cached user list through, empty for none."`
+	RedisPassword string        `yaml:"redis-password" secret:"true" doc:"Password for the Redis server."`
+}
+
+type LogConfig struct {
+	Level string `enum:"debug,info,warn,error" reload:"true" doc:"Least severe log messages to write."`
+}
+
+// RateLimitConfig limits how many requests each client may make per Window,
+// as a token bucket refilled over the window. Auth and Writes set separate
+// limits for their route groups; other requests get Requests, Window and
+// Key. A Requests of 0 turns the default limit off.
+type RateLimitConfig struct {
+	Requests       int           `range:"0,1000000" reload:"true" doc:"Requests each client may make per window, 0 for no limit."`
+	Window         time.Duration `range:"1s,24h" reload:"true" doc:"Period the request limit applies to."`
+	Key            string        `enum:"ip,session,user" reload:"true" doc:"What a client is: its IP address, its session or the user logged in. Anonymous requests are always counted by IP address."`
+	Auth           RateLimitRule `doc:"Limit for logging in, signing up, password resets and accepting invitations."`
+	Writes         RateLimitRule `doc:"Limit for other requests that change something, such as POST /users."`
+	TrustedProxies []string      `yaml:"trusted-proxies" reload:"true" doc:"IP addresses or CIDR ranges, e.g. 10.0.0.0/8, of proxies whose X-Forwarded-For header gives the client IP address."`
+}
+
+// RateLimitRule is the limit for one group of routes, see RateLimitConfig.
+// A Requests of 0 applies the default limit to the group instead.
+type RateLimitRule struct {
+	Requests int           `range:"0,1000000" reload:"true" doc:"Requests each client may make per window, 0 to apply rate-limit.requests instead."`
+	Window   time.Duration `range:"1s,24h" reload:"true" doc:"Period the request limit applies to."`
+	Key      string        `enum:"ip,session,user" reload:"true" doc:"What a client is: its IP address, its session or the user logged in."`
+}
+
+type PasswordConfig struct {
+	MinLength     int           `yaml:"min-length" range:"0,1024" reload:"true" doc:"Shortest password accepted for new or changed passwords, 0 for no minimum."`
+	RequireDigit  bool          `yaml:"require-digit" reload:"true" doc:"Require new or changed passwords to contain a digit."`
+	ResetTokenTTL time.Duration `yaml:"reset-token-ttl" range:"1m,72h" reload:"true" doc:"How long an emailed password reset link works."`
+}
+
+// EmailVerificationConfig covers confirming that users own their email
+// address, which is asked for on signup and whenever it changes.
+type EmailVerificationConfig struct {
+	RequireBeforeLogin bool          `yaml:"require-before-login" reload:"true" doc:"Refuse to log in users whose email address is not verified."`
+	TokenTTL           time.Duration `yaml:"token-ttl" range:"1m,720h" reload:"true" doc:"How long an emailed verification link works."`
+	ResendInterval     time.Duration `yaml:"resend-interval" range:"0s,24h" reload:"true" doc:"Shortest time between verification emails to one user, 0 for no limit."`
+}
+
+// SignupConfig decides who may create an account for themselves, through
+// /signup or POST /users. Admins can always add users.
+type SignupConfig struct {
+	Mode           string   `enum:"open,approval,invite-only" reload:"true" doc:"open lets anyone sign up, approval holds new accounts until an admin approves them and invite-only turns signup off."`
+	AllowedDomains []string `yaml:"allowed-domains" reload:"true" doc:"Email domains, e.g. example.com, that may sign up. Empty allows any, and an email address is then optional."`
+}
 
+// InvitationConfig covers the links admins email to invite people.
+type InvitationConfig struct {
+	TTL        time.Duration `range:"1h,2160h" reload:"true" doc:"How long an invitation link works."`
+	SigningKey string        `yaml:"signing-key" secret:"true" doc:"Key invitation links are signed with, the same on every instance. Invitations cannot be sent or accepted without it, and changing it makes links already sent stop working."`
+}
+
+// TwoFactorConfig covers the one-time codes from an authenticator app that
+// users who turn on two-factor authentication enter after their password.
+type TwoFactorConfig struct {
+	Issuer        string   `reload:"true" doc:"Name authenticator apps show next to the username."`
+	RequiredRoles []string `yaml:"required-roles" reload:"true" doc:"Roles, user or admin, that must set up two-factor authentication when they next log in."`
+	EncryptionKey string   `yaml:"encryption-key" secret:"true" doc:"Key authenticator secrets are encrypted with in the database. Two-factor authentication needs it, and changing it makes everyone set it up again."`
+}
+
+// PasskeyConfig covers logging in with passkeys and security keys through
+// WebAuthn. Browsers only offer them on the origin of server.public-url.
+type PasskeyConfig struct {
+	Name             string `reload:"true" doc:"Site name authenticators show when a passkey is registered."`
+	RPID             string `yaml:"rp-id" doc:"Domain passkeys are registered for, the host of server.public-url or a parent domain of it. Defaults to the host; changing it makes existing passkeys stop working."`
+	UserVerification string `yaml:"user-verification" enum:"required,preferred,discouraged" reload:"true" doc:"Whether authenticators must check a PIN or biometric, not only that someone is present."`
+}
+
+// LockoutConfig slows down and then stops password guessing. Failed logins
+// and two-factor codes are counted per account and per IP address, and the
+// counts are forgotten after Duration without a failure or, for an account,
+// when it logs in.
+type LockoutConfig struct {
+	MaxAttempts   int           `yaml:"max-attempts" range:"0,1000" reload:"true" doc:"Failed logins in a row that lock an account, 0 to never lock accounts."`
+	IPMaxAttempts int           `yaml:"ip-max-attempts" range:"0,1000000" reload:"true" doc:"Failed logins from one IP address that lock it out of every account, 0 to never lock addresses."`
+	Duration      time.Duration `range:"1m,720h" reload:"true" doc:"How long a lockout lasts, and how long failed logins are remembered."`
+	Delay         time.Duration `range:"0s,1h" reload:"true" doc:"Wait after a failed login before the account may try again, doubled by each further failure. 0 for no wait."`
+}
+
+type SessionConfig struct {
+	TTL time.Duration `range:"1m,720h" reload:"true" doc:"How long a login lasts."`
+}
+
+// MailConfig says how emails are sent. The stdout and file transports only
+// write them out, for local use.
+type MailConfig struct {
+	Transport    string `enum:"stdout,file,smtp" doc:"How emails are sent: written to stdout, appended to file or sent through an SMTP server."`
+	From         string `required:"true" doc:"Sender address of emails."`
+	File         string `doc:"File the file transport appends emails to."`
+	SMTPAddress  string `yaml:"smtp-address" doc:"host:port of the SMTP server."`
+	SMTPUsername string `yaml:"smtp-username" doc:"User to authenticate to the SMTP server as, empty for none."`
+	SMTPPassword string `yaml:"smtp-password" secret:"true" doc:"Password for the SMTP server."`
+}
+
+type CORSConfig struct {
+	AllowedOrigins []string `yaml:"allowed-origins" reload:"true" doc:"Origins, e.g. https://admin.example.com, allowed to call the API from a browser. * allows any."`
+}
+
+// FileName is the config file the config was loaded from, which may not
+// exist.
+func (config *Config) FileName() string {
+	return config.fileName
+}
+
+var current atomic.Value
+
+// GetConfig returns the current config. A reload swaps in a new *Config
+// rather than changing the one callers already hold, so the result must be
+// treated as read-only and fetched again to see reloaded settings.
 func GetConfig() *Config {
-	if config == nil {
-		config = &Config{}
+	if loaded, ok := current.Load().(*Config); ok {
+		return loaded
 	}
-	return config
+	current.CompareAndSwap(nil, &Config{})
+	return current.Load().(*Config)
+}
+
+// SetConfig makes config the one GetConfig returns.
+func SetConfig(config *Config) {
+	current.Store(config)
 }
 
 func (config *Config) ReadConfig(fileName string) error {
-	log.Printf("reading config: %s\n", fileName)
+	logging.Infof("reading config: %s", fileName)
 	configFileBytes, err := os.ReadFile(fileName)
 	if err != nil {
 		return errors.New(fmt.Sprintf("error opening config file: %s\n", err))
 	}
 
-	err = yaml.Unmarshal(configFileBytes, config)
+	err = yaml.UnmarshalStrict(configFileBytes, config)
 	if err != nil {
 		return errors.New(fmt.Sprintf("error unmarshalling config file:%s\n", err))
 	}
 
-	log.Printf("Config Values: %v\n", config)
-
 	return nil
 }
@@ -1,8 +1,12 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/go-yaml/yaml"
@@ -46,13 +50,213 @@ func TestApp(t *testing.T) {
 		app := GetConfig()
 		app.ReadConfig("config.yml")
 
-		if config.Db.Database != "database" {
-			t.Fatalf("Db config not loaded properly:%s", config.Db.Database)
+		if app.Db.Database != "database" {
+			t.Fatalf("Db config not loaded properly:%s", app.Db.Database)
 		}
 
-		if config.Db.Port != 3306 {
-			t.Fatalf("Port config not loaded properly:%d", config.Db.Port)
+		if app.Db.Port != 3306 {
+			t.Fatalf("Port config not loaded properly:%d", app.Db.Port)
 		}
 	})
 
+	t.Run("Load applies defaults, file, env and flags in order", func(t *testing.T) {
+		dir := t.TempDir()
+		fileName := filepath.Join(dir, "app-config.yml")
+		os.WriteFile(fileName, []byte("db:\n  host: filehost\n  port: 3307\n  username: fileuser\n"), 0644)
+
+		config := &Config{}
+		err := config.Load([]string{"-config", fileName, "-db.port", "3309"}, []string{"USERAPP_DB_PORT=3308", "USERAPP_DB_USERNAME=envuser", "USERAPP_DB_DATABASE=users"})
+		if err != nil {
+			t.Fatalf("error loading config: %s", err)
+		}
+
+		if config.Server.Address != ":8080" || config.Source("server.address").Layer != "default" {
+			t.Errorf("default not applied: %s from %s", config.Server.Address, config.Source("server.address"))
+		}
+		if config.Db.Host != "filehost" || config.Source("db.host").String() != "file: "+fileName {
+			t.Errorf("file not applied: %s from %s", config.Db.Host, config.Source("db.host"))
+		}
+		if config.Db.Username != "envuser" || config.Source("db.username").String() != "env: USERAPP_DB_USERNAME" {
+			t.Errorf("env not applied: %s from %s", config.Db.Username, config.Source("db.username"))
+		}
+		if config.Db.Port != 3309 || config.Source("db.port").String() != "flag: -db.port" {
+			t.Errorf("flag not applied: %d from %s", config.Db.Port, config.Source("db.port"))
+		}
+		if config.Password.MinLength != 0 || config.Password.RequireDigit {
+			t.Errorf("got password policy %+v want none by default", config.Password)
+		}
+	})
+
+	t.Run("Load reads secrets from _FILE variables", func(t *testing.T) {
+		dir := t.TempDir()
+		secret := filepath.Join(dir, "db-password")
+		os.WriteFile(secret, []byte("s3cret\n"), 0600)
+
+		config := &Config{}
+		err := config.Load(nil, []string{"USERAPP_DB_PASSWORD_FILE=" + secret, "USERAPP_DB_DATABASE=users"})
+		if err != nil {
+			t.Fatalf("error loading config: %s", err)
+		}
+
+		if config.Db.Password != "s3cret" {
+			t.Errorf("secret not read from file: %q", config.Db.Password)
+		}
+		if config.Source("db.password").String() != "env: USERAPP_DB_PASSWORD_FILE" {
+			t.Errorf("wrong source: %s", config.Source("db.password"))
+		}
+	})
+
+	t.Run("Load only requires the config file when one is named", func(t *testing.T) {
+		config := &Config{}
+		err := config.Load(nil, []string{"USERAPP_CONFIG=" + filepath.Join(t.TempDir(), "missing.yml")})
+		if err == nil {
+			t.Fatal("expected an error for a missing named config file")
+		}
+
+		err = config.Load([]string{"-db.database", "users"}, nil)
+		if err != nil {
+			t.Fatalf("a missing default config file should not be an error: %s", err)
+		}
+	})
+
+	t.Run("Load rejects bad values", func(t *testing.T) {
+		config := &Config{}
+		err := config.Load([]string{"-db.port", "abc"}, nil)
+		if err == nil || !strings.Contains(err.Error(), "-db.port") {
+			t.Fatalf("expected an error naming the flag, got: %v", err)
+		}
+
+		err = config.Load(nil, []string{"USERAPP_DEV=maybe"})
+		if err == nil || !strings.Contains(err.Error(), "USERAPP_DEV") {
+			t.Fatalf("expected an error naming the variable, got: %v", err)
+		}
+	})
+
+	t.Run("Print masks secrets when redacted", func(t *testing.T) {
+		config := &Config{}
+		err := config.Load([]string{"-db.password", "hunter2", "-db.database", "users"}, nil)
+		if err != nil {
+			t.Fatalf("error loading config: %s", err)
+		}
+
+		var output bytes.Buffer
+		config.Print(&output, true)
+		if strings.Contains(output.String(), "hunter2") || !strings.Contains(output.String(), "********") {
+			t.Errorf("password not redacted:\n%s", output.String())
+		}
+		if !strings.Contains(output.String(), "# flag: -db.password") {
+			t.Errorf("source not printed:\n%s", output.String())
+		}
+
+		output.Reset()
+		config.Print(&output, false)
+		if !strings.Contains(output.String(), "hunter2") {
+			t.Errorf("password missing from unredacted output:\n%s", output.String())
+		}
+	})
+
+	t.Run("Load reports every problem with where it was set", func(t *testing.T) {
+		fileName := filepath.Join(t.TempDir(), "app-config.yml")
+		os.WriteFile(fileName, []byte("db:\n  host: db\n  prot: 3306\n  database: users\ntracing:\n  exporter: jaeger\n"), 0644)
+
+		config := &Config{}
+		err := config.Load([]string{"-config", fileName, "-db.port", "70000"}, []string{"USERAPP_SERVER_ADDRESS=8080"})
+		var validationError *ValidationError
+		if !errors.As(err, &validationError) {
+			t.Fatalf("expected a ValidationError, got: %v", err)
+		}
+
+		want := []string{
+			fileName + ":3: unknown key \"prot\"",
+			fileName + ":6: tracing.exporter:",
+			"-db.port: db.port:",
+			"USERAPP_SERVER_ADDRESS: server.address:",
+		}
+		for _, expected := range want {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("missing problem %q in:\n%s", expected, err)
+			}
+		}
+		if len(validationError.Problems) != len(want) {
+			t.Errorf("wrong number of problems, got %d want %d:\n%s", len(validationError.Problems), len(want), err)
+		}
+		if config.Db.Host != "db" {
+			t.Errorf("config not loaded alongside errors, got %q want %q", config.Db.Host, "db")
+		}
+	})
+
+	t.Run("Validate requires an endpoint for the otlp exporter", func(t *testing.T) {
+		config := &Config{}
+		err := config.Load([]string{"-db.database", "users", "-tracing.exporter", "otlp"}, nil)
+		if err == nil || !strings.Contains(err.Error(), "tracing.endpoint") {
+			t.Fatalf("expected an error for tracing.endpoint, got: %v", err)
+		}
+
+		err = config.Load([]string{"-db.database", "users", "-tracing.exporter", "otlp", "-tracing.endpoint", "http://collector:4318"}, nil)
+		if err != nil {
+			t.Fatalf("error loading config: %s", err)
+		}
+	})
+
+	t.Run("checked in schema matches the Config struct", func(t *testing.T) {
+		var generated bytes.Buffer
+		err := WriteSchema(&generated)
+		if err != nil {
+			t.Fatalf("error generating schema: %s", err)
+		}
+
+		checkedIn, err := os.ReadFile("../../app-config.schema.json")
+		if err != nil {
+			t.Fatalf("error reading schema: %s", err)
+		}
+		if !bytes.Equal(generated.Bytes(), checkedIn) {
+			t.Fatal("app-config.schema.json is out of date, regenerate it with: user-app config schema > app-config.schema.json")
+		}
+	})
+
+	t.Run("Validate accepts a DSN in place of host and database", func(t *testing.T) {
+		config := &Config{}
+		err := config.Load([]string{"-db.host", ""}, nil)
+		if err == nil || !strings.Contains(err.Error(), "db.host: is required unless db.dsn is set") {
+			t.Fatalf("expected db.host to be required, got: %v", err)
+		}
+
+		err = config.Load([]string{"-db.host", "", "-db.dsn", "user:pass@tcp(db:3306)/users?parseTime=true"}, nil)
+		if err != nil {
+			t.Fatalf("error loading config with a DSN: %s", err)
+		}
+
+		err = config.Load([]string{"-db.dsn", "not a dsn"}, nil)
+		if err == nil || !strings.Contains(err.Error(), "db.dsn") {
+			t.Fatalf("expected an invalid DSN error, got: %v", err)
+		}
+	})
+
+	t.Run("Validate requires passkeys.rp-id to cover the public URL", func(t *testing.T) {
+		config := &Config{}
+		err := config.Load([]string{"-db.database", "users", "-server.public-url", "https://users.example.com", "-passkeys.rp-id", "other.com"}, nil)
+		if err == nil || !strings.Contains(err.Error(), "passkeys.rp-id") {
+			t.Fatalf("expected an error for passkeys.rp-id, got: %v", err)
+		}
+
+		for _, rpID := range []string{"users.example.com", "example.com"} {
+			err = config.Load([]string{"-db.database", "users", "-server.public-url", "https://users.example.com", "-passkeys.rp-id", rpID}, nil)
+			if err != nil {
+				t.Fatalf("error loading config with rp-id %s: %s", rpID, err)
+			}
+		}
+	})
+
+	t.Run("Validate requires rate-limit.trusted-proxies to be addresses or ranges", func(t *testing.T) {
+		config := &Config{}
+		err := config.Load([]string{"-db.database", "users", "-rate-limit.trusted-proxies", "10.0.0.0/8,proxy.internal"}, nil)
+		if err == nil || !strings.Contains(err.Error(), `rate-limit.trusted-proxies: must be IP addresses or CIDR ranges, got "proxy.internal"`) {
+			t.Fatalf("expected an error for rate-limit.trusted-proxies, got: %v", err)
+		}
+
+		err = config.Load([]string{"-db.database", "users", "-rate-limit.trusted-proxies", "10.0.0.0/8, 192.0.2.1, ::1"}, nil)
+		if err != nil {
+			t.Fatalf("error loading config: %s", err)
+		}
+	})
 }
@@ -0,0 +1,377 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-yaml/yaml"
+)
+
+const (
+	DefaultFileName = "app-config.yml"
+	envPrefix       = "USERAPP_"
+	fileSuffix      = "_FILE"
+)
+
+// Source records which layer an effective config value came from.
+type Source struct {
+	Layer string
+	Name  string
+}
+
+func (source Source) String() string {
+	if source.Name == "" {
+		return source.Layer
+	}
+	return source.Layer + ": " + source.Name
+}
+
+func setDefaults(config *Config) {
+	config.Server.Address = ":8080"
+	config.Db.Host = "localhost"
+	config.Db.Port = 3306
+	config.Db.MaxOpenConns = 25
+	config.Db.MaxIdleConns = 25
+	config.Db.ConnMaxLifetime = 5 * time.Minute
+	config.Db.ConnMaxIdleTime = time.Minute
+	config.Db.StartupTimeout = 30 * time.Second
+	config.Db.WriteRetries = 3
+	config.Db.IsolationLevel = "default"
+	config.Db.ReadYourWrites = 5 * time.Second
+	config.Db.ReplicaCheckInterval = 10 * time.Second
+	config.Server.RequestTimeout = 30 * time.Second
+	config.Server.ExportTimeout = time.Hour
+	config.Tracing.Exporter = "none"
+	config.Tracing.ServiceName = "user-app"
+	config.Cache.Size = 10000
+	config.Cache.TTL = time.Minute
+	config.Cache.NegativeTTL = 10 * time.Second
+	config.Log.Level = "info"
+	config.RateLimit.Window = time.Minute
+	config.RateLimit.Key = "ip"
+	config.RateLimit.Auth = RateLimitRule{Requests: 20, Window: time.Minute, Key: "ip"}
+	config.RateLimit.Writes = RateLimitRule{Window: time.Minute, Key: "user"}
+	config.Password.ResetTokenTTL = time.Hour
+	config.EmailVerification.TokenTTL = 24 * time.Hour
+	config.EmailVerification.ResendInterval = time.Minute
+	config.Session.TTL = 12 * time.Hour
+	config.Signup.Mode = "open"
+	config.Invitations.TTL = 7 * 24 * time.Hour
+	config.TwoFactor.Issuer = "user-app"
+	config.Passkeys.Name = "user-app"
+	config.Passkeys.UserVerification = "preferred"
+	config.Lockout.MaxAttempts = 5
+	config.Lockout.IPMaxAttempts = 50
+	config.Lockout.Duration = 15 * time.Minute
+	config.Lockout.Delay = time.Second
+	config.Server.PublicURL = "http://localhost:8080"
+	config.Mail.Transport = "stdout"
+	config.Mail.From = "user-app@localhost"
+}
+
+// Load builds the effective config in layers, each overriding the last:
+// defaults, the YAML file, USERAPP_* environment variables and finally the
+// command line flags in args. Any variable can instead be given as
+// USERAPP_<NAME>_FILE, naming a file to read the value from, which is how
+// Docker and Kubernetes mount secrets.
+//
+// Unknown keys, unparseable values and failed validation are all collected
+// into a single *ValidationError. The config is still fully loaded in that
+// case so it can be printed.
+func (config *Config) Load(args []string, environ []string) error {
+	*config = Config{sources: map[string]Source{}, lines: map[string]int{}}
+	setDefaults(config)
+	fields := configFields(config)
+	for _, field := range fields {
+		config.sources[field.key] = Source{Layer: "default"}
+	}
+
+	flags, fileName, err := parseFlags(fields, args)
+	if err != nil {
+		return err
+	}
+	env := environMap(environ)
+	fileRequired := fileName != ""
+	if fileName == "" {
+		fileName = env[envPrefix+"CONFIG"]
+		fileRequired = fileName != ""
+	}
+	if fileName == "" {
+		fileName = DefaultFileName
+	}
+
+	config.fileName = fileName
+	problems := []Problem{}
+	err = config.loadFile(fileName, fileRequired)
+	var validationError *ValidationError
+	if errors.As(err, &validationError) {
+		problems = append(problems, validationError.Problems...)
+	} else if err != nil {
+		return err
+	}
+
+	for _, field := range fields {
+		name := envName(field.key)
+		value, fromFile, ok, err := lookupEnv(env, name)
+		if fromFile {
+			name += fileSuffix
+		}
+		if err != nil {
+			problems = append(problems, Problem{Key: field.key, Location: name, Message: err.Error()})
+			continue
+		}
+		if !ok {
+			continue
+		}
+		err = setField(field.value, value)
+		if err != nil {
+			problems = append(problems, Problem{Key: field.key, Location: name, Message: "invalid value: " + err.Error()})
+			continue
+		}
+		config.sources[field.key] = Source{Layer: "env", Name: name}
+	}
+
+	for _, field := range fields {
+		value, ok := flags[field.key]
+		if !ok {
+			continue
+		}
+		err = setField(field.value, value)
+		if err != nil {
+			problems = append(problems, Problem{Key: field.key, Location: "-" + field.key, Message: "invalid value: " + err.Error()})
+			continue
+		}
+		config.sources[field.key] = Source{Layer: "flag", Name: "-" + field.key}
+	}
+
+	if errors.As(config.Validate(), &validationError) {
+		problems = append(problems, validationError.Problems...)
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func (config *Config) loadFile(fileName string, required bool) error {
+	contents, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening config file: %s", err)
+	}
+
+	var present map[string]any
+	err = yaml.Unmarshal(contents, &present)
+	if err != nil {
+		return decodeErrors(fileName, err)
+	}
+	for _, key := range yamlKeys("", present) {
+		if _, known := config.sources[key]; known {
+			config.sources[key] = Source{Layer: "file", Name: fileName}
+		}
+	}
+	config.lines = yamlLines(contents)
+
+	// Strict decoding still sets every field it understands before
+	// returning its errors, so the caller can carry on and report them
+	// alongside everything else.
+	err = yaml.UnmarshalStrict(contents, config)
+	if err != nil {
+		return decodeErrors(fileName, err)
+	}
+	return nil
+}
+
+// Source reports where the value for key, e.g. "db.password", came from.
+func (config *Config) Source(key string) Source {
+	source, ok := config.sources[key]
+	if !ok {
+		return Source{Layer: "default"}
+	}
+	return source
+}
+
+// Print writes every setting with its effective value and source. Secret
+// values are masked when redacted is set.
+func (config *Config) Print(writer io.Writer, redacted bool) error {
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	for _, field := range configFields(config) {
+		value := formatField(field.value)
+		if redacted && field.secret && value != "" {
+			value = "********"
+		}
+		fmt.Fprintf(table, "%s\t%s\t# %s\n", field.key, value, config.Source(field.key))
+	}
+	return table.Flush()
+}
+
+type configField struct {
+	key    string
+	value  reflect.Value
+	tag    reflect.StructTag
+	secret bool
+}
+
+// configFields lists every setting in config as a dotted key named the same
+// way as in the YAML file, e.g. "tracing.service-name".
+func configFields(config *Config) []configField {
+	return structFields("", reflect.ValueOf(config).Elem())
+}
+
+func structFields(prefix string, value reflect.Value) []configField {
+	fields := []configField{}
+	for i := 0; i < value.NumField(); i++ {
+		structField := value.Type().Field(i)
+		if structField.PkgPath != "" {
+			continue
+		}
+		key := prefix + yamlName(structField)
+		if structField.Type.Kind() == reflect.Struct {
+			fields = append(fields, structFields(key+".", value.Field(i))...)
+			continue
+		}
+		fields = append(fields, configField{key: key, value: value.Field(i), tag: structField.Tag, secret: structField.Tag.Get("secret") == "true"})
+	}
+	return fields
+}
+
+func yamlName(structField reflect.StructField) string {
+	name := strings.Split(structField.Tag.Get("yaml"), ",")[0]
+	if name == "" {
+		return strings.ToLower(structField.Name)
+	}
+	return name
+}
+
+func yamlKeys(prefix string, values map[string]any) []string {
+	keys := []string{}
+	for key, value := range values {
+		if nested, ok := value.(map[any]any); ok {
+			converted := map[string]any{}
+			for nestedKey, nestedValue := range nested {
+				converted[fmt.Sprint(nestedKey)] = nestedValue
+			}
+			keys = append(keys, yamlKeys(prefix+key+".", converted)...)
+			continue
+		}
+		keys = append(keys, prefix+key)
+	}
+	return keys
+}
+
+func envName(key string) string {
+	replacer := strings.NewReplacer(".", "_", "-", "_")
+	return envPrefix + strings.ToUpper(replacer.Replace(key))
+}
+
+func environMap(environ []string) map[string]string {
+	env := map[string]string{}
+	for _, entry := range environ {
+		name, value, found := strings.Cut(entry, "=")
+		if found {
+			env[name] = value
+		}
+	}
+	return env
+}
+
+func lookupEnv(env map[string]string, name string) (value string, fromFile bool, ok bool, err error) {
+	if fileName, set := env[name+fileSuffix]; set {
+		contents, err := os.ReadFile(fileName)
+		if err != nil {
+			return "", true, false, fmt.Errorf("error reading %s: %s", name+fileSuffix, err)
+		}
+		return strings.TrimRight(string(contents), "\r\n"), true, true, nil
+	}
+	value, ok = env[name]
+	return value, false, ok, nil
+}
+
+func parseFlags(fields []configField, args []string) (map[string]string, string, error) {
+	flagSet := flag.NewFlagSet("user-app", flag.ContinueOnError)
+	fileName := flagSet.String("config", "", "path to the YAML config file (default "+DefaultFileName+")")
+	values := map[string]string{}
+	for _, field := range fields {
+		key := field.key
+		flagSet.Func(key, field.tag.Get("doc")+" Overrides "+envName(key)+".", func(value string) error {
+			values[key] = value
+			return nil
+		})
+	}
+
+	err := flagSet.Parse(args)
+	if err != nil {
+		return nil, "", err
+	}
+	if flagSet.NArg() > 0 {
+		return nil, "", fmt.Errorf("unexpected arguments: %s", strings.Join(flagSet.Args(), " "))
+	}
+	return values, *fileName, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(duration))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(parsed)
+	case reflect.Int, reflect.Int64:
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(parsed)
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(parsed)
+	case reflect.Slice:
+		items := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+func formatField(field reflect.Value) string {
+	if field.Type() == durationType {
+		return time.Duration(field.Int()).String()
+	}
+	if field.Kind() == reflect.Slice {
+		return strings.Join(field.Interface().([]string), ",")
+	}
+	return fmt.Sprint(field.Interface())
+}
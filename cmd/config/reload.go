@@ -0,0 +1,170 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/letitloose/user-app/pkg/logging"
+	"github.com/letitloose/user-app/pkg/metrics"
+)
+
+var (
+	configReloads     = metrics.NewCounterVec("userapp_config_reloads_total", "Total number of config reloads by result.", "result")
+	lastReloadSuccess = metrics.NewGauge("userapp_config_last_reload_successful", "Whether the last config reload succeeded.")
+	lastReloadTime    = metrics.NewGauge("userapp_config_last_reload_success_timestamp_seconds", "Time of the last successful config reload.")
+)
+
+func init() {
+	metrics.MustRegister(configReloads, lastReloadSuccess, lastReloadTime)
+}
+
+// Reloader loads the config from the same args and environment the process
+// started with, again whenever the file changes or SIGHUP is received. A
+// reloaded config replaces the current one only if it is valid and differs
+// just in settings tagged reload.
+type Reloader struct {
+	args    []string
+	environ []string
+
+	mutex     sync.Mutex
+	active    *Config
+	lastError error
+	fileStamp string
+	listeners []func(*Config)
+}
+
+func NewReloader(args []string, environ []string) *Reloader {
+	return &Reloader{args: args, environ: environ}
+}
+
+// OnReload registers listener to be called with every config that is
+// swapped in, including the first.
+func (reloader *Reloader) OnReload(listener func(*Config)) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	reloader.listeners = append(reloader.listeners, listener)
+}
+
+// Reload loads the config and, if it is valid and needs no restart, makes it
+// the current config. Otherwise the current config is kept and the returned
+// *ValidationError says why.
+func (reloader *Reloader) Reload() error {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	next := &Config{}
+	err := next.Load(reloader.args, reloader.environ)
+	if err == nil && reloader.active != nil {
+		err = restartRequired(reloader.active, next)
+	}
+	reloader.fileStamp = fileStamp(next.FileName())
+	if err != nil {
+		reloader.lastError = err
+		configReloads.With("failure").Inc()
+		lastReloadSuccess.Set(0)
+		return err
+	}
+
+	reloader.active = next
+	reloader.lastError = nil
+	SetConfig(next)
+	configReloads.With("success").Inc()
+	lastReloadSuccess.Set(1)
+	lastReloadTime.Set(float64(time.Now().Unix()))
+	for _, listener := range reloader.listeners {
+		listener(next)
+	}
+	return nil
+}
+
+// LastError returns why the last reload was rejected, or nil if it
+// succeeded.
+func (reloader *Reloader) LastError() error {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	return reloader.lastError
+}
+
+// Watch reloads the config on SIGHUP and when the config file changes,
+// which is checked every interval, until ctx is done.
+func (reloader *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			logging.Infof("reloading config on SIGHUP")
+			reloader.logReload()
+		case <-ticker.C:
+			if reloader.fileChanged() {
+				logging.Infof("config file changed, reloading")
+				reloader.logReload()
+			}
+		}
+	}
+}
+
+func (reloader *Reloader) logReload() {
+	err := reloader.Reload()
+	if err != nil {
+		logging.Errorf("config not reloaded: %s", err)
+		return
+	}
+	logging.Infof("config reloaded")
+}
+
+func (reloader *Reloader) fileChanged() bool {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	if reloader.active == nil {
+		return false
+	}
+	return fileStamp(reloader.active.FileName()) != reloader.fileStamp
+}
+
+// fileStamp identifies a version of the file, empty if it does not exist.
+func fileStamp(fileName string) string {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+}
+
+// restartRequired reports the settings not tagged reload that differ between
+// the running config and next.
+func restartRequired(running *Config, next *Config) error {
+	runningFields := configFields(running)
+	problems := []Problem{}
+	for i, field := range configFields(next) {
+		if field.tag.Get("reload") == "true" {
+			continue
+		}
+		was, now := formatField(runningFields[i].value), formatField(field.value)
+		if was == now {
+			continue
+		}
+		message := fmt.Sprintf("changed from %q to %q, which needs a restart", was, now)
+		if field.secret {
+			message = "changed, which needs a restart"
+		}
+		problems = append(problems, Problem{Key: field.key, Location: next.location(field.key), Message: message})
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloader(t *testing.T) {
+	writeConfig := func(t *testing.T, fileName string, contents string) {
+		err := os.WriteFile(fileName, []byte("db:\n  database: users\n"+contents), 0644)
+		if err != nil {
+			t.Fatalf("error writing config: %s", err)
+		}
+	}
+
+	t.Run("Reload swaps in reloadable changes and rejects the rest", func(t *testing.T) {
+		defer SetConfig(GetConfig())
+		fileName := filepath.Join(t.TempDir(), "app-config.yml")
+		writeConfig(t, fileName, "log:\n  level: info\n")
+
+		reloader := NewReloader([]string{"-config", fileName}, nil)
+		levels := []string{}
+		reloader.OnReload(func(config *Config) {
+			levels = append(levels, config.Log.Level)
+		})
+		err := reloader.Reload()
+		if err != nil {
+			t.Fatalf("error loading config: %s", err)
+		}
+
+		writeConfig(t, fileName, "log:\n  level: debug\ncors:\n  allowed-origins: [https://admin.example.com]\n")
+		err = reloader.Reload()
+		if err != nil {
+			t.Fatalf("error reloading config: %s", err)
+		}
+		if GetConfig().Log.Level != "debug" || len(GetConfig().Cors.AllowedOrigins) != 1 {
+			t.Errorf("reloadable settings not applied: %+v", GetConfig())
+		}
+		if strings.Join(levels, ",") != "info,debug" {
+			t.Errorf("listener not called for each config, got %v", levels)
+		}
+
+		writeConfig(t, fileName, "log:\n  level: warn\nserver:\n  address: :9090\n")
+		err = reloader.Reload()
+		var validationError *ValidationError
+		if !errors.As(err, &validationError) || !strings.Contains(err.Error(), fileName+":6: server.address") {
+			t.Fatalf("expected server.address to need a restart, got: %v", err)
+		}
+		if reloader.LastError() != err {
+			t.Errorf("LastError got %v want %v", reloader.LastError(), err)
+		}
+		if GetConfig().Log.Level != "debug" || GetConfig().Server.Address != ":8080" {
+			t.Errorf("rejected config was applied: %+v", GetConfig())
+		}
+	})
+
+	t.Run("Watch reloads when the file changes", func(t *testing.T) {
+		defer SetConfig(GetConfig())
+		fileName := filepath.Join(t.TempDir(), "app-config.yml")
+		writeConfig(t, fileName, "log:\n  level: info\n")
+
+		reloader := NewReloader([]string{"-config", fileName}, nil)
+		reloaded := make(chan string, 1)
+		err := reloader.Reload()
+		if err != nil {
+			t.Fatalf("error loading config: %s", err)
+		}
+		reloader.OnReload(func(config *Config) {
+			reloaded <- config.Log.Level
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go reloader.Watch(ctx, 10*time.Millisecond)
+
+		writeConfig(t, fileName, "log:\n  level: error\n")
+		select {
+		case level := <-reloaded:
+			if level != "error" {
+				t.Errorf("got level %q want %q", level, "error")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("config not reloaded after the file changed")
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const schemaID = "https://github.com/letitloose/user-app/app-config.schema.json"
+
+// WriteSchema writes a JSON Schema describing the config file, generated
+// from the Config struct and its tags. Editors with YAML language support
+// use it for completion and inline validation.
+func WriteSchema(writer io.Writer) error {
+	schema := structSchema(reflect.TypeOf(Config{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["$id"] = schemaID
+	schema["title"] = "user-app config"
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(schema)
+}
+
+func structSchema(structType reflect.Type) map[string]any {
+	properties := map[string]any{}
+	for i := 0; i < structType.NumField(); i++ {
+		structField := structType.Field(i)
+		if structField.PkgPath != "" {
+			continue
+		}
+		properties[yamlName(structField)] = fieldSchema(structField)
+	}
+
+	return map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+func fieldSchema(structField reflect.StructField) map[string]any {
+	var schema map[string]any
+	switch {
+	case structField.Type == durationType:
+		schema = map[string]any{"type": "string", "pattern": `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`}
+	case structField.Type.Kind() == reflect.Struct:
+		schema = structSchema(structField.Type)
+	case structField.Type.Kind() == reflect.String:
+		schema = map[string]any{"type": "string"}
+	case structField.Type.Kind() == reflect.Bool:
+		schema = map[string]any{"type": "boolean"}
+	case structField.Type.Kind() == reflect.Int, structField.Type.Kind() == reflect.Int64:
+		schema = map[string]any{"type": "integer"}
+	case structField.Type.Kind() == reflect.Float64:
+		schema = map[string]any{"type": "number"}
+	case structField.Type.Kind() == reflect.Slice:
+		schema = map[string]any{"type": "array", "items": map[string]any{"type": "string"}}
+	default:
+		schema = map[string]any{}
+	}
+
+	if doc := structField.Tag.Get("doc"); doc != "" {
+		schema["description"] = doc
+	}
+	if enum := structField.Tag.Get("enum"); enum != "" {
+		schema["enum"] = strings.Split(enum, ",")
+	}
+	if bounds := structField.Tag.Get("range"); bounds != "" && structField.Type != durationType {
+		low, high, _ := strings.Cut(bounds, ",")
+		minimum, _ := strconv.Atoi(low)
+		maximum, _ := strconv.Atoi(high)
+		schema["minimum"] = minimum
+		schema["maximum"] = maximum
+	}
+	if structField.Tag.Get("required") == "true" && structField.Type.Kind() == reflect.String {
+		schema["minLength"] = 1
+	}
+	return schema
+}
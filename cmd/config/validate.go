@@ -0,0 +1,273 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/go-yaml/yaml"
+)
+
+// Problem is one thing wrong with the config. Location is where the bad
+// value was set, e.g. "app-config.yml:12", "USERAPP_DB_PORT" or "-db.port".
+type Problem struct {
+	Key      string
+	Location string
+	Message  string
+}
+
+func (problem Problem) String() string {
+	location := problem.Location
+	if location == "" {
+		location = "default"
+	}
+	if problem.Key == "" {
+		return fmt.Sprintf("%s: %s", location, problem.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, problem.Key, problem.Message)
+}
+
+// ValidationError reports every problem found rather than just the first,
+// so a broken config can be fixed in one go.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (err *ValidationError) Error() string {
+	lines := make([]string, 0, len(err.Problems))
+	for _, problem := range err.Problems {
+		lines = append(lines, "  "+problem.String())
+	}
+	return fmt.Sprintf("invalid config, %d problem(s):\n%s", len(err.Problems), strings.Join(lines, "\n"))
+}
+
+var (
+	yamlLinePattern     = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	unknownKeyPattern   = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+	duplicateKeyPattern = regexp.MustCompile(`^key (.+) already set in map$`)
+)
+
+// decodeErrors turns the errors from strict YAML decoding into problems
+// pointing at the offending line of fileName.
+func decodeErrors(fileName string, err error) error {
+	messages := []string{err.Error()}
+	var typeError *yaml.TypeError
+	if errors.As(err, &typeError) {
+		messages = typeError.Errors
+	}
+
+	problems := []Problem{}
+	for _, message := range messages {
+		problem := Problem{Location: fileName, Message: message}
+		if match := yamlLinePattern.FindStringSubmatch(message); match != nil {
+			problem.Location = fileName + ":" + match[1]
+			problem.Message = match[2]
+		}
+		if match := unknownKeyPattern.FindStringSubmatch(problem.Message); match != nil {
+			problem.Message = fmt.Sprintf("unknown key %q", match[1])
+		}
+		if match := duplicateKeyPattern.FindStringSubmatch(problem.Message); match != nil {
+			problem.Message = fmt.Sprintf("duplicate key %s", match[1])
+		}
+		problems = append(problems, problem)
+	}
+	return &ValidationError{Problems: problems}
+}
+
+// Validate checks the effective config and returns a *ValidationError
+// listing every problem, or nil if there are none.
+func (config *Config) Validate() error {
+	problems := []Problem{}
+	report := func(key string, format string, args ...any) {
+		problems = append(problems, Problem{Key: key, Location: config.location(key), Message: fmt.Sprintf(format, args...)})
+	}
+
+	for _, field := range configFields(config) {
+		value := formatField(field.value)
+		if field.tag.Get("required") == "true" && value == "" {
+			report(field.key, "is required")
+		}
+		if enum := field.tag.Get("enum"); enum != "" && !contains(strings.Split(enum, ","), value) {
+			report(field.key, "must be one of %s, got %q", strings.ReplaceAll(enum, ",", ", "), value)
+		}
+		if bounds := field.tag.Get("range"); bounds != "" {
+			checkRange(field, bounds, report)
+		}
+	}
+
+	if config.Db.DSN == "" {
+		if config.Db.Host == "" {
+			report("db.host", "is required unless db.dsn is set")
+		}
+		if config.Db.Database == "" {
+			report("db.database", "is required unless db.dsn is set")
+		}
+	} else if _, err := mysql.ParseDSN(config.Db.DSN); err != nil {
+		report("db.dsn", "is not a valid DSN: %s", err)
+	}
+	for _, dsn := range config.Db.Replicas {
+		if _, err := mysql.ParseDSN(dsn); err != nil {
+			report("db.replicas", "contains an invalid DSN: %s", err)
+		}
+	}
+	if config.Db.MaxIdleConns > config.Db.MaxOpenConns && config.Db.MaxOpenConns > 0 {
+		report("db.max-idle-conns", "must not be more than db.max-open-conns (%d), got %d", config.Db.MaxOpenConns, config.Db.MaxIdleConns)
+	}
+
+	_, port, err := net.SplitHostPort(config.Server.Address)
+	if err != nil {
+		report("server.address", "must be host:port or :port, got %q", config.Server.Address)
+	} else if number, err := strconv.Atoi(port); err != nil || number < 0 || number > 65535 {
+		report("server.address", "port must be between 0 and 65535, got %q", port)
+	}
+
+	switch config.Tracing.Exporter {
+	case "file":
+		if config.Tracing.File == "" {
+			report("tracing.file", "is required when tracing.exporter is file")
+		}
+	case "otlp":
+		endpoint, err := url.Parse(config.Tracing.Endpoint)
+		if config.Tracing.Endpoint == "" || err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+			report("tracing.endpoint", "must be an http(s) URL when tracing.exporter is otlp, got %q", config.Tracing.Endpoint)
+		}
+	}
+
+	publicURL, err := url.Parse(config.Server.PublicURL)
+	if err != nil || publicURL.Host == "" || (publicURL.Scheme != "http" && publicURL.Scheme != "https") {
+		report("server.public-url", "must be an http(s) URL, got %q", config.Server.PublicURL)
+	} else if rpID := config.Passkeys.RPID; rpID != "" && rpID != publicURL.Hostname() && !strings.HasSuffix(publicURL.Hostname(), "."+rpID) {
+		report("passkeys.rp-id", "must be %q or a parent domain of it, got %q", publicURL.Hostname(), rpID)
+	}
+
+	switch config.Mail.Transport {
+	case "file":
+		if config.Mail.File == "" {
+			report("mail.file", "is required when mail.transport is file")
+		}
+	case "smtp":
+		if _, _, err := net.SplitHostPort(config.Mail.SMTPAddress); err != nil {
+			report("mail.smtp-address", "must be host:port when mail.transport is smtp, got %q", config.Mail.SMTPAddress)
+		}
+	}
+
+	for _, domain := range config.Signup.AllowedDomains {
+		if domain == "" || strings.ContainsAny(domain, "@/ ") {
+			report("signup.allowed-domains", "must be domain names like example.com, got %q", domain)
+		}
+	}
+
+	for _, role := range config.TwoFactor.RequiredRoles {
+		if role != "user" && role != "admin" {
+			report("two-factor.required-roles", "must be user or admin, got %q", role)
+		}
+	}
+	if len(config.TwoFactor.RequiredRoles) > 0 && config.TwoFactor.EncryptionKey == "" {
+		report("two-factor.encryption-key", "is needed when two-factor.required-roles is set")
+	}
+
+	for _, proxy := range config.RateLimit.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				report("rate-limit.trusted-proxies", "must be IP addresses or CIDR ranges, got %q", proxy)
+			}
+		}
+	}
+
+	for _, origin := range config.Cors.AllowedOrigins {
+		parsed, err := url.Parse(origin)
+		if origin != "*" && (err != nil || parsed.Host == "" || parsed.Path != "" || (parsed.Scheme != "http" && parsed.Scheme != "https")) {
+			report("cors.allowed-origins", "must be * or scheme://host[:port], got %q", origin)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func checkRange(field configField, bounds string, report func(key string, format string, args ...any)) {
+	low, high, _ := strings.Cut(bounds, ",")
+	if field.value.Type() == durationType {
+		minimum, _ := time.ParseDuration(low)
+		maximum, _ := time.ParseDuration(high)
+		value := time.Duration(field.value.Int())
+		if value < minimum || value > maximum {
+			report(field.key, "must be between %s and %s, got %s", minimum, maximum, value)
+		}
+		return
+	}
+
+	minimum, _ := strconv.ParseInt(low, 10, 64)
+	maximum, _ := strconv.ParseInt(high, 10, 64)
+	value := field.value.Int()
+	if value < minimum || value > maximum {
+		report(field.key, "must be between %d and %d, got %d", minimum, maximum, value)
+	}
+}
+
+// location describes where the value for key was set, with the line number
+// when it came from the YAML file.
+func (config *Config) location(key string) string {
+	source := config.Source(key)
+	switch source.Layer {
+	case "file":
+		if line, ok := config.lines[key]; ok {
+			return fmt.Sprintf("%s:%d", source.Name, line)
+		}
+		return source.Name
+	case "env", "flag":
+		return source.Name
+	}
+	return "default"
+}
+
+// yamlLines maps each dotted key in a block-style YAML document to the line
+// it is defined on, which is all the config file uses.
+func yamlLines(contents []byte) map[string]int {
+	type parent struct {
+		indent int
+		key    string
+	}
+
+	lines := map[string]int{}
+	parents := []parent{}
+	for number, line := range strings.Split(string(contents), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "-") {
+			continue
+		}
+		key, _, found := strings.Cut(trimmed, ":")
+		if !found {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		for len(parents) > 0 && parents[len(parents)-1].indent >= indent {
+			parents = parents[:len(parents)-1]
+		}
+
+		path := strings.Trim(strings.TrimSpace(key), `"'`)
+		if len(parents) > 0 {
+			path = parents[len(parents)-1].key + "." + path
+		}
+		lines[path] = number + 1
+		parents = append(parents, parent{indent: indent, key: path})
+	}
+	return lines
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
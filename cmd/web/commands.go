@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/user"
+)
+
+const usage = `usage: user-app [command] [flags]
+
+commands:
+  serve                        start the web server (the default)
+  config print [--redacted]    print the effective config and where each value came from
+  config validate              check the config and list every problem found
+  config schema                print the JSON Schema for the config file
+  import [flags] FILE [config flags]
+                               import users from a csv, ndjson or yaml file
+      -format csv|ndjson|yaml  file format (default from the file extension)
+      -mode create|skip-existing|upsert
+                               what to do with users that already exist (default create)
+      -dry-run                 validate and report without changing anything
+      -generate-passwords      give new users without a password a random one
+      -map column:field,...    map file columns to user fields
+  export [flags] [FILE] [config flags]
+                               export users to FILE, or stdout when it is - or left out
+      -format csv|ndjson|json|yaml
+                               file format (default from the file extension, else json)
+      -fields field,...        fields to export, never the password (default all)
+      -search, -prefix, -domain
+                               only export matching users, like the list filters
+  set-role USERNAME user|admin [config flags]
+                               change what a user may see and do
+  disable-2fa USERNAME [config flags]
+                               turn off two-factor authentication for a user who lost their app
+
+Run "user-app serve -h" for the config flags.
+`
+
+func execute(args []string) error {
+	if len(args) == 0 {
+		return run(args)
+	}
+
+	switch args[0] {
+	case "serve":
+		return run(args[1:])
+	case "config":
+		return configCommand(args[1:], os.Stdout)
+	case "import":
+		return importCommand(args[1:], os.Stdout)
+	case "export":
+		return exportCommand(args[1:], os.Stdout)
+	case "set-role":
+		return setRoleCommand(args[1:], os.Stdout)
+	case "disable-2fa":
+		return disableTwoFactorCommand(args[1:], os.Stdout)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return nil
+	}
+	return run(args)
+}
+
+// configCommand handles the config subcommands. Any flags besides
+// --redacted are the config flags serve accepts, so the output matches what
+// serve would use.
+func configCommand(args []string, output io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing config command, expected one of: print, validate, schema")
+	}
+
+	switch args[0] {
+	case "schema":
+		return config.WriteSchema(output)
+	case "validate":
+		err := (&config.Config{}).Load(args[1:], os.Environ())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(output, "config is valid")
+		return nil
+	case "print":
+	default:
+		return fmt.Errorf("unknown config command %q, expected one of: print, validate, schema", args[0])
+	}
+
+	redacted := false
+	configArgs := []string{}
+	for _, arg := range args[1:] {
+		if arg == "--redacted" || arg == "-redacted" {
+			redacted = true
+			continue
+		}
+		configArgs = append(configArgs, arg)
+	}
+
+	// An invalid config is still printed, since seeing where each value
+	// came from is usually how the problem gets found.
+	effective := &config.Config{}
+	err := effective.Load(configArgs, os.Environ())
+	var validationError *config.ValidationError
+	if err != nil && !errors.As(err, &validationError) {
+		return err
+	}
+
+	printErr := effective.Print(output, redacted)
+	if err != nil {
+		return err
+	}
+	return printErr
+}
+
+var errImportFailed = errors.New("import failed, no users were changed")
+
+// importCommand imports users from a file in one transaction and prints what
+// happened to each row. Generated passwords are only printed here, so the
+// output needs to be kept until they have been handed out.
+func importCommand(args []string, output io.Writer) error {
+	flagSet := flag.NewFlagSet("user-app import", flag.ContinueOnError)
+	format := flagSet.String("format", "", "file format: csv, ndjson or yaml (default from the file extension)")
+	mode := flagSet.String("mode", user.ImportCreate, "what to do with users that already exist: create, skip-existing or upsert")
+	dryRun := flagSet.Bool("dry-run", false, "validate and report without changing anything")
+	generatePasswords := flagSet.Bool("generate-passwords", false, "give new users without a password a random one")
+	columns := flagSet.String("map", "", "comma separated column:field pairs, e.g. login:user-name")
+	err := flagSet.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flagSet.NArg() == 0 {
+		return errors.New("missing file to import")
+	}
+
+	fileName := flagSet.Arg(0)
+	options := user.ImportOptions{
+		Format:            *format,
+		Mode:              *mode,
+		DryRun:            *dryRun,
+		GeneratePasswords: *generatePasswords,
+		Columns:           map[string]string{},
+	}
+	if options.Format == "" {
+		options.Format = strings.TrimPrefix(filepath.Ext(fileName), ".")
+	}
+	for _, mapping := range strings.Split(*columns, ",") {
+		if mapping = strings.TrimSpace(mapping); mapping == "" {
+			continue
+		}
+		column, field, found := strings.Cut(mapping, ":")
+		if !found {
+			return fmt.Errorf("-map must be column:field pairs, got %q", mapping)
+		}
+		options.Columns[column] = field
+	}
+
+	config, err := loadConfig(flagSet.Args()[1:])
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	userService, db, err := setupUserService(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	report, err := userService.ImportUsers(commandContext(), file, options)
+	if err != nil {
+		return err
+	}
+	err = printImportReport(output, report)
+	if err != nil {
+		return err
+	}
+	if report.Failed > 0 {
+		return errImportFailed
+	}
+	return nil
+}
+
+func printImportReport(output io.Writer, report *user.ImportReport) error {
+	table := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ROW\tUSER\tRESULT\tDETAIL")
+	for _, row := range report.Rows {
+		detail := row.Error
+		if row.GeneratedPassword != "" {
+			detail = "password: " + row.GeneratedPassword
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\t%s\n", row.Row, row.Username, row.Result, detail)
+	}
+	err := table.Flush()
+	if err != nil {
+		return err
+	}
+
+	state := "committed"
+	if !report.Committed {
+		state = "not committed"
+	}
+	_, err = fmt.Fprintf(output, "%d created, %d updated, %d skipped, %d failed (%s)\n", report.Created, report.Updated, report.Skipped, report.Failed, state)
+	return err
+}
+
+// exportCommand streams users to a file or stdout.
+func exportCommand(args []string, output io.Writer) error {
+	flagSet := flag.NewFlagSet("user-app export", flag.ContinueOnError)
+	format := flagSet.String("format", "", "file format: csv, ndjson, json or yaml (default from the file extension, else json)")
+	fields := flagSet.String("fields", "", "comma separated fields to export (default all but the password)")
+	search := flagSet.String("search", "", "only export users with this in their username, names or email")
+	prefix := flagSet.String("prefix", "", "only export users whose username starts with this")
+	domain := flagSet.String("domain", "", "only export users with an email address at this domain")
+	err := flagSet.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	fileName, configArgs := "-", flagSet.Args()
+	if len(configArgs) > 0 {
+		fileName, configArgs = configArgs[0], configArgs[1:]
+	}
+	options := user.ExportOptions{
+		Format: *format,
+		Filter: user.ListFilter{Search: *search, Prefix: *prefix, Domain: *domain},
+	}
+	if options.Format == "" && fileName != "-" {
+		options.Format = strings.TrimPrefix(filepath.Ext(fileName), ".")
+	}
+	if options.Format == "" {
+		options.Format = "json"
+	}
+	if *fields != "" {
+		options.Fields = strings.Split(*fields, ",")
+	}
+
+	config, err := loadConfig(configArgs)
+	if err != nil {
+		return err
+	}
+	userService, db, err := setupUserService(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if fileName != "-" {
+		file, err := os.Create(fileName)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+	}
+	buffered := bufio.NewWriter(output)
+	err = userService.ExportUsers(commandContext(), buffered, options)
+	if err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+// setRoleCommand gives a user a role, which is how the first admin is made.
+func setRoleCommand(args []string, output io.Writer) error {
+	if len(args) < 2 || strings.HasPrefix(args[0], "-") {
+		return errors.New("usage: user-app set-role USERNAME user|admin [config flags]")
+	}
+	username, role := args[0], user.Role(args[1])
+
+	config, err := loadConfig(args[2:])
+	if err != nil {
+		return err
+	}
+	userService, db, err := setupUserService(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = userService.SetRole(commandContext(), username, role)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(output, "%s is now %s\n", username, role)
+	return err
+}
+
+// disableTwoFactorCommand turns off two-factor authentication for a user,
+// which is how an admin who lost their app and recovery codes gets back in.
+func disableTwoFactorCommand(args []string, output io.Writer) error {
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		return errors.New("usage: user-app disable-2fa USERNAME [config flags]")
+	}
+	username := args[0]
+
+	config, err := loadConfig(args[1:])
+	if err != nil {
+		return err
+	}
+	userService, db, err := setupUserService(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = userService.DisableTwoFactor(commandContext(), username)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(output, "two-factor authentication is off for %s\n", username)
+	return err
+}
+
+// loadConfig loads the config for a command into a new Config and makes it
+// the current one, rather than changing the one GetConfig handed out.
+func loadConfig(args []string) (*config.Config, error) {
+	loaded := &config.Config{}
+	err := loaded.Load(args, os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	config.SetConfig(loaded)
+	return loaded, nil
+}
+
+// commandContext is the context commands run in. Whoever can run them
+// already has the database credentials, so they act as an admin.
+func commandContext() context.Context {
+	return user.WithCaller(context.Background(), user.Caller{Role: user.RoleAdmin})
+}
+
+// setupUserService connects to the database for a one-off command. There is
+// no cache or replica, the commands go straight to the primary.
+func setupUserService(config *config.Config) (*user.UserService, *sql.DB, error) {
+	db, err := setupDatabase(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error setting up database: %s", err)
+	}
+	userRepo := user.NewUserRepository(db)
+	userRepo.SetWriteRetries(config.Db.WriteRetries)
+	err = userRepo.CreateTables(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("error creating tables: %s", err)
+	}
+	userService := user.NewUserService(userRepo, nil)
+	isolation, err := user.ParseIsolationLevel(config.Db.IsolationLevel)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	userService.SetIsolationLevel(isolation)
+	return userService, db, nil
+}
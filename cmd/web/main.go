@@ -1,40 +1,117 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log"
+	"os"
+	"time"
 
 	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/logging"
+	"github.com/letitloose/user-app/pkg/mail"
+	"github.com/letitloose/user-app/pkg/metrics"
+	"github.com/letitloose/user-app/pkg/redis"
 	"github.com/letitloose/user-app/pkg/server"
+	"github.com/letitloose/user-app/pkg/static"
+	"github.com/letitloose/user-app/pkg/tracing"
 	"github.com/letitloose/user-app/pkg/user"
+	"github.com/letitloose/user-app/pkg/view"
 )
 
+// configCheckInterval is how often the config file is checked for changes.
+const configCheckInterval = 2 * time.Second
+
+// loginAttemptPurgeInterval is how often failed logins older than
+// lockout.duration are deleted.
+const loginAttemptPurgeInterval = 10 * time.Minute
+
 func main() {
 
-	err := run("app-config.yml")
+	err := execute(os.Args[1:])
 	if err != nil {
 		log.Fatalf("error starting application: %s", err)
 	}
 }
 
-func run(configFile string) error {
+func run(args []string) error {
+	reloader := config.NewReloader(args, os.Environ())
+	reloader.OnReload(applyLogLevel)
+	err := reloader.Reload()
+	if err != nil {
+		return errors.New(fmt.Sprintf("error reading config: %s", err))
+	}
+	go reloader.Watch(context.Background(), configCheckInterval)
 	config := config.GetConfig()
-	err := config.ReadConfig(configFile)
+
+	tracer, err := setupTracing(config)
 	if err != nil {
-		return errors.New(fmt.Sprintf("error reading config file: %s", err))
+		return errors.New(fmt.Sprintf("error setting up tracing: %s", err))
 	}
+	tracing.SetTracer(tracer)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		tracer.Shutdown(ctx)
+	}()
 
 	db, err := setupDatabase(config)
 	if err != nil {
 		return errors.New(fmt.Sprintf("error setting up database: %s", err))
 	}
+	metrics.MustRegister(metrics.NewDBStatsCollectors("userapp", db)...)
+
+	assets, err := static.NewAssets(static.Files(config.Dev), config.Dev)
+	if err != nil {
+		return errors.New(fmt.Sprintf("error loading static files: %s", err))
+	}
+
+	renderer, err := view.NewRenderer(view.Layout(config.Dev), user.Templates(config.Dev), view.Funcs{"static": assets.URL}, config.Dev)
+	if err != nil {
+		return errors.New(fmt.Sprintf("error parsing templates: %s", err))
+	}
 
 	userRepo := user.NewUserRepository(db)
-	userService := user.NewUserService(userRepo)
+	userRepo.SetWriteRetries(config.Db.WriteRetries)
+	err = userRepo.CreateTables(context.Background())
+	if err != nil {
+		return errors.New(fmt.Sprintf("error creating tables: %s", err))
+	}
+	if len(config.Db.Replicas) > 0 {
+		replicas, err := setupReplicas(config)
+		if err != nil {
+			return errors.New(fmt.Sprintf("error setting up replicas: %s", err))
+		}
+		userRepo.SetReplicas(replicas, config.Db.ReadYourWrites)
+		go userRepo.CheckReplicas(context.Background(), config.Db.ReplicaCheckInterval)
+		metrics.MustRegister(metrics.NewGaugeFunc("userapp_db_replicas_healthy", "Number of read replicas currently taking reads.", func() float64 {
+			return float64(userRepo.HealthyReplicas())
+		}))
+	}
+	var store user.Store = userRepo
+	if config.Cache.Size > 0 {
+		cache := user.NewCachedStore(userRepo, config.Cache.Size, config.Cache.TTL, config.Cache.NegativeTTL)
+		if config.Cache.RedisAddress != "" {
+			cache.SetRemote(redis.NewClient(config.Cache.RedisAddress, config.Cache.RedisPassword))
+		}
+		store = cache
+	}
+	mailer, err := setupMailer(config)
+	if err != nil {
+		return errors.New(fmt.Sprintf("error setting up mail: %s", err))
+	}
+	userService := user.NewUserService(store, renderer)
+	userService.SetMailer(mailer)
+	isolation, err := user.ParseIsolationLevel(config.Db.IsolationLevel)
+	if err != nil {
+		return err
+	}
+	userService.SetIsolationLevel(isolation)
+	go userService.PurgeLoginAttempts(context.Background(), loginAttemptPurgeInterval)
 
-	server := server.NewServer(config, userService)
+	server := server.NewServer(config, userService, assets)
 	err = server.Run()
 	if err != nil {
 		log.Fatalf("error starting server:%s\n", err)
@@ -42,25 +119,129 @@ func run(configFile string) error {
 	return nil
 }
 
+func applyLogLevel(config *config.Config) {
+	level, err := logging.ParseLevel(config.Log.Level)
+	if err != nil {
+		logging.Warnf("keeping log level %s: %s", logging.GetLevel(), err)
+		return
+	}
+	logging.SetLevel(level)
+}
+
+func setupTracing(config *config.Config) (*tracing.Tracer, error) {
+	serviceName := config.Tracing.ServiceName
+
+	switch config.Tracing.Exporter {
+	case "", "none":
+		return tracing.NewTracer(nil), nil
+	case "file":
+		exporter, err := tracing.NewJSONFileExporter(config.Tracing.File, serviceName)
+		if err != nil {
+			return nil, err
+		}
+		logging.Infof("writing traces to %s", config.Tracing.File)
+		return tracing.NewTracer(exporter), nil
+	case "otlp":
+		logging.Infof("exporting traces to %s", config.Tracing.Endpoint)
+		return tracing.NewTracer(tracing.NewOTLPExporter(config.Tracing.Endpoint, serviceName)), nil
+	}
+
+	return nil, fmt.Errorf("unknown trace exporter: %s", config.Tracing.Exporter)
+}
+
+func setupMailer(config *config.Config) (mail.Mailer, error) {
+	switch config.Mail.Transport {
+	case "", "stdout":
+		return mail.NewWriterMailer(os.Stdout, config.Mail.From), nil
+	case "file":
+		logging.Infof("writing emails to %s", config.Mail.File)
+		return mail.NewFileMailer(config.Mail.File, config.Mail.From)
+	case "smtp":
+		return mail.NewSMTPMailer(config.Mail.SMTPAddress, config.Mail.SMTPUsername, config.Mail.SMTPPassword, config.Mail.From), nil
+	}
+
+	return nil, fmt.Errorf("unknown mail transport: %s", config.Mail.Transport)
+}
+
 func setupDatabase(config *config.Config) (*sql.DB, error) {
 
 	connString := assembleConnectString(config)
-	db, err := sql.Open("mysql", connString)
+	db, err := openDatabase(config, connString)
 	if err != nil {
 		return nil, err
 	}
 
-	err = db.Ping()
+	err = waitForDatabase(db, config.Db.StartupTimeout)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	log.Println("db connection successful!")
+	logging.Infof("db connection successful!")
+
+	return db, nil
+}
+
+// setupReplicas opens the read replicas. They are not waited for, the
+// repository's health checks keep them out of rotation until they answer.
+func setupReplicas(config *config.Config) ([]*sql.DB, error) {
+	replicas := []*sql.DB{}
+	for _, dsn := range config.Db.Replicas {
+		replica, err := openDatabase(config, dsn)
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, replica)
+	}
+	return replicas, nil
+}
 
+func openDatabase(config *config.Config, dsn string) (*sql.DB, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(config.Db.MaxOpenConns)
+	db.SetMaxIdleConns(config.Db.MaxIdleConns)
+	db.SetConnMaxLifetime(config.Db.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(config.Db.ConnMaxIdleTime)
 	return db, nil
 }
 
+// waitForDatabase pings db until it answers, backing off exponentially
+// between attempts, so the app can start alongside a database that is still
+// coming up. It gives up with the last error once timeout has passed.
+func waitForDatabase(db *sql.DB, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := 100 * time.Millisecond
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		logging.Warnf("database not ready, retrying in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+}
+
 func assembleConnectString(config *config.Config) string {
+	if config.Db.DSN != "" {
+		return config.Db.DSN
+	}
 
 	connectionString := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true",
 		config.Db.Username,
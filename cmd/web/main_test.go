@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
 	"log"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-yaml/yaml"
 	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/logging"
 )
 
 func setup() {
@@ -54,4 +59,96 @@ func TestMain(t *testing.T) {
 			t.Fatalf("connect string did not come out correctly: %s", connString)
 		}
 	})
+
+	t.Run("config print shows redacted values and their source", func(t *testing.T) {
+		var output bytes.Buffer
+		err := configCommand([]string{"print", "--redacted", "-db.password", "pass", "-db.host", "db", "-db.database", "users"}, &output)
+		if err != nil {
+			t.Fatalf("error printing config: %s", err)
+		}
+
+		if strings.Contains(output.String(), "pass ") || !strings.Contains(output.String(), "********") {
+			t.Errorf("password not redacted:\n%s", output.String())
+		}
+		if !strings.Contains(output.String(), "db.host") || !strings.Contains(output.String(), "# flag: -db.host") {
+			t.Errorf("db.host source missing:\n%s", output.String())
+		}
+	})
+
+	t.Run("config without print is an error", func(t *testing.T) {
+		err := configCommand([]string{"show"}, &bytes.Buffer{})
+		if err == nil {
+			t.Fatal("expected an error for an unknown config command")
+		}
+	})
+
+	t.Run("config validate lists problems and config schema prints the schema", func(t *testing.T) {
+		var output bytes.Buffer
+		err := configCommand([]string{"validate", "-db.port", "0"}, &output)
+		if err == nil || !strings.Contains(err.Error(), "db.port") || !strings.Contains(err.Error(), "db.database") {
+			t.Fatalf("expected problems for db.port and db.database, got: %v", err)
+		}
+
+		err = configCommand([]string{"validate", "-db.database", "users"}, &output)
+		if err != nil || !strings.Contains(output.String(), "config is valid") {
+			t.Fatalf("expected a valid config, got: %v\n%s", err, output.String())
+		}
+
+		output.Reset()
+		err = configCommand([]string{"schema"}, &output)
+		if err != nil || !strings.Contains(output.String(), `"additionalProperties": false`) {
+			t.Fatalf("expected a schema, got: %v\n%s", err, output.String())
+		}
+	})
+
+	t.Run("assembleConnectString prefers the DSN", func(t *testing.T) {
+		config := &config.Config{}
+		config.Db.Host = "localhost"
+		config.Db.DSN = "user:pass@tcp(replica:3306)/users"
+
+		connString := assembleConnectString(config)
+		if connString != config.Db.DSN {
+			t.Fatalf("got %s want %s", connString, config.Db.DSN)
+		}
+	})
+
+	t.Run("waitForDatabase gives up after the timeout", func(t *testing.T) {
+		db, err := sql.Open("mysql", "user:pass@tcp(127.0.0.1:1)/users?timeout=50ms")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		start := time.Now()
+		err = waitForDatabase(db, 300*time.Millisecond)
+		if err == nil {
+			t.Fatal("expected an error from an unreachable database")
+		}
+		if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 3*time.Second {
+			t.Errorf("gave up after %s, want about 300ms", elapsed)
+		}
+	})
+	t.Run("log.level hides the app's less severe log lines", func(t *testing.T) {
+		var output bytes.Buffer
+		defer log.SetOutput(log.Writer())
+		log.SetOutput(&output)
+		defer logging.SetLevel(logging.GetLevel())
+		db, err := sql.Open("mysql", "user:pass@tcp(127.0.0.1:1)/users?timeout=50ms")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		applyLogLevel(&config.Config{Log: config.LogConfig{Level: "error"}})
+		waitForDatabase(db, 100*time.Millisecond)
+		if output.Len() != 0 {
+			t.Errorf("got warnings at error level:\n%s", output.String())
+		}
+
+		applyLogLevel(&config.Config{Log: config.LogConfig{Level: "warn"}})
+		waitForDatabase(db, 100*time.Millisecond)
+		if !strings.Contains(output.String(), "warn: database not ready") {
+			t.Errorf("warning missing at warn level:\n%s", output.String())
+		}
+	})
 }
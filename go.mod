@@ -3,7 +3,8 @@ module github.com/letitloose/user-app
 go 1.18
 
 require (
-	github.com/go-sql-driver/mysql v1.7.0 // indirect
-	github.com/go-yaml/yaml v2.1.0+incompatible // indirect
-	github.com/mattn/go-sqlite3 v1.14.16 // indirect
+	github.com/go-sql-driver/mysql v1.7.0
+	github.com/go-yaml/yaml v2.1.0+incompatible
 )
+
+require github.com/mattn/go-sqlite3 v1.14.16
@@ -0,0 +1,75 @@
+// Package logging filters messages written with the standard log package by
+// severity. The level can be changed at any time, e.g. on config reload.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (level Level) String() string {
+	if level < LevelDebug || level > LevelError {
+		return fmt.Sprintf("level(%d)", int32(level))
+	}
+	return levelNames[level]
+}
+
+// ParseLevel returns the level named name, one of debug, info, warn or error.
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if levelName == name {
+			return Level(level), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+var current = int32(LevelInfo)
+
+func SetLevel(level Level) {
+	atomic.StoreInt32(&current, int32(level))
+}
+
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&current))
+}
+
+// Enabled reports whether messages at level are written.
+func Enabled(level Level) bool {
+	return level >= GetLevel()
+}
+
+func Debugf(format string, args ...any) {
+	logf(LevelDebug, format, args...)
+}
+
+func Infof(format string, args ...any) {
+	logf(LevelInfo, format, args...)
+}
+
+func Warnf(format string, args ...any) {
+	logf(LevelWarn, format, args...)
+}
+
+func Errorf(format string, args ...any) {
+	logf(LevelError, format, args...)
+}
+
+func logf(level Level, format string, args ...any) {
+	if !Enabled(level) {
+		return
+	}
+	log.Output(3, level.String()+": "+fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,40 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestLogging(t *testing.T) {
+	t.Run("messages below the level are dropped", func(t *testing.T) {
+		var output bytes.Buffer
+		defer log.SetOutput(log.Writer())
+		log.SetOutput(&output)
+		defer SetLevel(GetLevel())
+
+		SetLevel(LevelWarn)
+		Infof("hidden %d", 1)
+		Warnf("shown %d", 2)
+
+		if strings.Contains(output.String(), "hidden") {
+			t.Errorf("info message written at warn level:\n%s", output.String())
+		}
+		if !strings.Contains(output.String(), "warn: shown 2") {
+			t.Errorf("warn message missing:\n%s", output.String())
+		}
+	})
+
+	t.Run("ParseLevel accepts the level names", func(t *testing.T) {
+		level, err := ParseLevel("debug")
+		if err != nil || level != LevelDebug {
+			t.Errorf("got %v, %v want %v", level, err, LevelDebug)
+		}
+
+		_, err = ParseLevel("verbose")
+		if err == nil {
+			t.Error("expected an error for an unknown level")
+		}
+	})
+}
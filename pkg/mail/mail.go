@@ -0,0 +1,183 @@
+// Package mail sends the plain text emails the app needs, such as password
+// reset links, through SMTP or, for local use and tests, by writing them to
+// a file or stdout.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is one email. The sender is set by the Mailer.
+type Message struct {
+	To      []string
+	Subject string
+	Body    string
+}
+
+// Mailer sends messages.
+type Mailer interface {
+	Send(ctx context.Context, message *Message) error
+}
+
+// format renders message as an RFC 5322 email from from, with the body
+// quoted-printable encoded so any text survives transport.
+func format(from string, message *Message, date time.Time) ([]byte, error) {
+	if len(message.To) == 0 {
+		return nil, errors.New("mail: message has no recipients")
+	}
+	for _, address := range append([]string{from}, message.To...) {
+		if strings.ContainsAny(address, "\r\n") {
+			return nil, fmt.Errorf("mail: invalid address %q", address)
+		}
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	domain := from[strings.LastIndex(from, "@")+1:]
+
+	var output bytes.Buffer
+	fmt.Fprintf(&output, "From: %s\r\n", from)
+	fmt.Fprintf(&output, "To: %s\r\n", strings.Join(message.To, ", "))
+	fmt.Fprintf(&output, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(&output, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&output, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	output.WriteString("MIME-Version: 1.0\r\n")
+	output.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	output.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	body := quotedprintable.NewWriter(&output)
+	body.Write([]byte(strings.ReplaceAll(message.Body, "\n", "\r\n")))
+	body.Close()
+	return output.Bytes(), nil
+}
+
+// SMTPMailer sends messages through an SMTP server, upgrading to TLS with
+// STARTTLS when the server offers it.
+type SMTPMailer struct {
+	address  string
+	username string
+	password string
+	from     string
+	timeout  time.Duration
+}
+
+// NewSMTPMailer returns a mailer for the server at address, a host:port,
+// sending as from. It authenticates with username and password unless
+// username is empty.
+func NewSMTPMailer(address string, username string, password string, from string) *SMTPMailer {
+	return &SMTPMailer{address: address, username: username, password: password, from: from, timeout: 30 * time.Second}
+}
+
+func (mailer *SMTPMailer) Send(ctx context.Context, message *Message) error {
+	contents, err := format(mailer.from, message, time.Now())
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Timeout: mailer.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", mailer.address)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(mailer.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	host, _, _ := net.SplitHostPort(mailer.address)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if mailer.username != "" {
+		err = client.Auth(smtp.PlainAuth("", mailer.username, mailer.password, host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(mailer.from)
+	if err != nil {
+		return err
+	}
+	for _, to := range message.To {
+		err = client.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = data.Write(contents)
+	if err != nil {
+		return err
+	}
+	err = data.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// WriterMailer writes every message to a writer instead of sending it,
+// each followed by a blank line. It is safe for concurrent use.
+type WriterMailer struct {
+	from   string
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+// NewWriterMailer returns a mailer writing messages from from to writer,
+// e.g. os.Stdout.
+func NewWriterMailer(writer io.Writer, from string) *WriterMailer {
+	return &WriterMailer{writer: writer, from: from}
+}
+
+// NewFileMailer returns a mailer appending messages from from to the file
+// fileName, creating it if needed.
+func NewFileMailer(fileName string, from string) (*WriterMailer, error) {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterMailer(file, from), nil
+}
+
+func (mailer *WriterMailer) Send(ctx context.Context, message *Message) error {
+	contents, err := format(mailer.from, message, time.Now())
+	if err != nil {
+		return err
+	}
+
+	mailer.mutex.Lock()
+	defer mailer.mutex.Unlock()
+	_, err = mailer.writer.Write(append(contents, "\r\n\r\n"...))
+	return err
+}
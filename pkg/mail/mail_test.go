@@ -0,0 +1,129 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer speaks just enough SMTP to accept one message per connection,
+// sending what it received, commands and data, down the returned channel.
+func fakeServer(t *testing.T) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				var transcript strings.Builder
+				reply := func(line string) {
+					conn.Write([]byte(line + "\r\n"))
+				}
+
+				reply("220 localhost ESMTP")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					transcript.WriteString(line)
+					command := strings.ToUpper(strings.Fields(line)[0])
+					switch command {
+					case "EHLO":
+						reply("250-localhost")
+						reply("250 AUTH PLAIN")
+					case "AUTH":
+						reply("235 2.7.0 Authentication successful")
+					case "DATA":
+						reply("354 End data with <CR><LF>.<CR><LF>")
+						for {
+							line, err := reader.ReadString('\n')
+							if err != nil {
+								return
+							}
+							if line == ".\r\n" {
+								break
+							}
+							transcript.WriteString(line)
+						}
+						reply("250 OK")
+					case "QUIT":
+						reply("221 Bye")
+						received <- transcript.String()
+						return
+					default:
+						reply("250 OK")
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestMail(t *testing.T) {
+
+	t.Run("SMTPMailer authenticates and sends the message", func(t *testing.T) {
+		address, received := fakeServer(t)
+		mailer := NewSMTPMailer(address, "app", "secret", "app@example.com")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := mailer.Send(ctx, &Message{To: []string{"amy@example.com"}, Subject: "Réinitialiser", Body: "Open the link:\nhttps://example.com/password/reset?token=abc"})
+		if err != nil {
+			t.Fatalf("error sending: %s", err)
+		}
+
+		transcript := <-received
+		credentials := base64.StdEncoding.EncodeToString([]byte("\x00app\x00secret"))
+		for _, expected := range []string{
+			"AUTH PLAIN " + credentials,
+			"MAIL FROM:<app@example.com>",
+			"RCPT TO:<amy@example.com>",
+			"Subject: =?utf-8?q?R=C3=A9initialiser?=",
+			"https://example.com/password/reset?token=3Dabc",
+		} {
+			if !strings.Contains(transcript, expected) {
+				t.Errorf("missing %q in:\n%s", expected, transcript)
+			}
+		}
+	})
+
+	t.Run("WriterMailer writes each message in full", func(t *testing.T) {
+		var output bytes.Buffer
+		mailer := NewWriterMailer(&output, "app@example.com")
+
+		err := mailer.Send(context.Background(), &Message{To: []string{"amy@example.com", "bob@example.com"}, Subject: "Hello", Body: "Hi"})
+		if err != nil {
+			t.Fatalf("error writing: %s", err)
+		}
+		for _, expected := range []string{"From: app@example.com\r\n", "To: amy@example.com, bob@example.com\r\n", "Subject: Hello\r\n", "\r\n\r\nHi"} {
+			if !strings.Contains(output.String(), expected) {
+				t.Errorf("missing %q in:\n%s", expected, output.String())
+			}
+		}
+	})
+
+	t.Run("addresses cannot inject headers", func(t *testing.T) {
+		mailer := NewWriterMailer(&bytes.Buffer{}, "app@example.com")
+		err := mailer.Send(context.Background(), &Message{To: []string{"amy@example.com\r\nBcc: everyone@example.com"}})
+		if err == nil {
+			t.Error("expected an error for an address with a line break")
+		}
+	})
+}
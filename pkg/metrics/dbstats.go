@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"database/sql"
+)
+
+type dbStatsCollector struct {
+	name  string
+	help  string
+	kind  string
+	value func(stats sql.DBStats) float64
+	db    *sql.DB
+}
+
+func (collector *dbStatsCollector) Name() string {
+	return collector.name
+}
+
+func (collector *dbStatsCollector) Help() string {
+	return collector.help
+}
+
+func (collector *dbStatsCollector) Type() string {
+	return collector.kind
+}
+
+func (collector *dbStatsCollector) Samples() []Sample {
+	return []Sample{{Value: collector.value(collector.db.Stats())}}
+}
+
+// NewDBStatsCollectors exposes the connection pool statistics of db as
+// gauges and counters prefixed with "<prefix>_db_".
+func NewDBStatsCollectors(prefix string, db *sql.DB) []Collector {
+	stat := func(name string, help string, kind string, value func(stats sql.DBStats) float64) Collector {
+		return &dbStatsCollector{name: prefix + "_db_" + name, help: help, kind: kind, value: value, db: db}
+	}
+
+	return []Collector{
+		stat("max_open_connections", "Maximum number of open connections to the database.", "gauge", func(stats sql.DBStats) float64 {
+			return float64(stats.MaxOpenConnections)
+		}),
+		stat("open_connections", "The number of established connections both in use and idle.", "gauge", func(stats sql.DBStats) float64 {
+			return float64(stats.OpenConnections)
+		}),
+		stat("in_use_connections", "The number of connections currently in use.", "gauge", func(stats sql.DBStats) float64 {
+			return float64(stats.InUse)
+		}),
+		stat("idle_connections", "The number of idle connections.", "gauge", func(stats sql.DBStats) float64 {
+			return float64(stats.Idle)
+		}),
+		stat("wait_count_total", "The total number of connections waited for.", "counter", func(stats sql.DBStats) float64 {
+			return float64(stats.WaitCount)
+		}),
+		stat("wait_duration_seconds_total", "The total time blocked waiting for a new connection.", "counter", func(stats sql.DBStats) float64 {
+			return stats.WaitDuration.Seconds()
+		}),
+		stat("max_idle_closed_total", "The total number of connections closed due to SetMaxIdleConns.", "counter", func(stats sql.DBStats) float64 {
+			return float64(stats.MaxIdleClosed)
+		}),
+		stat("max_idle_time_closed_total", "The total number of connections closed due to SetConnMaxIdleTime.", "counter", func(stats sql.DBStats) float64 {
+			return float64(stats.MaxIdleTimeClosed)
+		}),
+		stat("max_lifetime_closed_total", "The total number of connections closed due to SetConnMaxLifetime.", "counter", func(stats sql.DBStats) float64 {
+			return float64(stats.MaxLifetimeClosed)
+		}),
+	}
+}
@@ -0,0 +1,290 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Sample is a single line of the text exposition format. Suffix is appended
+// to the metric name, e.g. "_bucket" for histogram buckets.
+type Sample struct {
+	Suffix string
+	Labels []Label
+	Value  float64
+}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Collector is anything the Registry can write out. Name, Help and Type make
+// up the metric family header, Samples the values at the time of a scrape.
+type Collector interface {
+	Name() string
+	Help() string
+	Type() string
+	Samples() []Sample
+}
+
+type desc struct {
+	name string
+	help string
+}
+
+func (desc *desc) Name() string {
+	return desc.name
+}
+
+func (desc *desc) Help() string {
+	return desc.help
+}
+
+type Counter struct {
+	desc
+	bits uint64
+}
+
+func NewCounter(name string, help string) *Counter {
+	return &Counter{desc: desc{name: name, help: help}}
+}
+
+func (counter *Counter) Inc() {
+	counter.Add(1)
+}
+
+func (counter *Counter) Add(value float64) {
+	if value < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	addFloat(&counter.bits, value)
+}
+
+func (counter *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&counter.bits))
+}
+
+func (counter *Counter) Type() string {
+	return "counter"
+}
+
+func (counter *Counter) Samples() []Sample {
+	return []Sample{{Value: counter.Value()}}
+}
+
+type Gauge struct {
+	desc
+	bits uint64
+}
+
+func NewGauge(name string, help string) *Gauge {
+	return &Gauge{desc: desc{name: name, help: help}}
+}
+
+func (gauge *Gauge) Set(value float64) {
+	atomic.StoreUint64(&gauge.bits, math.Float64bits(value))
+}
+
+func (gauge *Gauge) Add(value float64) {
+	addFloat(&gauge.bits, value)
+}
+
+func (gauge *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&gauge.bits))
+}
+
+func (gauge *Gauge) Type() string {
+	return "gauge"
+}
+
+func (gauge *Gauge) Samples() []Sample {
+	return []Sample{{Value: gauge.Value()}}
+}
+
+// GaugeFunc reports whatever its function returns at scrape time.
+type GaugeFunc struct {
+	desc
+	function func() float64
+}
+
+func NewGaugeFunc(name string, help string, function func() float64) *GaugeFunc {
+	return &GaugeFunc{desc: desc{name: name, help: help}, function: function}
+}
+
+func (gauge *GaugeFunc) Type() string {
+	return "gauge"
+}
+
+func (gauge *GaugeFunc) Samples() []Sample {
+	return []Sample{{Value: gauge.function()}}
+}
+
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type Histogram struct {
+	desc
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	return &Histogram{desc: desc{name: name, help: help}, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			histogram.counts[i]++
+		}
+	}
+	histogram.sum += value
+	histogram.count++
+}
+
+func (histogram *Histogram) Type() string {
+	return "histogram"
+}
+
+func (histogram *Histogram) Samples() []Sample {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	samples := make([]Sample, 0, len(histogram.buckets)+3)
+	for i, bound := range histogram.buckets {
+		samples = append(samples, Sample{
+			Suffix: "_bucket",
+			Labels: []Label{{Name: "le", Value: formatFloat(bound)}},
+			Value:  float64(histogram.counts[i]),
+		})
+	}
+	samples = append(samples,
+		Sample{Suffix: "_bucket", Labels: []Label{{Name: "le", Value: "+Inf"}}, Value: float64(histogram.count)},
+		Sample{Suffix: "_sum", Value: histogram.sum},
+		Sample{Suffix: "_count", Value: float64(histogram.count)},
+	)
+	return samples
+}
+
+// vec keeps one child collector per distinct combination of label values.
+type vec struct {
+	desc
+	labelNames []string
+	mutex      sync.RWMutex
+	children   map[string]Collector
+	values     map[string][]string
+	newChild   func() Collector
+}
+
+func newVec(name string, help string, labelNames []string, newChild func() Collector) *vec {
+	return &vec{
+		desc:       desc{name: name, help: help},
+		labelNames: labelNames,
+		children:   map[string]Collector{},
+		values:     map[string][]string{},
+		newChild:   newChild,
+	}
+}
+
+func (vec *vec) with(labelValues []string) Collector {
+	if len(labelValues) != len(vec.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", vec.name, len(vec.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	vec.mutex.RLock()
+	child, ok := vec.children[key]
+	vec.mutex.RUnlock()
+	if ok {
+		return child
+	}
+
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	if child, ok = vec.children[key]; ok {
+		return child
+	}
+	child = vec.newChild()
+	vec.children[key] = child
+	vec.values[key] = append([]string{}, labelValues...)
+	return child
+}
+
+func (vec *vec) Samples() []Sample {
+	vec.mutex.RLock()
+	defer vec.mutex.RUnlock()
+
+	keys := make([]string, 0, len(vec.children))
+	for key := range vec.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	samples := []Sample{}
+	for _, key := range keys {
+		labels := make([]Label, len(vec.labelNames))
+		for i, name := range vec.labelNames {
+			labels[i] = Label{Name: name, Value: vec.values[key][i]}
+		}
+		for _, sample := range vec.children[key].Samples() {
+			sample.Labels = append(append([]Label{}, labels...), sample.Labels...)
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+type CounterVec struct {
+	*vec
+}
+
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{vec: newVec(name, help, labelNames, func() Collector {
+		return NewCounter(name, help)
+	})}
+}
+
+func (counterVec *CounterVec) With(labelValues ...string) *Counter {
+	return counterVec.with(labelValues).(*Counter)
+}
+
+func (counterVec *CounterVec) Type() string {
+	return "counter"
+}
+
+type HistogramVec struct {
+	*vec
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{vec: newVec(name, help, labelNames, func() Collector {
+		return NewHistogram(name, help, buckets)
+	})}
+}
+
+func (histogramVec *HistogramVec) With(labelValues ...string) *Histogram {
+	return histogramVec.with(labelValues).(*Histogram)
+}
+
+func (histogramVec *HistogramVec) Type() string {
+	return "histogram"
+}
+
+func addFloat(bits *uint64, value float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		updated := math.Float64bits(math.Float64frombits(old) + value)
+		if atomic.CompareAndSwapUint64(bits, old, updated) {
+			return
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestMetrics(t *testing.T) {
+
+	t.Run("Write renders counters in the text format", func(t *testing.T) {
+		registry := NewRegistry()
+		counter := NewCounter("test_total", "A test counter.")
+		registry.MustRegister(counter)
+		counter.Inc()
+		counter.Add(2)
+
+		var output bytes.Buffer
+		err := registry.Write(&output)
+		if err != nil {
+			t.Fatalf("error writing metrics: %s", err)
+		}
+
+		expected := "# HELP test_total A test counter.\n# TYPE test_total counter\ntest_total 3\n"
+		if output.String() != expected {
+			t.Errorf("unexpected output: got %q want %q", output.String(), expected)
+		}
+	})
+
+	t.Run("Register rejects duplicate and invalid names", func(t *testing.T) {
+		registry := NewRegistry()
+		registry.MustRegister(NewGauge("test_gauge", "A gauge."))
+
+		err := registry.Register(NewGauge("test_gauge", "A gauge."))
+		if err == nil {
+			t.Fatal("expected an error registering a duplicate metric")
+		}
+
+		err = registry.Register(NewGauge("test-gauge", "A gauge."))
+		if err == nil {
+			t.Fatal("expected an error registering an invalid metric name")
+		}
+	})
+
+	t.Run("CounterVec writes one series per label set", func(t *testing.T) {
+		registry := NewRegistry()
+		counterVec := NewCounterVec("requests_total", "Requests.", "route", "code")
+		registry.MustRegister(counterVec)
+		counterVec.With("/users", "200").Inc()
+		counterVec.With("/users", "200").Inc()
+		counterVec.With("/users/", "500").Inc()
+
+		var output bytes.Buffer
+		registry.Write(&output)
+
+		if !strings.Contains(output.String(), `requests_total{route="/users",code="200"} 2`) {
+			t.Errorf("missing /users series: %s", output.String())
+		}
+		if !strings.Contains(output.String(), `requests_total{route="/users/",code="500"} 1`) {
+			t.Errorf("missing /users/ series: %s", output.String())
+		}
+	})
+
+	t.Run("Histogram buckets are cumulative", func(t *testing.T) {
+		registry := NewRegistry()
+		histogram := NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+		registry.MustRegister(histogram)
+		histogram.Observe(0.05)
+		histogram.Observe(0.5)
+		histogram.Observe(5)
+
+		var output bytes.Buffer
+		registry.Write(&output)
+
+		for _, line := range []string{
+			`latency_seconds_bucket{le="0.1"} 1`,
+			`latency_seconds_bucket{le="1"} 2`,
+			`latency_seconds_bucket{le="+Inf"} 3`,
+			`latency_seconds_sum 5.55`,
+			`latency_seconds_count 3`,
+		} {
+			if !strings.Contains(output.String(), line+"\n") {
+				t.Errorf("missing line %q in:\n%s", line, output.String())
+			}
+		}
+	})
+
+	t.Run("label values are escaped", func(t *testing.T) {
+		registry := NewRegistry()
+		counterVec := NewCounterVec("escaped_total", "Escaped.", "value")
+		registry.MustRegister(counterVec)
+		counterVec.With("a\"b\\c\n").Inc()
+
+		var output bytes.Buffer
+		registry.Write(&output)
+
+		if !strings.Contains(output.String(), `escaped_total{value="a\"b\\c\n"} 1`) {
+			t.Errorf("label value not escaped: %s", output.String())
+		}
+	})
+
+	t.Run("DB stats collectors report the pool", func(t *testing.T) {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatalf("failed to connect to DB: %s", err)
+		}
+		defer db.Close()
+		db.SetMaxOpenConns(3)
+
+		registry := NewRegistry()
+		registry.MustRegister(NewDBStatsCollectors("test", db)...)
+
+		var output bytes.Buffer
+		registry.Write(&output)
+
+		if !strings.Contains(output.String(), "test_db_max_open_connections 3\n") {
+			t.Errorf("missing max open connections gauge: %s", output.String())
+		}
+	})
+
+	t.Run("Handler serves the exposition content type", func(t *testing.T) {
+		registry := NewRegistry()
+		registry.MustRegister(NewCounter("served_total", "Served."))
+
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest("GET", "/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		registry.Handler().ServeHTTP(recorder, request)
+
+		if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+			t.Errorf("wrong content type: %s", contentType)
+		}
+		if !strings.Contains(recorder.Body.String(), "served_total 0") {
+			t.Errorf("unexpected body: %s", recorder.Body.String())
+		}
+	})
+}
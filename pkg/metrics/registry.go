@@ -0,0 +1,153 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+type Registry struct {
+	mutex      sync.RWMutex
+	collectors map[string]Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: map[string]Collector{}}
+}
+
+// DefaultRegistry is the registry served on /metrics. Packages register
+// their collectors with it from init or when they are constructed.
+var DefaultRegistry = NewRegistry()
+
+func Register(collector Collector) error {
+	return DefaultRegistry.Register(collector)
+}
+
+func MustRegister(collectors ...Collector) {
+	DefaultRegistry.MustRegister(collectors...)
+}
+
+func Unregister(name string) {
+	DefaultRegistry.Unregister(name)
+}
+
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
+
+func (registry *Registry) Register(collector Collector) error {
+	if !metricName.MatchString(collector.Name()) {
+		return fmt.Errorf("invalid metric name: %q", collector.Name())
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if _, exists := registry.collectors[collector.Name()]; exists {
+		return fmt.Errorf("metric already registered: %s", collector.Name())
+	}
+	registry.collectors[collector.Name()] = collector
+	return nil
+}
+
+func (registry *Registry) MustRegister(collectors ...Collector) {
+	for _, collector := range collectors {
+		err := registry.Register(collector)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (registry *Registry) Unregister(name string) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	delete(registry.collectors, name)
+}
+
+// Write renders every registered collector in the Prometheus text
+// exposition format, sorted by metric name.
+func (registry *Registry) Write(writer io.Writer) error {
+	registry.mutex.RLock()
+	collectors := make([]Collector, 0, len(registry.collectors))
+	for _, collector := range registry.collectors {
+		collectors = append(collectors, collector)
+	}
+	registry.mutex.RUnlock()
+
+	sort.Slice(collectors, func(i, j int) bool {
+		return collectors[i].Name() < collectors[j].Name()
+	})
+
+	buffered := bufio.NewWriter(writer)
+	for _, collector := range collectors {
+		fmt.Fprintf(buffered, "# HELP %s %s\n", collector.Name(), escapeHelp(collector.Help()))
+		fmt.Fprintf(buffered, "# TYPE %s %s\n", collector.Name(), collector.Type())
+		for _, sample := range collector.Samples() {
+			buffered.WriteString(collector.Name())
+			buffered.WriteString(sample.Suffix)
+			writeLabels(buffered, sample.Labels)
+			buffered.WriteByte(' ')
+			buffered.WriteString(formatFloat(sample.Value))
+			buffered.WriteByte('\n')
+		}
+	}
+	return buffered.Flush()
+}
+
+func (registry *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writer.WriteHeader(http.StatusOK)
+		registry.Write(writer)
+	})
+}
+
+func writeLabels(writer *bufio.Writer, labels []Label) {
+	if len(labels) == 0 {
+		return
+	}
+	writer.WriteByte('{')
+	for i, label := range labels {
+		if i > 0 {
+			writer.WriteByte(',')
+		}
+		writer.WriteString(label.Name)
+		writer.WriteString(`="`)
+		writer.WriteString(escapeLabelValue(label.Value))
+		writer.WriteByte('"')
+	}
+	writer.WriteByte('}')
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,481 @@
+// Package qr draws QR codes as SVG or PNG, for showing otpauth:// links to
+// authenticator apps. It only does what that needs: text is encoded in byte
+// mode at error correction level M, in versions 1 to 10, which holds up to
+// 213 bytes.
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// ErrTooLong is returned for text that does not fit in the largest
+// supported QR code.
+var ErrTooLong = errors.New("text is too long for a QR code")
+
+// quietZone is the light border, in modules, readers need around a code.
+const quietZone = 4
+
+// blocks describes how the codewords of a version at level M are split
+// into error correction blocks: count blocks of short data codewords, then
+// count2 blocks of one more, each followed by ecc error correction
+// codewords.
+type blocks struct {
+	ecc, count, short, count2 int
+}
+
+var levelM = [...]blocks{
+	1:  {10, 1, 16, 0},
+	2:  {16, 1, 28, 0},
+	3:  {26, 1, 44, 0},
+	4:  {18, 2, 32, 0},
+	5:  {24, 2, 43, 0},
+	6:  {16, 4, 27, 0},
+	7:  {18, 4, 31, 0},
+	8:  {22, 2, 38, 2},
+	9:  {22, 3, 36, 2},
+	10: {26, 4, 43, 1},
+}
+
+var alignments = [...][]int{
+	2:  {6, 18},
+	3:  {6, 22},
+	4:  {6, 26},
+	5:  {6, 30},
+	6:  {6, 34},
+	7:  {6, 22, 38},
+	8:  {6, 24, 42},
+	9:  {6, 26, 46},
+	10: {6, 28, 50},
+}
+
+func (layout blocks) dataCodewords() int {
+	return layout.count*layout.short + layout.count2*(layout.short+1)
+}
+
+// Code is a QR code, a square of dark and light modules.
+type Code struct {
+	size     int
+	modules  []bool
+	function []bool
+}
+
+// Encode returns the smallest QR code for text.
+func Encode(text string) (*Code, error) {
+	version := 1
+	for ; version < len(levelM); version++ {
+		if 4+countBits(version)+8*len(text) <= 8*levelM[version].dataCodewords() {
+			break
+		}
+	}
+	if version == len(levelM) {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTooLong, len(text))
+	}
+
+	size := 17 + 4*version
+	code := &Code{size: size, modules: make([]bool, size*size), function: make([]bool, size*size)}
+	code.drawFunctionPatterns(version)
+	code.drawCodewords(codewords(version, text))
+
+	best, lowest := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		code.applyMask(mask)
+		code.drawFormat(mask)
+		if penalty := code.penalty(); lowest < 0 || penalty < lowest {
+			best, lowest = mask, penalty
+		}
+		code.applyMask(mask)
+	}
+	code.applyMask(best)
+	code.drawFormat(best)
+	return code, nil
+}
+
+func countBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// codewords returns the data of text with its error correction, blocks
+// interleaved in the order they are drawn.
+func codewords(version int, text string) []byte {
+	layout := levelM[version]
+	capacity := layout.dataCodewords()
+
+	var bits bitBuffer
+	bits.append(0b0100, 4)
+	bits.append(len(text), countBits(version))
+	for _, b := range []byte(text) {
+		bits.append(int(b), 8)
+	}
+	terminator := 8*capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+	data := bits.bytes()
+	for pad := 0xec; len(data) < capacity; pad ^= 0xec ^ 0x11 {
+		data = append(data, byte(pad))
+	}
+
+	divisor := rsDivisor(layout.ecc)
+	var dataBlocks, eccBlocks [][]byte
+	for i := 0; i < layout.count+layout.count2; i++ {
+		length := layout.short
+		if i >= layout.count {
+			length++
+		}
+		dataBlocks = append(dataBlocks, data[:length])
+		eccBlocks = append(eccBlocks, rsRemainder(data[:length], divisor))
+		data = data[length:]
+	}
+
+	result := []byte{}
+	for i := 0; i <= layout.short; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < layout.ecc; i++ {
+		for _, block := range eccBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+type bitBuffer []bool
+
+func (buffer *bitBuffer) append(value int, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*buffer = append(*buffer, value>>i&1 == 1)
+	}
+}
+
+func (buffer bitBuffer) bytes() []byte {
+	result := make([]byte, len(buffer)/8)
+	for i, bit := range buffer {
+		if bit {
+			result[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x byte, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11d
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of degree,
+// without its leading coefficient.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < degree {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 2)
+	}
+	return result
+}
+
+// rsRemainder returns the error correction codewords for data.
+func rsRemainder(data []byte, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= gfMultiply(coefficient, factor)
+		}
+	}
+	return result
+}
+
+// Size is the width and height of code in modules, without a quiet zone.
+func (code *Code) Size() int {
+	return code.size
+}
+
+// Dark reports whether the module in column x and row y is dark.
+func (code *Code) Dark(x int, y int) bool {
+	return code.modules[y*code.size+x]
+}
+
+func (code *Code) set(x int, y int, dark bool) {
+	code.modules[y*code.size+x] = dark
+	code.function[y*code.size+x] = true
+}
+
+func (code *Code) drawFunctionPatterns(version int) {
+	for i := 0; i < code.size; i++ {
+		code.set(6, i, i%2 == 0)
+		code.set(i, 6, i%2 == 0)
+	}
+
+	finder := func(cx int, cy int) {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := cx+dx, cy+dy
+				if x < 0 || y < 0 || x >= code.size || y >= code.size {
+					continue
+				}
+				distance := abs(dx)
+				if abs(dy) > distance {
+					distance = abs(dy)
+				}
+				code.set(x, y, distance != 2 && distance != 4)
+			}
+		}
+	}
+	finder(3, 3)
+	finder(code.size-4, 3)
+	finder(3, code.size-4)
+
+	positions := alignments[version]
+	for i, cy := range positions {
+		for j, cx := range positions {
+			// The corners with finder patterns get no alignment pattern.
+			last := len(positions) - 1
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					distance := abs(dx)
+					if abs(dy) > distance {
+						distance = abs(dy)
+					}
+					code.set(cx+dx, cy+dy, distance != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format areas until a mask is chosen.
+	code.drawFormat(0)
+
+	if version >= 7 {
+		remainder := version
+		for i := 0; i < 12; i++ {
+			remainder = remainder<<1 ^ (remainder>>11)*0x1f25
+		}
+		bits := version<<12 | remainder
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 == 1
+			a, b := code.size-11+i%3, i/3
+			code.set(a, b, dark)
+			code.set(b, a, dark)
+		}
+	}
+}
+
+// formatBits returns the 15 format bits for level M with mask.
+func formatBits(mask int) int {
+	data := mask // level M is 00
+	remainder := data
+	for i := 0; i < 10; i++ {
+		remainder = remainder<<1 ^ (remainder>>9)*0x537
+	}
+	return (data<<10 | remainder) ^ 0x5412
+}
+
+func (code *Code) drawFormat(mask int) {
+	bits := formatBits(mask)
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		code.set(8, i, bit(i))
+	}
+	code.set(8, 7, bit(6))
+	code.set(8, 8, bit(7))
+	code.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		code.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		code.set(code.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		code.set(8, code.size-15+i, bit(i))
+	}
+	code.set(8, code.size-8, true)
+}
+
+// drawCodewords fills the modules left by the function patterns with data,
+// in two-module columns zigzagging up and down from the right.
+func (code *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := code.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vertical := 0; vertical < code.size; vertical++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vertical
+				if (right+1)&2 == 0 {
+					y = code.size - 1 - vertical
+				}
+				if code.function[y*code.size+x] || i >= len(data)*8 {
+					continue
+				}
+				code.modules[y*code.size+x] = data[i/8]>>(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules picked by mask. Applying it twice undoes
+// it.
+func (code *Code) applyMask(mask int) {
+	for y := 0; y < code.size; y++ {
+		for x := 0; x < code.size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !code.function[y*code.size+x] {
+				code.modules[y*code.size+x] = !code.modules[y*code.size+x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard code is to read, by the rules of the standard:
+// long runs, 2x2 blocks, patterns that look like finders and an unbalanced
+// amount of dark modules.
+func (code *Code) penalty() int {
+	result, dark := 0, 0
+	finderLike := []bool{true, false, true, true, true, false, true, false, false, false, false}
+	for _, rows := range []bool{true, false} {
+		at := func(line int, i int) bool {
+			if rows {
+				return code.Dark(i, line)
+			}
+			return code.Dark(line, i)
+		}
+		for line := 0; line < code.size; line++ {
+			run := 1
+			for i := 1; i <= code.size; i++ {
+				if i < code.size && at(line, i) == at(line, i-1) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					result += run - 2
+				}
+				run = 1
+			}
+			for i := 0; i+len(finderLike) <= code.size; i++ {
+				forward, backward := true, true
+				for k, want := range finderLike {
+					forward = forward && at(line, i+k) == want
+					backward = backward && at(line, i+len(finderLike)-1-k) == want
+				}
+				if forward {
+					result += 40
+				}
+				if backward {
+					result += 40
+				}
+			}
+		}
+	}
+	for y := 0; y < code.size; y++ {
+		for x := 0; x < code.size; x++ {
+			if code.Dark(x, y) {
+				dark++
+			}
+			if x > 0 && y > 0 && code.Dark(x, y) == code.Dark(x-1, y) && code.Dark(x, y) == code.Dark(x, y-1) && code.Dark(x, y) == code.Dark(x-1, y-1) {
+				result += 3
+			}
+		}
+	}
+	total := code.size * code.size
+	result += (abs(dark*20-total*10)+total-1)/total*10 - 10
+	return result
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// SVG draws code as an SVG image with a quiet zone, one unit per module, to
+// be scaled by the page.
+func (code *Code) SVG() []byte {
+	width := code.size + 2*quietZone
+	var svg bytes.Buffer
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, width, width)
+	fmt.Fprintf(&svg, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, width, width)
+	for y := 0; y < code.size; y++ {
+		for x := 0; x < code.size; x++ {
+			if code.Dark(x, y) {
+				fmt.Fprintf(&svg, "M%d %dh1v1h-1z", x+quietZone, y+quietZone)
+			}
+		}
+	}
+	svg.WriteString(`"/></svg>`)
+	return svg.Bytes()
+}
+
+// PNG draws code as a PNG image with a quiet zone, scale pixels per module.
+func (code *Code) PNG(scale int) ([]byte, error) {
+	if scale < 1 {
+		scale = 1
+	}
+	width := (code.size + 2*quietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, width, width), color.Palette{color.White, color.Black})
+	for y := 0; y < width; y++ {
+		for x := 0; x < width; x++ {
+			mx, my := x/scale-quietZone, y/scale-quietZone
+			if mx >= 0 && my >= 0 && mx < code.size && my < code.size && code.Dark(mx, my) {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	var buffer bytes.Buffer
+	err := png.Encode(&buffer, img)
+	return buffer.Bytes(), err
+}
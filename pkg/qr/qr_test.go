@@ -0,0 +1,84 @@
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestQR(t *testing.T) {
+
+	t.Run("error correction matches the worked example of the standard", func(t *testing.T) {
+		// HELLO WORLD at 1-M.
+		data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+		got := rsRemainder(data, rsDivisor(10))
+		want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got %v want %v", got, want)
+		}
+	})
+
+	t.Run("format bits match the table for level M", func(t *testing.T) {
+		want := []string{"101010000010010", "101000100100101", "101111001111100", "101101101001011",
+			"100010111111001", "100000011001110", "100111110010111", "100101010100000"}
+		for mask, bits := range want {
+			if got := fmt.Sprintf("%015b", formatBits(mask)); got != bits {
+				t.Errorf("got %s for mask %d want %s", got, mask, bits)
+			}
+		}
+	})
+
+	t.Run("the smallest version that fits is used, up to 10", func(t *testing.T) {
+		sizes := map[int]int{1: 21, 14: 21, 15: 25, 122: 45, 123: 49, 180: 53, 181: 57, 213: 57}
+		for length, size := range sizes {
+			code, err := Encode(strings.Repeat("a", length))
+			if err != nil || code.Size() != size {
+				t.Errorf("got %v for %d bytes want size %d", err, length, size)
+				continue
+			}
+			for _, corner := range [][2]int{{0, 0}, {size - 7, 0}, {0, size - 7}} {
+				if !code.Dark(corner[0], corner[1]) || !code.Dark(corner[0]+3, corner[1]+3) || code.Dark(corner[0]+1, corner[1]+1) {
+					t.Errorf("no finder pattern at %v in the %d byte code", corner, length)
+				}
+			}
+		}
+		if _, err := Encode(strings.Repeat("a", 214)); !errors.Is(err, ErrTooLong) {
+			t.Errorf("got %v for 214 bytes want %v", err, ErrTooLong)
+		}
+	})
+
+	t.Run("PNG and SVG draw the modules inside a quiet zone", func(t *testing.T) {
+		code, err := Encode("otpauth://totp/user-app:lou?secret=JBSWY3DPEHPK3PXP&issuer=user-app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := code.PNG(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("error decoding the PNG: %s", err)
+		}
+		width := (code.Size() + 2*quietZone) * 3
+		if img.Bounds().Dx() != width {
+			t.Fatalf("got a %d pixel wide PNG want %d", img.Bounds().Dx(), width)
+		}
+		for y := 0; y < code.Size(); y++ {
+			for x := 0; x < code.Size(); x++ {
+				r, _, _, _ := img.At((x+quietZone)*3+1, (y+quietZone)*3+1).RGBA()
+				if (r == 0) != code.Dark(x, y) {
+					t.Fatalf("got the wrong color at module %d,%d", x, y)
+				}
+			}
+		}
+
+		svg := string(code.SVG())
+		if !strings.HasPrefix(svg, "<svg ") || strings.Count(svg, "h1v1h-1z") == 0 || !strings.Contains(svg, "M4 4h1v1h-1z") {
+			t.Errorf("got %s want an SVG with the top left module at 4,4", svg)
+		}
+	})
+}
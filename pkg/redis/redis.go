@@ -0,0 +1,202 @@
+// Package redis is a small client for the parts of the Redis protocol
+// (RESP2) a cache needs: GET, SET with an expiry and DEL. It works with
+// Redis and compatible servers such as Valkey and KeyDB.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Error is an error reply from the server.
+type Error string
+
+func (err Error) Error() string {
+	return "redis: " + string(err)
+}
+
+const maxIdleConns = 4
+
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Client sends commands to the server at address, keeping a few idle
+// connections open for reuse. It is safe for concurrent use.
+type Client struct {
+	address  string
+	password string
+	timeout  time.Duration
+
+	mutex sync.Mutex
+	idle  []*conn
+}
+
+// NewClient returns a client for the server at address, authenticating
+// with password unless it is empty.
+func NewClient(address string, password string) *Client {
+	return &Client{address: address, password: password, timeout: time.Second}
+}
+
+func (client *Client) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := client.Do(ctx, "GET", key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected reply to GET: %v", reply)
+	}
+	return value, true, nil
+}
+
+func (client *Client) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := client.Do(ctx, "SET", key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (client *Client) Delete(ctx context.Context, keys ...string) error {
+	_, err := client.Do(ctx, append([]string{"DEL"}, keys...)...)
+	return err
+}
+
+// Do sends a command and returns its reply: nil, a string for a status, an
+// int64, []byte for a bulk string or []any for an array. An error reply is
+// returned as an Error.
+func (client *Client) Do(ctx context.Context, args ...string) (any, error) {
+	conn, err := client.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := roundTrip(ctx, conn, client.timeout, args)
+	var replyError Error
+	if err != nil && !errors.As(err, &replyError) {
+		conn.Close()
+		return nil, err
+	}
+	client.release(conn)
+	return reply, err
+}
+
+func (client *Client) conn(ctx context.Context) (*conn, error) {
+	client.mutex.Lock()
+	if count := len(client.idle); count > 0 {
+		conn := client.idle[count-1]
+		client.idle = client.idle[:count-1]
+		client.mutex.Unlock()
+		return conn, nil
+	}
+	client.mutex.Unlock()
+
+	dialer := net.Dialer{Timeout: client.timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", client.address)
+	if err != nil {
+		return nil, err
+	}
+	conn := &conn{Conn: netConn, reader: bufio.NewReader(netConn)}
+	if client.password != "" {
+		_, err = roundTrip(ctx, conn, client.timeout, []string{"AUTH", client.password})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (client *Client) release(conn *conn) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if len(client.idle) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	client.idle = append(client.idle, conn)
+}
+
+// Close closes the idle connections.
+func (client *Client) Close() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	for _, conn := range client.idle {
+		conn.Close()
+	}
+	client.idle = nil
+	return nil
+}
+
+func roundTrip(ctx context.Context, conn *conn, timeout time.Duration, args []string) (any, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > timeout {
+		deadline = time.Now().Add(timeout)
+	}
+	conn.SetDeadline(deadline)
+
+	_, err := conn.Write(encodeCommand(args))
+	if err != nil {
+		return nil, err
+	}
+	return readReply(conn.reader)
+}
+
+func encodeCommand(args []string) []byte {
+	command := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		command = append(command, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	return command
+}
+
+func readReply(reader *bufio.Reader) (any, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, Error(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(body)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return nil, err
+		}
+		return data[:length], nil
+	case '*':
+		count, err := strconv.Atoi(body)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]any, count)
+		for i := range items {
+			items[i], err = readReply(reader)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
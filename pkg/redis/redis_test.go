@@ -0,0 +1,117 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer answers AUTH, GET, SET and DEL from a map, enough to stand in
+// for Redis in tests.
+func fakeServer(t *testing.T, password string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var mutex sync.Mutex
+	values := map[string]string{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				authenticated := password == ""
+				for {
+					request, err := readReply(reader)
+					if err != nil {
+						return
+					}
+					args := []string{}
+					for _, arg := range request.([]any) {
+						args = append(args, string(arg.([]byte)))
+					}
+
+					mutex.Lock()
+					reply := "+OK\r\n"
+					switch {
+					case args[0] == "AUTH":
+						authenticated = args[1] == password
+						if !authenticated {
+							reply = "-WRONGPASS invalid password\r\n"
+						}
+					case !authenticated:
+						reply = "-NOAUTH Authentication required.\r\n"
+					case args[0] == "GET":
+						value, ok := values[args[1]]
+						reply = "$-1\r\n"
+						if ok {
+							reply = "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+						}
+					case args[0] == "SET":
+						values[args[1]] = args[2]
+					case args[0] == "DEL":
+						deleted := 0
+						for _, key := range args[1:] {
+							if _, ok := values[key]; ok {
+								delete(values, key)
+								deleted++
+							}
+						}
+						reply = ":" + strconv.Itoa(deleted) + "\r\n"
+					default:
+						reply = "-ERR unknown command\r\n"
+					}
+					mutex.Unlock()
+					conn.Write([]byte(reply))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	t.Run("Set, Get and Delete round trip a value", func(t *testing.T) {
+		client := NewClient(fakeServer(t, "secret"), "secret")
+		defer client.Close()
+		ctx := context.Background()
+
+		err := client.Set(ctx, "user:lou", []byte(`{"user-name":"lou"}`), time.Minute)
+		if err != nil {
+			t.Fatalf("error setting value: %s", err)
+		}
+		value, found, err := client.Get(ctx, "user:lou")
+		if err != nil || !found || string(value) != `{"user-name":"lou"}` {
+			t.Fatalf("got %q, %v, %v want the value set", value, found, err)
+		}
+
+		err = client.Delete(ctx, "user:lou", "users")
+		if err != nil {
+			t.Fatalf("error deleting value: %s", err)
+		}
+		_, found, err = client.Get(ctx, "user:lou")
+		if err != nil || found {
+			t.Fatalf("value still found after delete: %v", err)
+		}
+	})
+
+	t.Run("error replies are returned as Error", func(t *testing.T) {
+		client := NewClient(fakeServer(t, "secret"), "wrong")
+		defer client.Close()
+
+		_, _, err := client.Get(context.Background(), "user:lou")
+		if _, ok := err.(Error); !ok {
+			t.Fatalf("expected an Error reply, got: %v", err)
+		}
+	})
+}
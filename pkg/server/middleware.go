@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/metrics"
+	"github.com/letitloose/user-app/pkg/tracing"
+	"github.com/letitloose/user-app/pkg/user"
+	"github.com/letitloose/user-app/pkg/view"
+)
+
+var (
+	httpRequests = metrics.NewCounterVec("userapp_http_requests_total",
+		"Total number of HTTP requests by route, method and status code.", "route", "method", "code")
+	httpRequestDuration = metrics.NewHistogramVec("userapp_http_request_duration_seconds",
+		"HTTP request latency by route and method.", metrics.DefaultBuckets, "route", "method")
+)
+
+// defaultRequestTimeout is how long a request may run before its context is
+// canceled, when server.request-timeout is not set.
+const defaultRequestTimeout = 30 * time.Second
+
+// defaultExportTimeout is the timeout of GET /users/export when
+// server.export-timeout is not set.
+const defaultExportTimeout = time.Hour
+
+func init() {
+	metrics.MustRegister(httpRequests, httpRequestDuration)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(bytes []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(bytes)
+}
+
+// instrument records request counts and latency for every request served by
+// mux. Requests are labelled with the mux pattern they matched rather than
+// the raw path so that /users/{name} does not create a series per user.
+func instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		route := matchedRoute(mux, request)
+
+		recorder := &statusRecorder{ResponseWriter: writer}
+		start := time.Now()
+		mux.ServeHTTP(recorder, request)
+		elapsed := time.Since(start)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		httpRequests.With(route, request.Method, strconv.Itoa(recorder.status)).Inc()
+		httpRequestDuration.With(route, request.Method).Observe(elapsed.Seconds())
+	})
+}
+
+// trace wraps handler in a server span named after the route mux matches.
+func trace(mux *http.ServeMux, handler http.Handler) http.Handler {
+	return tracing.Middleware(handler, func(request *http.Request) string {
+		return "HTTP " + request.Method + " " + matchedRoute(mux, request)
+	})
+}
+
+func matchedRoute(mux *http.ServeMux, request *http.Request) string {
+	_, route := mux.Handler(request)
+	if route == "" {
+		return "unmatched"
+	}
+	return route
+}
+
+// withTimeout cancels the request context after timeout so that queries
+// started by the handler are abandoned along with the request. Exports
+// stream for as long as reading every user takes, so they get exportTimeout
+// instead.
+func withTimeout(handler http.Handler, timeout time.Duration, exportTimeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		limit := timeout
+		if request.URL.Path == "/users/export" {
+			limit = exportTimeout
+		}
+		ctx, cancel := context.WithTimeout(request.Context(), limit)
+		defer cancel()
+		handler.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// cors lets the browser origins listed in cors.allowed-origins call the API,
+// answering their preflight requests itself. The list is read from the
+// current config on every request so a reload applies immediately.
+func cors(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		origin := request.Header.Get("Origin")
+		writer.Header().Add("Vary", "Origin")
+		allowed := config.GetConfig().Cors.AllowedOrigins
+		if origin == "" || !(contains(allowed, origin) || contains(allowed, "*")) {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+
+		writer.Header().Set("Access-Control-Allow-Origin", origin)
+		if request.Method == http.MethodOptions && request.Header.Get("Access-Control-Request-Method") != "" {
+			writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+			writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			writer.Header().Set("Access-Control-Max-Age", "600")
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// secureHeaders sets a strict Content-Security-Policy with a fresh nonce for
+// every response. Templates read the nonce from the request context, so only
+// scripts the app rendered itself are allowed to run.
+func secureHeaders(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		nonce := view.NewNonce()
+		writer.Header().Set("Content-Security-Policy", contentSecurityPolicy(nonce))
+		writer.Header().Set("X-Content-Type-Options", "nosniff")
+		writer.Header().Set("X-Frame-Options", "DENY")
+		writer.Header().Set("Referrer-Policy", "same-origin")
+		handler.ServeHTTP(writer, request.WithContext(view.WithNonce(request.Context(), nonce)))
+	})
+}
+
+func contentSecurityPolicy(nonce string) string {
+	return "default-src 'none'; " +
+		"script-src 'nonce-" + nonce + "' 'strict-dynamic'; " +
+		"style-src 'self'; " +
+		"img-src 'self' data:; " +
+		"connect-src 'self'; " +
+		"form-action 'self'; " +
+		"base-uri 'none'; " +
+		"frame-ancestors 'none'"
+}
+
+// requestIDPattern is what an X-Request-ID from a trusted proxy must look
+// like to be kept.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID gives every request an ID, sent back in X-Request-ID and
+// recorded with audit events. Requests from rate-limit.trusted-proxies keep
+// the X-Request-ID they came with, so the proxy's logs can be matched up.
+func requestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get("X-Request-ID")
+		host, _, err := net.SplitHostPort(request.RemoteAddr)
+		if err != nil || !requestIDPattern.MatchString(id) || !trustedProxy(config.GetConfig().RateLimit.TrustedProxies, host) {
+			id = newRequestID()
+		}
+		writer.Header().Set("X-Request-ID", id)
+		handler.ServeHTTP(writer, request.WithContext(user.WithRequestID(request.Context(), id)))
+	})
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/logging"
+	"github.com/letitloose/user-app/pkg/metrics"
+	"github.com/letitloose/user-app/pkg/user"
+)
+
+var rateLimited = metrics.NewCounterVec("userapp_rate_limited_total",
+	"Total number of requests refused for going over a rate limit by route group.", "group")
+
+func init() {
+	metrics.MustRegister(rateLimited)
+}
+
+// RateLimit is what taking a request from a token bucket left of it.
+type RateLimit struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again, and RetryAfter how
+	// long until it holds a token for a refused request.
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps the token buckets requests are counted in.
+// MemoryRateLimitStore keeps them in the process; a store shared by every
+// instance, in Redis for example, makes the limits apply across them.
+type RateLimitStore interface {
+	// Take takes a token from the bucket under key, which holds limit tokens
+	// and refills completely over window.
+	Take(ctx context.Context, key string, limit int, window time.Duration) (RateLimit, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// MemoryRateLimitStore keeps token buckets in memory. Buckets that have
+// refilled are dropped once a minute. It is safe for concurrent use.
+type MemoryRateLimitStore struct {
+	now     func() time.Time
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{now: time.Now, buckets: map[string]*bucket{}}
+}
+
+func (store *MemoryRateLimitStore) Take(ctx context.Context, key string, limit int, window time.Duration) (RateLimit, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := store.now()
+	if now.Sub(store.swept) >= time.Minute {
+		for name, idle := range store.buckets {
+			if !idle.full.After(now) {
+				delete(store.buckets, name)
+			}
+		}
+		store.swept = now
+	}
+
+	capacity := float64(limit)
+	perSecond := capacity / window.Seconds()
+	current, ok := store.buckets[key]
+	if !ok {
+		current = &bucket{tokens: capacity, updated: now}
+		store.buckets[key] = current
+	}
+	tokens := math.Min(capacity, current.tokens+now.Sub(current.updated).Seconds()*perSecond)
+
+	result := RateLimit{Limit: limit}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - tokens) / perSecond)
+	}
+	current.tokens, current.updated = tokens, now
+	current.full = now.Add(seconds((capacity - tokens) / perSecond))
+	result.Remaining = int(tokens)
+	result.Reset = current.full.Sub(now)
+	return result, nil
+}
+
+func seconds(value float64) time.Duration {
+	return time.Duration(value * float64(time.Second))
+}
+
+// authPaths are the routes in the auth rate limit group when posted to.
+var authPaths = map[string]bool{
+	"/login":                true,
+	"/login/2fa":            true,
+	"/login/passkey/begin":  true,
+	"/login/passkey/finish": true,
+	"/signup":               true,
+	"/password/forgot":      true,
+	"/password/reset":       true,
+	"/email/verify/resend":  true,
+	"/invitations/accept":   true,
+}
+
+// rateLimitGroup picks the limit for request: rate-limit.auth for posts to
+// authPaths, rate-limit.writes for other requests that change something, and
+// the default limit for the rest or when the group has no limit of its own.
+func rateLimitGroup(settings config.RateLimitConfig, request *http.Request) (string, config.RateLimitRule) {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		if authPaths[request.URL.Path] && settings.Auth.Requests > 0 {
+			return "auth", settings.Auth
+		}
+		if !authPaths[request.URL.Path] && settings.Writes.Requests > 0 {
+			return "writes", settings.Writes
+		}
+	}
+	return "default", config.RateLimitRule{Requests: settings.Requests, Window: settings.Window, Key: settings.Key}
+}
+
+// rateLimitKey is who request is counted against under rule. Anonymous
+// requests are counted by IP address whatever the rule's key.
+func rateLimitKey(rule config.RateLimitRule, request *http.Request) string {
+	caller := user.CallerFromContext(request.Context())
+	switch {
+	case caller.Username != "" && rule.Key == "user":
+		return "user:" + caller.Username
+	case caller.Username != "" && rule.Key == "session":
+		return "session:" + user.SessionKey(request)
+	}
+	return "ip:" + user.ClientIPFromContext(request.Context())
+}
+
+// byCaller reports whether rule counts logged in callers by session or user
+// rather than by IP address.
+func byCaller(rule config.RateLimitRule) bool {
+	return rule.Key == "session" || rule.Key == "user"
+}
+
+// rateLimit refuses requests over the limit of their group with 429 Too Many
+// Requests and a Retry-After header, and tells clients where they stand in
+// RateLimit-* headers. It applies only the rules counted by caller when
+// callers is true, to run after the session is looked up, and only those
+// counted by IP address otherwise, to run before so floods are refused
+// without touching the database. The limits are read from the current config
+// on every request so a reload applies immediately. If store fails the
+// request is let through.
+func rateLimit(store RateLimitStore, callers bool, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		group, rule := rateLimitGroup(config.GetConfig().RateLimit, request)
+		if rule.Requests <= 0 || rule.Window <= 0 || byCaller(rule) != callers {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+
+		limit, err := store.Take(request.Context(), group+":"+rateLimitKey(rule, request), rule.Requests, rule.Window)
+		if err != nil {
+			logging.Errorf("error checking rate limit: %s", err)
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		writer.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Limit))
+		writer.Header().Set("RateLimit-Remaining", strconv.Itoa(limit.Remaining))
+		writer.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(limit.Reset)))
+		writer.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rule.Requests, ceilSeconds(rule.Window)))
+		if !limit.Allowed {
+			rateLimited.With(group).Inc()
+			retryAfter := ceilSeconds(limit.RetryAfter)
+			writer.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			writer.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprintf(writer, "too many requests, try again in %ds", retryAfter)
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+func ceilSeconds(duration time.Duration) int {
+	return int(math.Ceil(duration.Seconds()))
+}
+
+// realIP sets the RemoteAddr of requests from rate-limit.trusted-proxies to
+// the client address they forwarded: the last one in X-Forwarded-For that is
+// not a trusted proxy itself. Other requests keep theirs, so clients cannot
+// pick their own address. The address is also put in the request context for
+// the rate limits and lockouts.
+func realIP(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		proxies := config.GetConfig().RateLimit.TrustedProxies
+		host, _, err := net.SplitHostPort(request.RemoteAddr)
+		if err != nil {
+			host = request.RemoteAddr
+		}
+		if len(proxies) == 0 || err != nil || !trustedProxy(proxies, host) {
+			handler.ServeHTTP(writer, request.WithContext(user.WithClientIP(request.Context(), host)))
+			return
+		}
+
+		forwarded := strings.Split(strings.Join(request.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			address := strings.TrimSpace(forwarded[i])
+			if net.ParseIP(address) == nil {
+				break
+			}
+			host = address
+			if !trustedProxy(proxies, address) {
+				break
+			}
+		}
+		request = request.WithContext(user.WithClientIP(request.Context(), host))
+		request.RemoteAddr = net.JoinHostPort(host, "0")
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+func trustedProxy(proxies []string, address string) bool {
+	ip := net.ParseIP(address)
+	for _, proxy := range proxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil && network.Contains(ip) {
+			return true
+		}
+		if net.ParseIP(proxy).Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
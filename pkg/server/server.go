@@ -1,10 +1,11 @@
 package server
 
 import (
-	"log"
 	"net/http"
 
 	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/logging"
+	"github.com/letitloose/user-app/pkg/metrics"
 	"github.com/letitloose/user-app/pkg/static"
 	"github.com/letitloose/user-app/pkg/user"
 )
@@ -12,29 +13,49 @@ import (
 type Server struct {
 	config      *config.Config
 	userService *user.UserService
+	assets      *static.Assets
+	rateLimits  RateLimitStore
 }
 
-func NewServer(config *config.Config, userService *user.UserService) *Server {
+func NewServer(config *config.Config, userService *user.UserService, assets *static.Assets) *Server {
 	return &Server{
 		config:      config,
 		userService: userService,
+		assets:      assets,
+		rateLimits:  NewMemoryRateLimitStore(),
 	}
 }
 
+// SetRateLimitStore makes the rate limits count requests in store instead of
+// in memory.
+func (server *Server) SetRateLimitStore(store RateLimitStore) {
+	server.rateLimits = store
+}
+
 func (server *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
 
-	static.AddHandlersToMux(mux)
-	log.Println("adding user handlers")
+	server.assets.AddHandlersToMux(mux)
+	logging.Debugf("adding user handlers")
 	server.userService.AddHandlersToMux(mux)
-	return mux
+	mux.Handle("/metrics", metrics.Handler())
+	timeout := server.config.Server.RequestTimeout
+	if timeout == 0 {
+		timeout = defaultRequestTimeout
+	}
+	exportTimeout := server.config.Server.ExportTimeout
+	if exportTimeout == 0 {
+		exportTimeout = defaultExportTimeout
+	}
+	identified := server.userService.Identify(rateLimit(server.rateLimits, true, instrument(mux)))
+	return withTimeout(requestID(realIP(trace(mux, cors(secureHeaders(rateLimit(server.rateLimits, false, identified)))))), timeout, exportTimeout)
 }
 
 func (server *Server) Run() error {
 
-	log.Println("starting server on port 8080")
+	logging.Infof("starting server on %s", server.config.Server.Address)
 	httpServer := &http.Server{
-		Addr:    ":8080",
+		Addr:    server.config.Server.Address,
 		Handler: server.Handler(),
 	}
 
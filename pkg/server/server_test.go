@@ -1 +1,319 @@
 package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/metrics"
+	"github.com/letitloose/user-app/pkg/user"
+	"github.com/letitloose/user-app/pkg/view"
+)
+
+func TestServer(t *testing.T) {
+
+	t.Run("instrument counts requests by route pattern", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/things/", func(writer http.ResponseWriter, request *http.Request) {
+			writer.WriteHeader(http.StatusTeapot)
+		})
+		handler := instrument(mux)
+
+		for _, path := range []string{"/things/a", "/things/b"} {
+			request, err := http.NewRequest("GET", path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+		}
+
+		var output bytes.Buffer
+		metrics.DefaultRegistry.Write(&output)
+
+		expected := `userapp_http_requests_total{route="/things/",method="GET",code="418"} 2`
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("missing request counter %q in:\n%s", expected, output.String())
+		}
+		expected = `userapp_http_request_duration_seconds_count{route="/things/",method="GET"} 2`
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("missing latency histogram %q in:\n%s", expected, output.String())
+		}
+	})
+
+	t.Run("withTimeout puts a deadline on the request context", func(t *testing.T) {
+		var deadline time.Time
+		var hasDeadline bool
+		handler := withTimeout(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			deadline, hasDeadline = request.Context().Deadline()
+		}), time.Minute, time.Hour)
+
+		request, err := http.NewRequest("GET", "/users", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+
+		if !hasDeadline || time.Until(deadline) > time.Minute {
+			t.Errorf("request context has no deadline within a minute: %v", deadline)
+		}
+	})
+
+	t.Run("withTimeout gives exports their own timeout", func(t *testing.T) {
+		userService := user.NewUserService(slowStore{delay: 20 * time.Millisecond, users: 5}, nil)
+		mux := http.NewServeMux()
+		userService.AddHandlersToMux(mux)
+		handler := withTimeout(mux, 30*time.Millisecond, time.Minute)
+
+		ctx := user.WithCaller(context.Background(), user.Caller{Username: "boss", Role: user.RoleAdmin})
+		request, err := http.NewRequestWithContext(ctx, "GET", "/users/export?format=ndjson&fields=user-name", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if lines := strings.Count(recorder.Body.String(), "\n"); recorder.Code != http.StatusOK || lines != 5 {
+			t.Errorf("got %d with %d users want the whole export of 5 past the request timeout:\n%s", recorder.Code, lines, recorder.Body.String())
+		}
+	})
+
+	t.Run("secureHeaders sets a CSP with the nonce handed to the handler", func(t *testing.T) {
+		var nonce string
+		handler := secureHeaders(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			nonce = view.NonceFromContext(request.Context())
+		}))
+
+		request, err := http.NewRequest("GET", "/users", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		policy := recorder.Header().Get("Content-Security-Policy")
+		if nonce == "" || !strings.Contains(policy, "script-src 'nonce-"+nonce+"'") {
+			t.Errorf("policy does not allow the request nonce %q: %s", nonce, policy)
+		}
+		if strings.Contains(policy, "unsafe-inline") {
+			t.Errorf("policy allows inline scripts: %s", policy)
+		}
+
+		first := nonce
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+		if nonce == first {
+			t.Error("nonce was reused across requests")
+		}
+	})
+
+	t.Run("cors allows the configured origins from the current config", func(t *testing.T) {
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{Cors: config.CORSConfig{AllowedOrigins: []string{"https://admin.example.com"}}})
+
+		called := false
+		handler := cors(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			called = true
+		}))
+
+		request, err := http.NewRequest("OPTIONS", "/users", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Origin", "https://admin.example.com")
+		request.Header.Set("Access-Control-Request-Method", "DELETE")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusNoContent || called {
+			t.Errorf("preflight not answered by cors, got %d called %v", recorder.Code, called)
+		}
+		if recorder.Header().Get("Access-Control-Allow-Origin") != "https://admin.example.com" {
+			t.Errorf("origin not allowed: %v", recorder.Header())
+		}
+
+		config.SetConfig(&config.Config{})
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Header().Get("Access-Control-Allow-Origin") != "" || !called {
+			t.Errorf("origin still allowed after the config changed: %v", recorder.Header())
+		}
+	})
+
+	t.Run("MemoryRateLimitStore refills buckets over the window", func(t *testing.T) {
+		now := time.Unix(1700000000, 0)
+		store := NewMemoryRateLimitStore()
+		store.now = func() time.Time { return now }
+		ctx := context.Background()
+
+		for i := 0; i < 2; i++ {
+			if limit, _ := store.Take(ctx, "ip:192.0.2.1", 2, time.Minute); !limit.Allowed || limit.Remaining != 1-i {
+				t.Errorf("got %+v for request %d want allowed with %d remaining", limit, i+1, 1-i)
+			}
+		}
+		limit, _ := store.Take(ctx, "ip:192.0.2.1", 2, time.Minute)
+		if limit.Allowed || limit.RetryAfter != 30*time.Second || limit.Reset != time.Minute {
+			t.Errorf("got %+v over the limit want refused for 30s", limit)
+		}
+		if limit, _ := store.Take(ctx, "ip:192.0.2.2", 2, time.Minute); !limit.Allowed {
+			t.Errorf("got %+v for another key want allowed", limit)
+		}
+
+		now = now.Add(30 * time.Second)
+		if limit, _ := store.Take(ctx, "ip:192.0.2.1", 2, time.Minute); !limit.Allowed || limit.Remaining != 0 {
+			t.Errorf("got %+v after half the window want one more request", limit)
+		}
+		now = now.Add(2 * time.Minute)
+		store.Take(ctx, "ip:192.0.2.3", 2, time.Minute)
+		if len(store.buckets) != 1 {
+			t.Errorf("got %d buckets after the others refilled want 1", len(store.buckets))
+		}
+	})
+
+	t.Run("rateLimit applies the limit of the route group to each client", func(t *testing.T) {
+		defer config.SetConfig(config.GetConfig())
+		settings := &config.Config{RateLimit: config.RateLimitConfig{
+			Auth:   config.RateLimitRule{Requests: 2, Window: time.Minute, Key: "ip"},
+			Writes: config.RateLimitRule{Requests: 1, Window: time.Minute, Key: "user"},
+		}}
+		config.SetConfig(settings)
+		store := NewMemoryRateLimitStore()
+		identified := 0
+		handler := rateLimit(store, false, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			identified++
+			rateLimit(store, true, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})).ServeHTTP(writer, request)
+		}))
+		send := func(caller user.Caller, ip string, method string, path string) *httptest.ResponseRecorder {
+			ctx := user.WithClientIP(user.WithCaller(context.Background(), caller), ip)
+			request, err := http.NewRequestWithContext(ctx, method, path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			return recorder
+		}
+		amy := user.Caller{Username: "amy", Role: user.RoleUser}
+
+		for i := 0; i < 2; i++ {
+			if recorder := send(user.Caller{}, "192.0.2.1", "POST", "/login"); recorder.Code != http.StatusOK || recorder.Header().Get("RateLimit-Remaining") != strconv.Itoa(1-i) {
+				t.Errorf("got %d with headers %v for login %d want it allowed", recorder.Code, recorder.Header(), i+1)
+			}
+		}
+		recorder := send(user.Caller{}, "192.0.2.1", "POST", "/login")
+		if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "30" || recorder.Header().Get("RateLimit-Policy") != "2;w=60" {
+			t.Errorf("got %d with headers %v over the limit want %d and when to retry", recorder.Code, recorder.Header(), http.StatusTooManyRequests)
+		}
+		if identified != 2 {
+			t.Errorf("got %d requests past the IP limit want 2, with the refused one stopped before the session is looked up", identified)
+		}
+		if recorder = send(user.Caller{}, "192.0.2.2", "POST", "/login"); recorder.Code != http.StatusOK {
+			t.Errorf("got %d for another address want it allowed", recorder.Code)
+		}
+		if recorder = send(user.Caller{}, "192.0.2.1", "GET", "/login"); recorder.Code != http.StatusOK || recorder.Header().Get("RateLimit-Limit") != "" {
+			t.Errorf("got %d with headers %v for the login page want it unlimited", recorder.Code, recorder.Header())
+		}
+
+		if recorder = send(amy, "192.0.2.1", "POST", "/users"); recorder.Code != http.StatusOK {
+			t.Errorf("got %d for amy's first write want it allowed", recorder.Code)
+		}
+		if recorder = send(amy, "192.0.2.9", "PUT", "/users/amy"); recorder.Code != http.StatusTooManyRequests {
+			t.Errorf("got %d for amy's second write from another address want %d", recorder.Code, http.StatusTooManyRequests)
+		}
+
+		settings.RateLimit.Writes.Requests = 0
+		if recorder = send(amy, "192.0.2.1", "PUT", "/users/amy"); recorder.Code != http.StatusOK || recorder.Header().Get("RateLimit-Limit") != "" {
+			t.Errorf("got %d with headers %v after the limit was turned off want it unlimited", recorder.Code, recorder.Header())
+		}
+	})
+
+	t.Run("realIP takes the client address from X-Forwarded-For only through trusted proxies", func(t *testing.T) {
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{RateLimit: config.RateLimitConfig{TrustedProxies: []string{"10.0.0.0/8", "198.51.100.7"}}})
+		var remoteAddr, clientIP string
+		handler := realIP(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			remoteAddr, clientIP = request.RemoteAddr, user.ClientIPFromContext(request.Context())
+		}))
+
+		for _, test := range []struct{ from, forwarded, want string }{
+			{"10.0.0.1:1234", "203.0.113.9", "203.0.113.9:0"},
+			{"10.0.0.1:1234", "192.0.2.66, 203.0.113.9, 10.0.0.2", "203.0.113.9:0"},
+			{"198.51.100.7:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3:0"},
+			{"10.0.0.1:1234", "", "10.0.0.1:0"},
+			{"203.0.113.9:1234", "192.0.2.66", "203.0.113.9:1234"},
+		} {
+			request, err := http.NewRequest("GET", "/users", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.RemoteAddr = test.from
+			if test.forwarded != "" {
+				request.Header.Set("X-Forwarded-For", test.forwarded)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+			if remoteAddr != test.want {
+				t.Errorf("got %s from %s forwarding %q want %s", remoteAddr, test.from, test.forwarded, test.want)
+			}
+			if host, _, _ := net.SplitHostPort(test.want); clientIP != host {
+				t.Errorf("got client IP %s from %s forwarding %q want %s", clientIP, test.from, test.forwarded, host)
+			}
+		}
+	})
+
+	t.Run("requestID keeps the X-Request-ID of trusted proxies only", func(t *testing.T) {
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{RateLimit: config.RateLimitConfig{TrustedProxies: []string{"10.0.0.0/8"}}})
+		var id string
+		handler := requestID(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			id = user.RequestIDFromContext(request.Context())
+		}))
+
+		for _, test := range []struct{ from, header string }{
+			{"10.0.0.1:1234", "lb-42"},
+			{"203.0.113.9:1234", "lb-42"},
+			{"10.0.0.1:1234", "not valid"},
+		} {
+			request, err := http.NewRequest("GET", "/users", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.RemoteAddr = test.from
+			request.Header.Set("X-Request-ID", test.header)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			kept := test.from == "10.0.0.1:1234" && test.header == "lb-42"
+			if id == "" || recorder.Header().Get("X-Request-ID") != id || (id == test.header) != kept {
+				t.Errorf("got ID %q from %s sending %q, kept want %v", id, test.from, test.header, kept)
+			}
+		}
+	})
+}
+
+// slowStore lists users one every delay, checking the context like a
+// database would.
+type slowStore struct {
+	user.Store
+	delay time.Duration
+	users int
+}
+
+func (store slowStore) EachUser(ctx context.Context, filter user.ListFilter, fn func(user *user.User) error) error {
+	for i := 0; i < store.users; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(store.delay):
+		}
+		err := fn(&user.User{Username: "user" + strconv.Itoa(i)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,10 +1,123 @@
 package static
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
 	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
 )
 
-func AddHandlersToMux(mux *http.ServeMux) {
-	fileServer := http.FileServer(http.Dir("./pkg/static/"))
-	mux.Handle("/static/", http.StripPrefix("/static", fileServer))
+//go:embed css
+var embedded embed.FS
+
+// Files returns the static assets, read from the binary unless dev is set, in
+// which case they are read from pkg/static on disk so edits show up without
+// a rebuild.
+func Files(dev bool) fs.FS {
+	if dev {
+		return os.DirFS("pkg/static")
+	}
+	return embedded
+}
+
+type asset struct {
+	name   string
+	hashed string
+	hash   string
+	data   []byte
+}
+
+// Assets serves static files. Outside of dev mode every file is also served
+// under a name containing a hash of its content, so those URLs can be cached
+// forever and change whenever the file does.
+type Assets struct {
+	files    fs.FS
+	dev      bool
+	byName   map[string]*asset
+	byHashed map[string]*asset
+}
+
+func NewAssets(files fs.FS, dev bool) (*Assets, error) {
+	assets := &Assets{files: files, dev: dev, byName: map[string]*asset{}, byHashed: map[string]*asset{}}
+	if dev {
+		return assets, nil
+	}
+
+	err := fs.WalkDir(files, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])[:12]
+		extension := path.Ext(name)
+		asset := &asset{
+			name:   name,
+			hashed: strings.TrimSuffix(name, extension) + "." + hash + extension,
+			hash:   hash,
+			data:   data,
+		}
+		assets.byName[name] = asset
+		assets.byHashed[asset.hashed] = asset
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return assets, nil
+}
+
+// URL returns the path to link to name with, e.g. "css/skeleton.css" becomes
+// "/static/css/skeleton.3b6b1a1fb1c2.css".
+func (assets *Assets) URL(name string) string {
+	if asset, ok := assets.byName[name]; ok {
+		return "/static/" + asset.hashed
+	}
+	return "/static/" + name
+}
+
+func (assets *Assets) AddHandlersToMux(mux *http.ServeMux) {
+	mux.Handle("/static/", http.StripPrefix("/static/", assets))
+}
+
+func (assets *Assets) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	name := strings.TrimPrefix(request.URL.Path, "/")
+
+	if asset, ok := assets.byHashed[name]; ok {
+		writer.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		writer.Header().Set("ETag", `"`+asset.hash+`"`)
+		http.ServeContent(writer, request, asset.name, time.Time{}, bytes.NewReader(asset.data))
+		return
+	}
+
+	if asset, ok := assets.byName[name]; ok {
+		writer.Header().Set("Cache-Control", "no-cache")
+		writer.Header().Set("ETag", `"`+asset.hash+`"`)
+		http.ServeContent(writer, request, asset.name, time.Time{}, bytes.NewReader(asset.data))
+		return
+	}
+
+	if !assets.dev {
+		http.NotFound(writer, request)
+		return
+	}
+
+	data, err := fs.ReadFile(assets.files, name)
+	if err != nil {
+		http.NotFound(writer, request)
+		return
+	}
+	writer.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(writer, request, name, time.Time{}, bytes.NewReader(data))
 }
@@ -0,0 +1,105 @@
+package static
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestStatic(t *testing.T) {
+
+	files := fstest.MapFS{"css/site.css": {Data: []byte("body { color: red; }")}}
+
+	t.Run("URL returns a content-hashed path", func(t *testing.T) {
+		assets, err := NewAssets(files, false)
+		if err != nil {
+			t.Fatalf("error loading assets: %s", err)
+		}
+
+		url := assets.URL("css/site.css")
+		if !strings.HasPrefix(url, "/static/css/site.") || !strings.HasSuffix(url, ".css") || url == "/static/css/site.css" {
+			t.Fatalf("url is not content hashed: %s", url)
+		}
+	})
+
+	t.Run("hashed URLs are served with far-future cache headers", func(t *testing.T) {
+		assets, err := NewAssets(files, false)
+		if err != nil {
+			t.Fatalf("error loading assets: %s", err)
+		}
+		mux := http.NewServeMux()
+		assets.AddHandlersToMux(mux)
+
+		request, err := http.NewRequest("GET", assets.URL("css/site.css"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("wrong status code: got %v want %v", recorder.Code, http.StatusOK)
+		}
+		if cacheControl := recorder.Header().Get("Cache-Control"); cacheControl != "public, max-age=31536000, immutable" {
+			t.Errorf("wrong cache control: %s", cacheControl)
+		}
+		if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/css") {
+			t.Errorf("wrong content type: %s", contentType)
+		}
+		if recorder.Body.String() != "body { color: red; }" {
+			t.Errorf("wrong body: %s", recorder.Body.String())
+		}
+	})
+
+	t.Run("unhashed and unknown paths", func(t *testing.T) {
+		assets, err := NewAssets(files, false)
+		if err != nil {
+			t.Fatalf("error loading assets: %s", err)
+		}
+		mux := http.NewServeMux()
+		assets.AddHandlersToMux(mux)
+
+		request, _ := http.NewRequest("GET", "/static/css/site.css", nil)
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK || recorder.Header().Get("Cache-Control") != "no-cache" {
+			t.Errorf("unhashed path: got %v %s", recorder.Code, recorder.Header().Get("Cache-Control"))
+		}
+
+		request, _ = http.NewRequest("GET", "/static/css/missing.css", nil)
+		recorder = httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("missing file: got %v want %v", recorder.Code, http.StatusNotFound)
+		}
+	})
+
+	t.Run("dev mode reads files on every request", func(t *testing.T) {
+		devFiles := fstest.MapFS{"css/site.css": {Data: []byte("v1")}}
+		assets, err := NewAssets(devFiles, true)
+		if err != nil {
+			t.Fatalf("error loading assets: %s", err)
+		}
+		devFiles["css/site.css"] = &fstest.MapFile{Data: []byte("v2")}
+
+		request, _ := http.NewRequest("GET", "/css/site.css", nil)
+		recorder := httptest.NewRecorder()
+		assets.ServeHTTP(recorder, request)
+
+		if recorder.Body.String() != "v2" || assets.URL("css/site.css") != "/static/css/site.css" {
+			t.Errorf("dev mode did not serve from disk: %s", recorder.Body.String())
+		}
+	})
+
+	t.Run("the embedded stylesheets are available", func(t *testing.T) {
+		assets, err := NewAssets(Files(false), false)
+		if err != nil {
+			t.Fatalf("error loading assets: %s", err)
+		}
+		if assets.URL("css/skeleton.css") == "/static/css/skeleton.css" {
+			t.Error("skeleton.css was not embedded")
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/letitloose/user-app/pkg/logging"
+)
+
+// JSONFileExporter appends every finished span to a file as one line of
+// OTLP/JSON. It needs no collector, so it works offline and in development.
+type JSONFileExporter struct {
+	mutex       sync.Mutex
+	file        *os.File
+	encoder     *json.Encoder
+	serviceName string
+}
+
+func NewJSONFileExporter(fileName string, serviceName string) (*JSONFileExporter, error) {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONFileExporter{file: file, encoder: json.NewEncoder(file), serviceName: serviceName}, nil
+}
+
+func (exporter *JSONFileExporter) Export(span *Span) {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	err := exporter.encoder.Encode(encodeSpans(exporter.serviceName, []*Span{span}))
+	if err != nil {
+		logging.Errorf("error writing span %s: %s", span.Name, err)
+	}
+}
+
+func (exporter *JSONFileExporter) Shutdown(ctx context.Context) error {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	return exporter.file.Close()
+}
@@ -0,0 +1,28 @@
+package tracing
+
+import (
+	"net/http"
+)
+
+const TraceparentHeader = "traceparent"
+
+// Middleware starts a server span for every request, continuing the trace
+// from an incoming traceparent header when there is a valid one. spanName
+// should return a low cardinality name such as the matched route.
+func Middleware(next http.Handler, spanName func(request *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		remote, err := ParseTraceparent(request.Header.Get(TraceparentHeader))
+		if err == nil {
+			ctx = ContextWithRemoteSpanContext(ctx, remote)
+		}
+
+		ctx, span := GetTracer().Start(ctx, spanName(request), SpanKindServer)
+		defer span.End()
+		span.SetAttribute("http.method", request.Method)
+		span.SetAttribute("http.target", request.URL.RequestURI())
+
+		writer.Header().Set(TraceparentHeader, span.SpanContext.Traceparent())
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
@@ -0,0 +1,255 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/letitloose/user-app/pkg/logging"
+)
+
+// The types below are the subset of the OTLP/JSON trace encoding the app
+// produces. Both exporters write it, so files from the JSON file exporter
+// can be replayed into any OTLP collector.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string             `json:"key"`
+	Value otlpAttributeValue `json:"value"`
+}
+
+type otlpAttributeValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+const (
+	statusUnset = 0
+	statusError = 2
+)
+
+func encodeAttribute(key string, value any) otlpAttribute {
+	attribute := otlpAttribute{Key: key}
+	switch typed := value.(type) {
+	case string:
+		attribute.Value.StringValue = &typed
+	case bool:
+		attribute.Value.BoolValue = &typed
+	case int:
+		intValue := strconv.Itoa(typed)
+		attribute.Value.IntValue = &intValue
+	case int64:
+		intValue := strconv.FormatInt(typed, 10)
+		attribute.Value.IntValue = &intValue
+	case float64:
+		attribute.Value.DoubleValue = &typed
+	default:
+		stringValue := fmt.Sprint(typed)
+		attribute.Value.StringValue = &stringValue
+	}
+	return attribute
+}
+
+func encodeSpans(serviceName string, spans []*Span) otlpTraces {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		span.mutex.Lock()
+		otlp := otlpSpan{
+			TraceID:           span.SpanContext.TraceID.String(),
+			SpanID:            span.SpanContext.SpanID.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+			Status:            otlpStatus{Code: statusUnset},
+		}
+		if span.ParentSpanID.IsValid() {
+			otlp.ParentSpanID = span.ParentSpanID.String()
+		}
+		for _, attribute := range span.Attributes {
+			otlp.Attributes = append(otlp.Attributes, encodeAttribute(attribute.Key, attribute.Value))
+		}
+		if span.Err != nil {
+			otlp.Status = otlpStatus{Code: statusError, Message: span.Err.Error()}
+		}
+		span.mutex.Unlock()
+		encoded = append(encoded, otlp)
+	}
+
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{encodeAttribute("service.name", serviceName)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/letitloose/user-app"},
+			Spans: encoded,
+		}},
+	}}}
+}
+
+// OTLPExporter batches finished spans and posts them to an OTLP/HTTP
+// collector using the JSON encoding.
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+	batchSize   int
+	interval    time.Duration
+
+	queue   chan *Span
+	flush   chan chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func NewOTLPExporter(endpoint string, serviceName string) *OTLPExporter {
+	exporter := &OTLPExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		batchSize:   512,
+		interval:    5 * time.Second,
+		queue:       make(chan *Span, 2048),
+		flush:       make(chan chan struct{}),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go exporter.run()
+	return exporter
+}
+
+// Export queues the span for the next batch. Spans are dropped rather than
+// blocking the request if the collector has fallen behind.
+func (exporter *OTLPExporter) Export(span *Span) {
+	select {
+	case exporter.queue <- span:
+	default:
+	}
+}
+
+func (exporter *OTLPExporter) run() {
+	defer close(exporter.stopped)
+	ticker := time.NewTicker(exporter.interval)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := exporter.post(batch)
+		if err != nil {
+			logging.Errorf("error exporting %d spans: %s", len(batch), err)
+		}
+		batch = []*Span{}
+	}
+
+	for {
+		select {
+		case span := <-exporter.queue:
+			batch = append(batch, span)
+			if len(batch) >= exporter.batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case flushed := <-exporter.flush:
+			for drained := false; !drained; {
+				select {
+				case span := <-exporter.queue:
+					batch = append(batch, span)
+				default:
+					drained = true
+				}
+			}
+			send()
+			close(flushed)
+		case <-exporter.done:
+			return
+		}
+	}
+}
+
+func (exporter *OTLPExporter) post(spans []*Span) error {
+	body, err := json.Marshal(encodeSpans(exporter.serviceName, spans))
+	if err != nil {
+		return err
+	}
+
+	response, err := exporter.client.Post(exporter.endpoint+"/v1/traces", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", response.Status)
+	}
+	return nil
+}
+
+// Shutdown exports everything still queued and stops the background worker.
+// The worker is stopped even when ctx expires first, dropping the spans not
+// exported yet.
+func (exporter *OTLPExporter) Shutdown(ctx context.Context) error {
+	var err error
+	exporter.once.Do(func() {
+		defer close(exporter.done)
+		flushed := make(chan struct{})
+		select {
+		case exporter.flush <- flushed:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+		select {
+		case <-flushed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	})
+	return err
+}
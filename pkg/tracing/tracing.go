@@ -0,0 +1,241 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (traceID TraceID) String() string {
+	return hex.EncodeToString(traceID[:])
+}
+
+func (traceID TraceID) IsValid() bool {
+	return traceID != TraceID{}
+}
+
+func (spanID SpanID) String() string {
+	return hex.EncodeToString(spanID[:])
+}
+
+func (spanID SpanID) IsValid() bool {
+	return spanID != SpanID{}
+}
+
+// SpanContext is the part of a span that crosses process boundaries in the
+// W3C traceparent header.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (spanContext SpanContext) IsValid() bool {
+	return spanContext.TraceID.IsValid() && spanContext.SpanID.IsValid()
+}
+
+// Traceparent formats the span context as a version 00 traceparent header.
+func (spanContext SpanContext) Traceparent() string {
+	flags := "00"
+	if spanContext.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", spanContext.TraceID, spanContext.SpanID, flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header. Unknown future versions
+// are accepted as long as the version 00 fields can be read.
+func ParseTraceparent(header string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 {
+		return SpanContext{}, fmt.Errorf("malformed traceparent: %q", header)
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return SpanContext{}, fmt.Errorf("unsupported traceparent version: %q", header)
+	}
+	if len(traceID) != 32 || len(spanID) != 16 || len(flags) != 2 {
+		return SpanContext{}, fmt.Errorf("malformed traceparent: %q", header)
+	}
+
+	var spanContext SpanContext
+	_, err := hex.Decode(spanContext.TraceID[:], []byte(traceID))
+	if err != nil {
+		return SpanContext{}, fmt.Errorf("malformed trace id: %s", err)
+	}
+	_, err = hex.Decode(spanContext.SpanID[:], []byte(spanID))
+	if err != nil {
+		return SpanContext{}, fmt.Errorf("malformed span id: %s", err)
+	}
+	flagBytes, err := hex.DecodeString(flags)
+	if err != nil {
+		return SpanContext{}, fmt.Errorf("malformed trace flags: %s", err)
+	}
+	if !spanContext.IsValid() {
+		return SpanContext{}, fmt.Errorf("traceparent has an all zero id: %q", header)
+	}
+	spanContext.Sampled = flagBytes[0]&1 == 1
+
+	return spanContext, nil
+}
+
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+type Span struct {
+	Name         string
+	Kind         SpanKind
+	SpanContext  SpanContext
+	ParentSpanID SpanID
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   []Attribute
+	Err          error
+
+	mutex  sync.Mutex
+	ended  bool
+	tracer *Tracer
+}
+
+func (span *Span) SetAttribute(key string, value any) {
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	span.Attributes = append(span.Attributes, Attribute{Key: key, Value: value})
+}
+
+// RecordError marks the span as failed. A nil error is ignored so callers
+// can pass whatever they are about to return.
+func (span *Span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	span.Err = err
+}
+
+func (span *Span) End() {
+	span.mutex.Lock()
+	if span.ended {
+		span.mutex.Unlock()
+		return
+	}
+	span.ended = true
+	span.EndTime = time.Now()
+	span.mutex.Unlock()
+
+	if span.SpanContext.Sampled {
+		span.tracer.exporter.Export(span)
+	}
+}
+
+type Exporter interface {
+	Export(span *Span)
+	Shutdown(ctx context.Context) error
+}
+
+type Tracer struct {
+	exporter Exporter
+}
+
+func NewTracer(exporter Exporter) *Tracer {
+	if exporter == nil {
+		exporter = noopExporter{}
+	}
+	return &Tracer{exporter: exporter}
+}
+
+func (tracer *Tracer) Shutdown(ctx context.Context) error {
+	return tracer.exporter.Shutdown(ctx)
+}
+
+// Start begins a span that is a child of whatever span or remote span
+// context ctx carries, or a new root span if it carries neither.
+func (tracer *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	span := &Span{Name: name, Kind: kind, StartTime: time.Now(), tracer: tracer}
+
+	parent, ok := SpanContextFromContext(ctx)
+	if ok {
+		span.SpanContext.TraceID = parent.TraceID
+		span.SpanContext.Sampled = parent.Sampled
+		span.ParentSpanID = parent.SpanID
+	} else {
+		rand.Read(span.SpanContext.TraceID[:])
+		span.SpanContext.Sampled = true
+	}
+	rand.Read(span.SpanContext.SpanID[:])
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+var (
+	globalMutex  sync.RWMutex
+	globalTracer = NewTracer(nil)
+)
+
+// SetTracer replaces the tracer used by Start. Until it is called spans are
+// created and propagated but never exported.
+func SetTracer(tracer *Tracer) {
+	globalMutex.Lock()
+	defer globalMutex.Unlock()
+	globalTracer = tracer
+}
+
+func GetTracer() *Tracer {
+	globalMutex.RLock()
+	defer globalMutex.RUnlock()
+	return globalTracer
+}
+
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return GetTracer().Start(ctx, name, SpanKindInternal)
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithRemoteSpanContext records a span context received from another
+// process so the next span started from ctx continues its trace.
+func ContextWithRemoteSpanContext(ctx context.Context, spanContext SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, spanContext)
+}
+
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.SpanContext, true
+	}
+	spanContext, ok := ctx.Value(remoteKey{}).(SpanContext)
+	return spanContext, ok && spanContext.IsValid()
+}
+
+type noopExporter struct{}
+
+func (noopExporter) Export(span *Span) {}
+
+func (noopExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
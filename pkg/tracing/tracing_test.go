@@ -0,0 +1,208 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingExporter struct {
+	mutex sync.Mutex
+	spans []*Span
+}
+
+func (exporter *recordingExporter) Export(span *Span) {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	exporter.spans = append(exporter.spans, span)
+}
+
+func (exporter *recordingExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+
+	t.Run("ParseTraceparent reads a valid header", func(t *testing.T) {
+		header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+		spanContext, err := ParseTraceparent(header)
+		if err != nil {
+			t.Fatalf("error parsing traceparent: %s", err)
+		}
+		if spanContext.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("wrong trace id: %s", spanContext.TraceID)
+		}
+		if !spanContext.Sampled {
+			t.Error("sampled flag not read")
+		}
+		if spanContext.Traceparent() != header {
+			t.Errorf("round trip failed: got %s want %s", spanContext.Traceparent(), header)
+		}
+	})
+
+	t.Run("ParseTraceparent rejects invalid headers", func(t *testing.T) {
+		for _, header := range []string{
+			"",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+			"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+			"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		} {
+			_, err := ParseTraceparent(header)
+			if err == nil {
+				t.Errorf("expected an error parsing %q", header)
+			}
+		}
+	})
+
+	t.Run("child spans share the trace of their parent", func(t *testing.T) {
+		exporter := &recordingExporter{}
+		tracer := NewTracer(exporter)
+
+		ctx, parent := tracer.Start(context.Background(), "parent", SpanKindServer)
+		_, child := tracer.Start(ctx, "child", SpanKindInternal)
+		child.RecordError(errors.New("boom"))
+		child.End()
+		parent.End()
+
+		if len(exporter.spans) != 2 {
+			t.Fatalf("expected 2 exported spans, got %d", len(exporter.spans))
+		}
+		if child.SpanContext.TraceID != parent.SpanContext.TraceID {
+			t.Error("child span is not in the parent trace")
+		}
+		if child.ParentSpanID != parent.SpanContext.SpanID {
+			t.Error("child span does not point at its parent")
+		}
+		if child.Err == nil {
+			t.Error("error not recorded on child span")
+		}
+	})
+
+	t.Run("unsampled remote parents are not exported", func(t *testing.T) {
+		exporter := &recordingExporter{}
+		tracer := NewTracer(exporter)
+		remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+
+		_, span := tracer.Start(ContextWithRemoteSpanContext(context.Background(), remote), "span", SpanKindServer)
+		span.End()
+
+		if len(exporter.spans) != 0 {
+			t.Fatalf("unsampled span was exported")
+		}
+	})
+
+	t.Run("Middleware continues an incoming trace", func(t *testing.T) {
+		exporter := &recordingExporter{}
+		SetTracer(NewTracer(exporter))
+		defer SetTracer(NewTracer(nil))
+
+		var inner SpanContext
+		handler := Middleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			inner, _ = SpanContextFromContext(request.Context())
+		}), func(request *http.Request) string {
+			return "HTTP " + request.Method
+		})
+
+		request, err := http.NewRequest("GET", "/users", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if inner.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("trace not continued: %s", inner.TraceID)
+		}
+		if len(exporter.spans) != 1 || exporter.spans[0].ParentSpanID.String() != "00f067aa0ba902b7" {
+			t.Errorf("server span not parented to the remote span")
+		}
+		if !strings.Contains(recorder.Header().Get(TraceparentHeader), inner.TraceID.String()) {
+			t.Errorf("traceparent not returned: %s", recorder.Header().Get(TraceparentHeader))
+		}
+	})
+
+	t.Run("JSONFileExporter writes one OTLP document per span", func(t *testing.T) {
+		fileName := filepath.Join(t.TempDir(), "traces.json")
+		exporter, err := NewJSONFileExporter(fileName, "test-service")
+		if err != nil {
+			t.Fatalf("error creating exporter: %s", err)
+		}
+		tracer := NewTracer(exporter)
+		_, span := tracer.Start(context.Background(), "listAll", SpanKindClient)
+		span.SetAttribute("db.statement", "select 1")
+		span.End()
+		tracer.Shutdown(context.Background())
+
+		contents, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatalf("error reading traces: %s", err)
+		}
+		var traces otlpTraces
+		err = json.Unmarshal(contents, &traces)
+		if err != nil {
+			t.Fatalf("file is not OTLP/JSON: %s", err)
+		}
+		spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+		if len(spans) != 1 || spans[0].Name != "listAll" || *spans[0].Attributes[0].Value.StringValue != "select 1" {
+			t.Errorf("unexpected span in file: %s", contents)
+		}
+	})
+
+	t.Run("OTLPExporter posts batches on shutdown", func(t *testing.T) {
+		received := make(chan []byte, 1)
+		collector := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if request.URL.Path != "/v1/traces" {
+				t.Errorf("posted to the wrong path: %s", request.URL.Path)
+			}
+			body, _ := io.ReadAll(request.Body)
+			received <- body
+		}))
+		defer collector.Close()
+
+		tracer := NewTracer(NewOTLPExporter(collector.URL, "test-service"))
+		_, span := tracer.Start(context.Background(), "exported", SpanKindInternal)
+		span.End()
+		err := tracer.Shutdown(context.Background())
+		if err != nil {
+			t.Fatalf("error shutting down: %s", err)
+		}
+
+		body := <-received
+		if !strings.Contains(string(body), `"name":"exported"`) || !strings.Contains(string(body), `"stringValue":"test-service"`) {
+			t.Errorf("unexpected payload: %s", body)
+		}
+	})
+
+	t.Run("OTLPExporter stops its worker when shutdown times out", func(t *testing.T) {
+		exporter := NewOTLPExporter("http://127.0.0.1:0", "test-service")
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := exporter.Shutdown(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			t.Errorf("got error %s, want nil or %s", err, context.Canceled)
+		}
+
+		select {
+		case <-exporter.stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatal("worker still running after Shutdown returned")
+		}
+		err = exporter.Shutdown(context.Background())
+		if err != nil {
+			t.Errorf("got error %s from a second Shutdown, want nil", err)
+		}
+	})
+}
@@ -0,0 +1,421 @@
+package user
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/letitloose/user-app/pkg/logging"
+	"github.com/letitloose/user-app/pkg/tracing"
+)
+
+// Audit event actions.
+const (
+	AuditCreate      = "create"
+	AuditUpdate      = "update"
+	AuditDelete      = "delete"
+	AuditRoleChange  = "role-change"
+	AuditLogin       = "login"
+	AuditLogout      = "logout"
+	AuditLoginFailed = "login-failed"
+)
+
+// auditMask stands in for passwords in audit changes, which only show that
+// one was set or changed.
+const auditMask = "********"
+
+// AuditChange is one field of a user changed by an audited event.
+type AuditChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// AuditEvent is an entry in the audit log of what happened to users. Actor
+// is who did it, empty when done anonymously or from the command line, and
+// Subject the user it was done to. Events are numbered by Seq from 1 and
+// Hash covers the event and the Hash of the one before, so changing or
+// removing an event breaks the chain from there on, see VerifyAudit.
+type AuditEvent struct {
+	Seq       int64         `json:"seq"`
+	Time      time.Time     `json:"time"`
+	Action    string        `json:"action"`
+	Actor     string        `json:"actor,omitempty"`
+	Subject   string        `json:"subject"`
+	IP        string        `json:"ip,omitempty"`
+	RequestID string        `json:"request-id,omitempty"`
+	Changes   []AuditChange `json:"changes,omitempty"`
+	Hash      string        `json:"hash"`
+}
+
+// AuditFilter selects audit events: Actor, Subject and Action match
+// exactly, Since and Until bound the time and Before only lists events
+// older than that Seq, for paging. Zero fields match everything. Limit is
+// the most events listed, newest first.
+type AuditFilter struct {
+	Actor   string
+	Subject string
+	Action  string
+	Since   time.Time
+	Until   time.Time
+	Before  int64
+	Limit   int
+}
+
+// AuditChainError is returned by VerifyAudit for an event that does not
+// follow from the ones before it.
+type AuditChainError struct {
+	Seq     int64
+	Problem string
+}
+
+func (err *AuditChainError) Error() string {
+	return fmt.Sprintf("audit event %d %s", err.Seq, err.Problem)
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the ID of the request it serves,
+// recorded with audit events.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the ID set with WithRequestID, or "".
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// auditHash chains event to the hash of the event before it, "" for the
+// first.
+func auditHash(previous string, event *AuditEvent, changes string) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{previous, strconv.FormatInt(event.Seq, 10),
+		strconv.FormatInt(event.Time.Unix(), 10), event.Action, event.Actor, event.Subject,
+		event.IP, event.RequestID, changes}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (repository *userRepository) createAuditTable(ctx context.Context) error {
+	_, err := repository.database.ExecContext(ctx, `create table if not exists audit_events (seq bigint primary key,
+		time bigint not null,
+		action varchar(32) not null,
+		actor varchar(255) not null,
+		subject varchar(255) not null,
+		ip varchar(64) not null,
+		request_id varchar(128) not null,
+		changes text,
+		hash char(64) not null);`)
+	if err == nil {
+		// audit_head holds the Seq and Hash of the last event in its one row.
+		_, err = repository.database.ExecContext(ctx, `create table if not exists audit_head (id int primary key,
+			seq bigint not null,
+			hash char(64) not null);`)
+	}
+	if err == nil {
+		_, err = repository.database.ExecContext(ctx, `INSERT INTO audit_head (id, seq, hash) VALUES (1, 0, '');`)
+		if isDuplicateKey(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = repository.syncAuditHead(ctx)
+	}
+	return contextError(ctx, err)
+}
+
+const auditColumns = `seq, time, action, actor, subject, ip, request_id, changes, hash`
+
+// AddAuditEvent appends event to the audit log, setting its Seq and Hash.
+// Appends take turns: in this process on a mutex and across instances on
+// the row of audit_head, which each one updates first in its transaction.
+func (repository *userRepository) AddAuditEvent(ctx context.Context, event *AuditEvent) error {
+	ctx, span := startQuerySpan(ctx, "userRepository.AddAuditEvent", auditInsert)
+	defer span.End()
+
+	changes, err := json.Marshal(event.Changes)
+	if err != nil {
+		return err
+	}
+	repository.audits.Lock()
+	defer repository.audits.Unlock()
+	appendEvent := func() error {
+		return repository.WithTx(ctx, nil, func(tx Store) error {
+			return tx.(*userRepository).appendAuditEvent(ctx, event, string(changes))
+		})
+	}
+	for attempt := 0; ; attempt++ {
+		// A transaction the caller began is not retried, like exec.
+		if repository.tx != nil {
+			err = appendEvent()
+		} else {
+			err = repository.retryWrite(ctx, appendEvent)
+		}
+		// Events appended without the head, by an older version, leave it
+		// behind and the numbers collide.
+		if err == nil || !isDuplicateKey(err) || attempt == 2 {
+			break
+		}
+		err = repository.syncAuditHead(ctx)
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+const auditInsert = `INSERT INTO audit_events (` + auditColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+
+func (repository *userRepository) appendAuditEvent(ctx context.Context, event *AuditEvent, changes string) error {
+	_, err := repository.exec(ctx, `UPDATE audit_head SET seq = seq + 1 WHERE id = 1;`)
+	if err != nil {
+		return err
+	}
+	var previous string
+	err = repository.tx.QueryRowContext(ctx, `SELECT seq, hash FROM audit_head WHERE id = 1;`).Scan(&event.Seq, &previous)
+	if err != nil {
+		return err
+	}
+	event.Hash = auditHash(previous, event, changes)
+	_, err = repository.exec(ctx, auditInsert, event.Seq, event.Time.Unix(), event.Action, event.Actor, event.Subject,
+		event.IP, event.RequestID, changes, event.Hash)
+	if err == nil {
+		_, err = repository.exec(ctx, `UPDATE audit_head SET hash = ? WHERE id = 1;`, event.Hash)
+	}
+	return err
+}
+
+// syncAuditHead moves the head up to the last event if it is behind.
+func (repository *userRepository) syncAuditHead(ctx context.Context) error {
+	last, err := repository.lastAuditEvent(ctx)
+	if err != nil || last == nil {
+		return err
+	}
+	_, err = repository.exec(ctx, `UPDATE audit_head SET seq = ?, hash = ? WHERE id = 1 AND seq < ?;`, last.Seq, last.Hash, last.Seq)
+	return err
+}
+
+func (repository *userRepository) lastAuditEvent(ctx context.Context) (*AuditEvent, error) {
+	events, err := repository.ListAuditEvents(ctx, AuditFilter{Limit: 1})
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return events[0], nil
+}
+
+func (filter AuditFilter) where() (string, []any) {
+	conditions, args := []string{}, []any{}
+	if filter.Actor != "" {
+		conditions = append(conditions, `actor = ?`)
+		args = append(args, filter.Actor)
+	}
+	if filter.Subject != "" {
+		conditions = append(conditions, `subject = ?`)
+		args = append(args, filter.Subject)
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, `action = ?`)
+		args = append(args, filter.Action)
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, `time >= ?`)
+		args = append(args, filter.Since.Unix())
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, `time <= ?`)
+		args = append(args, filter.Until.Unix())
+	}
+	if filter.Before > 0 {
+		conditions = append(conditions, `seq < ?`)
+		args = append(args, filter.Before)
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// ListAuditEvents lists the audit events matching filter, newest first.
+func (repository *userRepository) ListAuditEvents(ctx context.Context, filter AuditFilter) ([]*AuditEvent, error) {
+	where, args := filter.where()
+	query := `SELECT ` + auditColumns + ` FROM audit_events` + where + ` ORDER BY seq DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ` + strconv.Itoa(filter.Limit)
+	}
+	query += `;`
+	ctx, span := startQuerySpan(ctx, "userRepository.ListAuditEvents", query)
+	defer span.End()
+
+	events := []*AuditEvent{}
+	err := repository.scanAuditEvents(ctx, query, args, func(event *AuditEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return events, nil
+}
+
+// EachAuditEvent calls fn with every audit event, oldest first, as the rows
+// are read. Returning an error from fn stops the listing and EachAuditEvent
+// returns it.
+func (repository *userRepository) EachAuditEvent(ctx context.Context, fn func(event *AuditEvent) error) error {
+	query := `SELECT ` + auditColumns + ` FROM audit_events ORDER BY seq;`
+	ctx, span := startQuerySpan(ctx, "userRepository.EachAuditEvent", query)
+	defer span.End()
+
+	err := repository.scanAuditEvents(ctx, query, nil, fn)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return err
+}
+
+func (repository *userRepository) scanAuditEvents(ctx context.Context, query string, args []any, fn func(event *AuditEvent) error) error {
+	rows, err := repository.query(ctx, repository.database, query, args...)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event := &AuditEvent{}
+		var at int64
+		var changes string
+		err = rows.Scan(&event.Seq, &at, &event.Action, &event.Actor, &event.Subject, &event.IP, &event.RequestID, &changes, &event.Hash)
+		if err == nil {
+			event.Time = time.Unix(at, 0)
+			err = json.Unmarshal([]byte(changes), &event.Changes)
+		}
+		if err == nil {
+			err = fn(event)
+		}
+		if err != nil {
+			return contextError(ctx, err)
+		}
+	}
+	return contextError(ctx, rows.Err())
+}
+
+// userChanges lists the fields that differ between before and after, with
+// passwords masked.
+func userChanges(before *User, after *User) []AuditChange {
+	changes := []AuditChange{}
+	if before.Password != after.Password {
+		change := AuditChange{Field: "password"}
+		if before.Password != "" {
+			change.Old = auditMask
+		}
+		if after.Password != "" {
+			change.New = auditMask
+		}
+		changes = append(changes, change)
+	}
+	for _, field := range []AuditChange{
+		{"first-name", before.FirstName, after.FirstName},
+		{"last-name", before.LastName, after.LastName},
+		{"email", before.Email, after.Email},
+		{"email-verified", strconv.FormatBool(before.EmailVerified), strconv.FormatBool(after.EmailVerified)},
+		{"role", string(before.Role), string(after.Role)},
+		{"status", string(before.Status), string(after.Status)},
+		{"groups", before.Groups.String(), after.Groups.String()},
+	} {
+		if field.Old != field.New {
+			changes = append(changes, field)
+		}
+	}
+	return changes
+}
+
+// audit appends an event about subject, done by the caller in ctx, to the
+// audit log. A failure is logged rather than undoing what was done.
+func (service *UserService) audit(ctx context.Context, action string, actor string, subject string, changes []AuditChange) {
+	event := &AuditEvent{
+		Time:      time.Now(),
+		Action:    action,
+		Actor:     actor,
+		Subject:   subject,
+		IP:        ClientIPFromContext(ctx),
+		RequestID: RequestIDFromContext(ctx),
+		Changes:   changes,
+	}
+	err := service.store.AddAuditEvent(ctx, event)
+	if err != nil {
+		logging.Errorf("error recording audit event %s of %s: %s", action, subject, err)
+		userErrors.With("audit").Inc()
+		return
+	}
+	auditEvents.With(action).Inc()
+}
+
+// auditChange records what the caller in ctx changed about a user, as a
+// role change when their role is among the changes.
+func (service *UserService) auditChange(ctx context.Context, before *User, after *User) {
+	changes := userChanges(before, after)
+	if len(changes) == 0 {
+		return
+	}
+	action := AuditUpdate
+	for _, change := range changes {
+		if change.Field == "role" {
+			action = AuditRoleChange
+		}
+	}
+	service.audit(ctx, action, CallerFromContext(ctx).Username, after.Username, changes)
+}
+
+// ListAudit lists the audit events matching filter, newest first.
+func (service *UserService) ListAudit(ctx context.Context, filter AuditFilter) ([]*AuditEvent, error) {
+	ctx, span := tracing.Start(ctx, "UserService.ListAudit")
+	defer span.End()
+
+	events, err := service.store.ListAuditEvents(ctx, filter)
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("audit").Inc()
+	}
+	return events, err
+}
+
+// VerifyAudit walks the audit log from the first event, checking that each
+// is numbered and hashed to follow the one before. It returns how many
+// events it checked and an *AuditChainError at the first that does not. The
+// chain cannot show events removed from the end; compare the count with an
+// earlier one for that.
+func (service *UserService) VerifyAudit(ctx context.Context) (int64, error) {
+	ctx, span := tracing.Start(ctx, "UserService.VerifyAudit")
+	defer span.End()
+
+	var checked int64
+	previous := ""
+	err := service.store.EachAuditEvent(ctx, func(event *AuditEvent) error {
+		if event.Seq != checked+1 {
+			return &AuditChainError{Seq: event.Seq, Problem: fmt.Sprintf("follows event %d", checked)}
+		}
+		changes, err := json.Marshal(event.Changes)
+		if err != nil {
+			return err
+		}
+		if auditHash(previous, event, string(changes)) != event.Hash {
+			return &AuditChainError{Seq: event.Seq, Problem: "does not match its hash"}
+		}
+		previous = event.Hash
+		checked++
+		return nil
+	})
+	if err != nil {
+		span.RecordError(err)
+	}
+	return checked, err
+}
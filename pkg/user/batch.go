@@ -0,0 +1,213 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// batchSize is how many rows go in one multi-row statement, well within the
+// placeholder limits of both MySQL and SQLite.
+const batchSize = 100
+
+// AddUsers inserts users with multi-row inserts in a single transaction, so
+// either all of them are added or none are.
+func (repository *userRepository) AddUsers(ctx context.Context, users []*User) error {
+	ctx, span := startQuerySpan(ctx, "userRepository.AddUsers", "insert into users ("+userColumns+") values (?, ?, ?, ?, ?, ?, ?, ?, ?), ...")
+	span.SetAttribute("db.rows", len(users))
+	defer span.End()
+
+	insertStatement := func(rows int) string {
+		return "insert into users (" + userColumns + ") values " + placeholders("(?, ?, ?, ?, ?, ?, ?, ?, ?)", rows)
+	}
+	prepared, err := repository.prepareBatch(ctx, len(users), insertStatement)
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+
+	err = repository.inTx(ctx, func(tx *sql.Tx) error {
+		for start := 0; start < len(users); start += batchSize {
+			chunk := users[start:batchEnd(start, len(users))]
+			args := make([]any, 0, len(chunk)*9)
+			for _, user := range chunk {
+				args = append(args, user.Username, user.Password, user.FirstName, user.LastName, user.Email, user.EmailVerified, storedRole(user), storedStatus(user), user.Groups)
+			}
+
+			result, err := txExec(ctx, tx, prepared[len(chunk)], insertStatement(len(chunk)), args...)
+			if err != nil {
+				return err
+			}
+			if err = expectRows(result, len(chunk), "users not inserted"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for _, user := range users {
+		repository.wrote(user.Username)
+	}
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// UpdateUsers updates users in a single transaction, failing without
+// changing any of them if one does not exist.
+func (repository *userRepository) UpdateUsers(ctx context.Context, users []*User) error {
+	ctx, span := startQuerySpan(ctx, "userRepository.UpdateUsers", updateStatement)
+	span.SetAttribute("db.rows", len(users))
+	defer span.End()
+
+	prepared, err := repository.prepareBatch(ctx, 1, func(int) string { return updateStatement })
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+
+	err = repository.inTx(ctx, func(tx *sql.Tx) error {
+		for _, user := range users {
+			result, err := txExec(ctx, tx, prepared[1], updateStatement, user.Password, user.FirstName, user.LastName, user.Email, user.EmailVerified, string(user.Role), string(user.Status), user.Groups, user.Username)
+			if err != nil {
+				return err
+			}
+			if err = expectRows(result, 1, fmt.Sprintf("user %s not updated", user.Username)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for _, user := range users {
+		repository.wrote(user.Username)
+	}
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// RemoveUsers deletes usernames in a single transaction, failing without
+// deleting any of them if one does not exist.
+func (repository *userRepository) RemoveUsers(ctx context.Context, usernames []string) error {
+	ctx, span := startQuerySpan(ctx, "userRepository.RemoveUsers", "delete from users where username in (?, ...);")
+	span.SetAttribute("db.rows", len(usernames))
+	defer span.End()
+
+	deleteStatement := func(rows int) string {
+		return "delete from users where username in (" + placeholders("?", rows) + ");"
+	}
+	prepared, err := repository.prepareBatch(ctx, len(usernames), deleteStatement)
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+
+	err = repository.inTx(ctx, func(tx *sql.Tx) error {
+		for start := 0; start < len(usernames); start += batchSize {
+			chunk := usernames[start:batchEnd(start, len(usernames))]
+			args := make([]any, 0, len(chunk))
+			for _, username := range chunk {
+				args = append(args, username)
+			}
+
+			result, err := txExec(ctx, tx, prepared[len(chunk)], deleteStatement(len(chunk)), args...)
+			if err != nil {
+				return err
+			}
+			if err = expectRows(result, len(chunk), "wrong number of rows affected"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for _, username := range usernames {
+		repository.wrote(username)
+	}
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// inTx runs write in a transaction on the primary, committing if it returns
+// nil and rolling back otherwise. The whole transaction is retried on
+// transient errors. When the repository is already in a transaction, write
+// runs in a savepoint of it instead.
+func (repository *userRepository) inTx(ctx context.Context, write func(tx *sql.Tx) error) error {
+	if repository.tx != nil {
+		return repository.savepoint(ctx, func(Store) error {
+			return write(repository.tx)
+		})
+	}
+	return repository.retryWrite(ctx, func() error {
+		tx, err := repository.database.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		err = write(tx)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// prepareBatch prepares the statements, built by statement for a number of
+// rows, needed to write rows in chunks of batchSize: one for a full chunk
+// and one for the remainder. They are prepared before the transaction
+// begins, which would otherwise hold the connection preparing needs when
+// the pool has only one. Nothing is prepared when the repository is already
+// in a transaction, for the same reason.
+func (repository *userRepository) prepareBatch(ctx context.Context, rows int, statement func(rows int) string) (map[int]*sql.Stmt, error) {
+	prepared := map[int]*sql.Stmt{}
+	if repository.tx != nil {
+		return prepared, nil
+	}
+	for _, size := range []int{batchSize, rows % batchSize} {
+		if size == 0 || size > rows || prepared[size] != nil {
+			continue
+		}
+		stmt, err := repository.statements.get(ctx, repository.database, statement(size))
+		if err != nil {
+			return nil, err
+		}
+		prepared[size] = stmt
+	}
+	return prepared, nil
+}
+
+// txExec runs statement in tx, through prepared when there is one.
+func txExec(ctx context.Context, tx *sql.Tx, prepared *sql.Stmt, statement string, args ...any) (sql.Result, error) {
+	if prepared == nil {
+		return tx.ExecContext(ctx, statement, args...)
+	}
+	return tx.StmtContext(ctx, prepared).ExecContext(ctx, args...)
+}
+
+func expectRows(result sql.Result, expected int, message string) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != int64(expected) {
+		return fmt.Errorf("%s: %d of %d rows affected", message, affected, expected)
+	}
+	return nil
+}
+
+func placeholders(group string, count int) string {
+	return strings.TrimSuffix(strings.Repeat(group+", ", count), ", ")
+}
+
+func batchEnd(start int, length int) int {
+	if start+batchSize < length {
+		return start + batchSize
+	}
+	return length
+}
@@ -0,0 +1,440 @@
+package user
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/letitloose/user-app/pkg/logging"
+)
+
+// RemoteCache is a cache shared between instances, such as Redis, that
+// CachedStore checks before going to the store. Get reports found as false
+// for a key that is not cached.
+type RemoteCache interface {
+	Get(ctx context.Context, key string) (value []byte, found bool, err error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// CacheStats counts CachedStore lookups. Shared lookups waited for a load
+// another caller had already started.
+type CacheStats struct {
+	Hits       uint64
+	RemoteHits uint64
+	Misses     uint64
+	Shared     uint64
+	Evictions  uint64
+	Entries    int
+}
+
+type cacheEntry struct {
+	key     string
+	value   any
+	expires time.Time
+}
+
+type cacheCall struct {
+	done  chan struct{}
+	value any
+	err   error
+}
+
+const listKey = "users"
+
+func userKey(username string) string {
+	return "user:" + username
+}
+
+// CachedStore is a read-through cache in front of another Store. Lookups
+// are kept in a least recently used list of at most size entries for ttl,
+// or negativeTTL for users that do not exist, and concurrent misses for the
+// same key share a single load. Writes go to the store and invalidate the
+// user and the list. The list is cached without passwords.
+//
+// Other instances only see a write once their entries expire. They can
+// share the user list through a RemoteCache, which is invalidated too.
+// Single users are kept out of it, since they carry the password hash.
+type CachedStore struct {
+	// Store is the wrapped store. What is not cached, such as EachUser,
+	// which streams listings too big to hold, and everything but users, goes
+	// straight to it. A new method that writes users must be overridden to
+	// invalidate them.
+	Store
+	remote      RemoteCache
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mutex      sync.Mutex
+	entries    map[string]*list.Element
+	recency    *list.List
+	calls      map[string]*cacheCall
+	generation uint64
+	stats      CacheStats
+}
+
+func NewCachedStore(store Store, size int, ttl time.Duration, negativeTTL time.Duration) *CachedStore {
+	return &CachedStore{
+		Store:       store,
+		size:        size,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     map[string]*list.Element{},
+		recency:     list.New(),
+		calls:       map[string]*cacheCall{},
+	}
+}
+
+func (cache *CachedStore) SetRemote(remote RemoteCache) {
+	cache.remote = remote
+}
+
+func (cache *CachedStore) Stats() CacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	stats := cache.stats
+	stats.Entries = cache.recency.Len()
+	return stats
+}
+
+func (cache *CachedStore) ListAll(ctx context.Context) ([]*User, error) {
+	value, err := cache.load(ctx, listKey, func(ctx context.Context) (any, error) {
+		users, err := cache.Store.ListAll(ctx)
+		for _, user := range users {
+			user.Password = ""
+		}
+		return users, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	users := []*User{}
+	for _, user := range value.([]*User) {
+		copied := *user
+		users = append(users, &copied)
+	}
+	return users, nil
+}
+
+func (cache *CachedStore) FindUser(ctx context.Context, username string) (*User, error) {
+	value, err := cache.load(ctx, userKey(username), func(ctx context.Context) (any, error) {
+		return cache.Store.FindUser(ctx, username)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	copied := *value.(*User)
+	return &copied, nil
+}
+
+func (cache *CachedStore) AddUser(ctx context.Context, user *User) error {
+	err := cache.Store.AddUser(ctx, user)
+	cache.invalidate(ctx, user.Username)
+	return err
+}
+
+func (cache *CachedStore) UpdateUser(ctx context.Context, user *User) error {
+	err := cache.Store.UpdateUser(ctx, user)
+	cache.invalidate(ctx, user.Username)
+	return err
+}
+
+func (cache *CachedStore) RemoveUser(ctx context.Context, username string) error {
+	err := cache.Store.RemoveUser(ctx, username)
+	cache.invalidate(ctx, username)
+	return err
+}
+
+func (cache *CachedStore) AddUsers(ctx context.Context, users []*User) error {
+	err := cache.Store.AddUsers(ctx, users)
+	cache.invalidate(ctx, usernames(users)...)
+	return err
+}
+
+func (cache *CachedStore) UpdateUsers(ctx context.Context, users []*User) error {
+	err := cache.Store.UpdateUsers(ctx, users)
+	cache.invalidate(ctx, usernames(users)...)
+	return err
+}
+
+func (cache *CachedStore) RemoveUsers(ctx context.Context, usernames []string) error {
+	err := cache.Store.RemoveUsers(ctx, usernames)
+	cache.invalidate(ctx, usernames...)
+	return err
+}
+
+// WithTx runs fn in a transaction of the underlying store. Reads in it skip
+// the cache, and every user it writes is invalidated once it is over.
+func (cache *CachedStore) WithTx(ctx context.Context, options *sql.TxOptions, fn func(tx Store) error) error {
+	written := &writtenUsers{}
+	err := cache.Store.WithTx(ctx, options, func(tx Store) error {
+		return fn(&trackingStore{Store: tx, written: written})
+	})
+	cache.invalidate(ctx, written.usernames...)
+	return err
+}
+
+type writtenUsers struct {
+	usernames []string
+}
+
+// trackingStore records the users written through it, including in nested
+// transactions.
+type trackingStore struct {
+	Store
+	written *writtenUsers
+}
+
+func (store *trackingStore) AddUser(ctx context.Context, user *User) error {
+	store.written.usernames = append(store.written.usernames, user.Username)
+	return store.Store.AddUser(ctx, user)
+}
+
+func (store *trackingStore) UpdateUser(ctx context.Context, user *User) error {
+	store.written.usernames = append(store.written.usernames, user.Username)
+	return store.Store.UpdateUser(ctx, user)
+}
+
+func (store *trackingStore) RemoveUser(ctx context.Context, username string) error {
+	store.written.usernames = append(store.written.usernames, username)
+	return store.Store.RemoveUser(ctx, username)
+}
+
+func (store *trackingStore) AddUsers(ctx context.Context, users []*User) error {
+	store.written.usernames = append(store.written.usernames, usernames(users)...)
+	return store.Store.AddUsers(ctx, users)
+}
+
+func (store *trackingStore) UpdateUsers(ctx context.Context, users []*User) error {
+	store.written.usernames = append(store.written.usernames, usernames(users)...)
+	return store.Store.UpdateUsers(ctx, users)
+}
+
+func (store *trackingStore) RemoveUsers(ctx context.Context, names []string) error {
+	store.written.usernames = append(store.written.usernames, names...)
+	return store.Store.RemoveUsers(ctx, names)
+}
+
+func (store *trackingStore) WithTx(ctx context.Context, options *sql.TxOptions, fn func(tx Store) error) error {
+	return store.Store.WithTx(ctx, options, func(tx Store) error {
+		return fn(&trackingStore{Store: tx, written: store.written})
+	})
+}
+
+func usernames(users []*User) []string {
+	names := make([]string, 0, len(users))
+	for _, user := range users {
+		names = append(names, user.Username)
+	}
+	return names
+}
+
+// loadTimeout bounds a shared load, which no longer ends with the request
+// that started it.
+const loadTimeout = 30 * time.Second
+
+// load returns the cached value for key, calling fetch on a miss unless a
+// load of key is already running, in which case it waits for that one. The
+// load runs on its own context, so a caller giving up only stops its own
+// wait and not the load the others share.
+func (cache *CachedStore) load(ctx context.Context, key string, fetch func(ctx context.Context) (any, error)) (any, error) {
+	cache.mutex.Lock()
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			cache.recency.MoveToFront(element)
+			cache.stats.Hits++
+			cache.mutex.Unlock()
+			cacheLookups.With("hit").Inc()
+			return entry.value, nil
+		}
+		cache.recency.Remove(element)
+		delete(cache.entries, key)
+	}
+
+	call, ok := cache.calls[key]
+	if ok {
+		cache.stats.Shared++
+		cache.mutex.Unlock()
+		cacheLookups.With("shared").Inc()
+	} else {
+		call = &cacheCall{done: make(chan struct{})}
+		cache.calls[key] = call
+		generation := cache.generation
+		cache.mutex.Unlock()
+		go cache.run(detachedContext{ctx}, key, call, generation, fetch)
+	}
+
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		return nil, &CanceledError{Err: ctx.Err()}
+	}
+}
+
+// run does the load of key for call and caches the result.
+func (cache *CachedStore) run(ctx context.Context, key string, call *cacheCall, generation uint64, fetch func(ctx context.Context) (any, error)) {
+	ctx, cancel := context.WithTimeout(ctx, loadTimeout)
+	defer cancel()
+	call.value, call.err = cache.fetch(ctx, key, fetch)
+
+	cache.mutex.Lock()
+	delete(cache.calls, key)
+	// A write during the load may have made the value stale, so it is only
+	// kept if nothing was invalidated in the meantime.
+	if call.err == nil && cache.generation == generation {
+		cache.add(key, call.value)
+	}
+	cache.mutex.Unlock()
+	close(call.done)
+}
+
+// fetch gets the value for key from the remote cache, if there is one and
+// key is the user list, or else from the store, copying the list to the
+// remote cache.
+func (cache *CachedStore) fetch(ctx context.Context, key string, fetch func(ctx context.Context) (any, error)) (any, error) {
+	remote := cache.remote
+	if key != listKey {
+		remote = nil
+	}
+	if remote != nil {
+		data, found, err := remote.Get(ctx, key)
+		if err != nil {
+			logging.Warnf("error reading %s from the remote cache: %s", key, err)
+		}
+		if found {
+			value, err := decodeCached(data)
+			if err == nil {
+				cache.count("remote_hit")
+				return value, nil
+			}
+			logging.Warnf("error decoding %s from the remote cache: %s", key, err)
+		}
+	}
+
+	cache.count("miss")
+	value, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := cache.entryTTL(value)
+	if remote != nil && ttl > 0 {
+		data, err := encodeCached(value.([]*User))
+		if err == nil {
+			err = remote.Set(ctx, key, data, ttl)
+		}
+		if err != nil {
+			logging.Warnf("error writing %s to the remote cache: %s", key, err)
+		}
+	}
+	return value, nil
+}
+
+func (cache *CachedStore) count(result string) {
+	cache.mutex.Lock()
+	if result == "miss" {
+		cache.stats.Misses++
+	} else {
+		cache.stats.RemoteHits++
+	}
+	cache.mutex.Unlock()
+	cacheLookups.With(result).Inc()
+}
+
+// cachedUser is how a listed user is kept in the remote cache, with no
+// field for the password.
+type cachedUser struct {
+	Username      string `json:"user-name"`
+	FirstName     string `json:"first-name"`
+	LastName      string `json:"last-name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email-verified"`
+	Role          Role   `json:"role"`
+	Status        Status `json:"status"`
+	Groups        Groups `json:"groups"`
+}
+
+func encodeCached(users []*User) ([]byte, error) {
+	cached := make([]cachedUser, 0, len(users))
+	for _, user := range users {
+		cached = append(cached, cachedUser{user.Username, user.FirstName, user.LastName, user.Email,
+			user.EmailVerified, user.Role, user.Status, user.Groups})
+	}
+	return json.Marshal(cached)
+}
+
+func decodeCached(data []byte) ([]*User, error) {
+	cached := []cachedUser{}
+	err := json.Unmarshal(data, &cached)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]*User, 0, len(cached))
+	for _, user := range cached {
+		users = append(users, &User{Username: user.Username, FirstName: user.FirstName, LastName: user.LastName,
+			Email: user.Email, EmailVerified: user.EmailVerified, Role: user.Role, Status: user.Status, Groups: user.Groups})
+	}
+	return users, nil
+}
+
+// entryTTL is how long value may be cached. A user with no username is the
+// store saying there is no such user.
+func (cache *CachedStore) entryTTL(value any) time.Duration {
+	if user, ok := value.(*User); ok && user.Username == "" {
+		return cache.negativeTTL
+	}
+	return cache.ttl
+}
+
+// add caches value, evicting the least recently used entries to stay
+// within size. The caller holds the mutex.
+func (cache *CachedStore) add(key string, value any) {
+	ttl := cache.entryTTL(value)
+	if ttl <= 0 || cache.size <= 0 {
+		return
+	}
+
+	cache.entries[key] = cache.recency.PushFront(&cacheEntry{key: key, value: value, expires: time.Now().Add(ttl)})
+	for cache.recency.Len() > cache.size {
+		oldest := cache.recency.Back()
+		cache.recency.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).key)
+		cache.stats.Evictions++
+	}
+}
+
+// invalidate drops the users and the user list from the local and remote
+// caches. It runs even when the write failed, since the write may have been
+// applied anyway.
+func (cache *CachedStore) invalidate(ctx context.Context, usernames ...string) {
+	keys := []string{listKey}
+	for _, username := range usernames {
+		keys = append(keys, userKey(username))
+	}
+
+	cache.mutex.Lock()
+	cache.generation++
+	for _, key := range keys {
+		if element, ok := cache.entries[key]; ok {
+			cache.recency.Remove(element)
+			delete(cache.entries, key)
+		}
+	}
+	cache.mutex.Unlock()
+
+	if cache.remote != nil {
+		err := cache.remote.Delete(ctx, keys...)
+		if err != nil {
+			logging.Warnf("error invalidating %s in the remote cache: %s", strings.Join(usernames, ", "), err)
+		}
+	}
+}
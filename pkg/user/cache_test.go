@@ -0,0 +1,331 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingStore is an in-memory Store of users that counts reads and can
+// hold them until released. It has none of the other Store methods.
+type countingStore struct {
+	Store
+	mutex   sync.Mutex
+	users   map[string]User
+	reads   int
+	release chan struct{}
+	// err, when set, is returned by the reads.
+	err error
+}
+
+func newCountingStore(users ...User) *countingStore {
+	store := &countingStore{users: map[string]User{}}
+	for _, user := range users {
+		store.users[user.Username] = user
+	}
+	return store
+}
+
+func (store *countingStore) read() {
+	store.mutex.Lock()
+	store.reads++
+	release := store.release
+	store.mutex.Unlock()
+	if release != nil {
+		<-release
+	}
+}
+
+func (store *countingStore) ListAll(ctx context.Context) ([]*User, error) {
+	store.read()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	users := []*User{}
+	for _, user := range store.users {
+		copied := user
+		users = append(users, &copied)
+	}
+	return users, nil
+}
+
+func (store *countingStore) EachUser(ctx context.Context, filter ListFilter, fn func(user *User) error) error {
+	users, _ := store.ListAll(ctx)
+	for _, user := range users {
+		err := fn(user)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *countingStore) FindUser(ctx context.Context, username string) (*User, error) {
+	store.read()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.err != nil {
+		return nil, store.err
+	}
+	user := store.users[username]
+	return &user, nil
+}
+
+func (store *countingStore) AddUser(ctx context.Context, user *User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.users[user.Username] = *user
+	return nil
+}
+
+func (store *countingStore) UpdateUser(ctx context.Context, user *User) error {
+	return store.AddUser(ctx, user)
+}
+
+func (store *countingStore) RemoveUser(ctx context.Context, username string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.users, username)
+	return nil
+}
+
+func (store *countingStore) AddUsers(ctx context.Context, users []*User) error {
+	for _, user := range users {
+		store.AddUser(ctx, user)
+	}
+	return nil
+}
+
+func (store *countingStore) UpdateUsers(ctx context.Context, users []*User) error {
+	return store.AddUsers(ctx, users)
+}
+
+func (store *countingStore) RemoveUsers(ctx context.Context, usernames []string) error {
+	for _, username := range usernames {
+		store.RemoveUser(ctx, username)
+	}
+	return nil
+}
+
+func (store *countingStore) WithTx(ctx context.Context, options *sql.TxOptions, fn func(tx Store) error) error {
+	return fn(store)
+}
+
+// fakeRemoteCache is an in-process RemoteCache.
+type fakeRemoteCache struct {
+	mutex  sync.Mutex
+	values map[string][]byte
+}
+
+func (remote *fakeRemoteCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	remote.mutex.Lock()
+	defer remote.mutex.Unlock()
+	value, ok := remote.values[key]
+	return value, ok, nil
+}
+
+func (remote *fakeRemoteCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	remote.mutex.Lock()
+	defer remote.mutex.Unlock()
+	remote.values[key] = value
+	return nil
+}
+
+func (remote *fakeRemoteCache) Delete(ctx context.Context, keys ...string) error {
+	remote.mutex.Lock()
+	defer remote.mutex.Unlock()
+	for _, key := range keys {
+		delete(remote.values, key)
+	}
+	return nil
+}
+
+func TestCachedStore(t *testing.T) {
+	ctx := context.Background()
+	lou := User{Username: "lou", FirstName: "lou"}
+
+	t.Run("lookups are cached until the user is written", func(t *testing.T) {
+		store := newCountingStore(lou)
+		cache := NewCachedStore(store, 10, time.Minute, time.Minute)
+
+		cache.FindUser(ctx, "lou")
+		cache.ListAll(ctx)
+		user, _ := cache.FindUser(ctx, "lou")
+		cache.ListAll(ctx)
+		if store.reads != 2 || user.FirstName != "lou" {
+			t.Fatalf("got %d reads and %q want 2 reads and %q", store.reads, user.FirstName, "lou")
+		}
+
+		user.FirstName = "changed by the caller"
+		cache.UpdateUser(ctx, &User{Username: "lou", FirstName: "louis"})
+		user, _ = cache.FindUser(ctx, "lou")
+		users, _ := cache.ListAll(ctx)
+		if store.reads != 4 || user.FirstName != "louis" || users[0].FirstName != "louis" {
+			t.Fatalf("stale after update: %d reads, %q, %q", store.reads, user.FirstName, users[0].FirstName)
+		}
+
+		stats := cache.Stats()
+		if stats.Hits != 2 || stats.Misses != 4 || stats.Entries != 2 {
+			t.Errorf("got stats %+v want 2 hits, 4 misses and 2 entries", stats)
+		}
+	})
+
+	t.Run("missing users are cached for the negative ttl", func(t *testing.T) {
+		store := newCountingStore()
+		cache := NewCachedStore(store, 10, time.Minute, 20*time.Millisecond)
+
+		cache.FindUser(ctx, "nobody")
+		user, _ := cache.FindUser(ctx, "nobody")
+		if store.reads != 1 || user.Username != "" {
+			t.Fatalf("got %d reads and %q want 1 read and no user", store.reads, user.Username)
+		}
+
+		time.Sleep(30 * time.Millisecond)
+		cache.FindUser(ctx, "nobody")
+		if store.reads != 2 {
+			t.Errorf("negative entry not expired, got %d reads want 2", store.reads)
+		}
+
+		cache.AddUser(ctx, &User{Username: "nobody"})
+		user, _ = cache.FindUser(ctx, "nobody")
+		if user.Username != "nobody" {
+			t.Errorf("added user still cached as missing")
+		}
+	})
+
+	t.Run("failed lookups are not cached", func(t *testing.T) {
+		store := newCountingStore(lou)
+		store.err = errors.New("database is down")
+		cache := NewCachedStore(store, 10, time.Minute, time.Minute)
+
+		_, err := cache.FindUser(ctx, "lou")
+		if err != store.err {
+			t.Fatalf("got %v want %v", err, store.err)
+		}
+
+		store.err = nil
+		user, err := cache.FindUser(ctx, "lou")
+		if err != nil || user.Username != "lou" {
+			t.Errorf("got %+v, %v want lou once the database is back", user, err)
+		}
+	})
+
+	t.Run("the least recently used entry is evicted", func(t *testing.T) {
+		store := newCountingStore(lou, User{Username: "ann"}, User{Username: "bob"})
+		cache := NewCachedStore(store, 2, time.Minute, time.Minute)
+
+		cache.FindUser(ctx, "lou")
+		cache.FindUser(ctx, "ann")
+		cache.FindUser(ctx, "lou")
+		cache.FindUser(ctx, "bob")
+		cache.FindUser(ctx, "lou")
+		cache.FindUser(ctx, "ann")
+		if store.reads != 4 || cache.Stats().Evictions != 2 {
+			t.Errorf("got %d reads and %d evictions want 4 and 2", store.reads, cache.Stats().Evictions)
+		}
+	})
+
+	t.Run("concurrent misses share one load", func(t *testing.T) {
+		store := newCountingStore(lou)
+		store.release = make(chan struct{})
+		cache := NewCachedStore(store, 10, time.Minute, time.Minute)
+
+		var wait sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				cache.FindUser(ctx, "lou")
+			}()
+		}
+		for cache.Stats().Shared < 9 {
+			time.Sleep(time.Millisecond)
+		}
+		close(store.release)
+		wait.Wait()
+
+		if store.reads != 1 {
+			t.Errorf("got %d reads want 1", store.reads)
+		}
+	})
+
+	t.Run("a caller giving up does not fail the load it shares", func(t *testing.T) {
+		store := newCountingStore(lou)
+		store.release = make(chan struct{})
+		cache := NewCachedStore(store, 10, time.Minute, time.Minute)
+
+		first, cancel := context.WithCancel(ctx)
+		errs := make(chan error, 1)
+		go func() {
+			_, err := cache.FindUser(first, "lou")
+			errs <- err
+		}()
+		for cache.Stats().Misses < 1 {
+			time.Sleep(time.Millisecond)
+		}
+		users := make(chan *User, 1)
+		go func() {
+			user, _ := cache.FindUser(ctx, "lou")
+			users <- user
+		}()
+		for cache.Stats().Shared < 1 {
+			time.Sleep(time.Millisecond)
+		}
+
+		cancel()
+		var canceled *CanceledError
+		if err := <-errs; !errors.As(err, &canceled) {
+			t.Errorf("got %v want a CanceledError for the caller that gave up", err)
+		}
+		close(store.release)
+		if user := <-users; user == nil || user.Username != "lou" {
+			t.Errorf("got %+v want lou for the caller still waiting", user)
+		}
+	})
+
+	t.Run("instances share the list and invalidations through the remote cache", func(t *testing.T) {
+		store := newCountingStore(User{Username: "lou", Password: "hash", FirstName: "lou"})
+		remote := &fakeRemoteCache{values: map[string][]byte{}}
+		first := NewCachedStore(store, 10, time.Minute, time.Minute)
+		first.SetRemote(remote)
+		second := NewCachedStore(store, 10, time.Minute, time.Minute)
+		second.SetRemote(remote)
+
+		first.ListAll(ctx)
+		users, _ := second.ListAll(ctx)
+		if store.reads != 1 || len(users) != 1 || users[0].FirstName != "lou" || second.Stats().RemoteHits != 1 {
+			t.Fatalf("second instance did not use the remote cache: %d reads, %+v", store.reads, second.Stats())
+		}
+
+		first.FindUser(ctx, "lou")
+		for key, value := range remote.values {
+			if key != listKey || strings.Contains(string(value), "password") || strings.Contains(string(value), "hash") {
+				t.Errorf("got %s: %s in the remote cache want only the list without passwords", key, value)
+			}
+		}
+
+		first.RemoveUser(ctx, "lou")
+		if _, found, _ := remote.Get(ctx, listKey); found {
+			t.Error("remote entry not invalidated")
+		}
+	})
+
+	t.Run("users written in a transaction are invalidated", func(t *testing.T) {
+		store := newCountingStore(lou)
+		cache := NewCachedStore(store, 10, time.Minute, time.Minute)
+
+		cache.FindUser(ctx, "lou")
+		cache.WithTx(ctx, nil, func(tx Store) error {
+			return tx.WithTx(ctx, nil, func(nested Store) error {
+				return nested.UpdateUser(ctx, &User{Username: "lou", FirstName: "louis"})
+			})
+		})
+		user, _ := cache.FindUser(ctx, "lou")
+		if user.FirstName != "louis" {
+			t.Errorf("got %q want %q", user.FirstName, "louis")
+		}
+	})
+}
@@ -0,0 +1,209 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+	"github.com/letitloose/user-app/pkg/tracing"
+)
+
+// exportFields are the fields exported by default and in this order.
+// Passwords are never exported, not even hashed.
+var exportFields = []string{"user-name", "first-name", "last-name", "email"}
+
+// ExportOptions controls ExportUsers. Format is csv, ndjson, json or yaml.
+// Fields picks and orders the fields written, all but the password when
+// empty, and Filter narrows the users exported.
+type ExportOptions struct {
+	Format string
+	Fields []string
+	Filter ListFilter
+}
+
+// exporter writes users in one format. write is called once per user as it
+// is read from the store and close after the last one.
+type exporter interface {
+	write(user *UserView) error
+	close() error
+}
+
+// ExportUsers streams the users matching options.Filter to writer as they
+// are read, so memory use does not grow with the number of users. Fields
+// the caller in ctx may not see are left empty. A *FormatError is returned
+// before anything is written if the format or a field is unknown. Other
+// errors can happen part way through, after some users have been written.
+func (service *UserService) ExportUsers(ctx context.Context, writer io.Writer, options ExportOptions) error {
+	ctx, span := tracing.Start(ctx, "UserService.ExportUsers")
+	defer span.End()
+	span.SetAttribute("format", options.Format)
+
+	fields, err := exportColumns(options.Fields)
+	if err != nil {
+		return err
+	}
+	encoder, err := newExporter(writer, options.Format, fields)
+	if err != nil {
+		return err
+	}
+
+	caller := CallerFromContext(ctx)
+	err = service.store.EachUser(ctx, options.Filter, func(user *User) error {
+		return encoder.write(NewUserView(user, caller))
+	})
+	if err == nil {
+		err = encoder.close()
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("export").Inc()
+	}
+	return err
+}
+
+// exportColumns resolves the requested fields, which may be named any way
+// an import column can, to their JSON names.
+func exportColumns(requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return exportFields, nil
+	}
+
+	fields := []string{}
+	for _, name := range requested {
+		field, ok := importFields[normalizeColumn(name)]
+		if field == "password" {
+			return nil, &FormatError{Message: "passwords cannot be exported"}
+		}
+		if !ok {
+			return nil, &FormatError{Message: fmt.Sprintf("unknown field %q, expected some of %s", name, strings.Join(exportFields, ", "))}
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+func newExporter(writer io.Writer, format string, fields []string) (exporter, error) {
+	switch format {
+	case "csv":
+		return &csvExporter{writer: csv.NewWriter(writer), fields: fields}, nil
+	case "ndjson", "jsonl":
+		return &jsonExporter{writer: writer, fields: fields, separator: "", end: ""}, nil
+	case "json":
+		return &jsonExporter{writer: writer, fields: fields, separator: ",\n", end: "]\n"}, nil
+	case "yaml", "yml":
+		return &yamlExporter{writer: writer, fields: fields}, nil
+	}
+	return nil, &FormatError{Message: fmt.Sprintf("unknown export format %q, expected csv, ndjson, json or yaml", format)}
+}
+
+type csvExporter struct {
+	writer  *csv.Writer
+	fields  []string
+	started bool
+}
+
+func (exporter *csvExporter) write(user *UserView) error {
+	if !exporter.started {
+		exporter.started = true
+		exporter.writer.Write(exporter.fields)
+	}
+	record := make([]string, len(exporter.fields))
+	for i, field := range exporter.fields {
+		record[i] = user.get(field)
+	}
+	return exporter.writer.Write(record)
+}
+
+func (exporter *csvExporter) close() error {
+	if !exporter.started {
+		exporter.started = true
+		exporter.writer.Write(exporter.fields)
+	}
+	exporter.writer.Flush()
+	return exporter.writer.Error()
+}
+
+// jsonExporter writes one object per user, either a line each for ndjson
+// or as the elements of one array for json, where separator and end are
+// set. Objects are built by hand to keep the fields in the order asked for.
+type jsonExporter struct {
+	writer    io.Writer
+	fields    []string
+	separator string
+	end       string
+	count     int
+	buffer    bytes.Buffer
+}
+
+func (exporter *jsonExporter) write(user *UserView) error {
+	exporter.buffer.Reset()
+	if exporter.end != "" {
+		if exporter.count == 0 {
+			exporter.buffer.WriteString("[")
+		} else {
+			exporter.buffer.WriteString(exporter.separator)
+		}
+	}
+	exporter.count++
+
+	exporter.buffer.WriteString("{")
+	for i, field := range exporter.fields {
+		if i > 0 {
+			exporter.buffer.WriteString(",")
+		}
+		key, _ := json.Marshal(field)
+		value, _ := json.Marshal(user.get(field))
+		exporter.buffer.Write(key)
+		exporter.buffer.WriteString(":")
+		exporter.buffer.Write(value)
+	}
+	exporter.buffer.WriteString("}")
+	if exporter.end == "" {
+		exporter.buffer.WriteString("\n")
+	}
+	_, err := exporter.writer.Write(exporter.buffer.Bytes())
+	return err
+}
+
+func (exporter *jsonExporter) close() error {
+	end := exporter.end
+	if end != "" && exporter.count == 0 {
+		end = "[" + end
+	}
+	_, err := io.WriteString(exporter.writer, end)
+	return err
+}
+
+// yamlExporter writes a list with one item per user.
+type yamlExporter struct {
+	writer io.Writer
+	fields []string
+	count  int
+}
+
+func (exporter *yamlExporter) write(user *UserView) error {
+	item := yaml.MapSlice{}
+	for _, field := range exporter.fields {
+		item = append(item, yaml.MapItem{Key: field, Value: user.get(field)})
+	}
+	contents, err := yaml.Marshal([]yaml.MapSlice{item})
+	if err != nil {
+		return err
+	}
+	exporter.count++
+	_, err = exporter.writer.Write(contents)
+	return err
+}
+
+func (exporter *yamlExporter) close() error {
+	if exporter.count > 0 {
+		return nil
+	}
+	_, err := io.WriteString(exporter.writer, "[]\n")
+	return err
+}
@@ -1,11 +1,24 @@
 package user
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
-	"text/template"
+	"time"
+
+	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/logging"
+	"github.com/letitloose/user-app/pkg/qr"
+	"github.com/letitloose/user-app/pkg/tracing"
+	"github.com/letitloose/user-app/pkg/view"
+	"github.com/letitloose/user-app/pkg/webauthn"
 )
 
 func (userService *UserService) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
@@ -33,31 +46,118 @@ func (userService *UserService) ServeHTTP(writer http.ResponseWriter, request *h
 func (userService *UserService) AddHandlersToMux(mux *http.ServeMux) {
 	mux.HandleFunc("/users", userService.ServeHTTP)
 	mux.HandleFunc("/users/", userService.ServeHTTP)
+	mux.HandleFunc("/users/import", userService.importUsers)
+	mux.HandleFunc("/users/export", userService.exportUsers)
+	mux.HandleFunc("/users/unlock", userService.unlockUser)
+	mux.HandleFunc("/password/forgot", userService.forgotPassword)
+	mux.HandleFunc("/password/reset", userService.resetPassword)
+	mux.HandleFunc("/email/verify", userService.verifyEmail)
+	mux.HandleFunc("/email/verify/resend", userService.resendVerification)
+	mux.HandleFunc("/login", userService.login)
+	mux.HandleFunc("/logout", userService.logout)
+	mux.HandleFunc("/signup", userService.signup)
+	mux.HandleFunc("/approvals", userService.approvals)
+	mux.HandleFunc("/invitations", userService.invitations)
+	mux.HandleFunc("/invitations/revoke", userService.changeInvitation)
+	mux.HandleFunc("/invitations/resend", userService.changeInvitation)
+	mux.HandleFunc("/invitations/accept", userService.acceptInvitation)
+	mux.HandleFunc("/login/2fa", userService.secondFactor)
+	mux.HandleFunc("/2fa", userService.twoFactor)
+	mux.HandleFunc("/2fa/setup", userService.setupTwoFactor)
+	mux.HandleFunc("/2fa/qr", userService.twoFactorQR)
+	mux.HandleFunc("/2fa/enable", userService.enableTwoFactor)
+	mux.HandleFunc("/2fa/recovery-codes", userService.newRecoveryCodes)
+	mux.HandleFunc("/2fa/disable", userService.disableTwoFactor)
+	mux.HandleFunc("/passkeys", userService.passkeys)
+	mux.HandleFunc("/passkeys/register/begin", userService.beginPasskeyRegistration)
+	mux.HandleFunc("/passkeys/register/finish", userService.finishPasskeyRegistration)
+	mux.HandleFunc("/passkeys/rename", userService.changePasskey)
+	mux.HandleFunc("/passkeys/remove", userService.changePasskey)
+	mux.HandleFunc("/login/passkey/begin", userService.beginPasskeyLogin)
+	mux.HandleFunc("/login/passkey/finish", userService.finishPasskeyLogin)
+	mux.HandleFunc("/audit", userService.auditLog)
+	mux.HandleFunc("/audit/verify", userService.verifyAudit)
 }
 
-func renderResponse(writer http.ResponseWriter, data any, templateName string) {
+func (userService *UserService) renderResponse(writer http.ResponseWriter, request *http.Request, data any, templateName string) {
 	if writer.Header().Get("Content-Type") == "application/json" {
 		bytes, _ := json.Marshal(data)
 		writer.WriteHeader(http.StatusOK)
 		writer.Write(bytes)
 	} else {
-		parsedTmpl, err := template.ParseFiles(templateName)
+		var page bytes.Buffer
+		err := userService.renderer.Render(&page, templateName, view.NewPage(writer, request, data))
 		if err != nil {
 			writer.WriteHeader(http.StatusInternalServerError)
-			writer.Write([]byte(fmt.Sprintf("template not found: %s", templateName)))
+			writer.Write([]byte(fmt.Sprintf("error rendering %s: %s", templateName, err)))
 			return
 		}
-		tmpl := template.Must(parsedTmpl, nil)
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
 		writer.WriteHeader(http.StatusOK)
-		tmpl.Execute(writer, data)
+		page.WriteTo(writer)
+	}
+}
+
+// StatusClientClosedRequest is the non-standard status nginx uses for a
+// request the client gave up on before the response was written.
+const StatusClientClosedRequest = 499
+
+func errorStatus(err error) int {
+	var policy *PasswordPolicyError
+	var format *FormatError
+	if errors.As(err, &policy) || errors.As(err, &format) {
+		return http.StatusBadRequest
+	}
+	var signup *SignupError
+	if errors.As(err, &signup) {
+		return http.StatusForbidden
+	}
+	var locked *LockedError
+	if errors.As(err, &locked) {
+		return http.StatusTooManyRequests
+	}
+	if err == ErrNotPending || err == ErrNoInvitation || err == ErrNoPasskey {
+		return http.StatusNotFound
+	}
+	if err == ErrInvalidCode || err == ErrInvalidPasskey {
+		return http.StatusBadRequest
+	}
+	if err == ErrTwoFactorEnabled {
+		return http.StatusConflict
+	}
+	var canceled *CanceledError
+	if errors.As(err, &canceled) {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return http.StatusServiceUnavailable
+		}
+		return StatusClientClosedRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// parseListFilter reads the search, prefix and domain query parameters
+// shared by the list and export.
+func parseListFilter(query url.Values) ListFilter {
+	return ListFilter{
+		Search: query.Get("search"),
+		Prefix: query.Get("prefix"),
+		Domain: query.Get("domain"),
 	}
 }
 
 func (userService *UserService) listUsers(writer http.ResponseWriter, request *http.Request) {
-	users := userService.ListAllUsers()
+	users, err := userService.ListUsers(request.Context(), parseListFilter(request.URL.Query()))
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
 
 	writer.Header().Set("Content-Type", request.Header.Get("Content-Type"))
-	renderResponse(writer, users, "pkg/user/templates/list.html")
+	_, span := tracing.Start(request.Context(), "renderResponse")
+	span.SetAttribute("template", "list.html")
+	userService.renderResponse(writer, request, NewUserViews(users, CallerFromContext(request.Context())), "list.html")
+	span.End()
 }
 
 func extractUsername(r *http.Request) (string, error) {
@@ -84,17 +184,35 @@ func (userService *UserService) findByUsername(writer http.ResponseWriter, reque
 		return
 	}
 
-	users, err := userService.FindByUsername(username)
+	user, err := userService.FindByUsername(request.Context(), username)
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
+		writer.WriteHeader(errorStatus(err))
 		fmt.Fprintf(writer, err.Error())
 		return
 	}
 
+	caller := CallerFromContext(request.Context())
+	userView := NewUserView(user, caller)
+	if caller.Role == RoleAdmin {
+		until, err := userService.LockedUntil(request.Context(), user.Username)
+		if err != nil {
+			writer.WriteHeader(errorStatus(err))
+			fmt.Fprintf(writer, err.Error())
+			return
+		}
+		if !until.IsZero() {
+			userView.LockedUntil = &until
+		}
+	}
+
 	writer.Header().Set("Content-Type", request.Header.Get("Content-Type"))
-	renderResponse(writer, users, "pkg/user/templates/show.html")
+	_, span := tracing.Start(request.Context(), "renderResponse")
+	span.SetAttribute("template", "show.html")
+	userService.renderResponse(writer, request, userView, "show.html")
+	span.End()
 }
 
+// deleteUser handles DELETE /users/NAME, for admins only.
 func (userService *UserService) deleteUser(writer http.ResponseWriter, request *http.Request) {
 	username, err := extractUsername(request)
 	if err != nil {
@@ -102,19 +220,33 @@ func (userService *UserService) deleteUser(writer http.ResponseWriter, request *
 		fmt.Fprintf(writer, err.Error())
 		return
 	}
+	if loggedIn(writer, request) == "" {
+		return
+	}
+	if CallerFromContext(request.Context()).Role != RoleAdmin {
+		writer.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(writer, "only admins may delete users")
+		return
+	}
 
-	err = userService.RemoveUser(username)
+	err = userService.RemoveUser(request.Context(), username)
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
+		writer.WriteHeader(errorStatus(err))
 		fmt.Fprintf(writer, err.Error())
 		return
 	}
 
+	// The page deletes with a plain fetch and then moves on to the list,
+	// where the flash is shown; API calls get no cookie.
+	if !wantsJSON(request) {
+		view.AddFlash(writer, request, "success", fmt.Sprintf("%s was deleted", username))
+	}
 	writer.Header().Set("Content-Type", "application/json")
 	writer.WriteHeader(http.StatusOK)
 	writer.Write([]byte("user successfully deleted"))
 }
 
+// updateUser handles PUT /users/NAME, by the user themselves or an admin.
 func (userService *UserService) updateUser(writer http.ResponseWriter, request *http.Request) {
 	username, err := extractUsername(request)
 	if err != nil {
@@ -122,25 +254,35 @@ func (userService *UserService) updateUser(writer http.ResponseWriter, request *
 		fmt.Fprintf(writer, err.Error())
 		return
 	}
+	caller := loggedIn(writer, request)
+	if caller == "" {
+		return
+	}
+	if caller != username && CallerFromContext(request.Context()).Role != RoleAdmin {
+		writer.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(writer, "only admins may change other users")
+		return
+	}
 
-	var user = &User{}
+	var input = &UserInput{}
 	decoder := json.NewDecoder(request.Body)
-	err = decoder.Decode(user)
+	err = decoder.Decode(input)
 	if err != nil {
 		writer.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(writer, err.Error())
 		return
 	}
 
+	user := input.user()
 	if username != user.Username {
 		writer.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(writer, "wrong user specified")
 		return
 	}
 
-	err = userService.UpdateUser(user)
+	err = userService.UpdateUser(request.Context(), user)
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
+		writer.WriteHeader(errorStatus(err))
 		fmt.Fprintf(writer, err.Error())
 		return
 	}
@@ -150,24 +292,1630 @@ func (userService *UserService) updateUser(writer http.ResponseWriter, request *
 	writer.Write([]byte("user successfully updated"))
 }
 
+// UserInput is what a client may set on a user. Anything else, such as the
+// role or whether the email address is verified, is for the app to decide.
+type UserInput struct {
+	Username  string `json:"user-name"`
+	Password  string `json:"password"`
+	FirstName string `json:"first-name"`
+	LastName  string `json:"last-name"`
+	Email     string `json:"email"`
+}
+
+func (input *UserInput) user() *User {
+	return &User{
+		Username:  input.Username,
+		Password:  input.Password,
+		FirstName: input.FirstName,
+		LastName:  input.LastName,
+		Email:     input.Email,
+	}
+}
+
 func (userService *UserService) createUser(writer http.ResponseWriter, request *http.Request) {
-	var user = &User{}
+	var input = &UserInput{}
 	decoder := json.NewDecoder(request.Body)
-	err := decoder.Decode(user)
+	err := decoder.Decode(input)
 	if err != nil {
 		writer.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(writer, err.Error())
 		return
 	}
 
-	err = userService.AddUser(user)
+	// Admins add users directly, anyone else signs up.
+	user := input.user()
+	if CallerFromContext(request.Context()).Role == RoleAdmin {
+		err = userService.AddUser(request.Context(), user)
+	} else {
+		err = userService.SignUp(request.Context(), user)
+	}
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
+		writer.WriteHeader(errorStatus(err))
 		fmt.Fprintf(writer, err.Error())
 		return
 	}
 
 	writer.Header().Set("Content-Type", "application/json")
+	if user.Status == StatusPending {
+		writer.WriteHeader(http.StatusAccepted)
+		writer.Write([]byte("user waiting for approval"))
+		return
+	}
 	writer.WriteHeader(http.StatusOK)
 	writer.Write([]byte("user successfully added"))
 }
+
+// maxImportSize limits the body of an import request.
+const maxImportSize = 10 << 20
+
+var importContentTypes = map[string]string{
+	"text/csv":             "csv",
+	"application/x-ndjson": "ndjson",
+	"application/jsonl":    "ndjson",
+	"application/yaml":     "yaml",
+	"application/x-yaml":   "yaml",
+	"text/yaml":            "yaml",
+}
+
+// importUsers handles POST /users/import, for admins only. The format comes
+// from the format query parameter or else the Content-Type. mode, dry-run
+// and generate-passwords set the other ImportOptions, and each map
+// parameter, e.g. map=login:user-name, maps a column to a field.
+func (userService *UserService) importUsers(writer http.ResponseWriter, request *http.Request) {
+	if CallerFromContext(request.Context()).Role != RoleAdmin {
+		writer.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(writer, "only admins may import users")
+		return
+	}
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := request.URL.Query()
+	options := ImportOptions{
+		Format:            query.Get("format"),
+		Mode:              query.Get("mode"),
+		DryRun:            query.Get("dry-run") == "true",
+		GeneratePasswords: query.Get("generate-passwords") == "true",
+		Columns:           map[string]string{},
+	}
+	if options.Format == "" {
+		contentType, _, _ := strings.Cut(request.Header.Get("Content-Type"), ";")
+		options.Format = importContentTypes[strings.TrimSpace(contentType)]
+	}
+	for _, mapping := range query["map"] {
+		column, field, found := strings.Cut(mapping, ":")
+		if !found {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(writer, "map must be column:field, got %q", mapping)
+			return
+		}
+		options.Columns[column] = field
+	}
+
+	body := http.MaxBytesReader(writer, request.Body, maxImportSize)
+	report, err := userService.ImportUsers(request.Context(), body, options)
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	status := http.StatusOK
+	if report.Failed > 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(report)
+}
+
+var exportContentTypes = map[string]string{
+	"csv":    "text/csv; charset=utf-8",
+	"ndjson": "application/x-ndjson",
+	"jsonl":  "application/x-ndjson",
+	"json":   "application/json",
+	"yaml":   "application/yaml",
+	"yml":    "application/yaml",
+}
+
+// exportResponse notes whether anything has been written, after which an
+// error can no longer change the status.
+type exportResponse struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (response *exportResponse) Write(contents []byte) (int, error) {
+	response.started = true
+	return response.ResponseWriter.Write(contents)
+}
+
+// exportUsers handles GET /users/export, streaming the users in the format
+// given by the format query parameter, json by default. fields is a comma
+// separated list of the fields to include and the list filters apply.
+func (userService *UserService) exportUsers(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writer.Header().Set("Allow", http.MethodGet)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := request.URL.Query()
+	options := ExportOptions{Format: query.Get("format"), Filter: parseListFilter(query)}
+	if options.Format == "" {
+		options.Format = "json"
+	}
+	if fields := query.Get("fields"); fields != "" {
+		options.Fields = strings.Split(fields, ",")
+	}
+	contentType, ok := exportContentTypes[options.Format]
+	if !ok {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "unknown export format %q, expected csv, ndjson, json or yaml", options.Format)
+		return
+	}
+
+	writer.Header().Set("Content-Type", contentType)
+	writer.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, options.Format))
+	response := &exportResponse{ResponseWriter: writer}
+	err := userService.ExportUsers(request.Context(), response, options)
+	if err != nil && !response.started {
+		writer.Header().Del("Content-Disposition")
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	if err != nil {
+		// The status has been sent, so all that can be done is to cut the
+		// response short and leave a trace of why.
+		logging.Warnf("export stopped part way: %s", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// maxFormSize limits the body of the password forms.
+const maxFormSize = 64 << 10
+
+// wantsJSON reports whether request is an API call rather than a form post
+// from a page.
+func wantsJSON(request *http.Request) bool {
+	contentType, _, _ := strings.Cut(request.Header.Get("Content-Type"), ";")
+	return strings.TrimSpace(contentType) == "application/json"
+}
+
+// readFields reads the named fields from a JSON object or form body.
+func readFields(writer http.ResponseWriter, request *http.Request, names ...string) (map[string]string, error) {
+	request.Body = http.MaxBytesReader(writer, request.Body, maxFormSize)
+	fields := map[string]string{}
+	if wantsJSON(request) {
+		err := json.NewDecoder(request.Body).Decode(&fields)
+		return fields, err
+	}
+	err := request.ParseForm()
+	for _, name := range names {
+		fields[name] = request.PostForm.Get(name)
+	}
+	return fields, err
+}
+
+// renderPage renders a page with status, which renderResponse cannot do.
+func (userService *UserService) renderPage(writer http.ResponseWriter, request *http.Request, status int, data any, templateName string) {
+	var page bytes.Buffer
+	err := userService.renderer.Render(&page, templateName, view.NewPage(writer, request, data))
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(writer, "error rendering %s: %s", templateName, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.WriteHeader(status)
+	page.WriteTo(writer)
+}
+
+type forgotPage struct {
+	Sent bool
+}
+
+type resetPage struct {
+	Token    string
+	Invalid  bool
+	Problems []string
+}
+
+const resetRequestedMessage = "If that account exists and has an email address, a reset link has been sent to it."
+
+// forgotPassword shows the form for and handles POST /password/forgot,
+// which takes a login, the username or email address. The response is the
+// same whether or not the account exists, even when sending fails, so it
+// cannot be used to find out who has an account.
+func (userService *UserService) forgotPassword(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		userService.renderPage(writer, request, http.StatusOK, forgotPage{}, "forgot.html")
+		return
+	case http.MethodPost:
+	default:
+		writer.Header().Set("Allow", "GET, POST")
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := readFields(writer, request, "login")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	// Looking up the account, storing a link and mailing it happen after the
+	// response, so how long it takes does not tell whether the account
+	// exists.
+	login := fields["login"]
+	userService.background(request.Context(), func(ctx context.Context) {
+		err := userService.RequestPasswordReset(ctx, login)
+		if err != nil {
+			logging.Errorf("error requesting password reset: %s", err)
+		}
+	})
+
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(writer).Encode(map[string]string{"message": resetRequestedMessage})
+		return
+	}
+	userService.renderPage(writer, request, http.StatusOK, forgotPage{Sent: true}, "forgot.html")
+}
+
+// resetPassword shows the form for a reset link, GET /password/reset?token=,
+// and handles setting the new password with POST /password/reset.
+func (userService *UserService) resetPassword(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		token := request.URL.Query().Get("token")
+		valid, err := userService.CheckResetToken(request.Context(), token)
+		if err != nil {
+			writer.WriteHeader(errorStatus(err))
+			fmt.Fprintf(writer, err.Error())
+			return
+		}
+		status := http.StatusOK
+		if !valid {
+			status = http.StatusBadRequest
+		}
+		userService.renderPage(writer, request, status, resetPage{Token: token, Invalid: !valid}, "reset.html")
+		return
+	case http.MethodPost:
+	default:
+		writer.Header().Set("Allow", "GET, POST")
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := readFields(writer, request, "token", "password", "confirm")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	page := resetPage{Token: fields["token"]}
+	if !wantsJSON(request) && fields["password"] != fields["confirm"] {
+		page.Problems = []string{"does not match the repeated one"}
+		userService.renderPage(writer, request, http.StatusBadRequest, page, "reset.html")
+		return
+	}
+
+	err = userService.ResetPassword(request.Context(), fields["token"], fields["password"])
+	var policy *PasswordPolicyError
+	switch {
+	case err == nil:
+	case wantsJSON(request) && err == ErrInvalidToken:
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	case err == ErrInvalidToken:
+		page.Invalid = true
+		userService.renderPage(writer, request, http.StatusBadRequest, page, "reset.html")
+		return
+	case !wantsJSON(request) && errors.As(err, &policy):
+		page.Problems = policy.Problems
+		userService.renderPage(writer, request, http.StatusBadRequest, page, "reset.html")
+		return
+	default:
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]string{"message": "password changed"})
+		return
+	}
+	view.AddFlash(writer, request, "success", "Your password was changed.")
+	http.Redirect(writer, request, "/users", http.StatusSeeOther)
+}
+
+type verifyPage struct {
+	Token   string
+	Invalid bool
+}
+
+type resendPage struct {
+	Sent bool
+}
+
+type loginPage struct {
+	Username   string
+	Problem    string
+	Unverified bool
+}
+
+const resendRequestedMessage = "If that account has an email address waiting to be confirmed, a new link has been sent to it."
+
+// verifyEmail shows the page for a verification link, GET
+// /email/verify?token=, and confirms the address with POST /email/verify.
+// Opening the link only shows a button, so mail scanners that follow links
+// do not use it up.
+func (userService *UserService) verifyEmail(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		token := request.URL.Query().Get("token")
+		valid, err := userService.CheckVerifyToken(request.Context(), token)
+		if err != nil {
+			writer.WriteHeader(errorStatus(err))
+			fmt.Fprintf(writer, err.Error())
+			return
+		}
+		status := http.StatusOK
+		if !valid {
+			status = http.StatusBadRequest
+		}
+		userService.renderPage(writer, request, status, verifyPage{Token: token, Invalid: !valid}, "verify.html")
+		return
+	case http.MethodPost:
+	default:
+		writer.Header().Set("Allow", "GET, POST")
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := readFields(writer, request, "token")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	user, err := userService.ConfirmEmail(request.Context(), fields["token"])
+	switch {
+	case err == nil:
+	case wantsJSON(request) && err == ErrInvalidToken:
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	case err == ErrInvalidToken:
+		userService.renderPage(writer, request, http.StatusBadRequest, verifyPage{Invalid: true}, "verify.html")
+		return
+	default:
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]string{"message": "email address confirmed", "email": user.Email})
+		return
+	}
+	view.AddFlash(writer, request, "success", fmt.Sprintf("%s is confirmed as your email address.", user.Email))
+	http.Redirect(writer, request, "/login", http.StatusSeeOther)
+}
+
+// resendVerification shows the form for and handles POST
+// /email/verify/resend, which takes a login like /password/forgot and
+// answers the same way whatever happened.
+func (userService *UserService) resendVerification(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		userService.renderPage(writer, request, http.StatusOK, resendPage{}, "resend.html")
+		return
+	case http.MethodPost:
+	default:
+		writer.Header().Set("Allow", "GET, POST")
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := readFields(writer, request, "login")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	err = userService.ResendVerification(request.Context(), fields["login"])
+	if err != nil {
+		logging.Errorf("error resending verification email: %s", err)
+	}
+
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(writer).Encode(map[string]string{"message": resendRequestedMessage})
+		return
+	}
+	userService.renderPage(writer, request, http.StatusOK, resendPage{Sent: true}, "resend.html")
+}
+
+// login shows the login form and handles POST /login, which sets the
+// session cookie.
+func (userService *UserService) login(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		userService.renderPage(writer, request, http.StatusOK, loginPage{}, "login.html")
+		return
+	case http.MethodPost:
+	default:
+		writer.Header().Set("Allow", "GET, POST")
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := readFields(writer, request, "username", "password")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	secret, err := userService.Login(request.Context(), fields["username"], fields["password"])
+	var required *TwoFactorRequiredError
+	if errors.As(err, &required) {
+		userService.loginChallenge(writer, request, required)
+		return
+	}
+	setRetryAfter(writer, err)
+	status := http.StatusOK
+	switch err {
+	case nil:
+	case ErrInvalidLogin:
+		status = http.StatusUnauthorized
+	case ErrEmailNotVerified, ErrAccountPending:
+		status = http.StatusForbidden
+	default:
+		status = errorStatus(err)
+	}
+	if err != nil && wantsJSON(request) {
+		writer.WriteHeader(status)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	if err != nil {
+		page := loginPage{Username: fields["username"], Problem: err.Error(), Unverified: err == ErrEmailNotVerified}
+		userService.renderPage(writer, request, status, page, "login.html")
+		return
+	}
+
+	setSessionCookie(writer, secret)
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]string{"message": "logged in"})
+		return
+	}
+	http.Redirect(writer, request, "/users", http.StatusSeeOther)
+}
+
+// logout handles POST /logout, ending the session and removing its cookie.
+func (userService *UserService) logout(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cookie, err := request.Cookie(sessionCookie); err == nil {
+		err = userService.Logout(request.Context(), cookie.Value)
+		if err != nil {
+			writer.WriteHeader(errorStatus(err))
+			fmt.Fprintf(writer, err.Error())
+			return
+		}
+	}
+	setSessionCookie(writer, "")
+	if wantsJSON(request) {
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(writer, request, "/login", http.StatusSeeOther)
+}
+
+type signupPage struct {
+	Closed   bool
+	Input    UserInput
+	Problems []string
+}
+
+// signup shows the signup form and handles POST /signup, which takes the
+// fields of a UserInput and, from the form, a repeated password.
+func (userService *UserService) signup(writer http.ResponseWriter, request *http.Request) {
+	page := signupPage{Closed: config.GetConfig().Signup.Mode == "invite-only"}
+	switch request.Method {
+	case http.MethodGet:
+		userService.renderPage(writer, request, http.StatusOK, page, "signup.html")
+		return
+	case http.MethodPost:
+	default:
+		writer.Header().Set("Allow", "GET, POST")
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := readFields(writer, request, "user-name", "first-name", "last-name", "email", "password", "confirm")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	page.Input = UserInput{Username: fields["user-name"], FirstName: fields["first-name"], LastName: fields["last-name"], Email: fields["email"]}
+	if !wantsJSON(request) && fields["password"] != fields["confirm"] {
+		page.Problems = []string{"Password does not match the repeated one"}
+		userService.renderPage(writer, request, http.StatusBadRequest, page, "signup.html")
+		return
+	}
+
+	user := page.Input.user()
+	user.Password = fields["password"]
+	err = userService.SignUp(request.Context(), user)
+	if err != nil && wantsJSON(request) {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	if err != nil {
+		status := errorStatus(err)
+		var policy *PasswordPolicyError
+		switch {
+		case errors.As(err, &policy):
+			for _, problem := range policy.Problems {
+				page.Problems = append(page.Problems, "Password "+problem)
+			}
+		case status < http.StatusInternalServerError:
+			page.Problems = []string{err.Error()}
+		default:
+			writer.WriteHeader(status)
+			fmt.Fprintf(writer, err.Error())
+			return
+		}
+		userService.renderPage(writer, request, status, page, "signup.html")
+		return
+	}
+
+	message := "Your account was created."
+	if user.Status == StatusPending {
+		message = "Thanks for signing up. You will get an email once an admin has approved your account."
+	} else if user.Email != "" {
+		message += " Check your email to confirm your address."
+	}
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusCreated)
+		json.NewEncoder(writer).Encode(map[string]string{"message": message, "status": string(user.Status)})
+		return
+	}
+	view.AddFlash(writer, request, "success", message)
+	http.Redirect(writer, request, "/login", http.StatusSeeOther)
+}
+
+// approvals shows admins the users waiting for approval and handles their
+// decisions, POST /approvals with a username and a decision of approve or
+// reject.
+func (userService *UserService) approvals(writer http.ResponseWriter, request *http.Request) {
+	caller := CallerFromContext(request.Context())
+	if caller.Role != RoleAdmin {
+		writer.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(writer, "only admins may approve users")
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		users, err := userService.PendingUsers(request.Context())
+		if err != nil {
+			writer.WriteHeader(errorStatus(err))
+			fmt.Fprintf(writer, err.Error())
+			return
+		}
+		writer.Header().Set("Content-Type", request.Header.Get("Content-Type"))
+		userService.renderResponse(writer, request, NewUserViews(users, caller), "approvals.html")
+		return
+	case http.MethodPost:
+	default:
+		writer.Header().Set("Allow", "GET, POST")
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := readFields(writer, request, "username", "decision")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	username := fields["username"]
+	var message string
+	switch fields["decision"] {
+	case "approve":
+		err = userService.ApproveUser(request.Context(), username)
+		message = fmt.Sprintf("%s was approved", username)
+	case "reject":
+		err = userService.RejectUser(request.Context(), username)
+		message = fmt.Sprintf("%s was rejected", username)
+	default:
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "decision must be approve or reject, got %q", fields["decision"])
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]string{"message": message})
+		return
+	}
+	view.AddFlash(writer, request, "success", message)
+	http.Redirect(writer, request, "/approvals", http.StatusSeeOther)
+}
+
+// invitations shows admins the invitations and a form for sending one, and
+// handles POST /invitations, which takes an email, a role and a
+// comma-separated list of groups.
+func (userService *UserService) invitations(writer http.ResponseWriter, request *http.Request) {
+	if CallerFromContext(request.Context()).Role != RoleAdmin {
+		writer.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(writer, "only admins may invite users")
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		invitations, err := userService.ListInvitations(request.Context())
+		if err != nil {
+			writer.WriteHeader(errorStatus(err))
+			fmt.Fprintf(writer, err.Error())
+			return
+		}
+		writer.Header().Set("Content-Type", request.Header.Get("Content-Type"))
+		userService.renderResponse(writer, request, invitations, "invitations.html")
+		return
+	case http.MethodPost:
+	default:
+		writer.Header().Set("Allow", "GET, POST")
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := readFields(writer, request, "email", "role", "groups")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	invitation, err := userService.Invite(request.Context(), fields["email"], Role(fields["role"]), ParseGroups(fields["groups"]))
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusCreated)
+		json.NewEncoder(writer).Encode(invitation)
+		return
+	}
+	view.AddFlash(writer, request, "success", fmt.Sprintf("%s was invited", invitation.Email))
+	http.Redirect(writer, request, "/invitations", http.StatusSeeOther)
+}
+
+// changeInvitation handles POST /invitations/revoke and POST
+// /invitations/resend, which take the id of an invitation.
+func (userService *UserService) changeInvitation(writer http.ResponseWriter, request *http.Request) {
+	if CallerFromContext(request.Context()).Role != RoleAdmin {
+		writer.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(writer, "only admins may invite users")
+		return
+	}
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := readFields(writer, request, "id")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	var message string
+	if strings.HasSuffix(request.URL.Path, "/revoke") {
+		err = userService.RevokeInvitation(request.Context(), fields["id"])
+		message = "The invitation was revoked"
+	} else {
+		err = userService.ResendInvitation(request.Context(), fields["id"])
+		message = "The invitation was sent again"
+	}
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]string{"message": message})
+		return
+	}
+	view.AddFlash(writer, request, "success", message)
+	http.Redirect(writer, request, "/invitations", http.StatusSeeOther)
+}
+
+type acceptPage struct {
+	Token    string
+	Email    string
+	Invalid  bool
+	Input    UserInput
+	Problems []string
+}
+
+// acceptInvitation shows the page for an invitation link, GET
+// /invitations/accept?token=, and creates the account with POST
+// /invitations/accept, which takes the token, a user-name, first-name,
+// last-name and password and, from the form, a repeated password.
+func (userService *UserService) acceptInvitation(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		page := acceptPage{Token: request.URL.Query().Get("token")}
+		invitation, err := userService.CheckInvitation(request.Context(), page.Token)
+		status := http.StatusOK
+		switch {
+		case err == ErrInvalidToken:
+			page.Invalid, status = true, http.StatusBadRequest
+		case err != nil:
+			writer.WriteHeader(errorStatus(err))
+			fmt.Fprintf(writer, err.Error())
+			return
+		default:
+			page.Email = invitation.Email
+		}
+		userService.renderPage(writer, request, status, page, "accept.html")
+		return
+	case http.MethodPost:
+	default:
+		writer.Header().Set("Allow", "GET, POST")
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := readFields(writer, request, "token", "user-name", "first-name", "last-name", "password", "confirm")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	page := acceptPage{Token: fields["token"]}
+	page.Input = UserInput{Username: fields["user-name"], FirstName: fields["first-name"], LastName: fields["last-name"]}
+	if !wantsJSON(request) {
+		invitation, err := userService.CheckInvitation(request.Context(), page.Token)
+		if err == nil {
+			page.Email = invitation.Email
+		}
+		if err == nil && fields["password"] != fields["confirm"] {
+			page.Problems = []string{"Password does not match the repeated one"}
+			userService.renderPage(writer, request, http.StatusBadRequest, page, "accept.html")
+			return
+		}
+	}
+
+	user := page.Input.user()
+	user.Password = fields["password"]
+	err = userService.AcceptInvitation(request.Context(), page.Token, user)
+	var policy *PasswordPolicyError
+	switch {
+	case err == nil:
+	case wantsJSON(request) && err == ErrInvalidToken:
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	case wantsJSON(request):
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	case err == ErrInvalidToken:
+		page.Invalid = true
+		userService.renderPage(writer, request, http.StatusBadRequest, page, "accept.html")
+		return
+	case errors.As(err, &policy):
+		for _, problem := range policy.Problems {
+			page.Problems = append(page.Problems, "Password "+problem)
+		}
+		userService.renderPage(writer, request, http.StatusBadRequest, page, "accept.html")
+		return
+	case errorStatus(err) < http.StatusInternalServerError:
+		page.Problems = []string{err.Error()}
+		userService.renderPage(writer, request, errorStatus(err), page, "accept.html")
+		return
+	default:
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusCreated)
+		json.NewEncoder(writer).Encode(map[string]string{"message": "account created", "user-name": user.Username})
+		return
+	}
+	view.AddFlash(writer, request, "success", "Your account was created. You can log in now.")
+	http.Redirect(writer, request, "/login", http.StatusSeeOther)
+}
+
+// twoFactorPage sets up two-factor authentication and asks for codes, in the
+// account settings or, with a Challenge, while logging in.
+type twoFactorPage struct {
+	Challenge string
+	Enabled   bool
+	Setup     *TwoFactorSetup
+	QR        template.HTML
+	Codes     []string
+	Problem   string
+}
+
+// withSetup adds setup to page, with a QR code for it unless its URI is too
+// long for one.
+func (page twoFactorPage) withSetup(setup *TwoFactorSetup) twoFactorPage {
+	page.Setup = setup
+	if code, err := qr.Encode(setup.URI); err == nil {
+		page.QR = template.HTML(code.SVG())
+	}
+	return page
+}
+
+// loginChallenge answers a login with the right password that needs a
+// two-factor code, or the setup of two-factor authentication, to finish.
+func (userService *UserService) loginChallenge(writer http.ResponseWriter, request *http.Request, required *TwoFactorRequiredError) {
+	page := twoFactorPage{Challenge: required.Challenge}
+	if required.Setup {
+		setup, err := userService.ChallengeSetup(request.Context(), required.Challenge)
+		if err != nil {
+			writer.WriteHeader(errorStatus(err))
+			fmt.Fprintf(writer, err.Error())
+			return
+		}
+		page = page.withSetup(setup)
+	}
+
+	if wantsJSON(request) {
+		response := map[string]any{"message": required.Error(), "challenge": required.Challenge}
+		if page.Setup != nil {
+			response["setup"] = page.Setup
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(writer).Encode(response)
+		return
+	}
+	userService.renderPage(writer, request, http.StatusOK, page, "twofactor.html")
+}
+
+// secondFactor handles POST /login/2fa, which takes the challenge from a
+// login and a code, or a recovery code, to finish it with.
+func (userService *UserService) secondFactor(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := readFields(writer, request, "challenge", "code")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	secret, codes, err := userService.CompleteLogin(request.Context(), fields["challenge"], fields["code"])
+	setRetryAfter(writer, err)
+	var locked *LockedError
+	switch {
+	case err == nil:
+	case !wantsJSON(request) && errors.As(err, &locked):
+		userService.renderPage(writer, request, http.StatusTooManyRequests, loginPage{Problem: err.Error()}, "login.html")
+		return
+	case wantsJSON(request) && err == ErrInvalidCode:
+		writer.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(writer, err.Error())
+		return
+	case err == ErrInvalidCode:
+		page := twoFactorPage{Challenge: fields["challenge"], Problem: err.Error()}
+		if setup, err := userService.ChallengeSetup(request.Context(), page.Challenge); err == nil {
+			page = page.withSetup(setup)
+		}
+		userService.renderPage(writer, request, http.StatusUnauthorized, page, "twofactor.html")
+		return
+	case wantsJSON(request) && err == ErrInvalidToken:
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	case err == ErrInvalidToken:
+		userService.renderPage(writer, request, http.StatusBadRequest, loginPage{Problem: "Your login timed out, please log in again."}, "login.html")
+		return
+	default:
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	setSessionCookie(writer, secret)
+	if wantsJSON(request) {
+		response := map[string]any{"message": "logged in"}
+		if codes != nil {
+			response["recovery-codes"] = codes
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(response)
+		return
+	}
+	if codes != nil {
+		userService.renderPage(writer, request, http.StatusOK, twoFactorPage{Enabled: true, Codes: codes}, "twofactor.html")
+		return
+	}
+	http.Redirect(writer, request, "/users", http.StatusSeeOther)
+}
+
+// setRetryAfter tells the client when to try again after a *LockedError.
+func setRetryAfter(writer http.ResponseWriter, err error) {
+	var locked *LockedError
+	if errors.As(err, &locked) {
+		writer.Header().Set("Retry-After", strconv.Itoa(int(locked.RetryAfter().Seconds())))
+	}
+}
+
+// loggedIn returns the username of the caller, or writes a 401 and returns
+// "" for anonymous requests.
+func loggedIn(writer http.ResponseWriter, request *http.Request) string {
+	username := CallerFromContext(request.Context()).Username
+	if username == "" {
+		writer.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(writer, "log in first")
+	}
+	return username
+}
+
+// twoFactor shows whether the caller has two-factor authentication on, with
+// the forms for changing that.
+func (userService *UserService) twoFactor(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writer.Header().Set("Allow", http.MethodGet)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	username := loggedIn(writer, request)
+	if username == "" {
+		return
+	}
+
+	enabled, err := userService.TwoFactorEnabled(request.Context(), username)
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]bool{"enabled": enabled})
+		return
+	}
+	userService.renderPage(writer, request, http.StatusOK, twoFactorPage{Enabled: enabled}, "twofactor.html")
+}
+
+// setupTwoFactor handles POST /2fa/setup, which gives the caller a secret
+// for their authenticator app to confirm with POST /2fa/enable.
+func (userService *UserService) setupTwoFactor(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	username := loggedIn(writer, request)
+	if username == "" {
+		return
+	}
+
+	setup, err := userService.StartTwoFactor(request.Context(), username)
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(setup)
+		return
+	}
+	userService.renderPage(writer, request, http.StatusOK, twoFactorPage{}.withSetup(setup), "twofactor.html")
+}
+
+// twoFactorQR draws the secret the caller is setting up as a QR code, an
+// SVG or, with format=png, a PNG.
+func (userService *UserService) twoFactorQR(writer http.ResponseWriter, request *http.Request) {
+	username := loggedIn(writer, request)
+	if username == "" {
+		return
+	}
+	setup, err := userService.PendingTwoFactor(request.Context(), username)
+	if err == nil && setup == nil {
+		writer.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(writer, "no two-factor setup is in progress")
+		return
+	}
+	var code *qr.Code
+	if err == nil {
+		code, err = qr.Encode(setup.URI)
+	}
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	// The code holds the secret.
+	writer.Header().Set("Cache-Control", "no-store")
+	if request.URL.Query().Get("format") == "png" {
+		image, err := code.PNG(6)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(writer, err.Error())
+			return
+		}
+		writer.Header().Set("Content-Type", "image/png")
+		writer.Write(image)
+		return
+	}
+	writer.Header().Set("Content-Type", "image/svg+xml")
+	writer.Write(code.SVG())
+}
+
+// enableTwoFactor handles POST /2fa/enable, which takes a code from the
+// app the caller just set up and answers with their recovery codes.
+func (userService *UserService) enableTwoFactor(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	username := loggedIn(writer, request)
+	if username == "" {
+		return
+	}
+	fields, err := readFields(writer, request, "code")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	codes, err := userService.EnableTwoFactor(request.Context(), username, fields["code"])
+	if err == ErrInvalidCode && !wantsJSON(request) {
+		page := twoFactorPage{Problem: err.Error()}
+		if setup, err := userService.PendingTwoFactor(request.Context(), username); err == nil && setup != nil {
+			page = page.withSetup(setup)
+		}
+		userService.renderPage(writer, request, http.StatusBadRequest, page, "twofactor.html")
+		return
+	}
+	userService.showRecoveryCodes(writer, request, codes, err)
+}
+
+// newRecoveryCodes handles POST /2fa/recovery-codes, which takes a code and
+// replaces the caller's recovery codes.
+func (userService *UserService) newRecoveryCodes(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	username := loggedIn(writer, request)
+	if username == "" {
+		return
+	}
+	fields, err := readFields(writer, request, "code")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	var codes []string
+	err = userService.CheckTwoFactor(request.Context(), username, fields["code"])
+	if err == nil {
+		codes, err = userService.NewRecoveryCodes(request.Context(), username)
+	}
+	if err == ErrInvalidCode && !wantsJSON(request) {
+		page := twoFactorPage{Enabled: true, Problem: err.Error()}
+		userService.renderPage(writer, request, http.StatusBadRequest, page, "twofactor.html")
+		return
+	}
+	userService.showRecoveryCodes(writer, request, codes, err)
+}
+
+func (userService *UserService) showRecoveryCodes(writer http.ResponseWriter, request *http.Request, codes []string, err error) {
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string][]string{"recovery-codes": codes})
+		return
+	}
+	userService.renderPage(writer, request, http.StatusOK, twoFactorPage{Enabled: true, Codes: codes}, "twofactor.html")
+}
+
+// disableTwoFactor handles POST /2fa/disable. Users turn off their own
+// two-factor authentication with a code, and admins anyone's by username,
+// for someone who lost their app and recovery codes.
+func (userService *UserService) disableTwoFactor(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	caller := CallerFromContext(request.Context())
+	if loggedIn(writer, request) == "" {
+		return
+	}
+	fields, err := readFields(writer, request, "code", "username")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	username := fields["username"]
+	switch {
+	case username != "" && username != caller.Username && caller.Role != RoleAdmin:
+		writer.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(writer, "only admins may turn off two-factor authentication for others")
+		return
+	case username == "" || username == caller.Username:
+		username = caller.Username
+		err = userService.CheckTwoFactor(request.Context(), username, fields["code"])
+	}
+	if err == ErrInvalidCode && !wantsJSON(request) {
+		page := twoFactorPage{Enabled: true, Problem: err.Error()}
+		userService.renderPage(writer, request, http.StatusBadRequest, page, "twofactor.html")
+		return
+	}
+	if err == nil {
+		err = userService.DisableTwoFactor(request.Context(), username)
+	}
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	message := "Two-factor authentication was turned off"
+	if username != caller.Username {
+		message = fmt.Sprintf("Two-factor authentication was turned off for %s", username)
+	}
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]string{"message": message})
+		return
+	}
+	view.AddFlash(writer, request, "success", message)
+	http.Redirect(writer, request, "/2fa", http.StatusSeeOther)
+}
+
+// passkeys lists the caller's passkeys, with the forms for registering,
+// renaming and removing them.
+func (userService *UserService) passkeys(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writer.Header().Set("Allow", http.MethodGet)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	username := loggedIn(writer, request)
+	if username == "" {
+		return
+	}
+
+	passkeys, err := userService.Passkeys(request.Context(), username)
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(passkeys)
+		return
+	}
+	userService.renderPage(writer, request, http.StatusOK, passkeys, "passkeys.html")
+}
+
+// readCredential reads the JSON a browser's PublicKeyCredential.toJSON
+// gives into response.
+func readCredential(writer http.ResponseWriter, request *http.Request, response any) bool {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+	err := json.NewDecoder(http.MaxBytesReader(writer, request.Body, maxFormSize)).Decode(response)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "error reading the credential: %s", err)
+		return false
+	}
+	return true
+}
+
+// beginPasskeyRegistration handles POST /passkeys/register/begin, which
+// takes a name for the new passkey and returns the options for
+// navigator.credentials.create.
+func (userService *UserService) beginPasskeyRegistration(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	username := loggedIn(writer, request)
+	if username == "" {
+		return
+	}
+
+	fields, err := readFields(writer, request, "name")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	options, err := userService.BeginPasskeyRegistration(request.Context(), username, fields["name"])
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(options)
+}
+
+// finishPasskeyRegistration handles POST /passkeys/register/finish, which
+// takes the credential the browser created.
+func (userService *UserService) finishPasskeyRegistration(writer http.ResponseWriter, request *http.Request) {
+	username := loggedIn(writer, request)
+	if username == "" {
+		return
+	}
+	response := &webauthn.RegistrationResponse{}
+	if !readCredential(writer, request, response) {
+		return
+	}
+
+	passkey, err := userService.FinishPasskeyRegistration(request.Context(), username, response)
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	view.AddFlash(writer, request, "success", fmt.Sprintf("The passkey %s was added", passkey.Name))
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(passkey)
+}
+
+// changePasskey handles POST /passkeys/rename, which takes the id of one of
+// the caller's passkeys and a new name, and POST /passkeys/remove, which
+// takes the id.
+func (userService *UserService) changePasskey(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	username := loggedIn(writer, request)
+	if username == "" {
+		return
+	}
+
+	fields, err := readFields(writer, request, "id", "name")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	var message string
+	if strings.HasSuffix(request.URL.Path, "/remove") {
+		err = userService.RemovePasskey(request.Context(), username, fields["id"])
+		message = "The passkey was removed"
+	} else {
+		err = userService.RenamePasskey(request.Context(), username, fields["id"], fields["name"])
+		message = "The passkey was renamed"
+	}
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]string{"message": message})
+		return
+	}
+	view.AddFlash(writer, request, "success", message)
+	http.Redirect(writer, request, "/passkeys", http.StatusSeeOther)
+}
+
+// beginPasskeyLogin handles POST /login/passkey/begin, which takes an
+// optional username and returns the options for
+// navigator.credentials.get.
+func (userService *UserService) beginPasskeyLogin(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := readFields(writer, request, "username")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	options, err := userService.BeginPasskeyLogin(request.Context(), fields["username"])
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(options)
+}
+
+// finishPasskeyLogin handles POST /login/passkey/finish, which takes the
+// signed assertion from the browser and starts a session.
+func (userService *UserService) finishPasskeyLogin(writer http.ResponseWriter, request *http.Request) {
+	response := &webauthn.AssertionResponse{}
+	if !readCredential(writer, request, response) {
+		return
+	}
+
+	secret, err := userService.FinishPasskeyLogin(request.Context(), response)
+	switch err {
+	case nil:
+	case ErrInvalidPasskey:
+		writer.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(writer, err.Error())
+		return
+	case ErrEmailNotVerified, ErrAccountPending:
+		writer.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(writer, err.Error())
+		return
+	default:
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	setSessionCookie(writer, secret)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]string{"message": "logged in"})
+}
+
+// unlockUser handles POST /users/unlock, which takes the username of an
+// account to lift the lockout of.
+func (userService *UserService) unlockUser(writer http.ResponseWriter, request *http.Request) {
+	if CallerFromContext(request.Context()).Role != RoleAdmin {
+		writer.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(writer, "only admins may unlock accounts")
+		return
+	}
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := readFields(writer, request, "username")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+	err = userService.Unlock(request.Context(), fields["username"])
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	message := fmt.Sprintf("%s was unlocked", fields["username"])
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]string{"message": message})
+		return
+	}
+	view.AddFlash(writer, request, "success", message)
+	http.Redirect(writer, request, "/users/"+url.PathEscape(fields["username"]), http.StatusSeeOther)
+}
+
+// auditActions are the actions the audit page can filter by.
+var auditActions = []string{AuditCreate, AuditUpdate, AuditDelete, AuditRoleChange, AuditLogin, AuditLogout, AuditLoginFailed}
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+type auditPage struct {
+	Events  []*AuditEvent
+	Query   url.Values
+	Actions []string
+	Older   string
+}
+
+// parseAuditFilter reads the actor, subject, action, since, until, before
+// and limit query parameters of GET /audit. Times are RFC 3339 or dates,
+// which cover the whole day in UTC.
+func parseAuditFilter(query url.Values) (AuditFilter, error) {
+	filter := AuditFilter{
+		Actor:   query.Get("actor"),
+		Subject: query.Get("subject"),
+		Action:  query.Get("action"),
+		Limit:   defaultAuditLimit,
+	}
+	for _, bound := range []struct {
+		name  string
+		value *time.Time
+		day   time.Duration
+	}{{"since", &filter.Since, 0}, {"until", &filter.Until, 24*time.Hour - time.Second}} {
+		value := query.Get(bound.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			parsed, err = time.Parse("2006-01-02", value)
+			parsed = parsed.Add(bound.day)
+		}
+		if err != nil {
+			return filter, &FormatError{Message: fmt.Sprintf("%s must be a date or RFC 3339 time, got %q", bound.name, value)}
+		}
+		*bound.value = parsed
+	}
+	if value := query.Get("before"); value != "" {
+		before, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || before < 1 {
+			return filter, &FormatError{Message: fmt.Sprintf("before must be an event number, got %q", value)}
+		}
+		filter.Before = before
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			return filter, &FormatError{Message: fmt.Sprintf("limit must be between 1 and %d, got %q", maxAuditLimit, value)}
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+// auditLog handles GET /audit, listing audit events newest first, filtered
+// by the query parameters parseAuditFilter reads.
+func (userService *UserService) auditLog(writer http.ResponseWriter, request *http.Request) {
+	if CallerFromContext(request.Context()).Role != RoleAdmin {
+		writer.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(writer, "only admins may see the audit log")
+		return
+	}
+	if request.Method != http.MethodGet {
+		writer.Header().Set("Allow", http.MethodGet)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := request.URL.Query()
+	filter, err := parseAuditFilter(query)
+	var events []*AuditEvent
+	if err == nil {
+		events, err = userService.ListAudit(request.Context(), filter)
+	}
+	if err != nil {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	if wantsJSON(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(events)
+		return
+	}
+	page := auditPage{Events: events, Query: query, Actions: auditActions}
+	if len(events) == filter.Limit {
+		older := url.Values{}
+		for name, values := range query {
+			older[name] = values
+		}
+		older.Set("before", strconv.FormatInt(events[len(events)-1].Seq, 10))
+		page.Older = "/audit?" + older.Encode()
+	}
+	userService.renderPage(writer, request, http.StatusOK, page, "audit.html")
+}
+
+// verifyAudit handles POST /audit/verify, checking the hash chain of the
+// whole audit log.
+func (userService *UserService) verifyAudit(writer http.ResponseWriter, request *http.Request) {
+	if CallerFromContext(request.Context()).Role != RoleAdmin {
+		writer.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(writer, "only admins may verify the audit log")
+		return
+	}
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	checked, err := userService.VerifyAudit(request.Context())
+	var broken *AuditChainError
+	if err != nil && !errors.As(err, &broken) {
+		writer.WriteHeader(errorStatus(err))
+		fmt.Fprintf(writer, err.Error())
+		return
+	}
+
+	if wantsJSON(request) {
+		result := map[string]any{"events": checked, "valid": broken == nil}
+		if broken != nil {
+			result["problem"] = broken.Error()
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(result)
+		return
+	}
+	if broken != nil {
+		view.AddFlash(writer, request, "error", fmt.Sprintf("The audit log has been tampered with: %s", broken.Error()))
+	} else {
+		view.AddFlash(writer, request, "success", fmt.Sprintf("The audit log checks out, %d events", checked))
+	}
+	http.Redirect(writer, request, "/audit", http.StatusSeeOther)
+}
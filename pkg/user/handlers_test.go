@@ -2,14 +2,44 @@ package user
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/tracing"
+	"github.com/letitloose/user-app/pkg/view"
+	"github.com/letitloose/user-app/pkg/webauthn"
+	"github.com/letitloose/user-app/pkg/webauthn/webauthntest"
 )
 
+type recordingExporter struct {
+	mutex sync.Mutex
+	names []string
+	spans []*tracing.Span
+}
+
+func (exporter *recordingExporter) Export(span *tracing.Span) {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	exporter.names = append(exporter.names, span.Name)
+	exporter.spans = append(exporter.spans, span)
+}
+
+func (exporter *recordingExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
 func setupHandlers(t *testing.T) *UserService {
 
 	db, err := sql.Open("sqlite3", ":memory:")
@@ -18,21 +48,30 @@ func setupHandlers(t *testing.T) *UserService {
 	}
 
 	userRepo := NewUserRepository(db)
-	err = userRepo.createUserTable()
+	err = userRepo.CreateTables(context.Background())
 	if err != nil {
 		t.Fatalf("failed to create user table: %s", err)
 	}
 	newUser := User{Username: "test", Password: "pwd", FirstName: "lou", LastName: "garwood", Email: "louis@mail.com"}
-	err = userRepo.addUser(&newUser)
+	err = userRepo.AddUser(context.Background(), &newUser)
 	if err != nil {
 		t.Fatalf("failed to add user: %s", err)
 	}
 
-	return NewUserService(userRepo)
+	return NewUserService(userRepo, setupRenderer(t))
+}
+
+func setupRenderer(t *testing.T) *view.Renderer {
+	renderer, err := view.NewRenderer(view.Layout(false), Templates(false), nil, false)
+	if err != nil {
+		t.Fatalf("failed to parse templates: %s", err)
+	}
+	return renderer
 }
 
 func teardownHandlers(service *UserService) {
-	service.repository.database.Close()
+	service.Wait()
+	service.store.(*userRepository).database.Close()
 }
 
 func TestHandlers(t *testing.T) {
@@ -56,7 +95,7 @@ func TestHandlers(t *testing.T) {
 				status, http.StatusOK)
 		}
 
-		expected := `[{"user-name":"test","password":"pwd","first-name":"lou","last-name":"garwood","email":"louis@mail.com"}]`
+		expected := `[{"user-name":"test","first-name":"lou","last-name":"garwood"}]`
 		if recorder.Body.String() != expected {
 			t.Errorf("handler returned unexpected body: got %v want %v",
 				recorder.Body.String(), expected)
@@ -82,7 +121,7 @@ func TestHandlers(t *testing.T) {
 				status, http.StatusOK)
 		}
 
-		expected := `{"user-name":"test","password":"pwd","first-name":"lou","last-name":"garwood","email":"louis@mail.com"}`
+		expected := `{"user-name":"test","first-name":"lou","last-name":"garwood"}`
 		if recorder.Body.String() != expected {
 			t.Errorf("handler returned unexpected body: got %v want %v",
 				recorder.Body.String(), expected)
@@ -92,7 +131,8 @@ func TestHandlers(t *testing.T) {
 	t.Run("test removeUser", func(t *testing.T) {
 		userService := setupHandlers(t)
 		defer teardownHandlers(userService)
-		request, err := http.NewRequest("DELETE", "/users/test", nil)
+		admin := WithCaller(context.Background(), Caller{Username: "boss", Role: RoleAdmin})
+		request, err := http.NewRequestWithContext(admin, "DELETE", "/users/test", nil)
 		request.Header.Set("Content-Type", "application/json")
 		if err != nil {
 			t.Fatal(err)
@@ -125,7 +165,7 @@ func TestHandlers(t *testing.T) {
 
 		handler.ServeHTTP(recorder, request)
 
-		expected = `{"user-name":"","password":"","first-name":"","last-name":"","email":""}`
+		expected = `{"user-name":"","first-name":"","last-name":""}`
 		if recorder.Body.String() != expected {
 			t.Errorf("handler returned unexpected body: got %v want %v",
 				recorder.Body.String(), expected)
@@ -170,10 +210,16 @@ func TestHandlers(t *testing.T) {
 
 		handler.ServeHTTP(recorder, request)
 
-		expected = `{"user-name":"test1","password":"pass","first-name":"lou","last-name":"gar","email":""}`
-		if recorder.Body.String() != expected {
-			t.Errorf("handler returned unexpected body: got %v want %v",
-				recorder.Body.String(), expected)
+		got := &UserView{}
+		json.Unmarshal(recorder.Body.Bytes(), got)
+		if !reflect.DeepEqual(*got, UserView{Username: "test1", FirstName: "lou", LastName: "gar"}) {
+			t.Errorf("handler returned unexpected user: got %+v", got)
+		}
+		// Responses never carry the password, so the stored hash is checked
+		// directly.
+		stored, _ := userService.store.FindUser(context.Background(), "test1")
+		if !verifyPassword(stored.Password, "pass") {
+			t.Errorf("password not stored as a hash of the one sent: %q", stored.Password)
 		}
 	})
 
@@ -182,7 +228,8 @@ func TestHandlers(t *testing.T) {
 		defer teardownHandlers(userService)
 		user := &User{Username: "test", Password: "pass", FirstName: "lou", LastName: "gar"}
 		userJson, err := json.Marshal(user)
-		request, err := http.NewRequest("PUT", "/users/test", bytes.NewBuffer(userJson))
+		self := WithCaller(context.Background(), Caller{Username: "test", Role: RoleUser})
+		request, err := http.NewRequestWithContext(self, "PUT", "/users/test", bytes.NewBuffer(userJson))
 		request.Header.Set("Content-Type", "application/json")
 		if err != nil {
 			t.Fatal(err)
@@ -215,21 +262,29 @@ func TestHandlers(t *testing.T) {
 
 		handler.ServeHTTP(recorder, request)
 
-		expected = `{"user-name":"test","password":"pass","first-name":"lou","last-name":"gar","email":""}`
-		if recorder.Body.String() != expected {
-			t.Errorf("handler returned unexpected body: got %v want %v",
-				recorder.Body.String(), expected)
+		got := &UserView{}
+		json.Unmarshal(recorder.Body.Bytes(), got)
+		if !reflect.DeepEqual(*got, UserView{Username: "test", FirstName: "lou", LastName: "gar"}) {
+			t.Errorf("handler returned unexpected user: got %+v", got)
+		}
+		// Responses never carry the password, so the stored hash is checked
+		// directly.
+		stored, _ := userService.store.FindUser(context.Background(), "test")
+		if !verifyPassword(stored.Password, "pass") {
+			t.Errorf("password not stored as a hash of the one sent: %q", stored.Password)
 		}
 	})
 
 	t.Run("test renderResponse returns json if content-type is json", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
 
-		userList := []User{{Username: "lou"}}
+		userList := []UserView{{Username: "lou"}}
 		response := httptest.NewRecorder()
 		response.Header().Set("Content-Type", "application/json")
-		renderResponse(response, userList, "")
+		userService.renderResponse(response, httptest.NewRequest("GET", "/users", nil), userList, "")
 
-		expected := `[{"user-name":"lou","password":"","first-name":"","last-name":"","email":""}]`
+		expected := `[{"user-name":"lou","first-name":"","last-name":""}]`
 		if response.Body.String() != expected {
 			t.Errorf("handler returned unexpected body: got %v want %v",
 				response.Body.String(), expected)
@@ -238,12 +293,17 @@ func TestHandlers(t *testing.T) {
 
 	t.Run("test renderResponse returns json if content-type is not json", func(t *testing.T) {
 
-		os.WriteFile("user.tmpl", []byte("<html>"), 0755)
-		defer os.Remove("user.tmpl")
+		layout := fstest.MapFS{"layout.html": {Data: []byte(`{{template "content" .}}`)}}
+		pages := fstest.MapFS{"user.html": {Data: []byte(`{{define "title"}}{{end}}{{define "content"}}<html>{{end}}`)}}
+		renderer, err := view.NewRenderer(layout, pages, nil, false)
+		if err != nil {
+			t.Fatalf("failed to parse templates: %s", err)
+		}
+		userService := NewUserService(nil, renderer)
 		userList := []User{{Username: "lou"}}
 		response := httptest.NewRecorder()
 		response.Header().Set("Content-Type", "application/text")
-		renderResponse(response, userList, "user.tmpl")
+		userService.renderResponse(response, httptest.NewRequest("GET", "/users", nil), userList, "user.html")
 
 		expected := "<html>"
 		if response.Body.String() != expected {
@@ -251,4 +311,948 @@ func TestHandlers(t *testing.T) {
 				response.Body.String(), expected)
 		}
 	})
+
+	t.Run("listUsers traces the handler, service and repository", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		exporter := &recordingExporter{}
+		tracing.SetTracer(tracing.NewTracer(exporter))
+		defer tracing.SetTracer(tracing.NewTracer(nil))
+
+		request, err := http.NewRequest("GET", "/users", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Content-Type", "application/json")
+		handler := tracing.Middleware(http.HandlerFunc(userService.ServeHTTP), func(request *http.Request) string {
+			return "HTTP GET /users"
+		})
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+
+		expected := []string{"userRepository.ListAll", "UserService.ListAllUsers", "renderResponse", "HTTP GET /users"}
+		if len(exporter.names) != len(expected) {
+			t.Fatalf("unexpected spans: got %v want %v", exporter.names, expected)
+		}
+		for i, name := range expected {
+			if exporter.names[i] != name {
+				t.Errorf("unexpected span: got %v want %v", exporter.names[i], name)
+			}
+			if exporter.spans[i].SpanContext.TraceID != exporter.spans[0].SpanContext.TraceID {
+				t.Errorf("span %s is not in the request trace", name)
+			}
+		}
+	})
+
+	t.Run("canceled requests map to 499 and timeouts to 503", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		request, err := http.NewRequestWithContext(ctx, "GET", "/users/test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		userService.ServeHTTP(recorder, request)
+		if recorder.Code != StatusClientClosedRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", recorder.Code, StatusClientClosedRequest)
+		}
+
+		ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+		request, err = http.NewRequestWithContext(ctx, "GET", "/users", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder = httptest.NewRecorder()
+		userService.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusServiceUnavailable {
+			t.Errorf("handler returned wrong status code: got %v want %v", recorder.Code, http.StatusServiceUnavailable)
+		}
+	})
+
+	t.Run("listUsers renders the embedded list page inside the layout", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		request, err := http.NewRequest("GET", "/users", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		userService.ServeHTTP(recorder, request)
+
+		if status := recorder.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		body := recorder.Body.String()
+		if !strings.Contains(body, "<title>User List</title>") || !strings.Contains(body, `<a href="/users/test">test</a>`) {
+			t.Errorf("handler returned unexpected body: %s", body)
+		}
+	})
+
+	t.Run("html pages escape user supplied values", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		err := userService.AddUser(context.Background(), &User{Username: "xss", Password: "password-1", FirstName: "<script>alert(1)</script>", LastName: `"><img src=x>`})
+		if err != nil {
+			t.Fatalf("error adding user: %s", err)
+		}
+
+		for _, path := range []string{"/users", "/users/xss"} {
+			request, err := http.NewRequest("GET", path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorder := httptest.NewRecorder()
+			userService.ServeHTTP(recorder, request)
+
+			body := recorder.Body.String()
+			if strings.Contains(body, "<script>alert(1)</script>") || strings.Contains(body, "<img src=x>") {
+				t.Errorf("%s rendered markup unescaped: %s", path, body)
+			}
+			if !strings.Contains(body, "&lt;script&gt;alert(1)&lt;/script&gt;") {
+				t.Errorf("%s did not render the escaped first name: %s", path, body)
+			}
+		}
+	})
+
+	t.Run("inline scripts carry the request nonce", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		request, err := http.NewRequest("GET", "/users/test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request = request.WithContext(view.WithNonce(request.Context(), "abc123"))
+
+		recorder := httptest.NewRecorder()
+		userService.ServeHTTP(recorder, request)
+
+		if !strings.Contains(recorder.Body.String(), `<script nonce="abc123">`) {
+			t.Errorf("script is missing the nonce: %s", recorder.Body.String())
+		}
+	})
+
+	t.Run("deleting a user leaves a flash for the next page", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		admin := WithCaller(context.Background(), Caller{Username: "boss", Role: RoleAdmin})
+		request, err := http.NewRequestWithContext(admin, "DELETE", "/users/test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		userService.ServeHTTP(recorder, request)
+
+		request, err = http.NewRequest("GET", "/users", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cookie := range recorder.Result().Cookies() {
+			request.AddCookie(cookie)
+		}
+		recorder = httptest.NewRecorder()
+		userService.ServeHTTP(recorder, request)
+
+		if !strings.Contains(recorder.Body.String(), "test was deleted") {
+			t.Errorf("flash message not rendered: %s", recorder.Body.String())
+		}
+	})
+
+	t.Run("deleting a user through the API sets no flash", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		admin := WithCaller(context.Background(), Caller{Username: "boss", Role: RoleAdmin})
+		request, err := http.NewRequestWithContext(admin, "DELETE", "/users/test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		userService.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("got %d want %d", recorder.Code, http.StatusOK)
+		}
+		if cookies := recorder.Result().Cookies(); len(cookies) != 0 {
+			t.Errorf("got cookies %v want none", cookies)
+		}
+	})
+
+	t.Run("only the user or an admin may change a user and only an admin delete one", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		before, _ := userService.store.FindUser(context.Background(), "test")
+
+		send := func(caller Caller, method string, body string) int {
+			request, err := http.NewRequestWithContext(WithCaller(context.Background(), caller), method, "/users/test", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Content-Type", "application/json")
+			recorder := httptest.NewRecorder()
+			userService.ServeHTTP(recorder, request)
+			return recorder.Code
+		}
+		update := `{"user-name":"test","password":"hijacked-pass-9"}`
+		cases := []struct {
+			caller Caller
+			method string
+			want   int
+		}{
+			{Caller{}, "PUT", http.StatusUnauthorized},
+			{Caller{Username: "other", Role: RoleUser}, "PUT", http.StatusForbidden},
+			{Caller{}, "DELETE", http.StatusUnauthorized},
+			{Caller{Username: "other", Role: RoleUser}, "DELETE", http.StatusForbidden},
+			{Caller{Username: "test", Role: RoleUser}, "DELETE", http.StatusForbidden},
+		}
+		for _, c := range cases {
+			if got := send(c.caller, c.method, update); got != c.want {
+				t.Errorf("got %d for %s by %+v want %d", got, c.method, c.caller, c.want)
+			}
+		}
+		after, _ := userService.store.FindUser(context.Background(), "test")
+		if after.Username != "test" || after.Password != before.Password {
+			t.Fatalf("refused requests changed the user: %+v", after)
+		}
+
+		if got := send(Caller{Username: "boss", Role: RoleAdmin}, "PUT", update); got != http.StatusOK {
+			t.Errorf("got %d for an admin's PUT want %d", got, http.StatusOK)
+		}
+	})
+
+	t.Run("POST /users/import is for admins and returns a report, 422 when rows failed", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		mux := http.NewServeMux()
+		userService.AddHandlersToMux(mux)
+
+		caller := Caller{Role: RoleAdmin}
+		post := func(url string, contentType string, body string) *httptest.ResponseRecorder {
+			request, err := http.NewRequestWithContext(WithCaller(context.Background(), caller), "POST", url, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Content-Type", contentType)
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		recorder := post("/users/import?map=login:user-name", "text/csv", "login,email,password\nimported,imported@mail.com,secret-1\n")
+		report := &ImportReport{}
+		json.Unmarshal(recorder.Body.Bytes(), report)
+		if recorder.Code != http.StatusOK || !report.Committed || report.Created != 1 {
+			t.Errorf("got %d %s want 200 and one created user", recorder.Code, recorder.Body.String())
+		}
+
+		recorder = post("/users/import", "application/x-ndjson", `{"user-name":"imported"}`+"\n")
+		report = &ImportReport{}
+		json.Unmarshal(recorder.Body.Bytes(), report)
+		if recorder.Code != http.StatusUnprocessableEntity || report.Committed || report.Rows[0].Error == "" {
+			t.Errorf("got %d %s want 422 with the reason", recorder.Code, recorder.Body.String())
+		}
+
+		recorder = post("/users/import", "text/plain", "imported")
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("got %d for an unknown format want %d", recorder.Code, http.StatusBadRequest)
+		}
+
+		before, _ := userService.store.FindUser(context.Background(), "test")
+		for _, caller = range []Caller{{}, {Username: "test", Role: RoleUser}} {
+			recorder = post("/users/import?mode=upsert", "text/csv", "user-name,password\ntest,hijacked-pass-9\nsneaked-in,sneaked-pass-9\n")
+			if recorder.Code != http.StatusForbidden {
+				t.Errorf("got %d for %+v want %d", recorder.Code, caller, http.StatusForbidden)
+			}
+		}
+		after, _ := userService.store.FindUser(context.Background(), "test")
+		sneaked, _ := userService.store.FindUser(context.Background(), "sneaked-in")
+		if after.Password != before.Password || sneaked.Username != "" {
+			t.Errorf("import applied for a caller who is not an admin")
+		}
+	})
+
+	t.Run("GET /users/export streams a download and rejects unknown formats", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		mux := http.NewServeMux()
+		userService.AddHandlersToMux(mux)
+
+		ctx := WithCaller(context.Background(), Caller{Role: RoleAdmin})
+		request, err := http.NewRequestWithContext(ctx, "GET", "/users/export?format=csv&fields=user-name,email&domain=mail.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		expected := "user-name,email\ntest,louis@mail.com\n"
+		if recorder.Code != http.StatusOK || recorder.Body.String() != expected {
+			t.Errorf("got %d %q want 200 %q", recorder.Code, recorder.Body.String(), expected)
+		}
+		if recorder.Header().Get("Content-Disposition") != `attachment; filename="users.csv"` {
+			t.Errorf("not offered as a download: %v", recorder.Header())
+		}
+
+		for _, url := range []string{"/users/export?format=xml", "/users/export?fields=password"} {
+			request, err = http.NewRequest("GET", url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorder = httptest.NewRecorder()
+			mux.ServeHTTP(recorder, request)
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("got %d for %s want %d", recorder.Code, url, http.StatusBadRequest)
+			}
+		}
+	})
+
+	t.Run("no endpoint returns password material to any caller", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		mux := http.NewServeMux()
+		userService.AddHandlersToMux(mux)
+		ctx := context.Background()
+
+		secret := "correct-horse-1"
+		err := userService.AddUser(ctx, &User{Username: "victim", Password: secret, Email: "victim@mail.com"})
+		if err != nil {
+			t.Fatalf("error adding user: %s", err)
+		}
+		stored, _ := userService.store.FindUser(ctx, "victim")
+		// The setup user's password "pwd" is stored as it is, so it is
+		// looked for too.
+		forbidden := []string{secret, stored.Password, strings.Split(stored.Password, "$")[2], "pbkdf2", `"password"`, `"pwd"`, ":pwd"}
+
+		type call struct {
+			method      string
+			url         string
+			contentType string
+			body        string
+		}
+		calls := []call{
+			{"GET", "/users", "application/json", ""},
+			{"GET", "/users", "", ""},
+			{"GET", "/users?search=victim", "application/json", ""},
+			{"GET", "/users/victim", "application/json", ""},
+			{"GET", "/users/victim", "", ""},
+			{"GET", "/users/test", "application/json", ""},
+			{"GET", "/users/export?format=json", "", ""},
+			{"GET", "/users/export?format=ndjson", "", ""},
+			{"GET", "/users/export?format=csv", "", ""},
+			{"GET", "/users/export?format=yaml", "", ""},
+			{"GET", "/users/export?fields=user-name,password", "", ""},
+			{"POST", "/users/import?dry-run=true", "text/csv", "user-name,password\nvictim," + secret + "\nnew-user," + secret + "\n"},
+			{"POST", "/users/import?mode=upsert&dry-run=true", "application/x-ndjson", `{"user-name":"victim","password":"` + secret + `"}` + "\n"},
+			{"POST", "/users", "application/json", `{"user-name":"victim","password":"` + secret + `"}`},
+			{"PUT", "/users/victim", "application/json", `{"user-name":"victim","password":"` + secret + `","email":"victim@mail.com"}`},
+			{"POST", "/login", "application/json", `{"username":"victim","password":"` + secret + `"}`},
+			{"POST", "/login", "application/json", `{"username":"victim","password":"wrong-` + secret + `"}`},
+			{"DELETE", "/users/victim", "", ""},
+		}
+		callers := []Caller{{}, {Username: "victim", Role: RoleUser}, {Username: "other", Role: RoleUser}, {Username: "boss", Role: RoleAdmin}}
+
+		for _, caller := range callers {
+			for _, call := range calls {
+				request, err := http.NewRequestWithContext(WithCaller(ctx, caller), call.method, call.url, strings.NewReader(call.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if call.contentType != "" {
+					request.Header.Set("Content-Type", call.contentType)
+				}
+				recorder := httptest.NewRecorder()
+				mux.ServeHTTP(recorder, request)
+
+				for _, value := range forbidden {
+					if strings.Contains(recorder.Body.String(), value) {
+						t.Errorf("%s %s as %+v returned %q in: %s", call.method, call.url, caller, value, recorder.Body.String())
+					}
+				}
+			}
+			userService.AddUser(ctx, &User{Username: "victim", Password: secret, Email: "victim@mail.com"})
+		}
+	})
+
+	t.Run("password reset pages do not reveal accounts and set the password", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		mailer := &recordingMailer{}
+		userService.SetMailer(mailer)
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{
+			Server:   config.ServerConfig{PublicURL: "https://users.example.com"},
+			Password: config.PasswordConfig{MinLength: 8, ResetTokenTTL: time.Hour},
+		})
+		mux := http.NewServeMux()
+		userService.AddHandlersToMux(mux)
+		post := func(url string, form url.Values) *httptest.ResponseRecorder {
+			request, err := http.NewRequest("POST", url, strings.NewReader(form.Encode()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		existing := post("/password/forgot", url.Values{"login": {"test"}})
+		missing := post("/password/forgot", url.Values{"login": {"nobody"}})
+		if existing.Code != missing.Code || existing.Body.String() != missing.Body.String() {
+			t.Errorf("responses differ for an existing and a missing account: %d %q and %d %q", existing.Code, existing.Body.String(), missing.Code, missing.Body.String())
+		}
+		userService.Wait()
+		if len(mailer.messages) != 1 {
+			t.Fatalf("got %d emails want 1", len(mailer.messages))
+		}
+		token := linkToken(t, mailer.messages[0], "/password/reset")
+
+		request, err := http.NewRequest("GET", "/password/reset?token=wrong", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "invalid or has expired") {
+			t.Errorf("got %d for an unknown token want %d and an explanation", recorder.Code, http.StatusBadRequest)
+		}
+
+		recorder = post("/password/reset", url.Values{"token": {token}, "password": {"new-password"}, "confirm": {"typo-password"}})
+		if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "does not match") {
+			t.Errorf("got %d for mismatched passwords want %d", recorder.Code, http.StatusBadRequest)
+		}
+		recorder = post("/password/reset", url.Values{"token": {token}, "password": {"new-password"}, "confirm": {"new-password"}})
+		if recorder.Code != http.StatusSeeOther {
+			t.Fatalf("got %d %s setting the password want %d", recorder.Code, recorder.Body.String(), http.StatusSeeOther)
+		}
+		stored, _ := userService.store.FindUser(context.Background(), "test")
+		if !verifyPassword(stored.Password, "new-password") {
+			t.Error("password not changed")
+		}
+	})
+
+	t.Run("logging in sets a session that identifies the caller until logout", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{
+			Server:   config.ServerConfig{PublicURL: "https://users.example.com"},
+			Password: config.PasswordConfig{MinLength: 8},
+			Session:  config.SessionConfig{TTL: time.Hour},
+		})
+		userService.AddUser(context.Background(), &User{Username: "amy", Password: "password-1", Email: "amy@example.com"})
+		mux := http.NewServeMux()
+		userService.AddHandlersToMux(mux)
+		handler := userService.Identify(mux)
+		send := func(method string, url string, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+			request, err := http.NewRequest(method, url, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			for _, cookie := range cookies {
+				request.AddCookie(cookie)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		recorder := send("POST", "/login", "username=amy&password=wrong-password")
+		if recorder.Code != http.StatusUnauthorized || !strings.Contains(recorder.Body.String(), "wrong username or password") {
+			t.Errorf("got %d for a wrong password want %d and the form again", recorder.Code, http.StatusUnauthorized)
+		}
+		recorder = send("POST", "/login", "username=amy&password=password-1")
+		cookies := recorder.Result().Cookies()
+		if recorder.Code != http.StatusSeeOther || len(cookies) != 1 || !cookies[0].HttpOnly || !cookies[0].Secure || cookies[0].SameSite != http.SameSiteLaxMode {
+			t.Fatalf("got %d and cookies %+v logging in want a redirect and a secure session cookie", recorder.Code, cookies)
+		}
+
+		recorder = send("GET", "/users/amy", "", cookies[0])
+		if !strings.Contains(recorder.Body.String(), "amy@example.com") || !strings.Contains(recorder.Body.String(), "not verified") {
+			t.Errorf("amy's own page does not show her unverified email: %s", recorder.Body.String())
+		}
+
+		recorder = send("POST", "/logout", "", cookies[0])
+		if recorder.Code != http.StatusSeeOther {
+			t.Errorf("got %d logging out want %d", recorder.Code, http.StatusSeeOther)
+		}
+		recorder = send("GET", "/users/amy", "", cookies[0])
+		if strings.Contains(recorder.Body.String(), "amy@example.com") {
+			t.Error("the session still works after logging out")
+		}
+	})
+
+	t.Run("verification pages confirm only through a POST and resend the same way for anyone", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		mailer := &recordingMailer{}
+		userService.SetMailer(mailer)
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{
+			Server:            config.ServerConfig{PublicURL: "https://users.example.com"},
+			EmailVerification: config.EmailVerificationConfig{TokenTTL: time.Hour},
+		})
+		mux := http.NewServeMux()
+		userService.AddHandlersToMux(mux)
+		send := func(method string, url string, form url.Values) *httptest.ResponseRecorder {
+			request, err := http.NewRequest(method, url, strings.NewReader(form.Encode()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		existing := send("POST", "/email/verify/resend", url.Values{"login": {"test"}})
+		missing := send("POST", "/email/verify/resend", url.Values{"login": {"nobody"}})
+		if existing.Code != missing.Code || existing.Body.String() != missing.Body.String() {
+			t.Errorf("responses differ for an existing and a missing account: %d %q and %d %q", existing.Code, existing.Body.String(), missing.Code, missing.Body.String())
+		}
+		userService.Wait()
+		if len(mailer.messages) != 1 {
+			t.Fatalf("got %d emails want 1", len(mailer.messages))
+		}
+		token := linkToken(t, mailer.messages[0], "/email/verify")
+
+		recorder := send("GET", "/email/verify?token="+token, nil)
+		stored, _ := userService.store.FindUser(context.Background(), "test")
+		if recorder.Code != http.StatusOK || stored.EmailVerified {
+			t.Fatalf("got %d and verified %v opening the link want the confirm page and nothing changed", recorder.Code, stored.EmailVerified)
+		}
+		recorder = send("POST", "/email/verify", url.Values{"token": {token}})
+		stored, _ = userService.store.FindUser(context.Background(), "test")
+		if recorder.Code != http.StatusSeeOther || !stored.EmailVerified {
+			t.Errorf("got %d and verified %v confirming want a redirect and the address verified", recorder.Code, stored.EmailVerified)
+		}
+		recorder = send("POST", "/email/verify", url.Values{"token": {token}})
+		if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "invalid or has expired") {
+			t.Errorf("got %d reusing the link want %d and an explanation", recorder.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("signing up waits in the approvals queue only admins can see", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		defer config.SetConfig(config.GetConfig())
+		settings := &config.Config{
+			Password: config.PasswordConfig{MinLength: 8},
+			Signup:   config.SignupConfig{Mode: "approval"},
+		}
+		config.SetConfig(settings)
+		mux := http.NewServeMux()
+		userService.AddHandlersToMux(mux)
+		send := func(caller Caller, method string, url string, contentType string, body string) *httptest.ResponseRecorder {
+			request, err := http.NewRequestWithContext(WithCaller(context.Background(), caller), method, url, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Content-Type", contentType)
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, request)
+			return recorder
+		}
+		form := "application/x-www-form-urlencoded"
+		admin := Caller{Username: "boss", Role: RoleAdmin}
+
+		recorder := send(Caller{}, "POST", "/signup", form, "user-name=amy&email=amy%40example.com&password=password-1&confirm=password-2")
+		if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "does not match") || !strings.Contains(recorder.Body.String(), "amy@example.com") {
+			t.Errorf("got %d for mismatched passwords want %d and the form filled in again", recorder.Code, http.StatusBadRequest)
+		}
+		recorder = send(Caller{}, "POST", "/signup", form, "user-name=amy&email=amy%40example.com&password=password-1&confirm=password-1")
+		if recorder.Code != http.StatusSeeOther {
+			t.Fatalf("got %d %s signing up want %d", recorder.Code, recorder.Body.String(), http.StatusSeeOther)
+		}
+		recorder = send(Caller{}, "POST", "/users", "application/json", `{"user-name":"bob","password":"password-1"}`)
+		if recorder.Code != http.StatusAccepted {
+			t.Errorf("got %d for an anonymous POST /users want %d", recorder.Code, http.StatusAccepted)
+		}
+
+		for _, caller := range []Caller{{}, {Username: "amy", Role: RoleUser}} {
+			if recorder = send(caller, "GET", "/approvals", "application/json", ""); recorder.Code != http.StatusForbidden {
+				t.Errorf("got %d for the queue as %+v want %d", recorder.Code, caller, http.StatusForbidden)
+			}
+		}
+		recorder = send(admin, "GET", "/approvals", "application/json", "")
+		expected := `[{"user-name":"amy","first-name":"","last-name":"","email":"amy@example.com","role":"user","status":"pending"},` +
+			`{"user-name":"bob","first-name":"","last-name":"","role":"user","status":"pending"}]`
+		if recorder.Body.String() != expected {
+			t.Errorf("got %s want %s", recorder.Body.String(), expected)
+		}
+
+		recorder = send(admin, "POST", "/approvals", form, "username=amy&decision=approve")
+		amy, _ := userService.store.FindUser(context.Background(), "amy")
+		if recorder.Code != http.StatusSeeOther || amy.Status != StatusActive {
+			t.Errorf("got %d and %q approving want a redirect and amy active", recorder.Code, amy.Status)
+		}
+		if recorder = send(admin, "POST", "/approvals", form, "username=amy&decision=reject"); recorder.Code != http.StatusNotFound {
+			t.Errorf("got %d rejecting an approved user want %d", recorder.Code, http.StatusNotFound)
+		}
+
+		settings.Signup.Mode = "invite-only"
+		if recorder = send(Caller{}, "POST", "/users", "application/json", `{"user-name":"carl","password":"password-1"}`); recorder.Code != http.StatusForbidden {
+			t.Errorf("got %d for an anonymous POST /users when invite-only want %d", recorder.Code, http.StatusForbidden)
+		}
+		if recorder = send(admin, "POST", "/users", "application/json", `{"user-name":"carl","password":"password-1"}`); recorder.Code != http.StatusOK {
+			t.Errorf("got %d for an admin POST /users when invite-only want %d", recorder.Code, http.StatusOK)
+		}
+	})
+
+	t.Run("admins invite through the form and invitees pick their username on the accept page", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		mailer := &recordingMailer{}
+		userService.SetMailer(mailer)
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{
+			Server:      config.ServerConfig{PublicURL: "https://users.example.com"},
+			Password:    config.PasswordConfig{MinLength: 8},
+			Invitations: config.InvitationConfig{TTL: time.Hour, SigningKey: "test key"},
+		})
+		mux := http.NewServeMux()
+		userService.AddHandlersToMux(mux)
+		send := func(caller Caller, method string, url string, contentType string, body string) *httptest.ResponseRecorder {
+			request, err := http.NewRequestWithContext(WithCaller(context.Background(), caller), method, url, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Content-Type", contentType)
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, request)
+			return recorder
+		}
+		form := "application/x-www-form-urlencoded"
+		admin := Caller{Username: "boss", Role: RoleAdmin}
+
+		for _, caller := range []Caller{{}, {Username: "amy", Role: RoleUser}} {
+			if recorder := send(caller, "POST", "/invitations", form, "email=eve%40example.com"); recorder.Code != http.StatusForbidden {
+				t.Errorf("got %d inviting as %+v want %d", recorder.Code, caller, http.StatusForbidden)
+			}
+		}
+		recorder := send(admin, "POST", "/invitations", form, "email=amy%40example.com&role=admin&groups=ops")
+		if recorder.Code != http.StatusSeeOther || len(mailer.messages) != 1 {
+			t.Fatalf("got %d %s and %d emails inviting want %d and one", recorder.Code, recorder.Body.String(), len(mailer.messages), http.StatusSeeOther)
+		}
+		recorder = send(admin, "GET", "/invitations", "", "")
+		if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "amy@example.com") || !strings.Contains(recorder.Body.String(), "Revoke") {
+			t.Errorf("got %d %s want the invitation listed with actions", recorder.Code, recorder.Body.String())
+		}
+
+		token := linkToken(t, mailer.messages[0], "/invitations/accept")
+		recorder = send(Caller{}, "GET", "/invitations/accept?token="+token, "", "")
+		if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "amy@example.com") {
+			t.Errorf("got %d %s want the accept form for amy@example.com", recorder.Code, recorder.Body.String())
+		}
+		if recorder = send(Caller{}, "GET", "/invitations/accept?token=forged", "", ""); recorder.Code != http.StatusBadRequest {
+			t.Errorf("got %d for a forged link want %d", recorder.Code, http.StatusBadRequest)
+		}
+		recorder = send(Caller{}, "POST", "/invitations/accept", form, "token="+token+"&user-name=amy&password=password-1&confirm=password-2")
+		if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "does not match") {
+			t.Errorf("got %d for mismatched passwords want %d", recorder.Code, http.StatusBadRequest)
+		}
+		recorder = send(Caller{}, "POST", "/invitations/accept", form, "token="+token+"&user-name=amy&password=password-1&confirm=password-1")
+		if recorder.Code != http.StatusSeeOther || recorder.Header().Get("Location") != "/login" {
+			t.Fatalf("got %d %s accepting want a redirect to /login", recorder.Code, recorder.Body.String())
+		}
+		amy, _ := userService.store.FindUser(context.Background(), "amy")
+		if amy.Role != RoleAdmin || !amy.Groups.Contains("ops") {
+			t.Errorf("got %+v want the invited role and groups", amy)
+		}
+
+		recorder = send(admin, "GET", "/invitations", "application/json", "")
+		var listed []Invitation
+		err := json.Unmarshal(recorder.Body.Bytes(), &listed)
+		if err != nil || len(listed) != 1 || listed[0].InvitedBy != "boss" || listed[0].AcceptedBy != "amy" {
+			t.Errorf("got %s, %v want boss's invitation accepted by amy", recorder.Body.String(), err)
+		}
+		if recorder = send(admin, "POST", "/invitations/revoke", "application/json", `{"id":"`+listed[0].ID+`"}`); recorder.Code != http.StatusNotFound {
+			t.Errorf("got %d revoking an accepted invitation want %d", recorder.Code, http.StatusNotFound)
+		}
+	})
+
+	t.Run("two-factor setup, login challenges and turning it off go through the pages", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{
+			Password:  config.PasswordConfig{MinLength: 8},
+			Session:   config.SessionConfig{TTL: time.Hour},
+			TwoFactor: config.TwoFactorConfig{Issuer: "user-app", EncryptionKey: "test key"},
+		})
+		ctx := context.Background()
+		userService.AddUser(ctx, &User{Username: "amy", Password: "password-1"})
+		mux := http.NewServeMux()
+		userService.AddHandlersToMux(mux)
+		handler := userService.Identify(mux)
+		send := func(caller Caller, method string, url string, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+			request, err := http.NewRequestWithContext(WithCaller(ctx, caller), method, url, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			for _, cookie := range cookies {
+				request.AddCookie(cookie)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		if recorder := send(Caller{}, "GET", "/2fa", ""); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("got %d for /2fa logged out want %d", recorder.Code, http.StatusUnauthorized)
+		}
+		session := send(Caller{}, "POST", "/login", "username=amy&password=password-1").Result().Cookies()
+		if len(session) != 1 {
+			t.Fatalf("got cookies %+v logging in want a session", session)
+		}
+
+		recorder := send(Caller{}, "POST", "/2fa/setup", "", session...)
+		setup, _ := userService.PendingTwoFactor(ctx, "amy")
+		if recorder.Code != http.StatusOK || setup == nil || !strings.Contains(recorder.Body.String(), "<svg") || !strings.Contains(recorder.Body.String(), setup.Secret) {
+			t.Fatalf("got %d %s setting up want the QR code and secret", recorder.Code, recorder.Body.String())
+		}
+		for format, contentType := range map[string]string{"png": "image/png", "svg": "image/svg+xml"} {
+			recorder = send(Caller{}, "GET", "/2fa/qr?format="+format, "", session...)
+			if recorder.Header().Get("Content-Type") != contentType || recorder.Header().Get("Cache-Control") != "no-store" || recorder.Body.Len() == 0 {
+				t.Errorf("got %d %v for the %s QR code", recorder.Code, recorder.Header(), format)
+			}
+		}
+		if recorder = send(Caller{}, "POST", "/2fa/enable", "code=abcdef", session...); recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "<svg") {
+			t.Errorf("got %d for a wrong code want %d and the setup again", recorder.Code, http.StatusBadRequest)
+		}
+		recorder = send(Caller{}, "POST", "/2fa/enable", "code="+appCode(t, setup, 0), session...)
+		if recorder.Code != http.StatusOK || strings.Count(recorder.Body.String(), "<code>") != recoveryCodeCount {
+			t.Fatalf("got %d %s confirming want the recovery codes", recorder.Code, recorder.Body.String())
+		}
+
+		recorder = send(Caller{}, "POST", "/login", "username=amy&password=password-1")
+		challenge := regexp.MustCompile(`name="challenge" value="([^"]+)"`).FindStringSubmatch(recorder.Body.String())
+		if recorder.Code != http.StatusOK || len(recorder.Result().Cookies()) != 0 || challenge == nil {
+			t.Fatalf("got %d %s logging in want the code form and no session yet", recorder.Code, recorder.Body.String())
+		}
+		form := "challenge=" + url.QueryEscape(challenge[1]) + "&code="
+		if recorder = send(Caller{}, "POST", "/login/2fa", form+"abcdef"); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("got %d for a wrong code want %d", recorder.Code, http.StatusUnauthorized)
+		}
+		recorder = send(Caller{}, "POST", "/login/2fa", form+appCode(t, setup, 1))
+		if recorder.Code != http.StatusSeeOther || len(recorder.Result().Cookies()) != 1 {
+			t.Fatalf("got %d %s for the right code want a redirect with a session", recorder.Code, recorder.Body.String())
+		}
+
+		if recorder = send(Caller{Username: "bob", Role: RoleUser}, "POST", "/2fa/disable", "username=amy"); recorder.Code != http.StatusForbidden {
+			t.Errorf("got %d turning off someone else's two-factor as a user want %d", recorder.Code, http.StatusForbidden)
+		}
+		if recorder = send(Caller{Username: "boss", Role: RoleAdmin}, "POST", "/2fa/disable", "username=amy"); recorder.Code != http.StatusSeeOther {
+			t.Errorf("got %d turning off amy's two-factor as an admin want %d", recorder.Code, http.StatusSeeOther)
+		}
+		if enabled, _ := userService.TwoFactorEnabled(ctx, "amy"); enabled {
+			t.Error("two-factor authentication is still on for amy")
+		}
+	})
+
+	t.Run("passkeys are added from their page and log in through JSON ceremonies", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{
+			Server:   config.ServerConfig{PublicURL: "https://users.example.com"},
+			Password: config.PasswordConfig{MinLength: 8},
+			Session:  config.SessionConfig{TTL: time.Hour},
+			Passkeys: config.PasskeyConfig{Name: "user-app", UserVerification: "required"},
+		})
+		ctx := context.Background()
+		userService.AddUser(ctx, &User{Username: "amy", Password: "password-1"})
+		mux := http.NewServeMux()
+		userService.AddHandlersToMux(mux)
+		handler := userService.Identify(mux)
+		send := func(contentType string, method string, url string, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+			request, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Content-Type", contentType)
+			for _, cookie := range cookies {
+				request.AddCookie(cookie)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			return recorder
+		}
+		const form, jsonType = "application/x-www-form-urlencoded", "application/json"
+		encode := func(value any) string {
+			data, _ := json.Marshal(value)
+			return string(data)
+		}
+
+		if recorder := send(jsonType, "POST", "/passkeys/register/begin", `{"name":"Laptop"}`); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("got %d registering logged out want %d", recorder.Code, http.StatusUnauthorized)
+		}
+		session := send(form, "POST", "/login", "username=amy&password=password-1").Result().Cookies()
+		recorder := send(jsonType, "POST", "/passkeys/register/begin", `{"name":"Laptop"}`, session...)
+		options := &webauthn.CreationOptions{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), options); recorder.Code != http.StatusOK || err != nil {
+			t.Fatalf("got %d %s starting registration", recorder.Code, recorder.Body.String())
+		}
+		authenticator := webauthntest.New("https://users.example.com")
+		created, err := authenticator.Create(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recorder = send(jsonType, "POST", "/passkeys/register/finish", encode(created), session...); recorder.Code != http.StatusCreated {
+			t.Fatalf("got %d %s finishing registration want %d", recorder.Code, recorder.Body.String(), http.StatusCreated)
+		}
+		recorder = send(form, "GET", "/passkeys", "", session...)
+		if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `value="Laptop"`) || !strings.Contains(recorder.Body.String(), "<script nonce") {
+			t.Errorf("got %d %s for the passkeys page want Laptop listed", recorder.Code, recorder.Body.String())
+		}
+
+		recorder = send(jsonType, "POST", "/login/passkey/begin", `{}`)
+		request := &webauthn.RequestOptions{}
+		json.Unmarshal(recorder.Body.Bytes(), request)
+		authenticator.UserVerified = false
+		assertion, _ := authenticator.Get(request)
+		if recorder = send(jsonType, "POST", "/login/passkey/finish", encode(assertion)); recorder.Code != http.StatusUnauthorized || len(recorder.Result().Cookies()) != 0 {
+			t.Errorf("got %d without user verification when it is required want %d", recorder.Code, http.StatusUnauthorized)
+		}
+		authenticator.UserVerified = true
+		recorder = send(jsonType, "POST", "/login/passkey/begin", `{"username":"amy"}`)
+		json.Unmarshal(recorder.Body.Bytes(), request)
+		assertion, _ = authenticator.Get(request)
+		recorder = send(jsonType, "POST", "/login/passkey/finish", encode(assertion))
+		if recorder.Code != http.StatusOK || len(recorder.Result().Cookies()) != 1 {
+			t.Fatalf("got %d %s logging in with the passkey want a session", recorder.Code, recorder.Body.String())
+		}
+		if recorder = send(form, "POST", "/login/passkey/finish", "not json"); recorder.Code != http.StatusBadRequest {
+			t.Errorf("got %d for a malformed credential want %d", recorder.Code, http.StatusBadRequest)
+		}
+
+		passkeys, _ := userService.Passkeys(ctx, "amy")
+		id := url.QueryEscape(passkeys[0].ID)
+		if recorder = send(form, "POST", "/passkeys/rename", "id="+id+"&name=Work", session...); recorder.Code != http.StatusSeeOther {
+			t.Errorf("got %d renaming want %d", recorder.Code, http.StatusSeeOther)
+		}
+		if recorder = send(form, "POST", "/passkeys/remove", "id=nope", session...); recorder.Code != http.StatusNotFound {
+			t.Errorf("got %d removing an unknown passkey want %d", recorder.Code, http.StatusNotFound)
+		}
+		if recorder = send(form, "POST", "/passkeys/remove", "id="+id, session...); recorder.Code != http.StatusSeeOther {
+			t.Errorf("got %d removing want %d", recorder.Code, http.StatusSeeOther)
+		}
+		if passkeys, _ = userService.Passkeys(ctx, "amy"); len(passkeys) != 0 {
+			t.Errorf("got %+v after removing want none", passkeys)
+		}
+	})
+
+	t.Run("locked out logins get 429 with Retry-After until an admin unlocks them", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{
+			Password: config.PasswordConfig{MinLength: 8},
+			Session:  config.SessionConfig{TTL: time.Hour},
+			Lockout:  config.LockoutConfig{MaxAttempts: 2, Duration: 15 * time.Minute},
+		})
+		userService.AddUser(context.Background(), &User{Username: "amy", Password: "password-1"})
+		mux := http.NewServeMux()
+		userService.AddHandlersToMux(mux)
+		send := func(caller Caller, method string, url string, contentType string, body string) *httptest.ResponseRecorder {
+			request, err := http.NewRequestWithContext(WithCaller(context.Background(), caller), method, url, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Content-Type", contentType)
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, request)
+			return recorder
+		}
+		form := "application/x-www-form-urlencoded"
+		admin := Caller{Username: "boss", Role: RoleAdmin}
+
+		if recorder := send(Caller{}, "POST", "/login", "application/json", `{"username":"amy","password":"wrong-password"}`); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("got %d for the first failure want %d", recorder.Code, http.StatusUnauthorized)
+		}
+		recorder := send(Caller{}, "POST", "/login", "application/json", `{"username":"amy","password":"wrong-password"}`)
+		if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "900" {
+			t.Errorf("got %d, Retry-After %q reaching the limit want %d, 900", recorder.Code, recorder.Header().Get("Retry-After"), http.StatusTooManyRequests)
+		}
+		recorder = send(Caller{}, "POST", "/login", form, "username=amy&password=password-1")
+		if recorder.Code != http.StatusTooManyRequests || !strings.Contains(recorder.Body.String(), "too many failed logins") {
+			t.Errorf("got %d for the login page while locked want %d and why", recorder.Code, http.StatusTooManyRequests)
+		}
+
+		recorder = send(admin, "GET", "/users/amy", "application/json", "")
+		if !strings.Contains(recorder.Body.String(), `"locked-until":`) {
+			t.Errorf("got %s for an admin want when the lockout ends", recorder.Body.String())
+		}
+		if recorder = send(admin, "GET", "/users/amy", "text/html", ""); !strings.Contains(recorder.Body.String(), `action="/users/unlock"`) {
+			t.Errorf("got no unlock button on the page for an admin")
+		}
+		if recorder = send(Caller{Username: "amy", Role: RoleUser}, "POST", "/users/unlock", form, "username=amy"); recorder.Code != http.StatusForbidden {
+			t.Errorf("got %d unlocking as a user want %d", recorder.Code, http.StatusForbidden)
+		}
+		if recorder = send(admin, "POST", "/users/unlock", form, "username=amy"); recorder.Code != http.StatusSeeOther {
+			t.Errorf("got %d unlocking as an admin want %d", recorder.Code, http.StatusSeeOther)
+		}
+		if recorder = send(Caller{}, "POST", "/login", form, "username=amy&password=password-1"); recorder.Code != http.StatusSeeOther {
+			t.Errorf("got %d logging in after the unlock want %d", recorder.Code, http.StatusSeeOther)
+		}
+	})
+
+	t.Run("admins see the audit log filtered through /audit and can verify it", func(t *testing.T) {
+		userService := setupHandlers(t)
+		defer teardownHandlers(userService)
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{Password: config.PasswordConfig{MinLength: 8}})
+		mux := http.NewServeMux()
+		userService.AddHandlersToMux(mux)
+		send := func(caller Caller, method string, url string, contentType string, body string) *httptest.ResponseRecorder {
+			request, err := http.NewRequestWithContext(WithCaller(context.Background(), caller), method, url, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Content-Type", contentType)
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, request)
+			return recorder
+		}
+		admin := Caller{Username: "boss", Role: RoleAdmin}
+
+		send(admin, "POST", "/users", "application/json", `{"user-name":"amy","password":"password-1"}`)
+		send(admin, "POST", "/users", "application/json", `{"user-name":"bob","password":"password-1"}`)
+		if recorder := send(admin, "DELETE", "/users/amy", "application/json", ""); recorder.Code != http.StatusOK {
+			t.Fatalf("got %d deleting amy want %d", recorder.Code, http.StatusOK)
+		}
+
+		if recorder := send(Caller{Username: "bob", Role: RoleUser}, "GET", "/audit", "application/json", ""); recorder.Code != http.StatusForbidden {
+			t.Errorf("got %d for the audit log as a user want %d", recorder.Code, http.StatusForbidden)
+		}
+		recorder := send(admin, "GET", "/audit?subject=amy&action=delete", "application/json", "")
+		var events []*AuditEvent
+		json.Unmarshal(recorder.Body.Bytes(), &events)
+		if recorder.Code != http.StatusOK || len(events) != 1 || events[0].Actor != "boss" || events[0].Subject != "amy" {
+			t.Errorf("got %d %s for amy's deletion want one event by boss", recorder.Code, recorder.Body.String())
+		}
+		if recorder = send(admin, "GET", "/audit?since=yesterday", "application/json", ""); recorder.Code != http.StatusBadRequest {
+			t.Errorf("got %d for a bad since want %d", recorder.Code, http.StatusBadRequest)
+		}
+		recorder = send(admin, "GET", "/audit?limit=2", "text/html", "")
+		if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "2 events") || !strings.Contains(recorder.Body.String(), "before=2") {
+			t.Errorf("got %d for the audit page want the 2 newest events and a link to older ones", recorder.Code)
+		}
+
+		recorder = send(admin, "POST", "/audit/verify", "application/json", "")
+		if recorder.Code != http.StatusOK || strings.TrimSpace(recorder.Body.String()) != `{"events":3,"valid":true}` {
+			t.Errorf("got %d %s verifying want all 3 events valid", recorder.Code, recorder.Body.String())
+		}
+	})
 }
@@ -0,0 +1,393 @@
+package user
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+	"github.com/letitloose/user-app/pkg/tracing"
+)
+
+// Import modes say what happens to a row whose user already exists.
+const (
+	ImportCreate       = "create"
+	ImportSkipExisting = "skip-existing"
+	ImportUpsert       = "upsert"
+)
+
+// ImportOptions controls ImportUsers. Format is csv, ndjson or yaml. Columns
+// maps CSV headers, or keys in the other formats, to user fields when they
+// are not already named like the JSON fields, e.g. "login" to "user-name".
+type ImportOptions struct {
+	Format            string
+	Mode              string
+	DryRun            bool
+	GeneratePasswords bool
+	Columns           map[string]string
+}
+
+// ImportRow reports what happened to one row. Row counts from 1, not
+// including a CSV header.
+type ImportRow struct {
+	Row               int    `json:"row"`
+	Username          string `json:"user-name"`
+	Result            string `json:"result"`
+	Error             string `json:"error,omitempty"`
+	GeneratedPassword string `json:"generated-password,omitempty"`
+}
+
+// ImportReport lists the outcome of every row. Imports are all or nothing:
+// Committed is false after a dry run or when any row failed, in which case
+// no user was changed and Created and Updated say what would have been.
+type ImportReport struct {
+	Committed bool        `json:"committed"`
+	Created   int         `json:"created"`
+	Updated   int         `json:"updated"`
+	Skipped   int         `json:"skipped"`
+	Failed    int         `json:"failed"`
+	Rows      []ImportRow `json:"rows"`
+}
+
+// FormatError is returned when an import cannot be read at all, as opposed
+// to rows in it being invalid, or an export asks for an unknown format or
+// field.
+type FormatError struct {
+	Message string
+}
+
+func (err *FormatError) Error() string {
+	return err.Message
+}
+
+// errImportRolledBack rolls the import transaction back when rows failed or
+// it is a dry run.
+var errImportRolledBack = errors.New("import rolled back")
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,255}$`)
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+// ImportUsers adds the users read from reader in one transaction. Every row
+// is validated and hashed as AddUser would, and the report says which rows
+// were created, updated, skipped or failed and why. Only parse errors that
+// stop the input being read at all are returned as an error.
+func (service *UserService) ImportUsers(ctx context.Context, reader io.Reader, options ImportOptions) (*ImportReport, error) {
+	ctx, span := tracing.Start(ctx, "UserService.ImportUsers")
+	defer span.End()
+
+	if options.Mode == "" {
+		options.Mode = ImportCreate
+	}
+	if options.Mode != ImportCreate && options.Mode != ImportSkipExisting && options.Mode != ImportUpsert {
+		return nil, &FormatError{Message: fmt.Sprintf("unknown import mode %q, expected create, skip-existing or upsert", options.Mode)}
+	}
+	records, err := readImport(reader, options.Format)
+	if err != nil {
+		span.RecordError(err)
+		return nil, &FormatError{Message: err.Error()}
+	}
+
+	report := &ImportReport{Rows: make([]ImportRow, len(records))}
+	users := make([]*User, len(records))
+	seen := map[string]int{}
+	for i, record := range records {
+		row := &report.Rows[i]
+		row.Row = i + 1
+		users[i], err = importUser(record, options.Columns)
+		if err == nil {
+			row.Username = users[i].Username
+			err = validateImport(users[i], seen, row.Row)
+		}
+		if err != nil {
+			row.Result, row.Error = "failed", err.Error()
+		}
+	}
+
+	newEmails := map[*User]string{}
+	befores := map[*User]*User{}
+	err = service.store.WithTx(ctx, nil, func(tx Store) error {
+		creates, updates := []*User{}, []*User{}
+		for i, user := range users {
+			row := &report.Rows[i]
+			if row.Result == "failed" {
+				continue
+			}
+			existing, newEmail, err := importWrite(ctx, tx, user, row, options)
+			if err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				row.Result, row.Error = "failed", err.Error()
+				continue
+			}
+			switch row.Result {
+			case "created":
+				creates = append(creates, user)
+				befores[user] = &User{}
+			case "updated":
+				updates = append(updates, user)
+				newEmails[user] = newEmail
+				befores[user] = existing
+			}
+		}
+
+		report.count()
+		if report.Failed > 0 || options.DryRun {
+			return errImportRolledBack
+		}
+		err := tx.AddUsers(ctx, creates)
+		if err == nil {
+			err = tx.UpdateUsers(ctx, updates)
+		}
+		for _, user := range updates {
+			if err == nil {
+				err = endSessions(ctx, tx, befores[user], user)
+			}
+		}
+		return err
+	})
+	if err == errImportRolledBack {
+		// Nothing was stored, so generated passwords are of no use.
+		for i := range report.Rows {
+			report.Rows[i].GeneratedPassword = ""
+		}
+		return report, nil
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("import").Inc()
+		return nil, err
+	}
+
+	report.Committed = true
+	usersCreated.Add(float64(report.Created))
+	usersUpdated.Add(float64(report.Updated))
+	for _, user := range users {
+		before, ok := befores[user]
+		if !ok {
+			continue
+		}
+		if before.Username == "" {
+			service.audit(ctx, AuditCreate, CallerFromContext(ctx).Username, user.Username, userChanges(before, user))
+		} else {
+			service.auditChange(ctx, before, user)
+		}
+	}
+	// Changed email addresses wait for confirmation as with UpdateUser. New
+	// users are not emailed, an import is not a signup, but can ask for a
+	// verification link themselves.
+	for user, newEmail := range newEmails {
+		service.confirmEmailChange(ctx, user, newEmail)
+	}
+	return report, nil
+}
+
+// importWrite decides what to do with a valid row, setting row.Result, and
+// hashes the password of a user that will be written. Passwords are only
+// generated for new users, existing ones keep theirs when the row has none.
+// An updated user keeps their email address until the new one it returns
+// is confirmed. The user as it was before is returned too, with an empty
+// Username for a new one.
+func importWrite(ctx context.Context, tx Store, user *User, row *ImportRow, options ImportOptions) (*User, string, error) {
+	existing, err := tx.FindUser(ctx, user.Username)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if existing.Username == "" {
+		if user.Password == "" && !options.GeneratePasswords {
+			return nil, "", errors.New("password is required for a new user unless passwords are generated")
+		}
+		if user.Password == "" {
+			user.Password, err = generatePassword()
+			if err != nil {
+				return nil, "", err
+			}
+			row.GeneratedPassword = user.Password
+		}
+		row.Result = "created"
+		return existing, "", setPassword(user)
+	}
+	switch options.Mode {
+	case ImportSkipExisting:
+		row.Result = "skipped"
+		return existing, "", nil
+	case ImportUpsert:
+		row.Result = "updated"
+		newEmail, err := prepareUpdate(ctx, tx, user)
+		return existing, newEmail, err
+	}
+	return nil, "", fmt.Errorf("user %s already exists", user.Username)
+}
+
+func (report *ImportReport) count() {
+	for _, row := range report.Rows {
+		switch row.Result {
+		case "created":
+			report.Created++
+		case "updated":
+			report.Updated++
+		case "skipped":
+			report.Skipped++
+		case "failed":
+			report.Failed++
+		}
+	}
+}
+
+func validateImport(user *User, seen map[string]int, row int) error {
+	if !usernamePattern.MatchString(user.Username) {
+		return fmt.Errorf("user-name must be 1 to 255 letters, digits, dots, dashes or underscores, got %q", user.Username)
+	}
+	if first, ok := seen[user.Username]; ok {
+		return fmt.Errorf("user %s is also on row %d", user.Username, first)
+	}
+	seen[user.Username] = row
+	if user.Email != "" && !emailPattern.MatchString(user.Email) {
+		return fmt.Errorf("email %q is not an email address", user.Email)
+	}
+	if user.Password != "" {
+		return checkPassword(user.Password)
+	}
+	return nil
+}
+
+// importFields maps the normalized names a column may have to the user
+// field it holds.
+var importFields = map[string]string{
+	"username":  "user-name",
+	"user":      "user-name",
+	"login":     "user-name",
+	"password":  "password",
+	"firstname": "first-name",
+	"lastname":  "last-name",
+	"email":     "email",
+	"mail":      "email",
+}
+
+func normalizeColumn(name string) string {
+	return strings.NewReplacer("-", "", "_", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(name)))
+}
+
+// importUser builds a user from record, whose keys are column names mapped
+// through columns or recognized by importFields.
+func importUser(record map[string]string, columns map[string]string) (*User, error) {
+	mapped := map[string]string{}
+	for column, field := range columns {
+		mapped[normalizeColumn(column)] = importFields[normalizeColumn(field)]
+	}
+
+	user := &User{}
+	for column, value := range record {
+		key := normalizeColumn(column)
+		field, ok := mapped[key]
+		if !ok {
+			field, ok = importFields[key]
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q", column)
+		}
+
+		value = strings.TrimSpace(value)
+		switch field {
+		case "user-name":
+			user.Username = value
+		case "password":
+			user.Password = value
+		case "first-name":
+			user.FirstName = value
+		case "last-name":
+			user.LastName = value
+		case "email":
+			user.Email = value
+		default:
+			return nil, fmt.Errorf("column %q is mapped to an unknown field", column)
+		}
+	}
+	return user, nil
+}
+
+// readImport parses every record of reader in format. Values are strings
+// keyed by column name whatever the format.
+func readImport(reader io.Reader, format string) ([]map[string]string, error) {
+	switch format {
+	case "csv":
+		return readCSV(reader)
+	case "ndjson", "jsonl":
+		return readNDJSON(reader)
+	case "yaml", "yml":
+		return readYAML(reader)
+	}
+	return nil, fmt.Errorf("unknown import format %q, expected csv, ndjson or yaml", format)
+}
+
+func readCSV(reader io.Reader) ([]map[string]string, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.TrimLeadingSpace = true
+	rows, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading csv: %s", err)
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("csv has no header row")
+	}
+
+	header, records := rows[0], []map[string]string{}
+	for _, row := range rows[1:] {
+		record := map[string]string{}
+		for i, column := range header {
+			record[column] = row[i]
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func readNDJSON(reader io.Reader) ([]map[string]string, error) {
+	decoder := json.NewDecoder(reader)
+	records := []map[string]string{}
+	for line := 1; ; line++ {
+		var record map[string]any
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading record %d: %s", line, err)
+		}
+		records = append(records, stringValues(record))
+	}
+}
+
+func readYAML(reader io.Reader) ([]map[string]string, error) {
+	contents, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	var documents []map[string]any
+	err = yaml.Unmarshal(contents, &documents)
+	if err != nil {
+		return nil, fmt.Errorf("error reading yaml, expected a list of users: %s", err)
+	}
+
+	records := []map[string]string{}
+	for _, document := range documents {
+		records = append(records, stringValues(document))
+	}
+	return records, nil
+}
+
+func stringValues(values map[string]any) map[string]string {
+	record := map[string]string{}
+	for key, value := range values {
+		if value != nil {
+			record[key] = fmt.Sprint(value)
+		}
+	}
+	return record
+}
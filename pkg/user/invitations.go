@@ -0,0 +1,439 @@
+package user
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/mail"
+	"github.com/letitloose/user-app/pkg/tracing"
+)
+
+// ErrNoInvitation is returned for revoking or resending an invitation that
+// does not exist or was already accepted or revoked.
+var ErrNoInvitation = errors.New("no such invitation is open")
+
+// InvitationState says where an invitation is up to.
+type InvitationState string
+
+const (
+	InvitationPending  InvitationState = "pending"
+	InvitationExpired  InvitationState = "expired"
+	InvitationAccepted InvitationState = "accepted"
+	InvitationRevoked  InvitationState = "revoked"
+)
+
+// Invitation is an admin asking someone by email to create an account,
+// which gets Role and Groups. AcceptedBy is the username they picked, so
+// together with InvitedBy it records who invited whom. State is worked out
+// when the invitation is read.
+type Invitation struct {
+	ID         string          `json:"id"`
+	Email      string          `json:"email"`
+	Role       Role            `json:"role"`
+	Groups     Groups          `json:"groups,omitempty"`
+	InvitedBy  string          `json:"invited-by"`
+	AcceptedBy string          `json:"accepted-by,omitempty"`
+	Revoked    bool            `json:"revoked"`
+	Created    time.Time       `json:"created"`
+	Expires    time.Time       `json:"expires"`
+	State      InvitationState `json:"state"`
+}
+
+func (invitation *Invitation) setState(now time.Time) {
+	switch {
+	case invitation.AcceptedBy != "":
+		invitation.State = InvitationAccepted
+	case invitation.Revoked:
+		invitation.State = InvitationRevoked
+	case now.After(invitation.Expires):
+		invitation.State = InvitationExpired
+	default:
+		invitation.State = InvitationPending
+	}
+}
+
+var errNoSigningKey = errors.New("invitations.signing-key is not set")
+
+// invitationKey is the key invitation links are signed with, which is only
+// needed, and so only checked for, once invitations are used.
+func invitationKey() ([]byte, error) {
+	key := config.GetConfig().Invitations.SigningKey
+	if key == "" {
+		return nil, errNoSigningKey
+	}
+	return []byte(key), nil
+}
+
+func signInvitation(id string, expires time.Time) (string, error) {
+	key, err := invitationKey()
+	if err != nil {
+		return "", err
+	}
+	payload := id + "." + strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// parseInvitationToken checks the signature on token and returns the id
+// and expiry it was signed with.
+func parseInvitationToken(token string) (id string, expires int64, ok bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", 0, false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	signed, err := signInvitation(parts[0], time.Unix(expires, 0))
+	if err != nil || !hmac.Equal([]byte(signed), []byte(token)) {
+		return "", 0, false
+	}
+	return parts[0], expires, true
+}
+
+func (repository *userRepository) createInvitationTable(ctx context.Context) error {
+	_, err := repository.database.ExecContext(ctx, `create table if not exists invitations (id char(32) primary key,
+		email varchar(255) not null,
+		role varchar(32) not null,
+		group_names text,
+		invited_by varchar(255) not null,
+		accepted_by varchar(255) not null default '',
+		revoked boolean not null default false,
+		created bigint not null,
+		expires bigint not null);`)
+	return contextError(ctx, err)
+}
+
+const invitationColumns = "id, email, role, group_names, invited_by, accepted_by, revoked, created, expires"
+
+// AddInvitation stores invitation.
+func (repository *userRepository) AddInvitation(ctx context.Context, invitation *Invitation) error {
+	query := `INSERT INTO invitations (` + invitationColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	ctx, span := startQuerySpan(ctx, "userRepository.AddInvitation", query)
+	defer span.End()
+
+	_, err := repository.exec(ctx, query, invitation.ID, invitation.Email, string(invitation.Role), invitation.Groups,
+		invitation.InvitedBy, invitation.AcceptedBy, invitation.Revoked, invitation.Created.Unix(), invitation.Expires.Unix())
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// FindInvitation returns the invitation with id, or nil if there is none.
+func (repository *userRepository) FindInvitation(ctx context.Context, id string) (*Invitation, error) {
+	query := `SELECT ` + invitationColumns + ` FROM invitations WHERE id = ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.FindInvitation", query)
+	defer span.End()
+
+	invitations, err := repository.queryInvitations(ctx, query, id)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	if len(invitations) == 0 {
+		return nil, nil
+	}
+	return invitations[0], nil
+}
+
+// ListInvitations returns every invitation, newest first.
+func (repository *userRepository) ListInvitations(ctx context.Context) ([]*Invitation, error) {
+	query := `SELECT ` + invitationColumns + ` FROM invitations ORDER BY created DESC, id;`
+	ctx, span := startQuerySpan(ctx, "userRepository.ListInvitations", query)
+	defer span.End()
+
+	invitations, err := repository.queryInvitations(ctx, query)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return invitations, err
+}
+
+func (repository *userRepository) queryInvitations(ctx context.Context, query string, args ...any) ([]*Invitation, error) {
+	rows, err := repository.query(ctx, repository.database, query, args...)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	invitations := []*Invitation{}
+	for rows.Next() {
+		invitation := &Invitation{}
+		var role string
+		var created, expires int64
+		err = rows.Scan(&invitation.ID, &invitation.Email, &role, &invitation.Groups, &invitation.InvitedBy,
+			&invitation.AcceptedBy, &invitation.Revoked, &created, &expires)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+		invitation.Role, invitation.Created, invitation.Expires = Role(role), time.Unix(created, 0), time.Unix(expires, 0)
+		invitation.setState(now)
+		invitations = append(invitations, invitation)
+	}
+	return invitations, contextError(ctx, rows.Err())
+}
+
+// UpdateInvitation saves the expiry, revocation and acceptance of
+// invitation.
+func (repository *userRepository) UpdateInvitation(ctx context.Context, invitation *Invitation) error {
+	query := `UPDATE invitations SET accepted_by = ?, revoked = ?, expires = ? WHERE id = ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.UpdateInvitation", query)
+	defer span.End()
+
+	_, err := repository.exec(ctx, query, invitation.AcceptedBy, invitation.Revoked, invitation.Expires.Unix(), invitation.ID)
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// ClaimInvitation marks the invitation id accepted by username, if it is
+// still pending. It reports false when it is not, or another caller claimed
+// it first.
+func (repository *userRepository) ClaimInvitation(ctx context.Context, id string, username string) (bool, error) {
+	query := `UPDATE invitations SET accepted_by = ? WHERE id = ? AND accepted_by = '' AND NOT revoked AND expires >= ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.ClaimInvitation", query)
+	defer span.End()
+
+	result, err := repository.exec(ctx, query, username, id, time.Now().Unix())
+	if err != nil {
+		span.RecordError(err)
+		return false, contextError(ctx, err)
+	}
+	claimed, err := result.RowsAffected()
+	return claimed == 1, err
+}
+
+// Invite emails email a link for creating an account with role and groups,
+// on behalf of the caller in ctx.
+func (service *UserService) Invite(ctx context.Context, email string, role Role, groups Groups) (*Invitation, error) {
+	ctx, span := tracing.Start(ctx, "UserService.Invite")
+	defer span.End()
+
+	email = strings.TrimSpace(email)
+	if !emailPattern.MatchString(email) {
+		return nil, &FormatError{Message: fmt.Sprintf("email %q is not an email address", email)}
+	}
+	if role == "" {
+		role = RoleUser
+	}
+	err := checkRole(role)
+	if err != nil {
+		return nil, err
+	}
+	if service.mailer == nil {
+		return nil, errNoMailer
+	}
+	if _, err = invitationKey(); err != nil {
+		return nil, err
+	}
+
+	random := make([]byte, 16)
+	_, err = rand.Read(random)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	invitation := &Invitation{
+		ID:        hex.EncodeToString(random),
+		Email:     email,
+		Role:      role,
+		Groups:    groups,
+		InvitedBy: CallerFromContext(ctx).Username,
+		Created:   now,
+		Expires:   now.Add(config.GetConfig().Invitations.TTL),
+		State:     InvitationPending,
+	}
+	err = service.store.AddInvitation(ctx, invitation)
+	if err == nil {
+		err = service.sendInvitation(ctx, invitation)
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("invite").Inc()
+		return nil, err
+	}
+	invitations.With("sent").Inc()
+	return invitation, nil
+}
+
+func (service *UserService) sendInvitation(ctx context.Context, invitation *Invitation) error {
+	inviter := "An admin"
+	if invitation.InvitedBy != "" {
+		inviter = invitation.InvitedBy
+	}
+	token, err := signInvitation(invitation.ID, invitation.Expires)
+	if err != nil {
+		return err
+	}
+	link := publicURL("/invitations/accept", url.Values{"token": {token}})
+	return service.mailer.Send(ctx, &mail.Message{
+		To:      []string{invitation.Email},
+		Subject: "You're invited to create an account",
+		Body: fmt.Sprintf("%s invited you to create an account.\n\n"+
+			"To pick a username and password, open this link before %s:\n\n%s\n\n"+
+			"If you weren't expecting this, you can ignore this email.\n",
+			inviter, invitation.Expires.UTC().Format("2 January 2006 15:04 MST"), link),
+	})
+}
+
+// ListInvitations returns every invitation, newest first.
+func (service *UserService) ListInvitations(ctx context.Context) ([]*Invitation, error) {
+	return service.store.ListInvitations(ctx)
+}
+
+// RevokeInvitation stops the link for the invitation id from working.
+func (service *UserService) RevokeInvitation(ctx context.Context, id string) error {
+	ctx, span := tracing.Start(ctx, "UserService.RevokeInvitation")
+	defer span.End()
+
+	invitation, err := service.openInvitation(ctx, id)
+	if err == nil {
+		invitation.Revoked = true
+		err = service.store.UpdateInvitation(ctx, invitation)
+	}
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	invitations.With("revoked").Inc()
+	return nil
+}
+
+// ResendInvitation emails the invitation id again with a link that expires
+// invitations.ttl from now. The link sent before stops working.
+func (service *UserService) ResendInvitation(ctx context.Context, id string) error {
+	ctx, span := tracing.Start(ctx, "UserService.ResendInvitation")
+	defer span.End()
+
+	invitation, err := service.openInvitation(ctx, id)
+	if err == nil && service.mailer == nil {
+		err = errNoMailer
+	}
+	if err == nil {
+		_, err = invitationKey()
+	}
+	if err == nil {
+		// Links are told apart by their expiry, so a resend in the same
+		// second still needs a new one.
+		expires := time.Now().Add(config.GetConfig().Invitations.TTL)
+		if expires.Unix() <= invitation.Expires.Unix() {
+			expires = invitation.Expires.Add(time.Second)
+		}
+		invitation.Expires = expires
+		err = service.store.UpdateInvitation(ctx, invitation)
+	}
+	if err == nil {
+		err = service.sendInvitation(ctx, invitation)
+	}
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	invitations.With("resent").Inc()
+	return nil
+}
+
+// openInvitation returns the invitation id if it was neither accepted nor
+// revoked. Expired ones count, since they can be resent.
+func (service *UserService) openInvitation(ctx context.Context, id string) (*Invitation, error) {
+	invitation, err := service.store.FindInvitation(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if invitation == nil || invitation.AcceptedBy != "" || invitation.Revoked {
+		return nil, ErrNoInvitation
+	}
+	return invitation, nil
+}
+
+// CheckInvitation returns the invitation a link with token is for, or
+// ErrInvalidToken if the link is forged, expired, replaced by a resend or
+// already used.
+func (service *UserService) CheckInvitation(ctx context.Context, token string) (*Invitation, error) {
+	if _, err := invitationKey(); err != nil {
+		return nil, err
+	}
+	id, expires, ok := parseInvitationToken(token)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	invitation, err := service.store.FindInvitation(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if invitation == nil || invitation.State != InvitationPending || invitation.Expires.Unix() != expires {
+		return nil, ErrInvalidToken
+	}
+	return invitation, nil
+}
+
+// AcceptInvitation creates user, with the username and password the
+// invitee picked, from the invitation token is for. The user gets the
+// invited email address, already verified, and the invitation's role and
+// groups. It returns ErrInvalidToken for a link that cannot be used and the
+// errors of AddUser, leaving the link usable, for a bad username or
+// password. The invitation is claimed and the user added in one
+// transaction, so neither happens without the other.
+func (service *UserService) AcceptInvitation(ctx context.Context, token string, user *User) error {
+	ctx, span := tracing.Start(ctx, "UserService.AcceptInvitation")
+	defer span.End()
+
+	invitation, err := service.CheckInvitation(ctx, token)
+	if err == nil {
+		err = service.checkNewUsername(ctx, user.Username)
+	}
+	if err == ErrInvalidToken {
+		invitations.With("invalid").Inc()
+		return err
+	}
+	if err == nil {
+		err = setPassword(user)
+	}
+	if err != nil {
+		return err
+	}
+
+	user.Email, user.EmailVerified = invitation.Email, true
+	user.Role, user.Groups, user.Status = invitation.Role, invitation.Groups, StatusActive
+	err = service.store.WithTx(ctx, nil, func(tx Store) error {
+		claimed, err := tx.ClaimInvitation(ctx, invitation.ID, user.Username)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return ErrInvalidToken
+		}
+		return tx.AddUser(ctx, user)
+	})
+	if err == ErrInvalidToken {
+		invitations.With("invalid").Inc()
+		return err
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("create").Inc()
+		return err
+	}
+	usersCreated.Inc()
+	invitations.With("accepted").Inc()
+	service.audit(ctx, AuditCreate, CallerFromContext(ctx).Username, user.Username, userChanges(&User{}, user))
+	return nil
+}
@@ -0,0 +1,326 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/logging"
+)
+
+// LockedError is returned for a login to an account, or from an IP
+// address, that is locked out after too many failures, or that comes
+// sooner after the last failure than the lockout.delay allows.
+type LockedError struct {
+	Until time.Time
+}
+
+func (err *LockedError) Error() string {
+	return fmt.Sprintf("too many failed logins, try again in %s", err.RetryAfter())
+}
+
+// RetryAfter is how long until the next login may be tried, rounded up to a
+// second.
+func (err *LockedError) RetryAfter() time.Duration {
+	wait := time.Until(err.Until).Truncate(time.Second) + time.Second
+	if wait < time.Second {
+		return time.Second
+	}
+	return wait
+}
+
+// Login attempts are counted under the account or the address they come
+// from, prefixed by what the key is.
+const (
+	lockoutAccount = "account:"
+	lockoutIP      = "ip:"
+)
+
+// LoginAttempts counts the failed logins under Key, an account or an IP
+// address. A login is refused until LockedUntil.
+type LoginAttempts struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+type clientIPKey struct{}
+
+// WithClientIP returns a context carrying the IP address a request came
+// from, which failed logins are counted against.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// ClientIPFromContext returns the address set with WithClientIP, or "".
+func ClientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+// clientIP is the address request came from, without the port.
+func clientIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+func (repository *userRepository) createLoginAttemptTable(ctx context.Context) error {
+	_, err := repository.database.ExecContext(ctx, `create table if not exists login_attempts (subject varchar(255) primary key,
+		failures int not null,
+		last_failure bigint not null,
+		locked_until bigint not null default 0);`)
+	return contextError(ctx, err)
+}
+
+// FindLoginAttempts returns the failed logins counted under key, or nil if
+// there are none.
+func (repository *userRepository) FindLoginAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	query := `SELECT subject, failures, last_failure, locked_until FROM login_attempts WHERE subject = ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.FindLoginAttempts", query)
+	defer span.End()
+
+	rows, err := repository.query(ctx, repository.database, query, key)
+	if err != nil {
+		span.RecordError(err)
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, contextError(ctx, rows.Err())
+	}
+	attempts := &LoginAttempts{}
+	var lastFailure, lockedUntil int64
+	err = rows.Scan(&attempts.Key, &attempts.Failures, &lastFailure, &lockedUntil)
+	if err != nil {
+		span.RecordError(err)
+		return nil, contextError(ctx, err)
+	}
+	attempts.LastFailure, attempts.LockedUntil = time.Unix(lastFailure, 0), time.Unix(lockedUntil, 0)
+	return attempts, nil
+}
+
+// AddLoginFailure counts a failed login at under key and returns the new
+// count. Failures under key before since are forgotten.
+func (repository *userRepository) AddLoginFailure(ctx context.Context, key string, at time.Time, since time.Time) (*LoginAttempts, error) {
+	query := `UPDATE login_attempts SET failures = CASE WHEN last_failure < ? THEN 1 ELSE failures + 1 END, last_failure = ? WHERE subject = ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.AddLoginFailure", query)
+	defer span.End()
+
+	result, err := repository.exec(ctx, query, since.Unix(), at.Unix(), key)
+	var updated int64
+	if err == nil {
+		updated, err = result.RowsAffected()
+	}
+	if err == nil && updated == 0 {
+		_, err = repository.exec(ctx, `INSERT INTO login_attempts (subject, failures, last_failure, locked_until) VALUES (?, 1, ?, 0);`, key, at.Unix())
+		if err != nil {
+			// Another instance counted the first failure just now.
+			_, err = repository.exec(ctx, query, since.Unix(), at.Unix(), key)
+		}
+	}
+	if err != nil {
+		span.RecordError(err)
+		return nil, contextError(ctx, err)
+	}
+	return repository.FindLoginAttempts(ctx, key)
+}
+
+// LockLogin refuses logins under key until until.
+func (repository *userRepository) LockLogin(ctx context.Context, key string, until time.Time) error {
+	query := `UPDATE login_attempts SET locked_until = ? WHERE subject = ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.LockLogin", query)
+	defer span.End()
+
+	_, err := repository.exec(ctx, query, until.Unix(), key)
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// ClearLoginAttempts forgets the failed logins under key and lifts any
+// lockout.
+func (repository *userRepository) ClearLoginAttempts(ctx context.Context, key string) error {
+	query := `DELETE FROM login_attempts WHERE subject = ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.ClearLoginAttempts", query)
+	defer span.End()
+
+	_, err := repository.exec(ctx, query, key)
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// RemoveLoginAttempts deletes the failed logins of every key whose last
+// failure was before since and that is not locked at now, returning how many
+// keys went.
+func (repository *userRepository) RemoveLoginAttempts(ctx context.Context, since time.Time, now time.Time) (int64, error) {
+	query := `DELETE FROM login_attempts WHERE last_failure < ? AND locked_until < ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.RemoveLoginAttempts", query)
+	defer span.End()
+
+	result, err := repository.exec(ctx, query, since.Unix(), now.Unix())
+	if err != nil {
+		span.RecordError(err)
+		return 0, contextError(ctx, err)
+	}
+	return result.RowsAffected()
+}
+
+// loginDelay is how long an account must wait after its failures-th failed
+// login in a row: lockout.delay, doubled for each failure after the first,
+// up to lockout.duration.
+func loginDelay(settings config.LockoutConfig, failures int) time.Duration {
+	delay := settings.Delay
+	if delay <= 0 || failures <= 0 {
+		return 0
+	}
+	for i := 1; i < failures && delay < settings.Duration; i++ {
+		delay *= 2
+	}
+	if settings.Duration > 0 && delay > settings.Duration {
+		return settings.Duration
+	}
+	return delay
+}
+
+// checkLockout returns a *LockedError if username, or ip, may not try to
+// log in yet.
+func (service *UserService) checkLockout(ctx context.Context, username string, ip string) error {
+	settings := config.GetConfig().Lockout
+	now := time.Now()
+	keys := []string{lockoutAccount + username}
+	if ip != "" {
+		keys = append(keys, lockoutIP+ip)
+	}
+	for _, key := range keys {
+		attempts, err := service.store.FindLoginAttempts(ctx, key)
+		if err != nil {
+			return err
+		}
+		if attempts == nil {
+			continue
+		}
+		until := attempts.LockedUntil
+		if key == keys[0] && now.Sub(attempts.LastFailure) < settings.Duration {
+			if next := attempts.LastFailure.Add(loginDelay(settings, attempts.Failures)); next.After(until) {
+				until = next
+			}
+		}
+		if until.After(now) {
+			lockouts.With("refused").Inc()
+			return &LockedError{Until: until}
+		}
+	}
+	return nil
+}
+
+// loginFailed counts a failed login to username from ip, locking either out
+// once it reaches its limit. It returns the *LockedError of a lockout it
+// started.
+func (service *UserService) loginFailed(ctx context.Context, username string, ip string) error {
+	settings := config.GetConfig().Lockout
+	now := time.Now()
+	since := now.Add(-settings.Duration)
+	var locked error
+
+	if settings.MaxAttempts > 0 || settings.Delay > 0 {
+		attempts, err := service.store.AddLoginFailure(ctx, lockoutAccount+username, now, since)
+		if err != nil {
+			return err
+		}
+		if settings.MaxAttempts > 0 && attempts.Failures >= settings.MaxAttempts {
+			until := now.Add(settings.Duration)
+			if err := service.store.LockLogin(ctx, attempts.Key, until); err != nil {
+				return err
+			}
+			logging.Warnf("locked out %s after %d failed logins", username, attempts.Failures)
+			lockouts.With("account").Inc()
+			service.notifyLockout(ctx, username, attempts.Failures, until)
+			locked = &LockedError{Until: until}
+		}
+	}
+
+	if ip != "" && settings.IPMaxAttempts > 0 {
+		attempts, err := service.store.AddLoginFailure(ctx, lockoutIP+ip, now, since)
+		if err != nil {
+			return err
+		}
+		if attempts.Failures >= settings.IPMaxAttempts {
+			until := now.Add(settings.Duration)
+			if err := service.store.LockLogin(ctx, attempts.Key, until); err != nil {
+				return err
+			}
+			logging.Warnf("locked out %s after %d failed logins", ip, attempts.Failures)
+			lockouts.With("ip").Inc()
+			locked = &LockedError{Until: until}
+		}
+	}
+	return locked
+}
+
+// notifyLockout tells username their account was locked, in case it was not
+// them trying.
+func (service *UserService) notifyLockout(ctx context.Context, username string, failures int, until time.Time) {
+	user, err := service.store.FindUser(ctx, username)
+	if err != nil || user.Username == "" {
+		return
+	}
+	service.notify(ctx, user, "Your account was locked",
+		fmt.Sprintf("There were %d failed attempts to log in to your account %s, so logging in is blocked until %s.\n\n"+
+			"If that wasn't you, someone may be guessing your password. You can change it at %s.\n",
+			failures, username, until.Format(time.RFC1123), publicURL("/password/forgot", nil)))
+}
+
+// PurgeLoginAttempts forgets failed logins older than lockout.duration
+// every interval until ctx is done, so the table only holds recent ones.
+func (service *UserService) PurgeLoginAttempts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		removed, err := service.store.RemoveLoginAttempts(ctx, now.Add(-config.GetConfig().Lockout.Duration), now)
+		if err != nil && ctx.Err() == nil {
+			logging.Errorf("error purging failed logins: %s", err)
+		} else if removed > 0 {
+			logging.Debugf("purged the failed logins of %d accounts and addresses", removed)
+		}
+	}
+}
+
+// LockedUntil returns when the lockout of username ends, or the zero time
+// if they are not locked out.
+func (service *UserService) LockedUntil(ctx context.Context, username string) (time.Time, error) {
+	attempts, err := service.store.FindLoginAttempts(ctx, lockoutAccount+username)
+	if err != nil || attempts == nil || !attempts.LockedUntil.After(time.Now()) {
+		return time.Time{}, err
+	}
+	return attempts.LockedUntil, nil
+}
+
+// Unlock lifts the lockout of username and forgets their failed logins.
+func (service *UserService) Unlock(ctx context.Context, username string) error {
+	err := service.store.ClearLoginAttempts(ctx, lockoutAccount+username)
+	if err != nil {
+		userErrors.With("unlock").Inc()
+		return err
+	}
+	lockouts.With("unlocked").Inc()
+	return nil
+}
@@ -0,0 +1,45 @@
+package user
+
+import (
+	"github.com/letitloose/user-app/pkg/metrics"
+)
+
+var (
+	usersCreated = metrics.NewCounter("userapp_users_created_total", "Total number of users created.")
+	usersUpdated = metrics.NewCounter("userapp_users_updated_total", "Total number of users updated.")
+	usersDeleted = metrics.NewCounter("userapp_users_deleted_total", "Total number of users deleted.")
+	// loginFailures is registered up front so the series exists before the
+	// first rejected login attempt increments it.
+	loginFailures = metrics.NewCounter("userapp_login_failures_total", "Total number of failed login attempts.")
+	userErrors    = metrics.NewCounterVec("userapp_user_operation_errors_total", "Total number of failed user service operations.", "operation")
+	cacheLookups  = metrics.NewCounterVec("userapp_user_cache_lookups_total", "Total number of user cache lookups by result.", "result")
+	// passwordResets counts reset links requested, resets completed and
+	// attempts with an invalid or expired link.
+	passwordResets = metrics.NewCounterVec("userapp_password_resets_total", "Total number of password reset steps by result.", "result")
+	// emailVerifications counts verification links sent, addresses confirmed,
+	// attempts with an invalid or expired link and throttled resends.
+	emailVerifications = metrics.NewCounterVec("userapp_email_verifications_total", "Total number of email verification steps by result.", "result")
+	// signups counts accounts signed up as active or pending, refused by the
+	// signup policy, and pending accounts approved or rejected.
+	signups = metrics.NewCounterVec("userapp_signups_total", "Total number of signups and approval decisions by result.", "result")
+	// invitations counts invitations sent, resent, revoked and accepted, and
+	// attempts with an invalid or expired link.
+	invitations = metrics.NewCounterVec("userapp_invitations_total", "Total number of invitation steps by result.", "result")
+	// twoFactorChecks counts two-factor codes and recovery codes accepted,
+	// wrong or reused codes, and two-factor authentication turned on or off.
+	twoFactorChecks = metrics.NewCounterVec("userapp_two_factor_total", "Total number of two-factor authentication steps by result.", "result")
+	// passkeyChecks counts passkeys registered and removed, logins with
+	// one, responses that did not verify and sign counts that went
+	// backwards.
+	passkeyChecks = metrics.NewCounterVec("userapp_passkeys_total", "Total number of passkey steps by result.", "result")
+	// lockouts counts accounts and IP addresses locked out, logins refused
+	// while locked out or too soon after a failure, and accounts unlocked by
+	// admins.
+	lockouts = metrics.NewCounterVec("userapp_lockouts_total", "Total number of login lockout events by result.", "result")
+	// auditEvents counts the events recorded in the audit log.
+	auditEvents = metrics.NewCounterVec("userapp_audit_events_total", "Total number of audit events recorded by action.", "action")
+)
+
+func init() {
+	metrics.MustRegister(usersCreated, usersUpdated, usersDeleted, loginFailures, userErrors, cacheLookups, passwordResets, emailVerifications, signups, invitations, twoFactorChecks, passkeyChecks, lockouts, auditEvents)
+}
@@ -0,0 +1,483 @@
+package user
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/logging"
+	"github.com/letitloose/user-app/pkg/tracing"
+	"github.com/letitloose/user-app/pkg/webauthn"
+)
+
+// ErrInvalidPasskey is returned for a passkey response that does not
+// verify, answers no ceremony in progress, or comes from an unknown
+// passkey.
+var ErrInvalidPasskey = errors.New("the passkey could not be checked, please try again")
+
+// ErrNoPasskey is returned for renaming or removing a passkey the user does
+// not have.
+var ErrNoPasskey = errors.New("no such passkey")
+
+// TokenPasskeyRegistration and TokenPasskeyLogin tokens are the challenges
+// of WebAuthn ceremonies in progress, found by the challenge the browser
+// sends back.
+const (
+	TokenPasskeyRegistration = "passkey-registration"
+	TokenPasskeyLogin        = "passkey-login"
+)
+
+// passkeyCeremonyTTL is how long a browser has to answer a challenge, a
+// little longer than it is asked to wait for the user.
+const passkeyCeremonyTTL = 6 * time.Minute
+
+const maxPasskeyName = 64
+
+// Passkey is a WebAuthn credential, from a security key or a platform
+// authenticator, that username logs in with. ID is the credential ID in
+// base64url and PublicKey its COSE key. SignCount is the authenticator's
+// signature counter at the last login, which authenticators that keep one
+// must raise every time.
+type Passkey struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"user-name"`
+	Name      string    `json:"name"`
+	PublicKey []byte    `json:"-"`
+	SignCount uint32    `json:"sign-count"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"last-used"`
+}
+
+func (passkey *Passkey) credential() webauthn.Credential {
+	id, _ := webauthn.Decode(passkey.ID)
+	return webauthn.Credential{ID: id, PublicKey: passkey.PublicKey, SignCount: passkey.SignCount}
+}
+
+// relyingParty is this app as WebAuthn sees it: the origin of
+// server.public-url and passkeys.rp-id or its host.
+func relyingParty() *webauthn.RelyingParty {
+	current := config.GetConfig()
+	rp := &webauthn.RelyingParty{ID: current.Passkeys.RPID, Name: current.Passkeys.Name, UserVerification: current.Passkeys.UserVerification}
+	if public, err := url.Parse(current.Server.PublicURL); err == nil {
+		rp.Origins = []string{public.Scheme + "://" + public.Host}
+		if rp.ID == "" {
+			rp.ID = public.Hostname()
+		}
+	}
+	return rp
+}
+
+// userHandle is the WebAuthn user ID of username. Authenticators store it,
+// so it is a hash rather than the username itself.
+func userHandle(username string) []byte {
+	sum := sha256.Sum256([]byte("user-app passkey " + username))
+	return sum[:]
+}
+
+func checkPasskeyName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxPasskeyName {
+		return "", &FormatError{Message: "the passkey name must be 1 to 64 characters"}
+	}
+	return name, nil
+}
+
+func (repository *userRepository) createPasskeyTable(ctx context.Context) error {
+	_, err := repository.database.ExecContext(ctx, `create table if not exists passkeys (id varchar(255) primary key,
+		username varchar(255) not null,
+		name varchar(255) not null,
+		public_key blob not null,
+		sign_count bigint not null default 0,
+		created bigint not null,
+		last_used bigint not null default 0);`)
+	return contextError(ctx, err)
+}
+
+const passkeyColumns = "id, username, name, public_key, sign_count, created, last_used"
+
+// AddPasskey stores passkey.
+func (repository *userRepository) AddPasskey(ctx context.Context, passkey *Passkey) error {
+	query := `INSERT INTO passkeys (` + passkeyColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?);`
+	ctx, span := startQuerySpan(ctx, "userRepository.AddPasskey", query)
+	defer span.End()
+
+	_, err := repository.exec(ctx, query, passkey.ID, passkey.Username, passkey.Name, passkey.PublicKey,
+		passkey.SignCount, passkey.Created.Unix(), unixOrZero(passkey.LastUsed))
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// FindPasskey returns the passkey with id, or nil if there is none.
+func (repository *userRepository) FindPasskey(ctx context.Context, id string) (*Passkey, error) {
+	query := `SELECT ` + passkeyColumns + ` FROM passkeys WHERE id = ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.FindPasskey", query)
+	defer span.End()
+
+	passkeys, err := repository.queryPasskeys(ctx, query, id)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	if len(passkeys) == 0 {
+		return nil, nil
+	}
+	return passkeys[0], nil
+}
+
+// ListPasskeys returns the passkeys of username, oldest first.
+func (repository *userRepository) ListPasskeys(ctx context.Context, username string) ([]*Passkey, error) {
+	query := `SELECT ` + passkeyColumns + ` FROM passkeys WHERE username = ? ORDER BY created, id;`
+	ctx, span := startQuerySpan(ctx, "userRepository.ListPasskeys", query)
+	defer span.End()
+
+	passkeys, err := repository.queryPasskeys(ctx, query, username)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return passkeys, err
+}
+
+func (repository *userRepository) queryPasskeys(ctx context.Context, query string, args ...any) ([]*Passkey, error) {
+	rows, err := repository.query(ctx, repository.database, query, args...)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	passkeys := []*Passkey{}
+	for rows.Next() {
+		passkey := &Passkey{}
+		var created, lastUsed int64
+		err = rows.Scan(&passkey.ID, &passkey.Username, &passkey.Name, &passkey.PublicKey, &passkey.SignCount, &created, &lastUsed)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+		passkey.Created = time.Unix(created, 0)
+		if lastUsed != 0 {
+			passkey.LastUsed = time.Unix(lastUsed, 0)
+		}
+		passkeys = append(passkeys, passkey)
+	}
+	return passkeys, contextError(ctx, rows.Err())
+}
+
+// RenamePasskey sets the name of the passkey with id.
+func (repository *userRepository) RenamePasskey(ctx context.Context, id string, name string) error {
+	query := `UPDATE passkeys SET name = ? WHERE id = ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.RenamePasskey", query)
+	defer span.End()
+
+	_, err := repository.exec(ctx, query, name, id)
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// UsePasskey records a login with the passkey with id, at which its
+// authenticator reported signCount. It reports false if a login reporting
+// as much or more was recorded first, by another caller too, unless the
+// authenticator keeps no counter and always reports 0.
+func (repository *userRepository) UsePasskey(ctx context.Context, id string, signCount uint32, used time.Time) (bool, error) {
+	query := `UPDATE passkeys SET sign_count = ?, last_used = ? WHERE id = ? AND (sign_count < ? OR ? = 0);`
+	ctx, span := startQuerySpan(ctx, "userRepository.UsePasskey", query)
+	defer span.End()
+
+	result, err := repository.exec(ctx, query, signCount, used.Unix(), id, signCount, signCount)
+	if err != nil {
+		span.RecordError(err)
+		return false, contextError(ctx, err)
+	}
+	updated, err := result.RowsAffected()
+	return updated == 1, err
+}
+
+// RemovePasskey deletes the passkey with id.
+func (repository *userRepository) RemovePasskey(ctx context.Context, id string) error {
+	query := `DELETE FROM passkeys WHERE id = ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.RemovePasskey", query)
+	defer span.End()
+
+	_, err := repository.exec(ctx, query, id)
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// RemovePasskeys deletes every passkey of username.
+func (repository *userRepository) RemovePasskeys(ctx context.Context, username string) error {
+	query := `DELETE FROM passkeys WHERE username = ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.RemovePasskeys", query)
+	defer span.End()
+
+	_, err := repository.exec(ctx, query, username)
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// Passkeys returns the passkeys of username.
+func (service *UserService) Passkeys(ctx context.Context, username string) ([]*Passkey, error) {
+	return service.store.ListPasskeys(ctx, username)
+}
+
+// userPasskey returns the passkey with id if it belongs to username, and
+// ErrNoPasskey otherwise.
+func (service *UserService) userPasskey(ctx context.Context, username string, id string) (*Passkey, error) {
+	passkey, err := service.store.FindPasskey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if passkey == nil || passkey.Username != username {
+		return nil, ErrNoPasskey
+	}
+	return passkey, nil
+}
+
+// BeginPasskeyRegistration returns the options for the browser of username
+// to create a passkey called name with. Its answer goes to
+// FinishPasskeyRegistration.
+func (service *UserService) BeginPasskeyRegistration(ctx context.Context, username string, name string) (*webauthn.CreationOptions, error) {
+	ctx, span := tracing.Start(ctx, "UserService.BeginPasskeyRegistration")
+	defer span.End()
+
+	name, err := checkPasskeyName(name)
+	if err != nil {
+		return nil, err
+	}
+	user, err := service.store.FindUser(ctx, username)
+	var existing []*Passkey
+	if err == nil {
+		existing, err = service.store.ListPasskeys(ctx, username)
+	}
+	var challenge []byte
+	if err == nil {
+		challenge, err = webauthn.NewChallenge()
+	}
+	if err == nil {
+		encoded := webauthn.Encode(challenge)
+		err = service.store.AddToken(ctx, &Token{Kind: TokenPasskeyRegistration, Hash: hashToken(encoded), Username: username, Data: name, Expires: time.Now().Add(passkeyCeremonyTTL)})
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("passkey").Inc()
+		return nil, err
+	}
+
+	exclude := make([]webauthn.Credential, 0, len(existing))
+	for _, passkey := range existing {
+		exclude = append(exclude, passkey.credential())
+	}
+	displayName := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if displayName == "" {
+		displayName = username
+	}
+	return relyingParty().CreationOptions(webauthn.User{ID: userHandle(username), Name: username, DisplayName: displayName}, challenge, exclude), nil
+}
+
+// FinishPasskeyRegistration checks the browser's answer to the options
+// BeginPasskeyRegistration gave username and stores the new passkey. It
+// returns ErrInvalidPasskey for an answer that does not check out.
+func (service *UserService) FinishPasskeyRegistration(ctx context.Context, username string, response *webauthn.RegistrationResponse) (*Passkey, error) {
+	ctx, span := tracing.Start(ctx, "UserService.FinishPasskeyRegistration")
+	defer span.End()
+
+	challenge, err := response.Challenge()
+	if err != nil {
+		passkeyChecks.With("invalid").Inc()
+		return nil, ErrInvalidPasskey
+	}
+	token, err := service.store.TakeToken(ctx, TokenPasskeyRegistration, hashToken(webauthn.Encode(challenge)))
+	if err != nil {
+		return nil, err
+	}
+	if token == nil || token.Username != username {
+		passkeyChecks.With("invalid").Inc()
+		return nil, ErrInvalidPasskey
+	}
+	credential, err := relyingParty().VerifyRegistration(response, challenge)
+	if err != nil {
+		logging.Warnf("passkey registration for %s failed: %s", username, err)
+		passkeyChecks.With("invalid").Inc()
+		return nil, ErrInvalidPasskey
+	}
+
+	passkey := &Passkey{
+		ID:        webauthn.Encode(credential.ID),
+		Username:  username,
+		Name:      token.Data,
+		PublicKey: credential.PublicKey,
+		SignCount: credential.SignCount,
+		Created:   time.Now(),
+	}
+	err = service.store.AddPasskey(ctx, passkey)
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("passkey").Inc()
+		return nil, err
+	}
+	passkeyChecks.With("registered").Inc()
+	return passkey, nil
+}
+
+// RenamePasskey renames the passkey id of username.
+func (service *UserService) RenamePasskey(ctx context.Context, username string, id string, name string) error {
+	name, err := checkPasskeyName(name)
+	if err != nil {
+		return err
+	}
+	if _, err := service.userPasskey(ctx, username, id); err != nil {
+		return err
+	}
+	return service.store.RenamePasskey(ctx, id, name)
+}
+
+// RemovePasskey removes the passkey id of username, so it no longer logs
+// them in.
+func (service *UserService) RemovePasskey(ctx context.Context, username string, id string) error {
+	if _, err := service.userPasskey(ctx, username, id); err != nil {
+		return err
+	}
+	err := service.store.RemovePasskey(ctx, id)
+	if err != nil {
+		userErrors.With("passkey").Inc()
+		return err
+	}
+	passkeyChecks.With("removed").Inc()
+	return nil
+}
+
+// BeginPasskeyLogin returns the options for a browser to log in with a
+// passkey, answered with FinishPasskeyLogin. With a username only their
+// passkeys are offered; without one the browser lets the user pick any
+// passkey they have for the site.
+func (service *UserService) BeginPasskeyLogin(ctx context.Context, username string) (*webauthn.RequestOptions, error) {
+	ctx, span := tracing.Start(ctx, "UserService.BeginPasskeyLogin")
+	defer span.End()
+
+	var passkeys []*Passkey
+	var err error
+	if username != "" {
+		passkeys, err = service.store.ListPasskeys(ctx, username)
+	}
+	var challenge []byte
+	if err == nil {
+		challenge, err = webauthn.NewChallenge()
+	}
+	if err == nil {
+		err = service.store.AddToken(ctx, &Token{Kind: TokenPasskeyLogin, Hash: hashToken(webauthn.Encode(challenge)), Username: username, Expires: time.Now().Add(passkeyCeremonyTTL)})
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("passkey").Inc()
+		return nil, err
+	}
+
+	allow := make([]webauthn.Credential, 0, len(passkeys))
+	for _, passkey := range passkeys {
+		allow = append(allow, passkey.credential())
+	}
+	return relyingParty().RequestOptions(challenge, allow), nil
+}
+
+// FinishPasskeyLogin checks the browser's answer to options from
+// BeginPasskeyLogin and starts a session for the passkey's user, returning
+// its secret. A passkey stands in for both the password and a two-factor
+// code. It returns ErrInvalidPasskey for an answer that does not check out,
+// including one whose signature counter shows the authenticator may have
+// been cloned, and ErrAccountPending or ErrEmailNotVerified for a user who
+// may not log in yet.
+func (service *UserService) FinishPasskeyLogin(ctx context.Context, response *webauthn.AssertionResponse) (string, error) {
+	ctx, span := tracing.Start(ctx, "UserService.FinishPasskeyLogin")
+	defer span.End()
+
+	var passkey *Passkey
+	fail := func(result string) (string, error) {
+		passkeyChecks.With(result).Inc()
+		loginFailures.Inc()
+		if passkey != nil {
+			service.audit(ctx, AuditLoginFailed, "", passkey.Username, nil)
+		}
+		return "", ErrInvalidPasskey
+	}
+	challenge, err := response.Challenge()
+	if err != nil {
+		return fail("invalid")
+	}
+	id, err := response.CredentialID()
+	if err != nil {
+		return fail("invalid")
+	}
+	token, err := service.store.TakeToken(ctx, TokenPasskeyLogin, hashToken(webauthn.Encode(challenge)))
+	if err == nil && token != nil {
+		passkey, err = service.store.FindPasskey(ctx, webauthn.Encode(id))
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("login").Inc()
+		return "", err
+	}
+	if token == nil || passkey == nil || (token.Username != "" && token.Username != passkey.Username) {
+		return fail("invalid")
+	}
+
+	credential := passkey.credential()
+	signCount, err := relyingParty().VerifyAssertion(response, challenge, &credential)
+	if err == webauthn.ErrSignCount {
+		logging.Warnf("passkey %q of %s reported sign count %d or lower, it may have been cloned", passkey.Name, passkey.Username, passkey.SignCount)
+		return fail("sign_count")
+	}
+	if err != nil {
+		logging.Warnf("passkey login for %s failed: %s", passkey.Username, err)
+		return fail("invalid")
+	}
+	used, err := service.store.UsePasskey(ctx, passkey.ID, signCount, time.Now())
+	if err == nil && !used {
+		return fail("sign_count")
+	}
+
+	var user *User
+	if err == nil {
+		user, err = service.store.FindUser(ctx, passkey.Username)
+	}
+	if err == nil && user.Username == "" {
+		return fail("invalid")
+	}
+	if err == nil {
+		if err = checkCanLogin(user); err != nil {
+			loginFailures.Inc()
+			service.audit(ctx, AuditLoginFailed, "", user.Username, nil)
+			return "", err
+		}
+	}
+	var secret string
+	if err == nil {
+		secret, err = service.startSession(ctx, user.Username)
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("login").Inc()
+		return "", err
+	}
+	passkeyChecks.With("login").Inc()
+	return secret, nil
+}
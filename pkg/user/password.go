@@ -0,0 +1,163 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/letitloose/user-app/cmd/config"
+)
+
+// PasswordPolicyError is returned when a new password does not meet the
+// password settings in the config.
+type PasswordPolicyError struct {
+	Problems []string
+}
+
+func (err *PasswordPolicyError) Error() string {
+	return "password " + strings.Join(err.Problems, " and ")
+}
+
+// checkPassword applies the current password policy, read on every call so
+// a config reload applies to the next password set. An empty password is
+// refused whatever the policy.
+func checkPassword(password string) error {
+	policy := config.GetConfig().Password
+	problems := []string{}
+	if password == "" {
+		problems = append(problems, "must not be empty")
+	} else if len([]rune(password)) < policy.MinLength {
+		problems = append(problems, "must be at least "+pluralizeCharacters(policy.MinLength)+" long")
+	}
+	if policy.RequireDigit && strings.IndexFunc(password, unicode.IsDigit) < 0 {
+		problems = append(problems, "must contain a digit")
+	}
+
+	if len(problems) > 0 {
+		return &PasswordPolicyError{Problems: problems}
+	}
+	return nil
+}
+
+func pluralizeCharacters(count int) string {
+	if count == 1 {
+		return "1 character"
+	}
+	return strconv.Itoa(count) + " characters"
+}
+
+// Passwords are stored as PBKDF2-HMAC-SHA256 hashes in the form
+// pbkdf2-sha256$<iterations>$<salt>$<hash>, with the salt and hash in
+// unpadded base64. The iteration count follows the OWASP recommendation.
+const (
+	hashScheme     = "pbkdf2-sha256"
+	hashIterations = 600000
+	saltLength     = 16
+)
+
+// hashPassword returns the stored form of password.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, saltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, hashIterations, sha256.Size)
+	return fmt.Sprintf("%s$%d$%s$%s", hashScheme, hashIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// isHashed reports whether stored came from hashPassword. Anything else is a
+// password stored in plaintext before passwords were hashed, which is
+// hashed when its user next logs in.
+func isHashed(stored string) bool {
+	return strings.HasPrefix(stored, hashScheme+"$")
+}
+
+// verifyPassword reports whether password matches hash, which came from
+// hashPassword or is a plaintext password from before. An empty password
+// never matches.
+func verifyPassword(hash string, password string) bool {
+	if password == "" {
+		return false
+	}
+	if !isHashed(hash) {
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+	}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != hashScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key := pbkdf2SHA256([]byte(password), salt, iterations, len(expected))
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// pbkdf2SHA256 derives a key of keyLength bytes as in RFC 8018 section 5.2.
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLength int) []byte {
+	mac := hmac.New(sha256.New, password)
+	key := make([]byte, 0, keyLength+sha256.Size)
+	block := make([]byte, 4)
+	for index := uint32(1); len(key) < keyLength; index++ {
+		binary.BigEndian.PutUint32(block, index)
+		mac.Reset()
+		mac.Write(salt)
+		mac.Write(block)
+		u := mac.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLength]
+}
+
+const generatedAlphabet = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// generatePassword returns a random password of 20 characters that meets
+// the current password policy, leaving out characters that are easily
+// confused.
+func generatePassword() (string, error) {
+	length := 20
+	if minimum := config.GetConfig().Password.MinLength; minimum > length {
+		length = minimum
+	}
+	for {
+		password := make([]byte, length)
+		for i := range password {
+			index, err := rand.Int(rand.Reader, big.NewInt(int64(len(generatedAlphabet))))
+			if err != nil {
+				return "", err
+			}
+			password[i] = generatedAlphabet[index.Int64()]
+		}
+		if checkPassword(string(password)) == nil {
+			return string(password), nil
+		}
+	}
+}
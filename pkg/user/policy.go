@@ -0,0 +1,174 @@
+package user
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// Role decides which fields of other users a caller may see.
+type Role string
+
+const (
+	RoleAnonymous Role = ""
+	RoleUser      Role = "user"
+	RoleAdmin     Role = "admin"
+)
+
+// Caller is who a request is made by. The zero Caller is anonymous.
+type Caller struct {
+	Username string
+	Role     Role
+}
+
+type callerKey struct{}
+
+// WithCaller returns a context carrying caller, which decides what the
+// views built from it show.
+func WithCaller(ctx context.Context, caller Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFromContext returns the caller set with WithCaller, or an anonymous
+// one.
+func CallerFromContext(ctx context.Context) Caller {
+	caller, _ := ctx.Value(callerKey{}).(Caller)
+	return caller
+}
+
+// fieldPolicy reports whether caller may see a field of user.
+type fieldPolicy func(caller Caller, user *User) bool
+
+func public(caller Caller, user *User) bool {
+	return true
+}
+
+func selfOrAdmin(caller Caller, user *User) bool {
+	return caller.Role == RoleAdmin || (caller.Username != "" && caller.Username == user.Username)
+}
+
+// fieldPolicies lists every field that can be shown, by its JSON name. A
+// field without a policy, like the password, is never shown to anyone.
+var fieldPolicies = map[string]fieldPolicy{
+	"user-name":  public,
+	"first-name": public,
+	"last-name":  public,
+	"email":      selfOrAdmin,
+	// Verification is only shown alongside the address, and the role to
+	// those who can see everything else about a user.
+	"email-verified": selfOrAdmin,
+	"role":           selfOrAdmin,
+	"status":         selfOrAdmin,
+	"groups":         selfOrAdmin,
+}
+
+func canSee(caller Caller, user *User, field string) bool {
+	policy, ok := fieldPolicies[field]
+	return ok && policy(caller, user)
+}
+
+// UserView is the read model of a user handed to responses and templates.
+// It has no password field, so one cannot leak by accident, and fields the
+// caller may not see are left empty.
+type UserView struct {
+	Username  string `json:"user-name"`
+	FirstName string `json:"first-name"`
+	LastName  string `json:"last-name"`
+	Email     string `json:"email,omitempty"`
+	// EmailVerified is false both for an unverified address and when the
+	// caller may not see the address.
+	EmailVerified bool     `json:"email-verified,omitempty"`
+	Role          string   `json:"role,omitempty"`
+	Status        string   `json:"status,omitempty"`
+	Groups        []string `json:"groups,omitempty"`
+	// LockedUntil is set, for admins, while the user is locked out after
+	// too many failed logins.
+	LockedUntil *time.Time `json:"locked-until,omitempty"`
+}
+
+// NewUserView shows user as caller is allowed to see it.
+func NewUserView(user *User, caller Caller) *UserView {
+	view := &UserView{}
+	for field := range fieldPolicies {
+		if canSee(caller, user, field) {
+			view.set(field, fieldValue(user, field))
+		}
+	}
+	return view
+}
+
+func (view *UserView) set(field string, value string) {
+	switch field {
+	case "user-name":
+		view.Username = value
+	case "first-name":
+		view.FirstName = value
+	case "last-name":
+		view.LastName = value
+	case "email":
+		view.Email = value
+	case "email-verified":
+		view.EmailVerified = value == "true"
+	case "role":
+		view.Role = value
+	case "status":
+		view.Status = value
+	case "groups":
+		if value != "" {
+			view.Groups = ParseGroups(value)
+		}
+	}
+}
+
+func (view *UserView) get(field string) string {
+	switch field {
+	case "user-name":
+		return view.Username
+	case "first-name":
+		return view.FirstName
+	case "last-name":
+		return view.LastName
+	case "email":
+		return view.Email
+	case "email-verified":
+		return strconv.FormatBool(view.EmailVerified)
+	case "role":
+		return view.Role
+	case "status":
+		return view.Status
+	case "groups":
+		return Groups(view.Groups).String()
+	}
+	return ""
+}
+
+func fieldValue(user *User, field string) string {
+	switch field {
+	case "user-name":
+		return user.Username
+	case "first-name":
+		return user.FirstName
+	case "last-name":
+		return user.LastName
+	case "email":
+		return user.Email
+	case "email-verified":
+		return strconv.FormatBool(user.EmailVerified)
+	case "role":
+		return string(user.Role)
+	case "status":
+		return string(user.Status)
+	case "groups":
+		return user.Groups.String()
+	}
+	return ""
+}
+
+// NewUserViews shows each of users as caller is allowed to see them.
+func NewUserViews(users []*User, caller Caller) []*UserView {
+	views := make([]*UserView, 0, len(users))
+	for _, user := range users {
+		views = append(views, NewUserView(user, caller))
+	}
+	return views
+}
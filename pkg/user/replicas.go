@@ -0,0 +1,135 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/letitloose/user-app/pkg/logging"
+)
+
+// replica is a read-only copy of the users table. Reads are routed away
+// from it while it is down.
+type replica struct {
+	database *sql.DB
+	down     int32
+}
+
+func (replica *replica) healthy() bool {
+	return atomic.LoadInt32(&replica.down) == 0
+}
+
+func (replica *replica) setHealthy(healthy bool) {
+	down := int32(1)
+	if healthy {
+		down = 0
+	}
+	if atomic.SwapInt32(&replica.down, down) != down {
+		logging.Warnf("replica healthy: %v", healthy)
+	}
+}
+
+// recentWrites remembers which users were modified in the last window so
+// their reads can go to the primary until the replicas have caught up.
+type recentWrites struct {
+	window time.Duration
+
+	mutex     sync.Mutex
+	lastWrite time.Time
+	users     map[string]time.Time
+}
+
+func (writes *recentWrites) record(username string) {
+	writes.mutex.Lock()
+	defer writes.mutex.Unlock()
+	now := time.Now()
+	for name, written := range writes.users {
+		if now.Sub(written) > writes.window {
+			delete(writes.users, name)
+		}
+	}
+	writes.users[username] = now
+	writes.lastWrite = now
+}
+
+// recent reports whether username, or any user when username is empty, was
+// written within the window.
+func (writes *recentWrites) recent(username string) bool {
+	writes.mutex.Lock()
+	defer writes.mutex.Unlock()
+	written := writes.lastWrite
+	if username != "" {
+		written = writes.users[username]
+	}
+	return time.Since(written) <= writes.window
+}
+
+// SetReplicas routes reads to replicas, round robin, leaving writes on the
+// primary. Reads of a user modified within readYourWrites, and lists after
+// any modification within it, still go to the primary so a client sees its
+// own changes despite replication lag.
+func (repository *userRepository) SetReplicas(replicas []*sql.DB, readYourWrites time.Duration) {
+	repository.replicas = nil
+	for _, database := range replicas {
+		repository.replicas = append(repository.replicas, &replica{database: database})
+	}
+	repository.writes = &recentWrites{window: readYourWrites, users: map[string]time.Time{}}
+}
+
+// CheckReplicas pings every replica each interval until ctx is done, taking
+// those that fail out of rotation until they answer again.
+func (repository *userRepository) CheckReplicas(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, replica := range repository.replicas {
+			pingCtx, cancel := context.WithTimeout(ctx, interval)
+			replica.setHealthy(replica.database.PingContext(pingCtx) == nil)
+			cancel()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reader picks the database to read username from, or the whole table when
+// username is empty, returning the replica used or nil for the primary.
+func (repository *userRepository) reader(username string) (*sql.DB, *replica) {
+	if len(repository.replicas) == 0 || repository.writes.recent(username) {
+		return repository.database, nil
+	}
+
+	start := atomic.AddUint32(&repository.nextReplica, 1)
+	for i := range repository.replicas {
+		replica := repository.replicas[(int(start)+i)%len(repository.replicas)]
+		if replica.healthy() {
+			return replica.database, replica
+		}
+	}
+	return repository.database, nil
+}
+
+// wrote records a write to username for read-your-writes routing. It is
+// called even when the write fails, since it may have been applied anyway.
+func (repository *userRepository) wrote(username string) {
+	if repository.writes != nil {
+		repository.writes.record(username)
+	}
+}
+
+// HealthyReplicas counts the replicas currently taking reads.
+func (repository *userRepository) HealthyReplicas() int {
+	healthy := 0
+	for _, replica := range repository.replicas {
+		if replica.healthy() {
+			healthy++
+		}
+	}
+	return healthy
+}
@@ -1,9 +1,19 @@
 package user
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/go-sql-driver/mysql"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -26,10 +36,10 @@ func TestRepository(t *testing.T) {
 	t.Run("AddUser inserts a user into the users table", func(t *testing.T) {
 		userRepo := setup(t)
 		defer tearDown(userRepo)
-		userRepo.createUserTable()
+		userRepo.CreateTables(context.Background())
 		newUser := User{Username: "test", Password: "pwd", FirstName: "lou", LastName: "garwood", Email: "louis@mail.com"}
 
-		err := userRepo.addUser(&newUser)
+		err := userRepo.AddUser(context.Background(), &newUser)
 		if err != nil {
 			t.Fatalf("error inserting user: %s", err)
 		}
@@ -39,11 +49,11 @@ func TestRepository(t *testing.T) {
 		userRepo := setup(t)
 		defer tearDown(userRepo)
 
-		userRepo.createUserTable()
+		userRepo.CreateTables(context.Background())
 		newUser := User{Username: "test", Password: "pwd", FirstName: "lou", LastName: "garwood", Email: "louis@mail.com"}
-		err := userRepo.addUser(&newUser)
+		err := userRepo.AddUser(context.Background(), &newUser)
 
-		user, err := userRepo.findUser("test")
+		user, err := userRepo.FindUser(context.Background(), "test")
 		if err != nil {
 			t.Fatalf("failed to get user: %s", err)
 		}
@@ -56,26 +66,43 @@ func TestRepository(t *testing.T) {
 		}
 	})
 
+	t.Run("FindUser tells a missing user from a failed query", func(t *testing.T) {
+		userRepo := setup(t)
+		defer tearDown(userRepo)
+		userRepo.CreateTables(context.Background())
+
+		user, err := userRepo.FindUser(context.Background(), "nobody")
+		if err != nil || user.Username != "" {
+			t.Fatalf("got %+v, %v want an empty user", user, err)
+		}
+
+		userRepo.database.Close()
+		user, err = userRepo.FindUser(context.Background(), "nobody")
+		if err == nil {
+			t.Errorf("got %+v want an error from a closed database", user)
+		}
+	})
+
 	t.Run("RemoveUser removes the user from the database", func(t *testing.T) {
 		userRepo := setup(t)
 		defer tearDown(userRepo)
 
-		userRepo.createUserTable()
+		userRepo.CreateTables(context.Background())
 		user := &User{Username: "test", Password: "test", FirstName: "brian", LastName: "boblan", Email: "lou@email.borg"}
-		userRepo.addUser(user)
+		userRepo.AddUser(context.Background(), user)
 
-		err := userRepo.removeUser("test")
+		err := userRepo.RemoveUser(context.Background(), "test")
 		if err != nil {
 			t.Fatalf("failed to remove user: %s", err)
 		}
 
-		foundUser, err := userRepo.findUser("test")
+		foundUser, err := userRepo.FindUser(context.Background(), "test")
 		if err != nil {
 			t.Fatalf("failed to find user: %s", err)
 		}
 
-		if *foundUser != (User{}) {
-			t.Fatalf("failed to remove user: %s", foundUser)
+		if !reflect.DeepEqual(*foundUser, User{}) {
+			t.Fatalf("failed to remove user: %+v", foundUser)
 		}
 	})
 
@@ -83,23 +110,333 @@ func TestRepository(t *testing.T) {
 		userRepo := setup(t)
 		defer tearDown(userRepo)
 
-		userRepo.createUserTable()
+		userRepo.CreateTables(context.Background())
 		user := &User{Username: "test", Password: "test", FirstName: "brian", LastName: "boblan", Email: "lou@email.borg"}
-		userRepo.addUser(user)
+		userRepo.AddUser(context.Background(), user)
 
 		user.LastName = "updateski"
-		err := userRepo.updateUser(user)
+		err := userRepo.UpdateUser(context.Background(), user)
 		if err != nil {
 			t.Fatalf("failed to remove user: %s", err)
 		}
 
-		foundUser, err := userRepo.findUser("test")
+		foundUser, err := userRepo.FindUser(context.Background(), "test")
 		if err != nil {
 			t.Fatalf("failed to find user: %s", err)
 		}
 
 		if foundUser.LastName != "updateski" {
-			t.Fatalf("failed to update user: %s", foundUser)
+			t.Fatalf("failed to update user: %+v", foundUser)
+		}
+	})
+
+	t.Run("RemoveLoginAttempts forgets old failures but keeps lockouts and recent ones", func(t *testing.T) {
+		userRepo := setup(t)
+		defer tearDown(userRepo)
+		ctx := context.Background()
+		userRepo.CreateTables(ctx)
+
+		now := time.Now()
+		since := now.Add(-15 * time.Minute)
+		userRepo.AddLoginFailure(ctx, "account:old", now.Add(-time.Hour), now.Add(-2*time.Hour))
+		userRepo.AddLoginFailure(ctx, "account:locked", now.Add(-time.Hour), now.Add(-2*time.Hour))
+		userRepo.LockLogin(ctx, "account:locked", now.Add(time.Hour))
+		userRepo.AddLoginFailure(ctx, "account:recent", now, since)
+
+		removed, err := userRepo.RemoveLoginAttempts(ctx, since, now)
+		if err != nil || removed != 1 {
+			t.Fatalf("got %d, %v want one key removed", removed, err)
+		}
+		for key, want := range map[string]bool{"account:old": false, "account:locked": true, "account:recent": true} {
+			attempts, err := userRepo.FindLoginAttempts(ctx, key)
+			if err != nil || (attempts != nil) != want {
+				t.Errorf("got %+v, %v for %s want kept %v", attempts, err, key, want)
+			}
+		}
+	})
+
+	t.Run("AddAuditEvent keeps the chain whole when instances append at once", func(t *testing.T) {
+		ctx := context.Background()
+		dsn := "file:" + filepath.Join(t.TempDir(), "audit.db") + "?_busy_timeout=10000"
+		instances := []*userRepository{}
+		for i := 0; i < 2; i++ {
+			db, err := sql.Open("sqlite3", dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			instance := NewUserRepository(db)
+			if err = instance.CreateTables(ctx); err != nil {
+				t.Fatalf("error creating tables: %s", err)
+			}
+			instances = append(instances, instance)
+		}
+
+		var wait sync.WaitGroup
+		errs := make(chan error, 200)
+		for i := 0; i < 200; i++ {
+			wait.Add(1)
+			go func(instance *userRepository, i int) {
+				defer wait.Done()
+				errs <- instance.AddAuditEvent(ctx, &AuditEvent{Time: time.Now(), Action: AuditLogin, Subject: fmt.Sprint("user", i)})
+			}(instances[i%2], i)
+		}
+		wait.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatalf("error appending: %s", err)
+			}
+		}
+
+		checked, err := NewUserService(instances[0], nil).VerifyAudit(ctx)
+		if err != nil || checked != 200 {
+			t.Fatalf("got %d events checked, %v want 200 in an unbroken chain", checked, err)
 		}
 	})
+
+	t.Run("CreateTables adds the columns tables from older versions lack", func(t *testing.T) {
+		userRepo := setup(t)
+		defer tearDown(userRepo)
+		ctx := context.Background()
+		userRepo.database.SetMaxOpenConns(1)
+		_, err := userRepo.database.Exec(`create table users (username varchar(255) unique, password varchar(255),
+			firstname varchar(255), lastname varchar(255), email varchar(255));`)
+		if err == nil {
+			_, err = userRepo.database.Exec(`insert into users values ('old', 'pwd', 'lou', 'garwood', 'lou@mail.com')`)
+		}
+		if err != nil {
+			t.Fatalf("error creating the old table: %s", err)
+		}
+
+		for i := 0; i < 2; i++ {
+			err = userRepo.CreateTables(ctx)
+			if err != nil {
+				t.Fatalf("error creating tables, run %d: %s", i+1, err)
+			}
+		}
+		found, err := userRepo.FindUser(ctx, "old")
+		if err != nil || found.Email != "lou@mail.com" || found.Role != RoleUser || found.Status != StatusActive || found.EmailVerified {
+			t.Errorf("got %+v, %v want the old user as an active, unverified user", found, err)
+		}
+	})
+
+	t.Run("retryWrite retries transient errors up to the limit", func(t *testing.T) {
+		userRepo := setup(t)
+		defer tearDown(userRepo)
+		userRepo.SetWriteRetries(2)
+
+		attempts := 0
+		err := userRepo.retryWrite(context.Background(), func() error {
+			attempts++
+			if attempts < 3 {
+				return &mysql.MySQLError{Number: mysqlDeadlock, Message: "Deadlock found"}
+			}
+			return nil
+		})
+		if err != nil || attempts != 3 {
+			t.Errorf("got %v after %d attempts want success after 3", err, attempts)
+		}
+
+		attempts = 0
+		err = userRepo.retryWrite(context.Background(), func() error {
+			attempts++
+			return driver.ErrBadConn
+		})
+		if !errors.Is(err, driver.ErrBadConn) || attempts != 3 {
+			t.Errorf("got %v after %d attempts want ErrBadConn after 3", err, attempts)
+		}
+
+		attempts = 0
+		err = userRepo.retryWrite(context.Background(), func() error {
+			attempts++
+			return &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+		})
+		if err == nil || attempts != 1 {
+			t.Errorf("non-transient error retried: %v after %d attempts", err, attempts)
+		}
+
+		for _, sent := range []error{mysql.ErrInvalidConn, syscall.ECONNRESET} {
+			attempts = 0
+			err = userRepo.retryWrite(context.Background(), func() error {
+				attempts++
+				return sent
+			})
+			if err != sent || attempts != 1 {
+				t.Errorf("write that may have been applied retried: %v after %d attempts", err, attempts)
+			}
+		}
+	})
+
+	t.Run("reads go to replicas except just after a write or when they fail", func(t *testing.T) {
+		openUsers := func(name string, firstName string) *sql.DB {
+			db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), name+".db"))
+			if err != nil {
+				t.Fatalf("failed to connect to DB: %s", err)
+			}
+			repository := NewUserRepository(db)
+			repository.CreateTables(context.Background())
+			err = repository.AddUser(context.Background(), &User{Username: "test", Password: "pwd", FirstName: firstName})
+			if err != nil {
+				t.Fatalf("failed to add user: %s", err)
+			}
+			return db
+		}
+		primary := openUsers("primary", "primary")
+		defer primary.Close()
+		replica := openUsers("replica", "replica")
+
+		userRepo := NewUserRepository(primary)
+		userRepo.SetReplicas([]*sql.DB{replica}, 50*time.Millisecond)
+		firstName := func() string {
+			user, err := userRepo.FindUser(context.Background(), "test")
+			if err != nil {
+				t.Fatalf("error finding user: %s", err)
+			}
+			return user.FirstName
+		}
+
+		if got := firstName(); got != "replica" {
+			t.Errorf("read before any write got %q want %q", got, "replica")
+		}
+
+		err := userRepo.UpdateUser(context.Background(), &User{Username: "test", Password: "pwd", FirstName: "updated"})
+		if err != nil {
+			t.Fatalf("error updating user: %s", err)
+		}
+		if got := firstName(); got != "updated" {
+			t.Errorf("read after a write got %q want %q", got, "updated")
+		}
+
+		time.Sleep(60 * time.Millisecond)
+		if got := firstName(); got != "replica" {
+			t.Errorf("read after the window got %q want %q", got, "replica")
+		}
+
+		replica.Close()
+		if got := firstName(); got != "updated" {
+			t.Errorf("read from a failed replica got %q want %q", got, "updated")
+		}
+		if userRepo.HealthyReplicas() != 0 {
+			t.Errorf("failed replica still in rotation")
+		}
+	})
+
+	t.Run("batch methods change all of the users or none of them", func(t *testing.T) {
+		userRepo := setup(t)
+		defer tearDown(userRepo)
+		userRepo.database.SetMaxOpenConns(1)
+		userRepo.CreateTables(context.Background())
+
+		users := []*User{}
+		for i := 0; i < 250; i++ {
+			users = append(users, &User{Username: fmt.Sprintf("user%d", i), Password: "pwd"})
+		}
+		err := userRepo.AddUsers(context.Background(), users)
+		if err != nil {
+			t.Fatalf("error adding users: %s", err)
+		}
+		listed, _ := userRepo.ListAll(context.Background())
+		if len(listed) != 250 {
+			t.Fatalf("got %d users want 250", len(listed))
+		}
+
+		err = userRepo.UpdateUsers(context.Background(), []*User{{Username: "user1", FirstName: "changed"}, {Username: "missing"}})
+		if err == nil {
+			t.Fatal("expected an error updating a missing user")
+		}
+		user, _ := userRepo.FindUser(context.Background(), "user1")
+		if user.FirstName != "" {
+			t.Errorf("update not rolled back, got first name %q", user.FirstName)
+		}
+
+		err = userRepo.RemoveUsers(context.Background(), []string{"user1", "user2", "missing"})
+		if err == nil {
+			t.Fatal("expected an error removing a missing user")
+		}
+		err = userRepo.RemoveUsers(context.Background(), usernames(users[:200]))
+		if err != nil {
+			t.Fatalf("error removing users: %s", err)
+		}
+		listed, _ = userRepo.ListAll(context.Background())
+		if len(listed) != 50 {
+			t.Errorf("got %d users want 50", len(listed))
+		}
+	})
+}
+
+// benchmarkRepository uses a SQLite file rather than memory so the numbers
+// include writing to disk, as they would against a real database.
+func benchmarkRepository(b *testing.B) *userRepository {
+	db, err := sql.Open("sqlite3", filepath.Join(b.TempDir(), "users.db"))
+	if err != nil {
+		b.Fatalf("failed to connect to DB: %s", err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	userRepo := NewUserRepository(db)
+	err = userRepo.CreateTables(context.Background())
+	if err != nil {
+		b.Fatalf("failed to create user table: %s", err)
+	}
+	return userRepo
+}
+
+func benchmarkUsers(count int) []*User {
+	users := make([]*User, 0, count)
+	for i := 0; i < count; i++ {
+		users = append(users, &User{Username: fmt.Sprintf("user%d", i), Password: "pwd", FirstName: "lou", LastName: "garwood", Email: "louis@mail.com"})
+	}
+	return users
+}
+
+func BenchmarkAddUser(b *testing.B) {
+	userRepo := benchmarkRepository(b)
+	users := benchmarkUsers(b.N)
+	b.ResetTimer()
+
+	for _, user := range users {
+		if err := userRepo.AddUser(context.Background(), user); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAddUsers(b *testing.B) {
+	userRepo := benchmarkRepository(b)
+	users := benchmarkUsers(b.N)
+	b.ResetTimer()
+
+	for start := 0; start < len(users); start += batchSize {
+		if err := userRepo.AddUsers(context.Background(), users[start:batchEnd(start, len(users))]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRemoveUser(b *testing.B) {
+	userRepo := benchmarkRepository(b)
+	users := benchmarkUsers(b.N)
+	userRepo.AddUsers(context.Background(), users)
+	b.ResetTimer()
+
+	for _, user := range users {
+		if err := userRepo.RemoveUser(context.Background(), user.Username); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRemoveUsers(b *testing.B) {
+	userRepo := benchmarkRepository(b)
+	users := benchmarkUsers(b.N)
+	userRepo.AddUsers(context.Background(), users)
+	names := usernames(users)
+	b.ResetTimer()
+
+	for start := 0; start < len(names); start += batchSize {
+		if err := userRepo.RemoveUsers(context.Background(), names[start:batchEnd(start, len(names))]); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
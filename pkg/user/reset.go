@@ -0,0 +1,190 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/logging"
+	"github.com/letitloose/user-app/pkg/mail"
+	"github.com/letitloose/user-app/pkg/tracing"
+)
+
+var errNoMailer = errors.New("no mailer configured")
+
+// RequestPasswordReset emails a single-use link for choosing a new password
+// to the user whose username or email address is login. Any earlier link
+// stops working. Nothing happens for a login that matches no user with an
+// email address, and callers must not tell the difference.
+func (service *UserService) RequestPasswordReset(ctx context.Context, login string) error {
+	ctx, span := tracing.Start(ctx, "UserService.RequestPasswordReset")
+	defer span.End()
+
+	users, err := service.findLogin(ctx, login)
+	if err == nil && len(users) > 0 && service.mailer == nil {
+		err = errNoMailer
+	}
+	for _, user := range users {
+		if err != nil {
+			break
+		}
+		err = service.sendResetLink(ctx, user)
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("password_reset").Inc()
+		return err
+	}
+	passwordResets.With("requested").Inc()
+	return nil
+}
+
+// findLogin returns the users with login as their username or, when it
+// looks like an email address, as their email.
+func (service *UserService) findLogin(ctx context.Context, login string) ([]*User, error) {
+	login = strings.TrimSpace(login)
+	if login == "" {
+		return nil, nil
+	}
+	if strings.Contains(login, "@") {
+		users := []*User{}
+		err := service.store.EachUser(ctx, ListFilter{Email: login}, func(user *User) error {
+			copied := *user
+			users = append(users, &copied)
+			return nil
+		})
+		return users, err
+	}
+
+	user, err := service.store.FindUser(ctx, login)
+	if err != nil || user.Username == "" {
+		return nil, err
+	}
+	return []*User{user}, nil
+}
+
+func (service *UserService) sendResetLink(ctx context.Context, user *User) error {
+	if user.Email == "" {
+		return nil
+	}
+	secret, hash, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	ttl := config.GetConfig().Password.ResetTokenTTL
+	err = service.store.WithTx(ctx, nil, func(tx Store) error {
+		err := tx.RemoveTokens(ctx, TokenPasswordReset, user.Username)
+		if err != nil {
+			return err
+		}
+		return tx.AddToken(ctx, &Token{Kind: TokenPasswordReset, Hash: hash, Username: user.Username, Expires: time.Now().Add(ttl)})
+	})
+	if err != nil {
+		return err
+	}
+
+	link := publicURL("/password/reset", url.Values{"token": {secret}})
+	return service.mailer.Send(ctx, &mail.Message{
+		To:      []string{user.Email},
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password for %s.\n\n"+
+			"To choose a new password, open this link within %s:\n\n%s\n\n"+
+			"If it wasn't you, you can ignore this email and your password will stay the same.\n",
+			user.Username, ttl, link),
+	})
+}
+
+// CheckResetToken reports whether secret is a password reset link that can
+// still be used.
+func (service *UserService) CheckResetToken(ctx context.Context, secret string) (bool, error) {
+	token, err := service.store.FindToken(ctx, TokenPasswordReset, hashToken(secret))
+	return token != nil, err
+}
+
+// ResetPassword sets the password of the user the reset link secret was
+// sent to, through the password policy, and uses up the link. Every session
+// of the user is logged out, in case whoever made them knew the old
+// password. It returns
+// ErrInvalidToken for a link that is unknown, expired or already used, and
+// a *PasswordPolicyError, leaving the link usable, for a weak password.
+func (service *UserService) ResetPassword(ctx context.Context, secret string, password string) error {
+	ctx, span := tracing.Start(ctx, "UserService.ResetPassword")
+	defer span.End()
+
+	var user *User
+	var before User
+	err := service.store.WithTx(ctx, nil, func(tx Store) error {
+		token, err := tx.TakeToken(ctx, TokenPasswordReset, hashToken(secret))
+		if err != nil {
+			return err
+		}
+		if token == nil {
+			return ErrInvalidToken
+		}
+		user, err = tx.FindUser(ctx, token.Username)
+		if err != nil {
+			return err
+		}
+		if user.Username == "" {
+			return ErrInvalidToken
+		}
+
+		before = *user
+		user.Password = password
+		err = setPassword(user)
+		if err != nil {
+			return err
+		}
+		err = tx.UpdateUser(ctx, user)
+		if err == nil {
+			err = tx.RemoveTokens(ctx, TokenPasswordReset, user.Username)
+		}
+		if err == nil {
+			err = tx.RemoveTokens(ctx, TokenSession, user.Username)
+		}
+		return err
+	})
+	if err == ErrInvalidToken {
+		passwordResets.With("invalid").Inc()
+		return err
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("password_reset").Inc()
+		return err
+	}
+	passwordResets.With("completed").Inc()
+	service.auditChange(ctx, &before, user)
+
+	service.notify(ctx, user, "Your password was changed",
+		fmt.Sprintf("The password for %s was just changed using a reset link.\n\n"+
+			"If it wasn't you, reset it again at %s and check your email account is secure.\n",
+			user.Username, publicURL("/password/forgot", nil)))
+	return nil
+}
+
+// notify emails user about something that has already happened, so
+// failing to is only logged. Users without an email address are skipped.
+func (service *UserService) notify(ctx context.Context, user *User, subject string, body string) {
+	if service.mailer == nil || user.Email == "" {
+		return
+	}
+	err := service.mailer.Send(ctx, &mail.Message{To: []string{user.Email}, Subject: subject, Body: body})
+	if err != nil {
+		logging.Errorf("error sending %q to %s: %s", subject, user.Username, err)
+	}
+}
+
+// publicURL is the absolute URL of path on the app, for links in emails.
+func publicURL(path string, query url.Values) string {
+	link := strings.TrimRight(config.GetConfig().Server.PublicURL, "/") + path
+	if len(query) > 0 {
+		link += "?" + query.Encode()
+	}
+	return link
+}
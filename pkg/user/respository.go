@@ -1,72 +1,374 @@
 package user
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/letitloose/user-app/pkg/tracing"
 )
 
+// User is a stored user, password hash and all. Responses use UserView
+// and request bodies UserInput instead, so it is only marshalled for the
+// remote cache.
 type User struct {
-	Username  string `json:"user-name"`
-	Password  string `json:"password"`
-	FirstName string `json:"first-name"`
-	LastName  string `json:"last-name"`
-	Email     string `json:"email"`
+	Username      string `json:"user-name"`
+	Password      string `json:"password"`
+	FirstName     string `json:"first-name"`
+	LastName      string `json:"last-name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email-verified"`
+	Role          Role   `json:"role"`
+	Status        Status `json:"status"`
+	Groups        Groups `json:"groups"`
+}
+
+// Status says whether a user may log in.
+type Status string
+
+const (
+	StatusActive Status = "active"
+	// StatusPending users signed up and wait for an admin to approve them.
+	StatusPending Status = "pending"
+)
+
+// Groups are the names of the groups a user belongs to. They are stored as
+// one comma separated column.
+type Groups []string
+
+// ParseGroups reads a comma separated list of group names, dropping blanks
+// and repeats.
+func ParseGroups(list string) Groups {
+	groups := Groups{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && !groups.Contains(name) {
+			groups = append(groups, name)
+		}
+	}
+	return groups
+}
+
+// Contains reports whether name is one of groups.
+func (groups Groups) Contains(name string) bool {
+	for _, group := range groups {
+		if group == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (groups Groups) String() string {
+	return strings.Join(groups, ",")
+}
+
+func (groups Groups) Value() (driver.Value, error) {
+	return groups.String(), nil
+}
+
+func (groups *Groups) Scan(value any) error {
+	switch value := value.(type) {
+	case nil:
+		*groups = nil
+	case string:
+		*groups = ParseGroups(value)
+	case []byte:
+		*groups = ParseGroups(string(value))
+	default:
+		return fmt.Errorf("cannot read groups from %T", value)
+	}
+	if len(*groups) == 0 {
+		*groups = nil
+	}
+	return nil
+}
+
+// userColumns are the columns of users read into a User, in the order of
+// userFields.
+const userColumns = "username, password, firstname, lastname, email, email_verified, role, status, group_names"
+
+// userFields are the destinations to scan userColumns into.
+func userFields(user *User) []any {
+	return []any{&user.Username, &user.Password, &user.FirstName, &user.LastName, &user.Email, &user.EmailVerified, &user.Role, &user.Status, &user.Groups}
+}
+
+// CanceledError is returned when a repository call is abandoned because its
+// context was canceled or timed out. Err is the context's error, so callers
+// can tell a client disconnect from a deadline with errors.Is.
+type CanceledError struct {
+	Err error
+}
+
+func (err *CanceledError) Error() string {
+	return "user operation canceled: " + err.Err.Error()
+}
+
+func (err *CanceledError) Unwrap() error {
+	return err.Err
 }
 
 type userRepository struct {
-	database *sql.DB
+	database     *sql.DB
+	statements   *statementCache
+	writeRetries int
+	// audits makes appends to the audit log from this process take turns.
+	audits *sync.Mutex
+
+	replicas    []*replica
+	writes      *recentWrites
+	nextReplica uint32
+
+	// tx is set on the repository WithTx hands to its callback, so every
+	// statement runs in the transaction. depth counts nested savepoints.
+	tx    *sql.Tx
+	depth int
 }
 
 func NewUserRepository(database *sql.DB) *userRepository {
-	return &userRepository{database: database}
+	return &userRepository{database: database, statements: newStatementCache(), writeRetries: defaultWriteRetries, audits: &sync.Mutex{}}
+}
+
+// Close releases the prepared statements. The databases are left open.
+func (repository *userRepository) Close() error {
+	return repository.statements.close()
 }
 
-func (repository *userRepository) listAll() []*User {
-	rows, _ := repository.database.Query(`SELECT username, password, firstname, lastname, email FROM users;`)
+// query runs query on database as a prepared statement, preparing it the
+// first time.
+func (repository *userRepository) query(ctx context.Context, database *sql.DB, query string, args ...any) (*sql.Rows, error) {
+	if repository.tx != nil {
+		return repository.tx.QueryContext(ctx, query, args...)
+	}
+	statement, err := repository.statements.get(ctx, database, query)
+	if err != nil {
+		return nil, err
+	}
+	return statement.QueryContext(ctx, args...)
+}
+
+// exec runs statement on the primary as a prepared statement, retrying
+// transient errors. In a transaction it is run once, since a deadlock there
+// rolls back the whole transaction.
+func (repository *userRepository) exec(ctx context.Context, statement string, args ...any) (sql.Result, error) {
+	if repository.tx != nil {
+		return repository.tx.ExecContext(ctx, statement, args...)
+	}
+	prepared, err := repository.statements.get(ctx, repository.database, statement)
+	if err != nil {
+		return nil, err
+	}
+
+	var result sql.Result
+	err = repository.retryWrite(ctx, func() (err error) {
+		result, err = prepared.ExecContext(ctx, args...)
+		return err
+	})
+	return result, err
+}
+
+func (repository *userRepository) ListAll(ctx context.Context) ([]*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users;`
+	ctx, span := startQuerySpan(ctx, "userRepository.ListAll", query)
+	defer span.End()
+
+	database, replica := repository.reader("")
+	rows, err := repository.query(ctx, database, query)
+	if err != nil && replica != nil && ctx.Err() == nil {
+		span.RecordError(err)
+		replica.setHealthy(false)
+		rows, err = repository.query(ctx, repository.database, query)
+	}
+	if err != nil {
+		span.RecordError(err)
+		return nil, contextError(ctx, err)
+	}
 	defer rows.Close()
 
 	users := []*User{}
 
 	for rows.Next() {
-		var (
-			username  string
-			password  string
-			firstname string
-			lastname  string
-			email     string
-		)
+		user := &User{}
+		rows.Scan(userFields(user)...)
+		users = append(users, user)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		span.RecordError(err)
+		return nil, contextError(ctx, err)
+	}
+
+	return users, nil
+}
+
+// ListFilter narrows a listing. Search matches any part of the username,
+// names or email, Prefix the start of the username, Domain the email domain,
+// Email the whole address and Status the status. Empty fields match
+// everything.
+type ListFilter struct {
+	Search string
+	Prefix string
+	Domain string
+	Email  string
+	Status Status
+}
+
+// IsEmpty reports whether filter matches every user.
+func (filter ListFilter) IsEmpty() bool {
+	return filter == ListFilter{}
+}
+
+// where builds the WHERE clause for filter, escaping LIKE wildcards in the
+// values so they match literally. The escape character is ! because MySQL
+// and SQLite disagree on how to write a backslash in a string literal.
+func (filter ListFilter) where() (string, []any) {
+	escape := strings.NewReplacer(`!`, `!!`, `%`, `!%`, `_`, `!_`).Replace
+	conditions, args := []string{}, []any{}
+	if filter.Search != "" {
+		pattern := "%" + escape(filter.Search) + "%"
+		conditions = append(conditions, `(username LIKE ? ESCAPE '!' OR firstname LIKE ? ESCAPE '!' OR lastname LIKE ? ESCAPE '!' OR email LIKE ? ESCAPE '!')`)
+		args = append(args, pattern, pattern, pattern, pattern)
+	}
+	if filter.Prefix != "" {
+		conditions = append(conditions, `username LIKE ? ESCAPE '!'`)
+		args = append(args, escape(filter.Prefix)+"%")
+	}
+	if filter.Domain != "" {
+		conditions = append(conditions, `email LIKE ? ESCAPE '!'`)
+		args = append(args, "%@"+escape(strings.TrimPrefix(filter.Domain, "@")))
+	}
+	if filter.Email != "" {
+		conditions = append(conditions, `email = ?`)
+		args = append(args, filter.Email)
+	}
+	if filter.Status != "" {
+		conditions = append(conditions, `status = ?`)
+		args = append(args, string(filter.Status))
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
 
-		rows.Scan(&username, &password, &firstname, &lastname, &email)
+// EachUser calls fn with every user matching filter, in username order, as
+// the rows are read, so the whole table is never held in memory. The User
+// passed to fn is reused for the next row. Returning an error from fn stops
+// the listing and EachUser returns it.
+func (repository *userRepository) EachUser(ctx context.Context, filter ListFilter, fn func(user *User) error) error {
+	where, args := filter.where()
+	query := `SELECT ` + userColumns + ` FROM users` + where + ` ORDER BY username;`
+	ctx, span := startQuerySpan(ctx, "userRepository.EachUser", query)
+	defer span.End()
+
+	database, replica := repository.reader("")
+	rows, err := repository.query(ctx, database, query, args...)
+	if err != nil && replica != nil && ctx.Err() == nil {
+		span.RecordError(err)
+		replica.setHealthy(false)
+		rows, err = repository.query(ctx, repository.database, query, args...)
+	}
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	defer rows.Close()
 
-		users = append(users, &User{
-			Username:  username,
-			Password:  password,
-			FirstName: firstname,
-			LastName:  lastname,
-			Email:     email,
-		})
+	user := &User{}
+	for rows.Next() {
+		err = rows.Scan(userFields(user)...)
+		if err == nil {
+			err = fn(user)
+		}
+		if err != nil {
+			span.RecordError(err)
+			return contextError(ctx, err)
+		}
 	}
 
-	return users
+	err = rows.Err()
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
 }
 
-func (repository *userRepository) createUserTable() error {
+// CreateTables creates any of the tables the repository uses that do not
+// exist yet.
+func (repository *userRepository) CreateTables(ctx context.Context) error {
+	err := repository.createUserTable(ctx)
+	if err == nil {
+		err = repository.createTokenTable(ctx)
+	}
+	if err == nil {
+		err = repository.createInvitationTable(ctx)
+	}
+	if err == nil {
+		err = repository.createTwoFactorTable(ctx)
+	}
+	if err == nil {
+		err = repository.createPasskeyTable(ctx)
+	}
+	if err == nil {
+		err = repository.createLoginAttemptTable(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	return repository.createAuditTable(ctx)
+}
+
+func (repository *userRepository) createUserTable(ctx context.Context) error {
+
+	_, err := repository.database.ExecContext(ctx, `create table if not exists users (username varchar(255) unique,
+		password varchar(255),
+		firstname varchar(255),
+		lastname varchar(255),
+		email varchar(255),
+		email_verified boolean not null default false,
+		role varchar(32) not null default 'user',
+		status varchar(16) not null default 'active',
+		group_names text);`)
+	if err != nil {
+		return contextError(ctx, err)
+	}
 
-	_, err := repository.database.Exec(`create table if not exists users (username varchar(255) unique, 
-		password varchar(255), 
-		firstname varchar(255), 
-		lastname varchar(255), 
-		email varchar(255));`)
+	// Tables created before these columns existed get them added.
+	err = repository.addColumn(ctx, "users", "email_verified", "boolean not null default false")
+	if err != nil {
+		return err
+	}
+	err = repository.addColumn(ctx, "users", "role", "varchar(32) not null default 'user'")
 	if err != nil {
 		return err
 	}
+	err = repository.addColumn(ctx, "users", "status", "varchar(16) not null default 'active'")
+	if err != nil {
+		return err
+	}
+	return repository.addColumn(ctx, "users", "group_names", "text")
+}
 
-	return nil
+// addColumn adds column to table unless it is already there. Neither MySQL
+// nor SQLite has ADD COLUMN IF NOT EXISTS, so it looks first.
+func (repository *userRepository) addColumn(ctx context.Context, table string, column string, definition string) error {
+	rows, err := repository.database.QueryContext(ctx, "select "+column+" from "+table+" limit 0")
+	if err == nil {
+		return rows.Close()
+	}
+	_, err = repository.database.ExecContext(ctx, "alter table "+table+" add column "+column+" "+definition)
+	return contextError(ctx, err)
 }
 
-func (repository *userRepository) userTableExists() bool {
+func (repository *userRepository) userTableExists(ctx context.Context) bool {
 
-	rows, err := repository.database.Query(`desc users`)
+	rows, err := repository.database.QueryContext(ctx, `desc users`)
 	if rows != nil {
 		defer rows.Close()
 	}
@@ -78,13 +380,17 @@ func (repository *userRepository) userTableExists() bool {
 	return false
 }
 
-func (repository *userRepository) addUser(user *User) error {
+func (repository *userRepository) AddUser(ctx context.Context, user *User) error {
 
-	insertStatement := "insert into users (username, password, firstname, lastname, email) values (?, ?, ?, ?, ?)"
+	insertStatement := "insert into users (" + userColumns + ") values (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	ctx, span := startQuerySpan(ctx, "userRepository.AddUser", insertStatement)
+	defer span.End()
 
-	result, err := repository.database.Exec(insertStatement, user.Username, user.Password, user.FirstName, user.LastName, user.Email)
+	result, err := repository.exec(ctx, insertStatement, user.Username, user.Password, user.FirstName, user.LastName, user.Email, user.EmailVerified, storedRole(user), storedStatus(user), user.Groups)
+	repository.wrote(user.Username)
 	if err != nil {
-		return err
+		span.RecordError(err)
+		return contextError(ctx, err)
 	}
 
 	numRows, err := result.RowsAffected()
@@ -98,13 +404,36 @@ func (repository *userRepository) addUser(user *User) error {
 	return nil
 }
 
-func (repository *userRepository) updateUser(user *User) error {
+// updateStatement changes everything about a user but their username. An
+// empty role or status keeps the one they have.
+const updateStatement = "update users set password=?, firstname=?, lastname=?, email=?, email_verified=?, role=coalesce(nullif(?, ''), role), status=coalesce(nullif(?, ''), status), group_names=? where username=?;"
+
+// storedRole is the role a new user is added with.
+func storedRole(user *User) string {
+	if user.Role == RoleAnonymous {
+		return string(RoleUser)
+	}
+	return string(user.Role)
+}
+
+// storedStatus is the status a new user is added with.
+func storedStatus(user *User) string {
+	if user.Status == "" {
+		return string(StatusActive)
+	}
+	return string(user.Status)
+}
+
+func (repository *userRepository) UpdateUser(ctx context.Context, user *User) error {
 
-	updateStatment := "update users set password=?, firstname=?, lastname=?, email=? where username=?;"
+	ctx, span := startQuerySpan(ctx, "userRepository.UpdateUser", updateStatement)
+	defer span.End()
 
-	result, err := repository.database.Exec(updateStatment, user.Password, user.FirstName, user.LastName, user.Email, user.Username)
+	result, err := repository.exec(ctx, updateStatement, user.Password, user.FirstName, user.LastName, user.Email, user.EmailVerified, string(user.Role), string(user.Status), user.Groups, user.Username)
+	repository.wrote(user.Username)
 	if err != nil {
-		return err
+		span.RecordError(err)
+		return contextError(ctx, err)
 	}
 
 	numRows, err := result.RowsAffected()
@@ -118,38 +447,54 @@ func (repository *userRepository) updateUser(user *User) error {
 	return nil
 }
 
-func (repository *userRepository) findUser(usernameParam string) (*User, error) {
-	query := "select username,  password, firstname, lastname, email from users where username = ?"
-
-	rows := repository.database.QueryRow(query, usernameParam)
-
-	var (
-		username  string
-		password  string
-		firstname string
-		lastname  string
-		email     string
-	)
-
-	rows.Scan(&username, &password, &firstname, &lastname, &email)
+func (repository *userRepository) FindUser(ctx context.Context, usernameParam string) (*User, error) {
+	query := "select " + userColumns + " from users where username = ?"
+	ctx, span := startQuerySpan(ctx, "userRepository.FindUser", query)
+	defer span.End()
+
+	user := &User{}
+	scan := func(database *sql.DB) error {
+		*user = User{}
+		fields := userFields(user)
+		if repository.tx != nil {
+			return repository.tx.QueryRowContext(ctx, query, usernameParam).Scan(fields...)
+		}
+		statement, err := repository.statements.get(ctx, database, query)
+		if err != nil {
+			return err
+		}
+		return statement.QueryRowContext(ctx, usernameParam).Scan(fields...)
+	}
 
-	user := &User{
-		Username:  username,
-		Password:  password,
-		FirstName: firstname,
-		LastName:  lastname,
-		Email:     email,
+	database, replica := repository.reader(usernameParam)
+	err := scan(database)
+	if err != nil && err != sql.ErrNoRows && replica != nil && ctx.Err() == nil {
+		span.RecordError(err)
+		replica.setHealthy(false)
+		err = scan(repository.database)
+	}
+	if err == sql.ErrNoRows {
+		return &User{}, nil
+	}
+	if err != nil {
+		span.RecordError(err)
+		return nil, contextError(ctx, err)
 	}
 
 	return user, nil
 }
 
-func (repository *userRepository) removeUser(username string) error {
+func (repository *userRepository) RemoveUser(ctx context.Context, username string) error {
 
 	deleteQuery := "delete from users where username = ?;"
-	result, err := repository.database.Exec(deleteQuery, username)
+	ctx, span := startQuerySpan(ctx, "userRepository.RemoveUser", deleteQuery)
+	defer span.End()
+
+	result, err := repository.exec(ctx, deleteQuery, username)
+	repository.wrote(username)
 	if err != nil {
-		return err
+		span.RecordError(err)
+		return contextError(ctx, err)
 	}
 
 	rowsAffected, err := result.RowsAffected()
@@ -162,3 +507,18 @@ func (repository *userRepository) removeUser(username string) error {
 	}
 	return nil
 }
+
+func startQuerySpan(ctx context.Context, name string, statement string) (context.Context, *tracing.Span) {
+	ctx, span := tracing.GetTracer().Start(ctx, name, tracing.SpanKindClient)
+	span.SetAttribute("db.statement", statement)
+	return ctx, span
+}
+
+// contextError replaces err with a CanceledError when it was caused by ctx
+// ending, since drivers report that in their own ways.
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return &CanceledError{Err: ctx.Err()}
+	}
+	return err
+}
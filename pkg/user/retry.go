@@ -0,0 +1,80 @@
+package user
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const defaultWriteRetries = 3
+
+// MySQL error numbers for failures that succeed when the statement is
+// simply run again.
+const (
+	mysqlLockWaitTimeout = 1205
+	mysqlDeadlock        = 1213
+)
+
+// mysqlDuplicateEntry is the MySQL error number for a unique key violation.
+const mysqlDuplicateEntry = 1062
+
+// SetWriteRetries sets how many times a write is retried after a transient
+// error, 0 for never.
+func (repository *userRepository) SetWriteRetries(retries int) {
+	repository.writeRetries = retries
+}
+
+// retryWrite runs write, running it again with exponential backoff while it
+// fails with a transient error and retries remain.
+func (repository *userRepository) retryWrite(ctx context.Context, write func() error) error {
+	backoff := 20 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := write()
+		if err == nil || attempt >= repository.writeRetries || !isTransient(err) {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return contextError(ctx, err)
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// isTransient reports whether err is a deadlock, lock timeout or connection
+// failure that left the write undone, so it is safe to run again. Writes are
+// not idempotent, so a connection lost after the statement was sent, such as
+// mysql.ErrInvalidConn or ECONNRESET, is not retried: it may have been
+// applied.
+func isTransient(err error) bool {
+	var mysqlError *mysql.MySQLError
+	if errors.As(err, &mysqlError) {
+		return mysqlError.Number == mysqlDeadlock || mysqlError.Number == mysqlLockWaitTimeout
+	}
+	// The driver only returns ErrBadConn when nothing was sent, and a refused
+	// connection never got as far as sending.
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	// SQLite, used in tests, reports a busy database only in the message.
+	return strings.Contains(err.Error(), "database is locked")
+}
+
+// isDuplicateKey reports whether err is a write refused for repeating a
+// primary or unique key.
+func isDuplicateKey(err error) bool {
+	var mysqlError *mysql.MySQLError
+	if errors.As(err, &mysqlError) {
+		return mysqlError.Number == mysqlDuplicateEntry
+	}
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
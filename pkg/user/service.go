@@ -1,29 +1,281 @@
 package user
 
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/letitloose/user-app/pkg/mail"
+	"github.com/letitloose/user-app/pkg/tracing"
+	"github.com/letitloose/user-app/pkg/view"
+)
+
 type UserService struct {
-	repository *userRepository
+	store     Store
+	renderer  *view.Renderer
+	isolation sql.IsolationLevel
+	mailer    mail.Mailer
+	tasks     sync.WaitGroup
+}
+
+func NewUserService(store Store, renderer *view.Renderer) *UserService {
+	return &UserService{store: store, renderer: renderer}
+}
+
+// SetIsolationLevel sets the isolation level WithTx uses.
+func (service *UserService) SetIsolationLevel(level sql.IsolationLevel) {
+	service.isolation = level
+}
+
+// SetMailer sets how emails to users, such as password reset links, are
+// sent. Without one, the features that email users return an error.
+func (service *UserService) SetMailer(mailer mail.Mailer) {
+	service.mailer = mailer
+}
+
+// backgroundTimeout bounds work done after the request that asked for it
+// has been answered.
+const backgroundTimeout = time.Minute
+
+// detachedContext keeps the values of a context, such as the trace, but not
+// its cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// background runs fn without holding up the request ctx belongs to, on a
+// context that keeps its values but outlives it.
+func (service *UserService) background(ctx context.Context, fn func(ctx context.Context)) {
+	service.tasks.Add(1)
+	go func() {
+		defer service.tasks.Done()
+		ctx, cancel := context.WithTimeout(detachedContext{ctx}, backgroundTimeout)
+		defer cancel()
+		fn(ctx)
+	}()
+}
+
+// Wait waits for work handlers left running in the background, such as
+// sending password reset emails, to finish.
+func (service *UserService) Wait() {
+	service.tasks.Wait()
+}
+
+// WithTx runs fn with a Store that does everything in one transaction, for
+// operations that must happen together or not at all. It is committed if fn
+// returns nil and rolled back if fn returns an error or panics; calling
+// tx.WithTx inside fn nests a savepoint.
+func (service *UserService) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	return service.WithTxOptions(ctx, &sql.TxOptions{Isolation: service.isolation}, fn)
 }
 
-func NewUserService(repository *userRepository) *UserService {
-	return &UserService{repository: repository}
+// WithTxOptions is WithTx with a different isolation level or a read-only
+// transaction.
+func (service *UserService) WithTxOptions(ctx context.Context, options *sql.TxOptions, fn func(tx Store) error) error {
+	ctx, span := tracing.Start(ctx, "UserService.WithTx")
+	defer span.End()
+	span.SetAttribute("db.isolation_level", options.Isolation.String())
+
+	err := service.store.WithTx(ctx, options, fn)
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("transaction").Inc()
+	}
+	return err
+}
+
+func (service *UserService) ListAllUsers(ctx context.Context) ([]*User, error) {
+	ctx, span := tracing.Start(ctx, "UserService.ListAllUsers")
+	defer span.End()
+
+	users, err := service.store.ListAll(ctx)
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("list").Inc()
+	}
+	return users, err
+}
+
+// ListUsers lists the users matching filter. An empty filter is the same
+// as ListAllUsers and is served from the cache when there is one.
+func (service *UserService) ListUsers(ctx context.Context, filter ListFilter) ([]*User, error) {
+	if filter.IsEmpty() {
+		return service.ListAllUsers(ctx)
+	}
+	ctx, span := tracing.Start(ctx, "UserService.ListUsers")
+	defer span.End()
+
+	users := []*User{}
+	err := service.store.EachUser(ctx, filter, func(user *User) error {
+		copied := *user
+		users = append(users, &copied)
+		return nil
+	})
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("list").Inc()
+		return nil, err
+	}
+	return users, nil
+}
+
+func (service *UserService) FindByUsername(ctx context.Context, username string) (*User, error) {
+	ctx, span := tracing.Start(ctx, "UserService.FindByUsername")
+	defer span.End()
+
+	user, err := service.store.FindUser(ctx, username)
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("find").Inc()
+	}
+	return user, err
 }
 
-func (service *UserService) ListAllUsers() []*User {
-	return service.repository.listAll()
+func (service *UserService) RemoveUser(ctx context.Context, username string) error {
+	ctx, span := tracing.Start(ctx, "UserService.RemoveUser")
+	defer span.End()
+
+	before, err := service.store.FindUser(ctx, username)
+	if err == nil {
+		err = service.store.WithTx(ctx, nil, func(tx Store) error {
+			return removeUser(ctx, tx, username)
+		})
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("delete").Inc()
+		return err
+	}
+	usersDeleted.Inc()
+	if before.Username != "" {
+		service.audit(ctx, AuditDelete, CallerFromContext(ctx).Username, username, userChanges(before, &User{}))
+	}
+	return nil
 }
 
-func (service *UserService) FindByUsername(username string) (*User, error) {
-	return service.repository.findUser(username)
+// removeUser deletes username with their two-factor secrets and passkeys.
+// A user added again under the same name must not find the sessions, links
+// or lockout of the one removed, so those go too.
+func removeUser(ctx context.Context, tx Store, username string) error {
+	err := tx.RemoveUser(ctx, username)
+	if err == nil {
+		err = tx.RemoveTwoFactor(ctx, username)
+	}
+	if err == nil {
+		err = tx.RemovePasskeys(ctx, username)
+	}
+	for _, kind := range tokenKinds {
+		if err == nil {
+			err = tx.RemoveTokens(ctx, kind, username)
+		}
+	}
+	if err == nil {
+		err = tx.ClearLoginAttempts(ctx, lockoutAccount+username)
+	}
+	return err
+}
+
+func (service *UserService) AddUser(ctx context.Context, user *User) error {
+	ctx, span := tracing.Start(ctx, "UserService.AddUser")
+	defer span.End()
+
+	err := setPassword(user)
+	if err != nil {
+		return err
+	}
+	err = service.store.AddUser(ctx, user)
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("create").Inc()
+		return err
+	}
+	usersCreated.Inc()
+	service.audit(ctx, AuditCreate, CallerFromContext(ctx).Username, user.Username, userChanges(&User{}, user))
+	service.verifyNewUser(ctx, user)
+	return nil
 }
 
-func (service *UserService) RemoveUser(username string) error {
-	return service.repository.removeUser(username)
+func (service *UserService) UpdateUser(ctx context.Context, user *User) error {
+	ctx, span := tracing.Start(ctx, "UserService.UpdateUser")
+	defer span.End()
+
+	before, err := service.store.FindUser(ctx, user.Username)
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("update").Inc()
+		return err
+	}
+	newEmail, err := prepareUpdate(ctx, service.store, user)
+	if err != nil {
+		return err
+	}
+	err = service.store.WithTx(ctx, nil, func(tx Store) error {
+		err := tx.UpdateUser(ctx, user)
+		if err != nil {
+			return err
+		}
+		return endSessions(ctx, tx, before, user)
+	})
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("update").Inc()
+		return err
+	}
+	usersUpdated.Inc()
+	service.auditChange(ctx, before, user)
+	service.confirmEmailChange(ctx, user, newEmail)
+	return nil
+}
+
+// SetRole gives the user username role.
+func (service *UserService) SetRole(ctx context.Context, username string, role Role) error {
+	ctx, span := tracing.Start(ctx, "UserService.SetRole")
+	defer span.End()
+
+	err := checkRole(role)
+	if err != nil {
+		return err
+	}
+	user, err := service.store.FindUser(ctx, username)
+	if err == nil && user.Username == "" {
+		err = fmt.Errorf("user %s does not exist", username)
+	}
+	var before User
+	if err == nil {
+		before = *user
+		user.Role = role
+		err = service.store.UpdateUser(ctx, user)
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("update").Inc()
+		return err
+	}
+	usersUpdated.Inc()
+	service.auditChange(ctx, &before, user)
+	return nil
 }
 
-func (service *UserService) AddUser(user *User) error {
-	return service.repository.addUser(user)
+func checkRole(role Role) error {
+	if role != RoleUser && role != RoleAdmin {
+		return &FormatError{Message: fmt.Sprintf("unknown role %q, expected user or admin", role)}
+	}
+	return nil
 }
 
-func (service *UserService) UpdateUser(user *User) error {
-	return service.repository.updateUser(user)
+// setPassword checks user.Password against the password policy and
+// replaces it with its hash, which is all that is ever stored.
+func setPassword(user *User) error {
+	err := checkPassword(user.Password)
+	if err != nil {
+		return err
+	}
+	user.Password, err = hashPassword(user.Password)
+	return err
 }
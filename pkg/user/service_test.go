@@ -1,10 +1,19 @@
 package user
 
 import (
+	"context"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/mail"
+	"github.com/letitloose/user-app/pkg/webauthn/webauthntest"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -16,21 +25,50 @@ func setupService(t *testing.T) *UserService {
 	}
 
 	userRepo := NewUserRepository(db)
-	err = userRepo.createUserTable()
+	err = userRepo.CreateTables(context.Background())
 	if err != nil {
 		t.Fatalf("failed to create user table: %s", err)
 	}
 	newUser := User{Username: "test", Password: "pwd", FirstName: "lou", LastName: "garwood", Email: "louis@mail.com"}
-	err = userRepo.addUser(&newUser)
+	err = userRepo.AddUser(context.Background(), &newUser)
 	if err != nil {
 		t.Fatalf("failed to add user: %s", err)
 	}
 
-	return NewUserService(userRepo)
+	return NewUserService(userRepo, setupRenderer(t))
 }
 
 func teardownService(service *UserService) {
-	service.repository.database.Close()
+	service.store.(*userRepository).database.Close()
+}
+
+// recordingMailer keeps the messages sent instead of sending them.
+type recordingMailer struct {
+	messages []*mail.Message
+}
+
+func (mailer *recordingMailer) Send(ctx context.Context, message *mail.Message) error {
+	mailer.messages = append(mailer.messages, message)
+	return nil
+}
+
+// linkToken finds the token in the link to path in message.
+func linkToken(t *testing.T, message *mail.Message, path string) string {
+	_, link, found := strings.Cut(message.Body, "https://users.example.com"+path+"?token=")
+	if !found {
+		t.Fatalf("no %s link in: %s", path, message.Body)
+	}
+	return strings.Fields(link)[0]
+}
+
+// appCode is the code an authenticator app set up with setup shows offset
+// periods from now.
+func appCode(t *testing.T, setup *TwoFactorSetup, offset int64) string {
+	secret, err := base32Secret.DecodeString(setup.Secret)
+	if err != nil {
+		t.Fatalf("error decoding secret %q: %s", setup.Secret, err)
+	}
+	return totpCode(secret, totpStep(time.Now())+offset, totpDigits)
 }
 
 func TestUserService(t *testing.T) {
@@ -39,7 +77,10 @@ func TestUserService(t *testing.T) {
 		userService := setupService(t)
 		defer teardownService(userService)
 
-		userList := userService.ListAllUsers()
+		userList, err := userService.ListAllUsers(context.Background())
+		if err != nil {
+			t.Fatalf("error listing users: %s", err)
+		}
 
 		userListType := fmt.Sprintf("%T", userList)
 
@@ -51,7 +92,7 @@ func TestUserService(t *testing.T) {
 	t.Run("FindUserByName returns a user", func(t *testing.T) {
 		userService := setupService(t)
 		defer teardownService(userService)
-		user, err := userService.FindByUsername("test")
+		user, err := userService.FindByUsername(context.Background(), "test")
 		if err != nil {
 			t.Fatalf("error finding user: %s", err)
 		}
@@ -63,12 +104,12 @@ func TestUserService(t *testing.T) {
 	t.Run("AddUser adds a user", func(t *testing.T) {
 		userService := setupService(t)
 		defer teardownService(userService)
-		err := userService.RemoveUser("test")
+		err := userService.RemoveUser(context.Background(), "test")
 		if err != nil {
 			t.Fatalf("error removing user: %s", err)
 		}
 
-		user, err := userService.FindByUsername("test")
+		user, err := userService.FindByUsername(context.Background(), "test")
 		if err != nil {
 			t.Fatalf("error finding user: %s", err)
 		}
@@ -82,12 +123,12 @@ func TestUserService(t *testing.T) {
 		defer teardownService(userService)
 
 		newUser := User{Username: "test1", Password: "pwd", FirstName: "addison", LastName: "garwood", Email: "louis@mail.com"}
-		err := userService.AddUser(&newUser)
+		err := userService.AddUser(context.Background(), &newUser)
 		if err != nil {
 			t.Fatalf("error adding user: %s", err)
 		}
 
-		user, err := userService.FindByUsername("test1")
+		user, err := userService.FindByUsername(context.Background(), "test1")
 		if err != nil {
 			t.Fatalf("error finding user: %s", err)
 		}
@@ -100,17 +141,17 @@ func TestUserService(t *testing.T) {
 		userService := setupService(t)
 		defer teardownService(userService)
 
-		user, err := userService.FindByUsername("test")
+		user, err := userService.FindByUsername(context.Background(), "test")
 		if err != nil {
 			t.Fatalf("error finding test user: %s", err)
 		}
 		user.LastName = "banks"
-		err = userService.UpdateUser(user)
+		err = userService.UpdateUser(context.Background(), user)
 		if err != nil {
 			t.Fatalf("error adding user: %s", err)
 		}
 
-		foundUser, err := userService.FindByUsername("test")
+		foundUser, err := userService.FindByUsername(context.Background(), "test")
 		if err != nil {
 			t.Fatalf("error finding user: %s", err)
 		}
@@ -118,4 +159,1189 @@ func TestUserService(t *testing.T) {
 			t.Fatalf("did not return a correct user, expected: banks, got:%s", user.LastName)
 		}
 	})
+
+	t.Run("AddUser and RemoveUser update the operation counters", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		created := usersCreated.Value()
+		deleted := usersDeleted.Value()
+
+		newUser := User{Username: "counted", Password: "pwd"}
+		err := userService.AddUser(context.Background(), &newUser)
+		if err != nil {
+			t.Fatalf("error adding user: %s", err)
+		}
+		err = userService.RemoveUser(context.Background(), "counted")
+		if err != nil {
+			t.Fatalf("error removing user: %s", err)
+		}
+
+		if usersCreated.Value() != created+1 {
+			t.Fatalf("created counter not incremented: %v", usersCreated.Value())
+		}
+		if usersDeleted.Value() != deleted+1 {
+			t.Fatalf("deleted counter not incremented: %v", usersDeleted.Value())
+		}
+	})
+
+	t.Run("a canceled context surfaces as a CanceledError", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := userService.ListAllUsers(ctx)
+		var canceled *CanceledError
+		if !errors.As(err, &canceled) || !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected a CanceledError wrapping context.Canceled, got: %v", err)
+		}
+
+		err = userService.AddUser(ctx, &User{Username: "late", Password: "password-1"})
+		if !errors.As(err, &canceled) {
+			t.Fatalf("expected a CanceledError, got: %v", err)
+		}
+	})
+
+	t.Run("AddUser applies the current password policy", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{Password: config.PasswordConfig{MinLength: 8, RequireDigit: true}})
+
+		err := userService.AddUser(context.Background(), &User{Username: "weak", Password: "short"})
+		var policy *PasswordPolicyError
+		if !errors.As(err, &policy) || len(policy.Problems) != 2 {
+			t.Fatalf("expected two password policy problems, got: %v", err)
+		}
+
+		err = userService.AddUser(context.Background(), &User{Username: "strong", Password: "longer-with-1"})
+		if err != nil {
+			t.Fatalf("error adding user with a valid password: %s", err)
+		}
+	})
+
+	t.Run("WithTx commits, rolls back on error or panic and nests savepoints", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		// Every connection to :memory: is a separate database.
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		ctx := context.Background()
+		exists := func(username string) bool {
+			user, err := userService.FindByUsername(ctx, username)
+			if err != nil {
+				t.Fatalf("error finding %s: %s", username, err)
+			}
+			return user.Username == username
+		}
+
+		err := userService.WithTx(ctx, func(tx Store) error {
+			err := tx.AddUser(ctx, &User{Username: "committed"})
+			if err != nil {
+				return err
+			}
+			return tx.AddUsers(ctx, []*User{{Username: "batched"}})
+		})
+		if err != nil || !exists("committed") || !exists("batched") {
+			t.Fatalf("transaction not committed: %v", err)
+		}
+
+		failure := errors.New("assigning roles failed")
+		err = userService.WithTx(ctx, func(tx Store) error {
+			tx.AddUser(ctx, &User{Username: "rolled-back"})
+			return failure
+		})
+		if err != failure || exists("rolled-back") {
+			t.Fatalf("transaction not rolled back on error: %v", err)
+		}
+
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("panic not passed on")
+				}
+			}()
+			userService.WithTx(ctx, func(tx Store) error {
+				tx.AddUser(ctx, &User{Username: "panicked"})
+				panic("boom")
+			})
+		}()
+		if exists("panicked") {
+			t.Fatal("transaction not rolled back on panic")
+		}
+
+		err = userService.WithTx(ctx, func(tx Store) error {
+			tx.AddUser(ctx, &User{Username: "outer"})
+			nestedErr := tx.WithTx(ctx, nil, func(nested Store) error {
+				nested.AddUser(ctx, &User{Username: "inner"})
+				return failure
+			})
+			if nestedErr != failure {
+				t.Errorf("got %v from the savepoint want %v", nestedErr, failure)
+			}
+			return nil
+		})
+		if err != nil || !exists("outer") || exists("inner") {
+			t.Fatalf("savepoint not rolled back on its own: %v", err)
+		}
+	})
+
+	t.Run("ParseIsolationLevel reads the config names", func(t *testing.T) {
+		level, err := ParseIsolationLevel("repeatable-read")
+		if err != nil || level != sql.LevelRepeatableRead {
+			t.Errorf("got %v, %v want %v", level, err, sql.LevelRepeatableRead)
+		}
+
+		_, err = ParseIsolationLevel("snapshot")
+		if err == nil {
+			t.Error("expected an error for an unknown isolation level")
+		}
+	})
+
+	t.Run("Login hashes a password stored in plaintext before passwords were hashed", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		ctx := context.Background()
+
+		if _, err := userService.Login(ctx, "test", "wrong"); err != ErrInvalidLogin {
+			t.Errorf("got %v for a wrong password want %v", err, ErrInvalidLogin)
+		}
+		if _, err := userService.Login(ctx, "test", "pwd"); err != nil {
+			t.Fatalf("error logging in with a plaintext stored password: %s", err)
+		}
+		stored, _ := userService.FindByUsername(ctx, "test")
+		if !isHashed(stored.Password) || !verifyPassword(stored.Password, "pwd") {
+			t.Fatalf("got %q stored after logging in want a hash of the password", stored.Password)
+		}
+		if _, err := userService.Login(ctx, "test", "pwd"); err != nil {
+			t.Errorf("error logging in with the rehashed password: %s", err)
+		}
+	})
+
+	t.Run("pbkdf2SHA256 matches the published test vector", func(t *testing.T) {
+		key := pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64)
+		expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+		if hex.EncodeToString(key) != expected {
+			t.Errorf("got %x want %s", key, expected)
+		}
+	})
+
+	t.Run("ImportUsers reads csv, ndjson and yaml with mapped columns", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		ctx := context.Background()
+
+		inputs := []struct {
+			format  string
+			input   string
+			columns map[string]string
+		}{
+			{"csv", "login,Password,First Name,surname\ncsv-user,secret-1,ann,lee\n", map[string]string{"surname": "last-name"}},
+			{"ndjson", `{"user-name":"ndjson-user","password":"secret-1","first-name":"ann","surname":"lee"}` + "\n", map[string]string{"surname": "last-name"}},
+			{"yaml", "- username: yaml-user\n  password: secret-1\n  first_name: ann\n  surname: lee\n", map[string]string{"surname": "last_name"}},
+		}
+		for _, input := range inputs {
+			report, err := userService.ImportUsers(ctx, strings.NewReader(input.input), ImportOptions{Format: input.format, Columns: input.columns})
+			if err != nil || !report.Committed || report.Created != 1 {
+				t.Fatalf("%s import not committed: %+v, %v", input.format, report, err)
+			}
+
+			user, err := userService.FindByUsername(ctx, input.format+"-user")
+			if err != nil {
+				t.Fatalf("error finding %s user: %s", input.format, err)
+			}
+			if user.FirstName != "ann" || user.LastName != "lee" || !verifyPassword(user.Password, "secret-1") {
+				t.Errorf("%s user imported as %+v", input.format, user)
+			}
+		}
+
+		_, err := userService.ImportUsers(ctx, strings.NewReader("login\n\"unterminated\n"), ImportOptions{Format: "csv"})
+		var formatError *FormatError
+		if !errors.As(err, &formatError) {
+			t.Errorf("got %v for a broken csv want a FormatError", err)
+		}
+	})
+
+	t.Run("ImportUsers is all or nothing and reports every row", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		ctx := context.Background()
+		exists := func(username string) bool {
+			user, err := userService.FindByUsername(ctx, username)
+			if err != nil {
+				t.Fatalf("error finding %s: %s", username, err)
+			}
+			return user.Username == username
+		}
+
+		input := "user-name,email,password\nfine,fine@mail.com,secret-1\nbad name,,\nfine,,\nmailer,not-an-email,\ntest,,\n"
+		report, err := userService.ImportUsers(ctx, strings.NewReader(input), ImportOptions{Format: "csv"})
+		if err != nil {
+			t.Fatalf("error importing: %s", err)
+		}
+		if report.Committed || exists("fine") {
+			t.Fatal("import with failed rows was committed")
+		}
+		results := []string{}
+		for _, row := range report.Rows {
+			results = append(results, row.Result)
+		}
+		expected := "created,failed,failed,failed,failed"
+		if strings.Join(results, ",") != expected || report.Failed != 4 {
+			t.Errorf("got %v want %s", results, expected)
+		}
+
+		report, err = userService.ImportUsers(ctx, strings.NewReader("user-name,password\nfine,secret-1\n"), ImportOptions{Format: "csv", DryRun: true})
+		if err != nil || report.Committed || report.Created != 1 || exists("fine") {
+			t.Errorf("dry run changed users or did not report: %+v, %v", report, err)
+		}
+	})
+
+	t.Run("ImportUsers skips or updates existing users and generates passwords", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		ctx := context.Background()
+		input := "user-name,first-name\ntest,louis\nnewcomer,nia\n"
+
+		report, err := userService.ImportUsers(ctx, strings.NewReader(input), ImportOptions{Format: "csv", Mode: ImportSkipExisting, GeneratePasswords: true})
+		if err != nil || !report.Committed || report.Skipped != 1 || report.Created != 1 {
+			t.Fatalf("skip-existing import reported %+v, %v", report, err)
+		}
+		generated := report.Rows[1].GeneratedPassword
+		newcomer, _ := userService.FindByUsername(ctx, "newcomer")
+		if generated == "" || !verifyPassword(newcomer.Password, generated) {
+			t.Errorf("generated password %q not stored for the new user", generated)
+		}
+		if report.Rows[0].GeneratedPassword != "" {
+			t.Error("password generated for an existing user")
+		}
+		existing, _ := userService.FindByUsername(ctx, "test")
+		if existing.FirstName != "lou" {
+			t.Errorf("skipped user was changed: %+v", existing)
+		}
+		if _, err = userService.Login(ctx, "newcomer", ""); err != ErrInvalidLogin {
+			t.Errorf("got %v logging in to an imported user with an empty password want %v", err, ErrInvalidLogin)
+		}
+
+		report, err = userService.ImportUsers(ctx, strings.NewReader("user-name,email\nbob,bob@example.com\n"), ImportOptions{Format: "csv"})
+		if err != nil || report.Committed || report.Failed != 1 {
+			t.Errorf("got %+v, %v importing a new user without a password want the row failed", report, err)
+		}
+		if _, err = userService.Login(ctx, "bob", ""); err != ErrInvalidLogin {
+			t.Errorf("got %v logging in with an empty password want %v", err, ErrInvalidLogin)
+		}
+		if err = checkPassword(""); err == nil {
+			t.Error("got no error for an empty password under a policy with no minimum")
+		}
+
+		report, err = userService.ImportUsers(ctx, strings.NewReader(input), ImportOptions{Format: "csv", Mode: ImportUpsert})
+		if err != nil || !report.Committed || report.Updated != 2 {
+			t.Fatalf("upsert import reported %+v, %v", report, err)
+		}
+		existing, _ = userService.FindByUsername(ctx, "test")
+		if existing.FirstName != "louis" || existing.Password != "pwd" {
+			t.Errorf("upserted user did not keep the existing password: %+v", existing)
+		}
+	})
+
+	t.Run("ExportUsers streams every format without passwords", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		ctx := WithCaller(context.Background(), Caller{Role: RoleAdmin})
+		userService.AddUser(ctx, &User{Username: "amy", Password: "secret-1", FirstName: "amy, \"a\"", Email: "amy@example.com"})
+
+		expected := map[string]string{
+			"csv":    "user-name,email\namy,amy@example.com\ntest,louis@mail.com\n",
+			"ndjson": `{"user-name":"amy","email":"amy@example.com"}` + "\n" + `{"user-name":"test","email":"louis@mail.com"}` + "\n",
+			"json":   `[{"user-name":"amy","email":"amy@example.com"},` + "\n" + `{"user-name":"test","email":"louis@mail.com"}]` + "\n",
+			"yaml":   "- user-name: amy\n  email: amy@example.com\n- user-name: test\n  email: louis@mail.com\n",
+		}
+		for format, want := range expected {
+			var output strings.Builder
+			err := userService.ExportUsers(ctx, &output, ExportOptions{Format: format, Fields: []string{"user-name", "email"}})
+			if err != nil || output.String() != want {
+				t.Errorf("%s export got %q, %v want %q", format, output.String(), err, want)
+			}
+		}
+
+		var output strings.Builder
+		err := userService.ExportUsers(ctx, &output, ExportOptions{Format: "csv"})
+		if err != nil || strings.Contains(output.String(), "pwd") || strings.Contains(output.String(), "pbkdf2") {
+			t.Errorf("default export includes passwords: %q, %v", output.String(), err)
+		}
+		if !strings.Contains(output.String(), `"amy, ""a"""`) {
+			t.Errorf("csv values not quoted: %q", output.String())
+		}
+
+		err = userService.ExportUsers(ctx, &output, ExportOptions{Format: "json", Fields: []string{"password"}})
+		var formatError *FormatError
+		if !errors.As(err, &formatError) {
+			t.Errorf("got %v exporting passwords want a FormatError", err)
+		}
+		output.Reset()
+		err = userService.ExportUsers(ctx, &output, ExportOptions{Format: "json", Filter: ListFilter{Prefix: "nobody"}})
+		if err != nil || output.String() != "[]\n" {
+			t.Errorf("got %q, %v for an empty export want []", output.String(), err)
+		}
+	})
+
+	t.Run("ListUsers applies the list filters", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		ctx := context.Background()
+		userService.store.AddUsers(ctx, []*User{
+			{Username: "amy", Password: "secret-1", LastName: "garwood", Email: "amy@example.com"},
+			{Username: "a_b", Password: "secret-1", Email: "ab@example.org"},
+		})
+
+		filters := []struct {
+			filter   ListFilter
+			expected string
+		}{
+			{ListFilter{Search: "garwood"}, "amy,test"},
+			{ListFilter{Prefix: "a"}, "a_b,amy"},
+			{ListFilter{Prefix: "a_"}, "a_b"},
+			{ListFilter{Domain: "@example.com"}, "amy"},
+			{ListFilter{Search: "example", Domain: "example.org"}, "a_b"},
+		}
+		for _, filter := range filters {
+			users, err := userService.ListUsers(ctx, filter.filter)
+			if err != nil {
+				t.Fatalf("error listing %+v: %s", filter.filter, err)
+			}
+			if got := strings.Join(usernames(users), ","); got != filter.expected {
+				t.Errorf("got %s for %+v want %s", got, filter.filter, filter.expected)
+			}
+		}
+	})
+
+	t.Run("NewUserView shows email only to admins and the user themselves", func(t *testing.T) {
+		user := &User{Username: "amy", Password: "secret-1", FirstName: "amy", Email: "amy@example.com"}
+		callers := []struct {
+			caller Caller
+			email  string
+		}{
+			{Caller{}, ""},
+			{Caller{Username: "bob", Role: RoleUser}, ""},
+			{Caller{Username: "amy", Role: RoleUser}, "amy@example.com"},
+			{Caller{Username: "root", Role: RoleAdmin}, "amy@example.com"},
+		}
+		for _, caller := range callers {
+			view := NewUserView(user, caller.caller)
+			expected := UserView{Username: "amy", FirstName: "amy", Email: caller.email}
+			if !reflect.DeepEqual(*view, expected) {
+				t.Errorf("got %+v as %+v want %+v", view, caller.caller, expected)
+			}
+		}
+	})
+
+	t.Run("password reset links are emailed, work once and go through the policy", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		mailer := &recordingMailer{}
+		userService.SetMailer(mailer)
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{
+			Server:   config.ServerConfig{PublicURL: "https://users.example.com/"},
+			Password: config.PasswordConfig{MinLength: 8, ResetTokenTTL: time.Hour},
+		})
+		ctx := context.Background()
+
+		err := userService.RequestPasswordReset(ctx, "nobody")
+		if err != nil || len(mailer.messages) != 0 {
+			t.Fatalf("got %v and %d emails for an unknown login want neither", err, len(mailer.messages))
+		}
+		err = userService.RequestPasswordReset(ctx, "test")
+		if err == nil {
+			err = userService.RequestPasswordReset(ctx, "louis@mail.com")
+		}
+		if err != nil || len(mailer.messages) != 2 || mailer.messages[1].To[0] != "louis@mail.com" {
+			t.Fatalf("reset links not sent by username and email: %v, %+v", err, mailer.messages)
+		}
+		first, second := linkToken(t, mailer.messages[0], "/password/reset"), linkToken(t, mailer.messages[1], "/password/reset")
+		if valid, _ := userService.CheckResetToken(ctx, first); valid {
+			t.Error("an earlier link still works after a new one was sent")
+		}
+		session, hash, _ := newToken()
+		userService.store.AddToken(ctx, &Token{Kind: TokenSession, Hash: hash, Username: "test", Expires: time.Now().Add(time.Hour)})
+
+		err = userService.ResetPassword(ctx, second, "short")
+		var policy *PasswordPolicyError
+		if !errors.As(err, &policy) {
+			t.Fatalf("got %v for a weak password want a PasswordPolicyError", err)
+		}
+		err = userService.ResetPassword(ctx, second, "long-enough")
+		if err != nil {
+			t.Fatalf("error resetting the password: %s", err)
+		}
+		user, _ := userService.FindByUsername(ctx, "test")
+		if !verifyPassword(user.Password, "long-enough") {
+			t.Errorf("password not changed: %q", user.Password)
+		}
+		if user, _ := userService.Authenticate(ctx, session); user != nil {
+			t.Errorf("got %+v for a session from before the reset want none", user)
+		}
+		if last := mailer.messages[len(mailer.messages)-1]; last.Subject != "Your password was changed" {
+			t.Errorf("no notice of the change sent, last email: %+v", last)
+		}
+		if err = userService.ResetPassword(ctx, second, "another-one"); err != ErrInvalidToken {
+			t.Errorf("got %v reusing a link want %v", err, ErrInvalidToken)
+		}
+
+		secret, hash, _ := newToken()
+		userService.store.AddToken(ctx, &Token{Kind: TokenPasswordReset, Hash: hash, Username: "test", Expires: time.Now().Add(-time.Minute)})
+		if err = userService.ResetPassword(ctx, secret, "long-enough"); err != ErrInvalidToken {
+			t.Errorf("got %v for an expired link want %v", err, ErrInvalidToken)
+		}
+	})
+
+	t.Run("email addresses are confirmed on signup and changes wait for confirmation", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		mailer := &recordingMailer{}
+		userService.SetMailer(mailer)
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{
+			Server:            config.ServerConfig{PublicURL: "https://users.example.com"},
+			Password:          config.PasswordConfig{MinLength: 8},
+			EmailVerification: config.EmailVerificationConfig{TokenTTL: time.Hour, ResendInterval: time.Minute},
+		})
+		ctx := context.Background()
+
+		err := userService.AddUser(ctx, &User{Username: "amy", Password: "password-1", Email: "amy@example.com"})
+		if err != nil {
+			t.Fatalf("error adding user: %s", err)
+		}
+		if len(mailer.messages) != 1 || mailer.messages[0].To[0] != "amy@example.com" {
+			t.Fatalf("got %+v want a verification email to amy@example.com", mailer.messages)
+		}
+		signup := linkToken(t, mailer.messages[0], "/email/verify")
+		err = userService.SetRole(ctx, "amy", RoleAdmin)
+		if err != nil {
+			t.Fatalf("error setting role: %s", err)
+		}
+
+		err = userService.UpdateUser(ctx, &User{Username: "amy", FirstName: "Amy", Email: "amy@new.example.com"})
+		if err != nil {
+			t.Fatalf("error updating user: %s", err)
+		}
+		user, _ := userService.FindByUsername(ctx, "amy")
+		if user.Email != "amy@example.com" || user.EmailVerified || user.Role != RoleAdmin || user.FirstName != "Amy" {
+			t.Errorf("got %+v want the old address, still unverified, the role kept and the name changed", user)
+		}
+		if len(mailer.messages) != 3 || mailer.messages[1].To[0] != "amy@new.example.com" || mailer.messages[2].To[0] != "amy@example.com" {
+			t.Fatalf("got %+v want a link to the new address and a notice to the old one", mailer.messages)
+		}
+		if valid, _ := userService.CheckVerifyToken(ctx, signup); valid {
+			t.Error("the signup link still works after a new one was sent")
+		}
+
+		confirmed, err := userService.ConfirmEmail(ctx, linkToken(t, mailer.messages[1], "/email/verify"))
+		if err != nil {
+			t.Fatalf("error confirming: %s", err)
+		}
+		user, _ = userService.FindByUsername(ctx, "amy")
+		if confirmed.Email != "amy@new.example.com" || user.Email != "amy@new.example.com" || !user.EmailVerified || user.Role != RoleAdmin {
+			t.Errorf("got %+v after confirming want the new address, verified", user)
+		}
+		if _, err = userService.ConfirmEmail(ctx, linkToken(t, mailer.messages[1], "/email/verify")); err != ErrInvalidToken {
+			t.Errorf("got %v reusing a link want %v", err, ErrInvalidToken)
+		}
+	})
+
+	t.Run("ResendVerification sends the pending address at most once per interval", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		mailer := &recordingMailer{}
+		userService.SetMailer(mailer)
+		defer config.SetConfig(config.GetConfig())
+		settings := &config.Config{
+			Server:            config.ServerConfig{PublicURL: "https://users.example.com"},
+			Password:          config.PasswordConfig{MinLength: 8},
+			EmailVerification: config.EmailVerificationConfig{TokenTTL: time.Hour, ResendInterval: time.Minute},
+		}
+		config.SetConfig(settings)
+		ctx := context.Background()
+
+		err := userService.ResendVerification(ctx, "test")
+		if err != nil || len(mailer.messages) != 1 || mailer.messages[0].To[0] != "louis@mail.com" {
+			t.Fatalf("got %v and %+v want a link for the unverified address", err, mailer.messages)
+		}
+		err = userService.ResendVerification(ctx, "louis@mail.com")
+		if err != nil || len(mailer.messages) != 1 {
+			t.Fatalf("got %v and %d emails resending at once want the resend throttled", err, len(mailer.messages))
+		}
+
+		settings.EmailVerification.ResendInterval = 0
+		err = userService.UpdateUser(ctx, &User{Username: "test", Email: "lou@new.example.com"})
+		if err == nil {
+			err = userService.ResendVerification(ctx, "test")
+		}
+		last := mailer.messages[len(mailer.messages)-1]
+		if err != nil || last.To[0] != "lou@new.example.com" {
+			t.Fatalf("got %v and %+v want the pending address sent again", err, last)
+		}
+
+		_, err = userService.ConfirmEmail(ctx, linkToken(t, last, "/email/verify"))
+		sent := len(mailer.messages)
+		if err == nil {
+			err = userService.ResendVerification(ctx, "test")
+		}
+		if err != nil || len(mailer.messages) != sent {
+			t.Errorf("got %v and %d emails want nothing sent for a verified address", err, len(mailer.messages)-sent)
+		}
+	})
+
+	t.Run("Login checks the password and can require a verified email", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		defer config.SetConfig(config.GetConfig())
+		settings := &config.Config{
+			Password: config.PasswordConfig{MinLength: 8},
+			Session:  config.SessionConfig{TTL: time.Hour},
+		}
+		config.SetConfig(settings)
+		ctx := context.Background()
+		userService.AddUser(ctx, &User{Username: "amy", Password: "password-1", Email: "amy@example.com"})
+
+		for _, login := range [][2]string{{"amy", "wrong-password"}, {"nobody", "password-1"}} {
+			if _, err := userService.Login(ctx, login[0], login[1]); err != ErrInvalidLogin {
+				t.Errorf("got %v logging in as %v want %v", err, login, ErrInvalidLogin)
+			}
+		}
+
+		settings.EmailVerification.RequireBeforeLogin = true
+		if _, err := userService.Login(ctx, "amy", "password-1"); err != ErrEmailNotVerified {
+			t.Errorf("got %v for an unverified user want %v", err, ErrEmailNotVerified)
+		}
+		settings.EmailVerification.RequireBeforeLogin = false
+		secret, err := userService.Login(ctx, "amy", "password-1")
+		if err != nil {
+			t.Fatalf("error logging in: %s", err)
+		}
+		user, err := userService.Authenticate(ctx, secret)
+		if err != nil || user == nil || user.Username != "amy" || user.Role != RoleUser {
+			t.Fatalf("got %+v, %v for the session want amy as a user", user, err)
+		}
+
+		err = userService.Logout(ctx, secret)
+		if err != nil {
+			t.Fatalf("error logging out: %s", err)
+		}
+		if user, _ = userService.Authenticate(ctx, secret); user != nil {
+			t.Errorf("got %+v after logging out want no user", user)
+		}
+
+		kept, _ := userService.Login(ctx, "amy", "password-1")
+		userService.UpdateUser(ctx, &User{Username: "amy", FirstName: "amy"})
+		if user, _ = userService.Authenticate(ctx, kept); user == nil {
+			t.Error("session logged out by a change that kept the password")
+		}
+		userService.UpdateUser(ctx, &User{Username: "amy", Password: "password-2"})
+		if user, _ = userService.Authenticate(ctx, kept); user != nil {
+			t.Errorf("got %+v for a session from before the password changed want none", user)
+		}
+
+		old, _ := userService.Login(ctx, "amy", "password-2")
+		userService.RemoveUser(ctx, "amy")
+		userService.AddUser(ctx, &User{Username: "amy", Password: "password-3"})
+		if user, _ = userService.Authenticate(ctx, old); user != nil {
+			t.Errorf("got %+v for a session of a removed user want none", user)
+		}
+
+		database := userService.store.(*userRepository).database
+		_, err = database.Exec(`CREATE TRIGGER keep_passkeys BEFORE DELETE ON passkeys BEGIN SELECT RAISE(FAIL, 'refused'); END;`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session, _ := userService.Login(ctx, "amy", "password-3")
+		_, err = database.Exec(`INSERT INTO passkeys (id, username, name, public_key, sign_count, created) VALUES ('key', 'amy', 'phone', '', 0, 0);`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = userService.RemoveUser(ctx, "amy"); err == nil {
+			t.Fatal("got no error when removing the passkeys failed")
+		}
+		if user, _ = userService.Authenticate(ctx, session); user == nil || user.Username != "amy" {
+			t.Errorf("got %+v after a failed removal want amy and her session kept", user)
+		}
+	})
+
+	t.Run("SignUp applies the signup policy and approvals tell the applicant", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		mailer := &recordingMailer{}
+		userService.SetMailer(mailer)
+		defer config.SetConfig(config.GetConfig())
+		settings := &config.Config{
+			Server:            config.ServerConfig{PublicURL: "https://users.example.com"},
+			Password:          config.PasswordConfig{MinLength: 8},
+			EmailVerification: config.EmailVerificationConfig{TokenTTL: time.Hour},
+			Session:           config.SessionConfig{TTL: time.Hour},
+			Signup:            config.SignupConfig{Mode: "invite-only"},
+		}
+		config.SetConfig(settings)
+		ctx := context.Background()
+
+		var signup *SignupError
+		var format *FormatError
+		err := userService.SignUp(ctx, &User{Username: "amy", Password: "password-1", Email: "amy@example.com"})
+		if !errors.As(err, &signup) {
+			t.Errorf("got %v signing up when invite-only want a SignupError", err)
+		}
+		settings.Signup = config.SignupConfig{Mode: "approval", AllowedDomains: []string{"example.com"}}
+		refused := []struct {
+			user   User
+			policy bool
+		}{
+			{User{Username: "amy", Password: "password-1", Email: "amy@other.org"}, true},
+			{User{Username: "amy", Password: "password-1"}, false},
+			{User{Username: "amy smith", Password: "password-1", Email: "amy@example.com"}, false},
+			{User{Username: "test", Password: "password-1", Email: "lou@example.com"}, false},
+		}
+		for _, refusal := range refused {
+			err = userService.SignUp(ctx, &refusal.user)
+			if refusal.policy && !errors.As(err, &signup) || !refusal.policy && !errors.As(err, &format) {
+				t.Errorf("got %v signing up %+v", err, refusal.user)
+			}
+		}
+
+		amy := &User{Username: "amy", Password: "password-1", Email: "Amy@EXAMPLE.com", Role: RoleAdmin}
+		err = userService.SignUp(ctx, amy)
+		if err != nil || amy.Status != StatusPending || amy.Role != RoleUser {
+			t.Fatalf("got %v and %+v signing up want a pending user", err, amy)
+		}
+		if _, err = userService.Login(ctx, "amy", "password-1"); err != ErrAccountPending {
+			t.Errorf("got %v logging in while pending want %v", err, ErrAccountPending)
+		}
+		pending, err := userService.PendingUsers(ctx)
+		if err != nil || len(pending) != 1 || pending[0].Username != "amy" {
+			t.Errorf("got %+v, %v want amy waiting", pending, err)
+		}
+
+		err = userService.ApproveUser(ctx, "amy")
+		if err != nil {
+			t.Fatalf("error approving: %s", err)
+		}
+		if last := mailer.messages[len(mailer.messages)-1]; last.Subject != "Your account was approved" {
+			t.Errorf("applicant not told of the approval, last email: %+v", last)
+		}
+		if _, err = userService.Login(ctx, "amy", "password-1"); err != nil {
+			t.Errorf("got %v logging in once approved", err)
+		}
+		if err = userService.ApproveUser(ctx, "amy"); err != ErrNotPending {
+			t.Errorf("got %v approving twice want %v", err, ErrNotPending)
+		}
+
+		userService.SignUp(ctx, &User{Username: "bob", Password: "password-1", Email: "bob@example.com"})
+		err = userService.RejectUser(ctx, "bob")
+		if err != nil {
+			t.Fatalf("error rejecting: %s", err)
+		}
+		bob, _ := userService.FindByUsername(ctx, "bob")
+		if last := mailer.messages[len(mailer.messages)-1]; bob.Username != "" || last.To[0] != "bob@example.com" {
+			t.Errorf("got %+v and last email %+v want bob removed and told", bob, last)
+		}
+	})
+
+	t.Run("invitations create users with the invited role and groups once", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		mailer := &recordingMailer{}
+		userService.SetMailer(mailer)
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{
+			Server:      config.ServerConfig{PublicURL: "https://users.example.com"},
+			Password:    config.PasswordConfig{MinLength: 8},
+			Signup:      config.SignupConfig{Mode: "invite-only"},
+			Invitations: config.InvitationConfig{TTL: time.Hour, SigningKey: "test key"},
+		})
+		ctx := WithCaller(context.Background(), Caller{Username: "test", Role: RoleAdmin})
+
+		withKey := config.GetConfig()
+		noKey := *withKey
+		noKey.Invitations.SigningKey = ""
+		config.SetConfig(&noKey)
+		if _, err := userService.Invite(ctx, "amy@example.com", RoleUser, nil); err != errNoSigningKey {
+			t.Errorf("got %v inviting without invitations.signing-key want %v", err, errNoSigningKey)
+		}
+		config.SetConfig(withKey)
+
+		var format *FormatError
+		if _, err := userService.Invite(ctx, "not an address", RoleUser, nil); !errors.As(err, &format) {
+			t.Errorf("got %v inviting a bad address want a FormatError", err)
+		}
+		if _, err := userService.Invite(ctx, "amy@example.com", "owner", nil); !errors.As(err, &format) {
+			t.Errorf("got %v inviting with an unknown role want a FormatError", err)
+		}
+
+		invitation, err := userService.Invite(ctx, "amy@example.com", RoleAdmin, ParseGroups("ops, dev"))
+		if err != nil {
+			t.Fatalf("error inviting: %s", err)
+		}
+		first := linkToken(t, mailer.messages[0], "/invitations/accept")
+		err = userService.ResendInvitation(ctx, invitation.ID)
+		if err != nil {
+			t.Fatalf("error resending: %s", err)
+		}
+		token := linkToken(t, mailer.messages[1], "/invitations/accept")
+		if first == token {
+			t.Fatalf("resending kept the same link %s", token)
+		}
+
+		forged := token[:strings.LastIndex(token, ".")+1] + "AAAA"
+		for _, bad := range []string{first, forged, "nonsense"} {
+			if _, err = userService.CheckInvitation(ctx, bad); err != ErrInvalidToken {
+				t.Errorf("got %v checking %q want %v", err, bad, ErrInvalidToken)
+			}
+		}
+
+		weak := &User{Username: "amy", Password: "short"}
+		var policy *PasswordPolicyError
+		if err = userService.AcceptInvitation(ctx, token, weak); !errors.As(err, &policy) {
+			t.Errorf("got %v accepting with a weak password want a PasswordPolicyError", err)
+		}
+		taken := &User{Username: "test", Password: "password-1"}
+		if err = userService.AcceptInvitation(ctx, token, taken); !errors.As(err, &format) {
+			t.Errorf("got %v accepting with a taken username want a FormatError", err)
+		}
+
+		config.SetConfig(&noKey)
+		if err = userService.AcceptInvitation(ctx, token, &User{Username: "amy", Password: "password-1"}); err != errNoSigningKey {
+			t.Errorf("got %v accepting without invitations.signing-key want %v", err, errNoSigningKey)
+		}
+		config.SetConfig(withKey)
+
+		database := userService.store.(*userRepository).database
+		_, err = database.Exec(`CREATE TRIGGER refuse_carol BEFORE INSERT ON users WHEN NEW.username = 'carol' BEGIN SELECT RAISE(FAIL, 'refused'); END;`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = userService.AcceptInvitation(ctx, token, &User{Username: "carol", Password: "password-1"}); err == nil {
+			t.Fatalf("got no error when adding the user failed")
+		}
+		if _, err = userService.CheckInvitation(ctx, token); err != nil {
+			t.Fatalf("got %v checking an invitation whose user was not added want it still open", err)
+		}
+
+		err = userService.AcceptInvitation(ctx, token, &User{Username: "amy", Password: "password-1", Email: "other@example.com", Role: RoleUser})
+		if err != nil {
+			t.Fatalf("error accepting: %s", err)
+		}
+		amy, _ := userService.FindByUsername(ctx, "amy")
+		if amy.Email != "amy@example.com" || !amy.EmailVerified || amy.Role != RoleAdmin || amy.Status != StatusActive || !reflect.DeepEqual(amy.Groups, Groups{"ops", "dev"}) {
+			t.Errorf("got %+v want the invited, verified address, role and groups", amy)
+		}
+		if err = userService.AcceptInvitation(ctx, token, &User{Username: "amy2", Password: "password-1"}); err != ErrInvalidToken {
+			t.Errorf("got %v accepting twice want %v", err, ErrInvalidToken)
+		}
+
+		bob, _ := userService.Invite(ctx, "bob@example.com", RoleUser, nil)
+		err = userService.RevokeInvitation(ctx, bob.ID)
+		if err != nil {
+			t.Fatalf("error revoking: %s", err)
+		}
+		if err = userService.AcceptInvitation(ctx, linkToken(t, mailer.messages[2], "/invitations/accept"), &User{Username: "bob", Password: "password-1"}); err != ErrInvalidToken {
+			t.Errorf("got %v accepting a revoked invitation want %v", err, ErrInvalidToken)
+		}
+		if err = userService.ResendInvitation(ctx, bob.ID); err != ErrNoInvitation {
+			t.Errorf("got %v resending a revoked invitation want %v", err, ErrNoInvitation)
+		}
+
+		listed, err := userService.ListInvitations(ctx)
+		if err != nil || len(listed) != 2 {
+			t.Fatalf("got %+v, %v want two invitations", listed, err)
+		}
+		for _, listing := range listed {
+			if listing.InvitedBy != "test" {
+				t.Errorf("got %q as the inviter of %s want test", listing.InvitedBy, listing.Email)
+			}
+			if listing.Email == "amy@example.com" && (listing.State != InvitationAccepted || listing.AcceptedBy != "amy") {
+				t.Errorf("got %+v want accepted by amy", listing)
+			}
+			if listing.Email == "bob@example.com" && listing.State != InvitationRevoked {
+				t.Errorf("got %+v want revoked", listing)
+			}
+		}
+	})
+
+	t.Run("TOTP codes match the RFC 6238 test vectors", func(t *testing.T) {
+		secret := []byte("12345678901234567890")
+		vectors := map[int64]string{59: "94287082", 1111111109: "07081804", 1111111111: "14050471",
+			1234567890: "89005924", 2000000000: "69279037", 20000000000: "65353130"}
+		for unix, want := range vectors {
+			if got := totpCode(secret, totpStep(time.Unix(unix, 0)), 8); got != want {
+				t.Errorf("got %s at %d want %s", got, unix, want)
+			}
+		}
+	})
+
+	t.Run("two-factor codes work once each and recovery codes stand in for them", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		defer config.SetConfig(config.GetConfig())
+		settings := &config.Config{
+			Password:  config.PasswordConfig{MinLength: 8},
+			Session:   config.SessionConfig{TTL: time.Hour},
+			TwoFactor: config.TwoFactorConfig{Issuer: "user-app", EncryptionKey: "test key"},
+		}
+		config.SetConfig(settings)
+		ctx := context.Background()
+		userService.AddUser(ctx, &User{Username: "amy", Password: "password-1"})
+
+		setup, err := userService.StartTwoFactor(ctx, "amy")
+		if err != nil {
+			t.Fatalf("error starting setup: %s", err)
+		}
+		if !strings.HasPrefix(setup.URI, "otpauth://totp/user-app:amy?") || !strings.Contains(setup.URI, "secret="+setup.Secret) {
+			t.Errorf("got URI %s", setup.URI)
+		}
+		if again, _ := userService.StartTwoFactor(ctx, "amy"); again.Secret != setup.Secret {
+			t.Errorf("got a new secret starting again before confirming")
+		}
+		stored, _ := userService.store.FindTwoFactor(ctx, "amy")
+		if secret, _ := base32Secret.DecodeString(setup.Secret); strings.Contains(stored.Secret, setup.Secret) || strings.Contains(stored.Secret, string(secret)) {
+			t.Errorf("got the secret stored in the clear: %s", stored.Secret)
+		}
+		if _, err = userService.Login(ctx, "amy", "password-1"); err != nil {
+			t.Errorf("got %v logging in before confirming want a session", err)
+		}
+
+		if _, err = userService.EnableTwoFactor(ctx, "amy", "abcdef"); err != ErrInvalidCode {
+			t.Errorf("got %v confirming with a wrong code want %v", err, ErrInvalidCode)
+		}
+		// Both codes are worked out up front, so a new period starting while
+		// the test runs does not turn the reused code into a fresh one.
+		confirmCode, nextCode := appCode(t, setup, 0), appCode(t, setup, 1)
+		codes, err := userService.EnableTwoFactor(ctx, "amy", confirmCode)
+		if err != nil || len(codes) != recoveryCodeCount {
+			t.Fatalf("got %v, %v confirming want %d recovery codes", codes, err, recoveryCodeCount)
+		}
+		if _, err = userService.StartTwoFactor(ctx, "amy"); err != ErrTwoFactorEnabled {
+			t.Errorf("got %v starting over want %v", err, ErrTwoFactorEnabled)
+		}
+
+		login := func() string {
+			_, err := userService.Login(ctx, "amy", "password-1")
+			var required *TwoFactorRequiredError
+			if !errors.As(err, &required) || required.Setup {
+				t.Fatalf("got %v logging in want a challenge for a code", err)
+			}
+			return required.Challenge
+		}
+		challenge := login()
+		if _, _, err = userService.CompleteLogin(ctx, challenge, confirmCode); err != ErrInvalidCode {
+			t.Errorf("got %v reusing the code that confirmed the setup want %v", err, ErrInvalidCode)
+		}
+		secret, _, err := userService.CompleteLogin(ctx, challenge, nextCode)
+		if err != nil {
+			t.Fatalf("error completing the login: %s", err)
+		}
+		if user, _ := userService.Authenticate(ctx, secret); user == nil || user.Username != "amy" {
+			t.Errorf("got %+v for the session want amy", user)
+		}
+		if _, _, err = userService.CompleteLogin(ctx, challenge, nextCode); err != ErrInvalidToken {
+			t.Errorf("got %v completing a finished login want %v", err, ErrInvalidToken)
+		}
+
+		if _, _, err = userService.CompleteLogin(ctx, login(), strings.ToUpper(codes[0])); err != nil {
+			t.Errorf("got %v logging in with a recovery code", err)
+		}
+		if _, _, err = userService.CompleteLogin(ctx, login(), codes[0]); err != ErrInvalidCode {
+			t.Errorf("got %v reusing a recovery code want %v", err, ErrInvalidCode)
+		}
+
+		settings.TwoFactor.RequiredRoles = []string{"user"}
+		userService.AddUser(ctx, &User{Username: "bob", Password: "password-1"})
+		_, err = userService.Login(ctx, "bob", "password-1")
+		var required *TwoFactorRequiredError
+		if !errors.As(err, &required) || !required.Setup {
+			t.Fatalf("got %v logging in when the role requires two-factor want a challenge to set it up", err)
+		}
+		bobSetup, err := userService.ChallengeSetup(ctx, required.Challenge)
+		if err != nil {
+			t.Fatalf("error getting the setup: %s", err)
+		}
+		secret, codes, err = userService.CompleteLogin(ctx, required.Challenge, appCode(t, bobSetup, 0))
+		if err != nil || secret == "" || len(codes) != recoveryCodeCount {
+			t.Errorf("got %q, %v, %v setting up while logging in want a session and recovery codes", secret, codes, err)
+		}
+
+		err = userService.DisableTwoFactor(ctx, "amy")
+		if enabled, _ := userService.TwoFactorEnabled(ctx, "amy"); err != nil || enabled {
+			t.Errorf("got %v and enabled %t turning it off", err, enabled)
+		}
+	})
+
+	t.Run("passkeys register, log in once per challenge and catch cloned authenticators", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{
+			Server:    config.ServerConfig{PublicURL: "https://users.example.com"},
+			Password:  config.PasswordConfig{MinLength: 8},
+			Session:   config.SessionConfig{TTL: time.Hour},
+			TwoFactor: config.TwoFactorConfig{RequiredRoles: []string{"user"}},
+			Passkeys:  config.PasskeyConfig{Name: "user-app", UserVerification: "preferred"},
+		})
+		ctx := context.Background()
+		userService.AddUser(ctx, &User{Username: "amy", Password: "password-1"})
+		userService.AddUser(ctx, &User{Username: "bob", Password: "password-1"})
+		authenticator := webauthntest.New("https://users.example.com")
+
+		var format *FormatError
+		if _, err := userService.BeginPasskeyRegistration(ctx, "amy", " "); !errors.As(err, &format) {
+			t.Errorf("got %v registering without a name want a FormatError", err)
+		}
+		options, err := userService.BeginPasskeyRegistration(ctx, "amy", "Laptop")
+		if err != nil {
+			t.Fatalf("error starting registration: %s", err)
+		}
+		if options.RelyingParty.ID != "users.example.com" || options.User.Name != "amy" {
+			t.Errorf("got %+v want options for amy at users.example.com", options)
+		}
+		created, err := webauthntest.New("https://users.example.com").Create(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = userService.FinishPasskeyRegistration(ctx, "bob", created); err != ErrInvalidPasskey {
+			t.Errorf("got %v finishing amy's registration as bob want %v", err, ErrInvalidPasskey)
+		}
+		options, _ = userService.BeginPasskeyRegistration(ctx, "amy", "Laptop")
+		created, _ = authenticator.Create(options)
+		passkey, err := userService.FinishPasskeyRegistration(ctx, "amy", created)
+		if err != nil || passkey.Name != "Laptop" || passkey.ID != created.ID {
+			t.Fatalf("got %+v, %v finishing registration", passkey, err)
+		}
+		if _, err = userService.FinishPasskeyRegistration(ctx, "amy", created); err != ErrInvalidPasskey {
+			t.Errorf("got %v finishing the same registration twice want %v", err, ErrInvalidPasskey)
+		}
+		options, _ = userService.BeginPasskeyRegistration(ctx, "amy", "Laptop again")
+		if _, err = authenticator.Create(options); err != webauthntest.ErrExcluded {
+			t.Errorf("got %v registering the same authenticator twice want %v", err, webauthntest.ErrExcluded)
+		}
+		clone := authenticator.Clone()
+
+		login := func(username string, authenticator *webauthntest.Authenticator) (string, error) {
+			options, err := userService.BeginPasskeyLogin(ctx, username)
+			if err != nil {
+				t.Fatalf("error starting login: %s", err)
+			}
+			assertion, err := authenticator.Get(options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return userService.FinishPasskeyLogin(ctx, assertion)
+		}
+		for _, username := range []string{"amy", ""} {
+			secret, err := login(username, authenticator)
+			if err != nil {
+				t.Fatalf("got %v logging in with %q want a session without a two-factor code", err, username)
+			}
+			if user, _ := userService.Authenticate(ctx, secret); user == nil || user.Username != "amy" {
+				t.Errorf("got %+v for the session want amy", user)
+			}
+		}
+		passkeys, _ := userService.Passkeys(ctx, "amy")
+		if len(passkeys) != 1 || passkeys[0].SignCount != 2 || passkeys[0].LastUsed.IsZero() {
+			t.Errorf("got %+v want one passkey used twice", passkeys)
+		}
+
+		if _, err = login("bob", authenticator); err != ErrInvalidPasskey {
+			t.Errorf("got %v logging in as bob with amy's passkey want %v", err, ErrInvalidPasskey)
+		}
+		if _, err = login("amy", clone); err != ErrInvalidPasskey {
+			t.Errorf("got %v logging in with a cloned authenticator want %v", err, ErrInvalidPasskey)
+		}
+		loginOptions, _ := userService.BeginPasskeyLogin(ctx, "amy")
+		assertion, _ := authenticator.Get(loginOptions)
+		userService.FinishPasskeyLogin(ctx, assertion)
+		if _, err = userService.FinishPasskeyLogin(ctx, assertion); err != ErrInvalidPasskey {
+			t.Errorf("got %v replaying a login want %v", err, ErrInvalidPasskey)
+		}
+
+		if err = userService.RenamePasskey(ctx, "bob", passkey.ID, "Mine"); err != ErrNoPasskey {
+			t.Errorf("got %v renaming amy's passkey as bob want %v", err, ErrNoPasskey)
+		}
+		if err = userService.RenamePasskey(ctx, "amy", passkey.ID, "Work laptop"); err != nil {
+			t.Errorf("error renaming: %s", err)
+		}
+		if err = userService.RemovePasskey(ctx, "amy", passkey.ID); err != nil {
+			t.Errorf("error removing: %s", err)
+		}
+		if _, err = login("", authenticator); err != ErrInvalidPasskey {
+			t.Errorf("got %v logging in with a removed passkey want %v", err, ErrInvalidPasskey)
+		}
+	})
+
+	t.Run("failed logins lock out accounts and addresses until they expire or an admin unlocks them", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		mailer := &recordingMailer{}
+		userService.SetMailer(mailer)
+		defer config.SetConfig(config.GetConfig())
+		settings := &config.Config{
+			Server:   config.ServerConfig{PublicURL: "https://users.example.com"},
+			Password: config.PasswordConfig{MinLength: 8},
+			Session:  config.SessionConfig{TTL: time.Hour},
+			Lockout:  config.LockoutConfig{MaxAttempts: 3, IPMaxAttempts: 8, Duration: 15 * time.Minute},
+		}
+		config.SetConfig(settings)
+		ctx := WithClientIP(context.Background(), "192.0.2.1")
+		userService.AddUser(ctx, &User{Username: "amy", Password: "password-1", Email: "amy@example.com"})
+		userService.AddUser(ctx, &User{Username: "bob", Password: "password-1"})
+		sent := len(mailer.messages)
+
+		fail := func(username string) error {
+			_, err := userService.Login(ctx, username, "wrong-password")
+			return err
+		}
+		var locked *LockedError
+		for i := 0; i < 2; i++ {
+			if err := fail("amy"); err != ErrInvalidLogin {
+				t.Errorf("got %v for failure %d want %v", err, i+1, ErrInvalidLogin)
+			}
+		}
+		if _, err := userService.Login(ctx, "amy", "password-1"); err != nil {
+			t.Fatalf("got %v logging in below the limit want a session", err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := fail("amy"); err != ErrInvalidLogin {
+				t.Errorf("got %v for failure %d after logging in want the count to start over", err, i+1)
+			}
+		}
+		if err := fail("amy"); !errors.As(err, &locked) || locked.RetryAfter() < 14*time.Minute {
+			t.Fatalf("got %v for the failure reaching the limit want a lockout of 15m", err)
+		}
+		if _, err := userService.Login(ctx, "amy", "password-1"); !errors.As(err, &locked) {
+			t.Errorf("got %v for the right password while locked want a *LockedError", err)
+		}
+		if len(mailer.messages) != sent+1 || mailer.messages[sent].To[0] != "amy@example.com" || mailer.messages[sent].Subject != "Your account was locked" {
+			t.Errorf("got %d emails want amy told once about the lockout", len(mailer.messages)-sent)
+		}
+		if until, err := userService.LockedUntil(ctx, "amy"); err != nil || until.IsZero() {
+			t.Errorf("got %v, %v for amy's lockout want when it ends", until, err)
+		}
+
+		if err := userService.Unlock(ctx, "amy"); err != nil {
+			t.Fatalf("error unlocking: %s", err)
+		}
+		if until, _ := userService.LockedUntil(ctx, "amy"); !until.IsZero() {
+			t.Errorf("got a lockout until %v after unlocking", until)
+		}
+		if _, err := userService.Login(ctx, "amy", "password-1"); err != nil {
+			t.Errorf("got %v logging in after unlocking want a session", err)
+		}
+
+		for _, username := range []string{"nobody", "nobody"} {
+			if err := fail(username); err != ErrInvalidLogin {
+				t.Errorf("got %v below the address limit want %v", err, ErrInvalidLogin)
+			}
+		}
+		if err := fail("someone"); !errors.As(err, &locked) {
+			t.Errorf("got %v for the failure reaching the address limit want a *LockedError", err)
+		}
+		if _, err := userService.Login(ctx, "bob", "password-1"); !errors.As(err, &locked) {
+			t.Errorf("got %v for bob from a locked address want a *LockedError", err)
+		}
+		if _, err := userService.Login(WithClientIP(ctx, "192.0.2.2"), "bob", "password-1"); err != nil {
+			t.Errorf("got %v for bob from another address want a session", err)
+		}
+
+		settings.Lockout = config.LockoutConfig{Duration: 15 * time.Minute, Delay: time.Minute}
+		ctx = WithClientIP(ctx, "192.0.2.3")
+		if err := fail("bob"); err != ErrInvalidLogin {
+			t.Errorf("got %v for a failure with only a delay want %v", err, ErrInvalidLogin)
+		}
+		if _, err := userService.Login(ctx, "bob", "password-1"); !errors.As(err, &locked) || locked.RetryAfter() > time.Minute {
+			t.Errorf("got %v logging in straight after a failure want to wait up to a minute", err)
+		}
+
+		for failures, want := range map[int]time.Duration{0: 0, 1: time.Minute, 3: 4 * time.Minute, 10: 15 * time.Minute} {
+			if got := loginDelay(settings.Lockout, failures); got != want {
+				t.Errorf("got a delay of %s after %d failures want %s", got, failures, want)
+			}
+		}
+	})
+
+	t.Run("the audit log records who changed users and logged in, chained so tampering shows", func(t *testing.T) {
+		userService := setupService(t)
+		defer teardownService(userService)
+		userService.store.(*userRepository).database.SetMaxOpenConns(1)
+		defer config.SetConfig(config.GetConfig())
+		config.SetConfig(&config.Config{
+			Password: config.PasswordConfig{MinLength: 8},
+			Session:  config.SessionConfig{TTL: time.Hour},
+		})
+		ctx := WithRequestID(WithClientIP(context.Background(), "192.0.2.1"), "request-1")
+		admin := WithCaller(ctx, Caller{Username: "boss", Role: RoleAdmin})
+
+		userService.AddUser(admin, &User{Username: "amy", Password: "password-1", FirstName: "Amy"})
+		userService.UpdateUser(admin, &User{Username: "amy", Password: "password-2", FirstName: "Amelia"})
+		userService.SetRole(admin, "amy", RoleAdmin)
+		userService.Login(ctx, "amy", "wrong-password")
+		secret, _ := userService.Login(ctx, "amy", "password-2")
+		userService.Logout(WithCaller(ctx, Caller{Username: "amy", Role: RoleAdmin}), secret)
+		userService.RemoveUser(admin, "amy")
+
+		events, err := userService.ListAudit(ctx, AuditFilter{Subject: "amy"})
+		if err != nil {
+			t.Fatalf("error listing the audit log: %s", err)
+		}
+		got := []string{}
+		for i := len(events) - 1; i >= 0; i-- {
+			got = append(got, events[i].Actor+" "+events[i].Action)
+		}
+		want := "boss create,boss update,boss role-change, login-failed,amy login,amy logout,boss delete"
+		if strings.Join(got, ",") != want {
+			t.Fatalf("got events %s want %s", strings.Join(got, ","), want)
+		}
+		update := events[len(events)-2]
+		expected := []AuditChange{{"password", auditMask, auditMask}, {"first-name", "Amy", "Amelia"}}
+		if !reflect.DeepEqual(update.Changes, expected) {
+			t.Errorf("got changes %+v for the update want %+v", update.Changes, expected)
+		}
+		if update.IP != "192.0.2.1" || update.RequestID != "request-1" || update.Time.IsZero() {
+			t.Errorf("got %+v want the IP, request ID and time of the request", update)
+		}
+		if changes := events[len(events)-3].Changes; len(changes) != 1 || changes[0] != (AuditChange{"role", "user", "admin"}) {
+			t.Errorf("got changes %+v for the role change want user to admin", changes)
+		}
+
+		failed, _ := userService.ListAudit(ctx, AuditFilter{Action: AuditLoginFailed})
+		recent, _ := userService.ListAudit(ctx, AuditFilter{Limit: 2, Before: events[0].Seq})
+		if len(failed) != 1 || len(recent) != 2 || recent[0].Seq != events[0].Seq-1 {
+			t.Errorf("got %d failed logins and %d events before the last want 1 and 2", len(failed), len(recent))
+		}
+
+		checked, err := userService.VerifyAudit(ctx)
+		if err != nil || checked != events[0].Seq {
+			t.Fatalf("got %d, %v verifying want all %d events to check out", checked, err, events[0].Seq)
+		}
+		database := userService.store.(*userRepository).database
+		if _, err = database.Exec(`UPDATE audit_events SET actor = 'someone' WHERE seq = 2;`); err != nil {
+			t.Fatal(err)
+		}
+		var broken *AuditChainError
+		if checked, err = userService.VerifyAudit(ctx); !errors.As(err, &broken) || broken.Seq != 2 || checked != 1 {
+			t.Errorf("got %d, %v after changing event 2 want it reported", checked, err)
+		}
+		if _, err = database.Exec(`UPDATE audit_events SET actor = 'boss' WHERE seq = 2;`); err == nil {
+			_, err = database.Exec(`DELETE FROM audit_events WHERE seq = 3;`)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = userService.VerifyAudit(ctx); !errors.As(err, &broken) || broken.Seq != 4 {
+			t.Errorf("got %v after removing event 3 want event 4 reported", err)
+		}
+	})
 }
@@ -0,0 +1,250 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/logging"
+	"github.com/letitloose/user-app/pkg/tracing"
+)
+
+// ErrInvalidLogin is returned for an unknown username or a wrong password,
+// without saying which.
+var ErrInvalidLogin = errors.New("wrong username or password")
+
+// ErrEmailNotVerified is returned for a correct login when
+// email-verification.require-before-login is set and the user has not
+// confirmed their email address.
+var ErrEmailNotVerified = errors.New("confirm your email address before logging in")
+
+// ErrAccountPending is returned for a correct login by a user who signed up
+// and is still waiting for an admin to approve them.
+var ErrAccountPending = errors.New("your account is waiting for an admin to approve it")
+
+// sessionCookie holds the secret of a session token.
+const sessionCookie = "session"
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// checkNoPassword takes as long as checking a real password, so a login for
+// a user that does not exist cannot be told apart by its timing.
+func checkNoPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = hashPassword("not a password")
+	})
+	verifyPassword(dummyHash, password)
+}
+
+// rehashPassword replaces the plaintext password stored for user, who just
+// logged in with it, with its hash. Failures are only logged, the next login
+// tries again.
+func (service *UserService) rehashPassword(ctx context.Context, user *User, password string) {
+	hashed := *user
+	var err error
+	hashed.Password, err = hashPassword(password)
+	if err == nil {
+		err = service.store.UpdateUser(ctx, &hashed)
+	}
+	if err != nil {
+		logging.Errorf("error hashing the stored password of %s: %s", user.Username, err)
+	}
+}
+
+// Login checks username and password and starts a session, returning the
+// secret identifying it. It returns ErrInvalidLogin for a wrong username or
+// password, a *LockedError after too many of them, see lockout, and
+// ErrAccountPending or ErrEmailNotVerified for a user who may not log in
+// yet. For a user with two-factor authentication on, or whose
+// role requires it, it returns a *TwoFactorRequiredError instead of a
+// session, to be finished with CompleteLogin.
+func (service *UserService) Login(ctx context.Context, username string, password string) (string, error) {
+	ctx, span := tracing.Start(ctx, "UserService.Login")
+	defer span.End()
+
+	ip := ClientIPFromContext(ctx)
+	err := service.checkLockout(ctx, username, ip)
+	var locked *LockedError
+	if errors.As(err, &locked) {
+		loginFailures.Inc()
+		service.audit(ctx, AuditLoginFailed, "", username, nil)
+		return "", err
+	}
+	var user *User
+	if err == nil {
+		user, err = service.store.FindUser(ctx, username)
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("login").Inc()
+		return "", err
+	}
+	if user.Username == "" || !isHashed(user.Password) {
+		checkNoPassword(password)
+	}
+	if user.Username == "" || !verifyPassword(user.Password, password) {
+		loginFailures.Inc()
+		service.audit(ctx, AuditLoginFailed, "", username, nil)
+		if err := service.loginFailed(ctx, username, ip); err != nil {
+			return "", err
+		}
+		return "", ErrInvalidLogin
+	}
+	if !isHashed(user.Password) {
+		service.rehashPassword(ctx, user, password)
+	}
+	if err := checkCanLogin(user); err != nil {
+		loginFailures.Inc()
+		service.audit(ctx, AuditLoginFailed, "", username, nil)
+		return "", err
+	}
+
+	enabled, err := service.TwoFactorEnabled(ctx, user.Username)
+	var secret string
+	switch {
+	case err != nil:
+	case enabled || twoFactorRequired(user.Role):
+		secret, err = service.newChallenge(ctx, user.Username)
+		if err == nil {
+			return "", &TwoFactorRequiredError{Challenge: secret, Setup: !enabled}
+		}
+	default:
+		secret, err = service.startSession(ctx, user.Username)
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("login").Inc()
+		return "", err
+	}
+	return secret, nil
+}
+
+// checkCanLogin returns ErrAccountPending or ErrEmailNotVerified for a user
+// who may not log in yet, however they prove who they are.
+func checkCanLogin(user *User) error {
+	if user.Status == StatusPending {
+		return ErrAccountPending
+	}
+	if config.GetConfig().EmailVerification.RequireBeforeLogin && !user.EmailVerified {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
+
+// startSession logs in username, returning the secret of their session. The
+// failed logins to their account are forgotten.
+func (service *UserService) startSession(ctx context.Context, username string) (string, error) {
+	secret, hash, err := newToken()
+	if err == nil {
+		err = service.store.ClearLoginAttempts(ctx, lockoutAccount+username)
+	}
+	if err == nil {
+		err = service.store.AddToken(ctx, &Token{Kind: TokenSession, Hash: hash, Username: username, Expires: time.Now().Add(config.GetConfig().Session.TTL)})
+	}
+	if err != nil {
+		return "", err
+	}
+	service.audit(ctx, AuditLogin, username, username, nil)
+	return secret, nil
+}
+
+// newChallenge holds the login of username, who gave the right password,
+// until they enter a two-factor code.
+func (service *UserService) newChallenge(ctx context.Context, username string) (string, error) {
+	secret, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	return secret, service.store.AddToken(ctx, &Token{Kind: TokenLoginChallenge, Hash: hash, Username: username, Expires: time.Now().Add(challengeTTL)})
+}
+
+// Logout ends the session secret identifies.
+func (service *UserService) Logout(ctx context.Context, secret string) error {
+	token, err := service.store.TakeToken(ctx, TokenSession, hashToken(secret))
+	if err == nil && token != nil {
+		service.audit(ctx, AuditLogout, token.Username, token.Username, nil)
+	}
+	return err
+}
+
+// Authenticate returns the user whose session secret identifies, or nil if
+// the session does not exist or has expired.
+func (service *UserService) Authenticate(ctx context.Context, secret string) (*User, error) {
+	token, err := service.store.FindToken(ctx, TokenSession, hashToken(secret))
+	if err != nil || token == nil {
+		return nil, err
+	}
+	user, err := service.store.FindUser(ctx, token.Username)
+	if err != nil || user.Username == "" || user.Status == StatusPending {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Identify sets the caller of requests with a session cookie to the user
+// logged in, with their role. Other requests stay anonymous. Every request
+// gets its client IP, see WithClientIP.
+func (service *UserService) Identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		request = request.WithContext(WithClientIP(request.Context(), clientIP(request)))
+		cookie, err := request.Cookie(sessionCookie)
+		if err != nil || cookie.Value == "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		user, err := service.Authenticate(request.Context(), cookie.Value)
+		if err != nil {
+			logging.Errorf("error checking session: %s", err)
+		}
+		if user != nil {
+			request = request.WithContext(WithCaller(request.Context(), Caller{Username: user.Username, Role: user.Role}))
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// SessionKey identifies the session request is made in without revealing
+// its secret, or is "" for a request without a session cookie.
+func SessionKey(request *http.Request) string {
+	cookie, err := request.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	return hashToken(cookie.Value)
+}
+
+// setSessionCookie hands the browser the session secret, or removes it when
+// secret is empty.
+func setSessionCookie(writer http.ResponseWriter, secret string) {
+	cookie := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    secret,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.GetConfig().Server.PublicURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if secret == "" {
+		cookie.MaxAge = -1
+	} else {
+		cookie.MaxAge = int(config.GetConfig().Session.TTL.Seconds())
+	}
+	http.SetCookie(writer, cookie)
+}
+
+// endSessions logs out every session of a user whose password changed from
+// before to after, so one started with the old password does not outlive
+// it.
+func endSessions(ctx context.Context, tx Store, before *User, after *User) error {
+	if before.Username == "" || before.Password == after.Password {
+		return nil
+	}
+	return tx.RemoveTokens(ctx, TokenSession, after.Username)
+}
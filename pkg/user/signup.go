@@ -0,0 +1,151 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/tracing"
+)
+
+// SignupError is returned when the signup policy does not let someone
+// create an account.
+type SignupError struct {
+	Message string
+}
+
+func (err *SignupError) Error() string {
+	return err.Message
+}
+
+// ErrNotPending is returned for approving or rejecting a user who is not
+// waiting for approval.
+var ErrNotPending = errors.New("no such user is waiting for approval")
+
+// SignUp adds user for someone creating an account for themselves, as the
+// signup policy allows. The user gets the user role and, in approval mode,
+// waits as pending until an admin approves them. It returns a *SignupError
+// when the policy refuses them and a *FormatError for an unusable username
+// or email address.
+func (service *UserService) SignUp(ctx context.Context, user *User) error {
+	ctx, span := tracing.Start(ctx, "UserService.SignUp")
+	defer span.End()
+
+	settings := config.GetConfig().Signup
+	err := checkSignup(settings, user)
+	if err == nil {
+		err = service.checkNewUsername(ctx, user.Username)
+	}
+	if err != nil {
+		signups.With("refused").Inc()
+		return err
+	}
+
+	user.Role, user.Status, user.EmailVerified = RoleUser, StatusActive, false
+	if settings.Mode == "approval" {
+		user.Status = StatusPending
+	}
+	err = service.AddUser(ctx, user)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	signups.With(string(user.Status)).Inc()
+	return nil
+}
+
+// checkSignup applies the signup policy in settings to user.
+func checkSignup(settings config.SignupConfig, user *User) error {
+	if settings.Mode == "invite-only" {
+		return &SignupError{Message: "signing up is by invitation only"}
+	}
+	if user.Email != "" && !emailPattern.MatchString(user.Email) {
+		return &FormatError{Message: fmt.Sprintf("email %q is not an email address", user.Email)}
+	}
+	if len(settings.AllowedDomains) == 0 {
+		return nil
+	}
+	if user.Email == "" {
+		return &FormatError{Message: "an email address is required to sign up"}
+	}
+	domain := user.Email[strings.LastIndex(user.Email, "@")+1:]
+	for _, allowed := range settings.AllowedDomains {
+		if strings.EqualFold(domain, strings.TrimPrefix(allowed, "@")) {
+			return nil
+		}
+	}
+	return &SignupError{Message: fmt.Sprintf("email addresses at %s cannot sign up", domain)}
+}
+
+// checkNewUsername returns a *FormatError if username is unusable or taken.
+func (service *UserService) checkNewUsername(ctx context.Context, username string) error {
+	if !usernamePattern.MatchString(username) {
+		return &FormatError{Message: fmt.Sprintf("user-name must be 1 to 255 letters, digits, dots, dashes or underscores, got %q", username)}
+	}
+	existing, err := service.store.FindUser(ctx, username)
+	if err == nil && existing.Username != "" {
+		err = &FormatError{Message: fmt.Sprintf("user-name %s is taken", username)}
+	}
+	return err
+}
+
+// PendingUsers lists the users waiting for an admin to approve them.
+func (service *UserService) PendingUsers(ctx context.Context) ([]*User, error) {
+	return service.ListUsers(ctx, ListFilter{Status: StatusPending})
+}
+
+// ApproveUser lets the pending user username log in and tells them so.
+func (service *UserService) ApproveUser(ctx context.Context, username string) error {
+	ctx, span := tracing.Start(ctx, "UserService.ApproveUser")
+	defer span.End()
+
+	user, err := service.pendingUser(ctx, username)
+	var before User
+	if err == nil {
+		before = *user
+		user.Status = StatusActive
+		err = service.store.UpdateUser(ctx, user)
+	}
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	signups.With("approved").Inc()
+	service.auditChange(ctx, &before, user)
+	service.notify(ctx, user, "Your account was approved",
+		fmt.Sprintf("Your account %s was approved. You can log in at %s.\n", user.Username, publicURL("/login", nil)))
+	return nil
+}
+
+// RejectUser removes the pending user username and tells them so.
+func (service *UserService) RejectUser(ctx context.Context, username string) error {
+	ctx, span := tracing.Start(ctx, "UserService.RejectUser")
+	defer span.End()
+
+	user, err := service.pendingUser(ctx, username)
+	if err == nil {
+		err = service.store.RemoveUser(ctx, username)
+	}
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	signups.With("rejected").Inc()
+	service.audit(ctx, AuditDelete, CallerFromContext(ctx).Username, username, userChanges(user, &User{}))
+	service.notify(ctx, user, "Your account request was declined",
+		fmt.Sprintf("Your request for the account %s was declined and the details you gave have been removed.\n", user.Username))
+	return nil
+}
+
+func (service *UserService) pendingUser(ctx context.Context, username string) (*User, error) {
+	user, err := service.store.FindUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user.Username == "" || user.Status != StatusPending {
+		return nil, ErrNotPending
+	}
+	return user, nil
+}
@@ -0,0 +1,51 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// statementCache prepares each query once per database, primary or
+// replica, and reuses the statement for every later call.
+type statementCache struct {
+	mutex    sync.Mutex
+	prepared map[*sql.DB]map[string]*sql.Stmt
+}
+
+func newStatementCache() *statementCache {
+	return &statementCache{prepared: map[*sql.DB]map[string]*sql.Stmt{}}
+}
+
+func (cache *statementCache) get(ctx context.Context, database *sql.DB, query string) (*sql.Stmt, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if statement, ok := cache.prepared[database][query]; ok {
+		return statement, nil
+	}
+
+	statement, err := database.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if cache.prepared[database] == nil {
+		cache.prepared[database] = map[string]*sql.Stmt{}
+	}
+	cache.prepared[database][query] = statement
+	return statement, nil
+}
+
+func (cache *statementCache) close() error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	var firstErr error
+	for _, statements := range cache.prepared {
+		for _, statement := range statements {
+			if err := statement.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	cache.prepared = map[*sql.DB]map[string]*sql.Stmt{}
+	return firstErr
+}
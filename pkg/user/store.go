@@ -0,0 +1,78 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Store keeps users. The database repository is the real one, CachedStore
+// wraps another Store to avoid repeating lookups.
+//
+// FindUser returns a User with an empty Username, not an error, when there
+// is no such user.
+type Store interface {
+	ListAll(ctx context.Context) ([]*User, error)
+	EachUser(ctx context.Context, filter ListFilter, fn func(user *User) error) error
+	FindUser(ctx context.Context, username string) (*User, error)
+	AddUser(ctx context.Context, user *User) error
+	UpdateUser(ctx context.Context, user *User) error
+	RemoveUser(ctx context.Context, username string) error
+
+	// The batch methods change all of the users or, on error, none of them.
+	AddUsers(ctx context.Context, users []*User) error
+	UpdateUsers(ctx context.Context, users []*User) error
+	RemoveUsers(ctx context.Context, usernames []string) error
+
+	// Tokens are the single-use secrets emailed to users, see Token.
+	AddToken(ctx context.Context, token *Token) error
+	FindToken(ctx context.Context, kind string, hash string) (*Token, error)
+	LastToken(ctx context.Context, kind string, username string) (*Token, error)
+	TakeToken(ctx context.Context, kind string, hash string) (*Token, error)
+	RemoveTokens(ctx context.Context, kind string, username string) error
+
+	// Invitations are emailed by admins to people who may create an
+	// account, see Invitation. FindInvitation returns nil when there is no
+	// such invitation.
+	AddInvitation(ctx context.Context, invitation *Invitation) error
+	FindInvitation(ctx context.Context, id string) (*Invitation, error)
+	ListInvitations(ctx context.Context) ([]*Invitation, error)
+	UpdateInvitation(ctx context.Context, invitation *Invitation) error
+	ClaimInvitation(ctx context.Context, id string, username string) (bool, error)
+
+	// Two-factor authentication, see TwoFactor. FindTwoFactor returns nil
+	// for a user without it.
+	FindTwoFactor(ctx context.Context, username string) (*TwoFactor, error)
+	SaveTwoFactor(ctx context.Context, twoFactor *TwoFactor) error
+	RemoveTwoFactor(ctx context.Context, username string) error
+	UseTwoFactorStep(ctx context.Context, username string, step int64) (bool, error)
+
+	// Passkeys are WebAuthn credentials users log in with, see Passkey.
+	// FindPasskey returns nil when there is no such passkey.
+	AddPasskey(ctx context.Context, passkey *Passkey) error
+	FindPasskey(ctx context.Context, id string) (*Passkey, error)
+	ListPasskeys(ctx context.Context, username string) ([]*Passkey, error)
+	RenamePasskey(ctx context.Context, id string, name string) error
+	UsePasskey(ctx context.Context, id string, signCount uint32, used time.Time) (bool, error)
+	RemovePasskey(ctx context.Context, id string) error
+	RemovePasskeys(ctx context.Context, username string) error
+
+	// Failed logins are counted under an account or IP address key, see
+	// LoginAttempts. FindLoginAttempts returns nil when there are none.
+	FindLoginAttempts(ctx context.Context, key string) (*LoginAttempts, error)
+	AddLoginFailure(ctx context.Context, key string, at time.Time, since time.Time) (*LoginAttempts, error)
+	LockLogin(ctx context.Context, key string, until time.Time) error
+	ClearLoginAttempts(ctx context.Context, key string) error
+	RemoveLoginAttempts(ctx context.Context, since time.Time, now time.Time) (int64, error)
+
+	// The audit log is append-only, see AuditEvent. AddAuditEvent sets the
+	// event's Seq and Hash.
+	AddAuditEvent(ctx context.Context, event *AuditEvent) error
+	ListAuditEvents(ctx context.Context, filter AuditFilter) ([]*AuditEvent, error)
+	EachAuditEvent(ctx context.Context, fn func(event *AuditEvent) error) error
+
+	// WithTx runs fn with a Store that does everything in one transaction,
+	// committed only if fn returns nil. Calling WithTx on that Store nests a
+	// savepoint.
+	WithTx(ctx context.Context, options *sql.TxOptions, fn func(tx Store) error) error
+}
@@ -0,0 +1,20 @@
+package user
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+)
+
+//go:embed templates/*.html
+var embeddedTemplates embed.FS
+
+// Templates returns the user pages, from pkg/user/templates on disk in dev
+// mode or from the binary otherwise.
+func Templates(dev bool) fs.FS {
+	if dev {
+		return os.DirFS("pkg/user/templates")
+	}
+	templates, _ := fs.Sub(embeddedTemplates, "templates")
+	return templates
+}
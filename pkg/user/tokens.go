@@ -0,0 +1,181 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Token kinds.
+const (
+	TokenPasswordReset = "password-reset"
+	TokenVerifyEmail   = "verify-email"
+	TokenSession       = "session"
+)
+
+// tokenKinds lists every kind of token, which all go when their user is
+// removed.
+var tokenKinds = []string{TokenPasswordReset, TokenVerifyEmail, TokenSession,
+	TokenLoginChallenge, TokenRecoveryCode, TokenPasskeyRegistration, TokenPasskeyLogin}
+
+// ErrInvalidToken is returned for a token that does not exist, has expired
+// or has already been used.
+var ErrInvalidToken = errors.New("the link is invalid or has expired")
+
+// Token is a single-use secret emailed to a user, such as a password reset
+// link. Only the hash of the secret is stored, so a leaked table cannot be
+// used to take over accounts. Data holds anything else the kind of token
+// needs.
+type Token struct {
+	Kind     string
+	Hash     string
+	Username string
+	Data     string
+	Created  time.Time
+	Expires  time.Time
+}
+
+// newToken returns a random secret to send to the user and the hash to
+// store for it.
+func newToken() (secret string, hash string, err error) {
+	random := make([]byte, 32)
+	_, err = rand.Read(random)
+	if err != nil {
+		return "", "", err
+	}
+	secret = base64.RawURLEncoding.EncodeToString(random)
+	return secret, hashToken(secret), nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (repository *userRepository) createTokenTable(ctx context.Context) error {
+	_, err := repository.database.ExecContext(ctx, `create table if not exists tokens (kind varchar(32) not null,
+		hash char(64) not null,
+		username varchar(255) not null,
+		data text,
+		created bigint not null default 0,
+		expires bigint not null,
+		primary key (kind, hash));`)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return repository.addColumn(ctx, "tokens", "created", "bigint not null default 0")
+}
+
+// AddToken stores token, clearing out expired tokens of any kind while it
+// is at it.
+func (repository *userRepository) AddToken(ctx context.Context, token *Token) error {
+	query := `INSERT INTO tokens (kind, hash, username, data, created, expires) VALUES (?, ?, ?, ?, ?, ?);`
+	ctx, span := startQuerySpan(ctx, "userRepository.AddToken", query)
+	defer span.End()
+
+	_, err := repository.exec(ctx, `DELETE FROM tokens WHERE expires < ?;`, time.Now().Unix())
+	if err == nil {
+		if token.Created.IsZero() {
+			token.Created = time.Now()
+		}
+		_, err = repository.exec(ctx, query, token.Kind, token.Hash, token.Username, token.Data, token.Created.Unix(), token.Expires.Unix())
+	}
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// FindToken returns the unexpired token of kind with hash, or nil if there
+// is none.
+func (repository *userRepository) FindToken(ctx context.Context, kind string, hash string) (*Token, error) {
+	query := `SELECT kind, hash, username, data, created, expires FROM tokens WHERE kind = ? AND hash = ? AND expires >= ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.FindToken", query)
+	defer span.End()
+
+	token, err := repository.queryToken(ctx, query, kind, hash, time.Now().Unix())
+	if err != nil {
+		span.RecordError(err)
+	}
+	return token, err
+}
+
+// LastToken returns the newest unexpired token of kind for username, or nil
+// if there is none.
+func (repository *userRepository) LastToken(ctx context.Context, kind string, username string) (*Token, error) {
+	query := `SELECT kind, hash, username, data, created, expires FROM tokens WHERE kind = ? AND username = ? AND expires >= ? ORDER BY created DESC LIMIT 1;`
+	ctx, span := startQuerySpan(ctx, "userRepository.LastToken", query)
+	defer span.End()
+
+	token, err := repository.queryToken(ctx, query, kind, username, time.Now().Unix())
+	if err != nil {
+		span.RecordError(err)
+	}
+	return token, err
+}
+
+func (repository *userRepository) queryToken(ctx context.Context, query string, args ...any) (*Token, error) {
+	rows, err := repository.query(ctx, repository.database, query, args...)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, contextError(ctx, rows.Err())
+	}
+
+	token := &Token{}
+	var data sql.NullString
+	var created, expires int64
+	err = rows.Scan(&token.Kind, &token.Hash, &token.Username, &data, &created, &expires)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	token.Data, token.Created, token.Expires = data.String, time.Unix(created, 0), time.Unix(expires, 0)
+	return token, nil
+}
+
+// TakeToken returns the unexpired token of kind with hash and deletes it,
+// so it can only be used once. It returns nil if there is no such token or
+// another caller took it first.
+func (repository *userRepository) TakeToken(ctx context.Context, kind string, hash string) (*Token, error) {
+	token, err := repository.FindToken(ctx, kind, hash)
+	if err != nil || token == nil {
+		return nil, err
+	}
+
+	query := `DELETE FROM tokens WHERE kind = ? AND hash = ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.TakeToken", query)
+	defer span.End()
+	result, err := repository.exec(ctx, query, kind, hash)
+	if err != nil {
+		span.RecordError(err)
+		return nil, contextError(ctx, err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil || deleted == 0 {
+		return nil, err
+	}
+	return token, nil
+}
+
+// RemoveTokens deletes every token of kind for username.
+func (repository *userRepository) RemoveTokens(ctx context.Context, kind string, username string) error {
+	query := `DELETE FROM tokens WHERE kind = ? AND username = ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.RemoveTokens", query)
+	defer span.End()
+
+	_, err := repository.exec(ctx, query, kind, username)
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
@@ -0,0 +1,554 @@
+package user
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/tracing"
+)
+
+// ErrInvalidCode is returned for a two-factor code that is wrong, too old,
+// already used, or a recovery code that does not exist.
+var ErrInvalidCode = errors.New("the code is wrong or has already been used")
+
+// ErrTwoFactorEnabled is returned for setting up two-factor authentication
+// for a user who already has it.
+var ErrTwoFactorEnabled = errors.New("two-factor authentication is already on")
+
+var errNoEncryptionKey = errors.New("two-factor.encryption-key is not set")
+
+// TwoFactorRequiredError is returned by Login for a correct password when a
+// code is needed too. Challenge identifies the login to CompleteLogin. With
+// Setup, the user has to set up two-factor authentication first, as their
+// role requires it.
+type TwoFactorRequiredError struct {
+	Challenge string
+	Setup     bool
+}
+
+func (err *TwoFactorRequiredError) Error() string {
+	if err.Setup {
+		return "set up two-factor authentication to log in"
+	}
+	return "enter the code from your authenticator app"
+}
+
+// TokenLoginChallenge tokens are logins waiting for a two-factor code and
+// TokenRecoveryCode tokens the codes that stand in for one.
+const (
+	TokenLoginChallenge = "login-challenge"
+	TokenRecoveryCode   = "recovery-code"
+)
+
+const (
+	totpDigits = 6
+	totpPeriod = 30 * time.Second
+	// totpSkew is how many periods a code may be off by, for clocks that
+	// are not quite right.
+	totpSkew = 1
+
+	challengeTTL      = 10 * time.Minute
+	recoveryCodeCount = 10
+	// Recovery codes last until they are used or replaced.
+	recoveryCodeTTL = 100 * 365 * 24 * time.Hour
+)
+
+var base32Secret = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactor is the authenticator app of a user. Secret is sealed with
+// two-factor.encryption-key, see sealSecret. It only protects logins once
+// Enabled, after the user entered a code showing their app is set up.
+// LastStep is the period of the last code used, so no code works twice.
+type TwoFactor struct {
+	Username string
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+// TwoFactorSetup is what a user adds to their authenticator app: the
+// secret, in base32, and the otpauth:// URI with it that QR codes hold.
+type TwoFactorSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+func newTwoFactorSetup(username string, secret []byte) *TwoFactorSetup {
+	issuer := config.GetConfig().TwoFactor.Issuer
+	encoded := base32Secret.EncodeToString(secret)
+	query := url.Values{
+		"secret":    {encoded},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(int(totpPeriod.Seconds()))},
+	}
+	uri := "otpauth://totp/" + url.PathEscape(issuer) + ":" + url.PathEscape(username) + "?" + query.Encode()
+	return &TwoFactorSetup{Secret: encoded, URI: uri}
+}
+
+// totpCode is the RFC 6238 code for secret in period step, which is the
+// HOTP code of RFC 4226 with the step as the counter.
+func totpCode(secret []byte, step int64, digits int) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < digits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulus)
+}
+
+func totpStep(now time.Time) int64 {
+	return now.Unix() / int64(totpPeriod.Seconds())
+}
+
+// matchTOTP returns the step code is right for around now, or -1.
+func matchTOTP(secret []byte, code string, now time.Time) int64 {
+	code = strings.ReplaceAll(code, " ", "")
+	step := totpStep(now)
+	for offset := int64(-totpSkew); offset <= totpSkew; offset++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step+offset, totpDigits)), []byte(code)) == 1 {
+			return step + offset
+		}
+	}
+	return -1
+}
+
+func secretCipher() (cipher.AEAD, error) {
+	key := config.GetConfig().TwoFactor.EncryptionKey
+	if key == "" {
+		return nil, errNoEncryptionKey
+	}
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealSecret encrypts secret with AES-GCM under a key derived from
+// two-factor.encryption-key, so a leaked table does not give away codes.
+func sealSecret(secret []byte) (string, error) {
+	aead, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, secret, nil)), nil
+}
+
+func openSecret(sealed string) ([]byte, error) {
+	aead, err := secretCipher()
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return nil, errors.New("two-factor secret is corrupt")
+	}
+	secret, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("two-factor secret does not decrypt, was two-factor.encryption-key changed?")
+	}
+	return secret, nil
+}
+
+// normalizeRecoveryCode lets recovery codes be typed in any case, with or
+// without the dash.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func newRecoveryCode() (string, error) {
+	random := make([]byte, 5)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32Secret.EncodeToString(random))
+	return code[:4] + "-" + code[4:], nil
+}
+
+func (repository *userRepository) createTwoFactorTable(ctx context.Context) error {
+	_, err := repository.database.ExecContext(ctx, `create table if not exists two_factor (username varchar(255) primary key,
+		secret text not null,
+		enabled boolean not null default false,
+		last_step bigint not null default 0);`)
+	return contextError(ctx, err)
+}
+
+// FindTwoFactor returns the authenticator app of username, or nil if they
+// have none.
+func (repository *userRepository) FindTwoFactor(ctx context.Context, username string) (*TwoFactor, error) {
+	query := `SELECT username, secret, enabled, last_step FROM two_factor WHERE username = ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.FindTwoFactor", query)
+	defer span.End()
+
+	rows, err := repository.query(ctx, repository.database, query, username)
+	if err != nil {
+		span.RecordError(err)
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, contextError(ctx, rows.Err())
+	}
+	twoFactor := &TwoFactor{}
+	err = rows.Scan(&twoFactor.Username, &twoFactor.Secret, &twoFactor.Enabled, &twoFactor.LastStep)
+	if err != nil {
+		span.RecordError(err)
+		return nil, contextError(ctx, err)
+	}
+	return twoFactor, nil
+}
+
+// SaveTwoFactor stores twoFactor in place of any the user had.
+func (repository *userRepository) SaveTwoFactor(ctx context.Context, twoFactor *TwoFactor) error {
+	query := `REPLACE INTO two_factor (username, secret, enabled, last_step) VALUES (?, ?, ?, ?);`
+	ctx, span := startQuerySpan(ctx, "userRepository.SaveTwoFactor", query)
+	defer span.End()
+
+	_, err := repository.exec(ctx, query, twoFactor.Username, twoFactor.Secret, twoFactor.Enabled, twoFactor.LastStep)
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// RemoveTwoFactor deletes the authenticator app of username.
+func (repository *userRepository) RemoveTwoFactor(ctx context.Context, username string) error {
+	query := `DELETE FROM two_factor WHERE username = ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.RemoveTwoFactor", query)
+	defer span.End()
+
+	_, err := repository.exec(ctx, query, username)
+	if err != nil {
+		span.RecordError(err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// UseTwoFactorStep records that a code for step was used by username. It
+// reports false if one for step or later already was, by another caller
+// too.
+func (repository *userRepository) UseTwoFactorStep(ctx context.Context, username string, step int64) (bool, error) {
+	query := `UPDATE two_factor SET last_step = ? WHERE username = ? AND last_step < ?;`
+	ctx, span := startQuerySpan(ctx, "userRepository.UseTwoFactorStep", query)
+	defer span.End()
+
+	result, err := repository.exec(ctx, query, step, username, step)
+	if err != nil {
+		span.RecordError(err)
+		return false, contextError(ctx, err)
+	}
+	used, err := result.RowsAffected()
+	return used == 1, err
+}
+
+// TwoFactorEnabled reports whether username logs in with a code as well as
+// their password.
+func (service *UserService) TwoFactorEnabled(ctx context.Context, username string) (bool, error) {
+	twoFactor, err := service.store.FindTwoFactor(ctx, username)
+	return twoFactor != nil && twoFactor.Enabled, err
+}
+
+// StartTwoFactor returns a new secret for username to add to their
+// authenticator app, or the one they were given before and have not
+// confirmed yet. It takes effect once EnableTwoFactor gets a code for it.
+func (service *UserService) StartTwoFactor(ctx context.Context, username string) (*TwoFactorSetup, error) {
+	ctx, span := tracing.Start(ctx, "UserService.StartTwoFactor")
+	defer span.End()
+
+	setup, err := service.PendingTwoFactor(ctx, username)
+	if err != nil || setup != nil {
+		return setup, err
+	}
+
+	secret := make([]byte, 20)
+	_, err = rand.Read(secret)
+	var sealed string
+	if err == nil {
+		sealed, err = sealSecret(secret)
+	}
+	if err == nil {
+		err = service.store.SaveTwoFactor(ctx, &TwoFactor{Username: username, Secret: sealed})
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("two_factor").Inc()
+		return nil, err
+	}
+	return newTwoFactorSetup(username, secret), nil
+}
+
+// PendingTwoFactor returns the secret username was given by StartTwoFactor
+// and has not confirmed, or nil if there is none. It returns
+// ErrTwoFactorEnabled once it is confirmed, since secrets in use are never
+// shown again.
+func (service *UserService) PendingTwoFactor(ctx context.Context, username string) (*TwoFactorSetup, error) {
+	twoFactor, err := service.store.FindTwoFactor(ctx, username)
+	if err != nil || twoFactor == nil {
+		return nil, err
+	}
+	if twoFactor.Enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	secret, err := openSecret(twoFactor.Secret)
+	if err != nil {
+		// Start over with a new secret under the current key.
+		return nil, nil
+	}
+	return newTwoFactorSetup(username, secret), nil
+}
+
+// EnableTwoFactor turns on two-factor authentication for username if code
+// is right for the secret StartTwoFactor gave them, and returns their
+// recovery codes. Each works once in place of a code, for when the app is
+// lost, and they are only ever shown here.
+func (service *UserService) EnableTwoFactor(ctx context.Context, username string, code string) ([]string, error) {
+	ctx, span := tracing.Start(ctx, "UserService.EnableTwoFactor")
+	defer span.End()
+
+	twoFactor, err := service.store.FindTwoFactor(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if twoFactor != nil && twoFactor.Enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	if twoFactor == nil {
+		return nil, ErrInvalidCode
+	}
+	secret, err := openSecret(twoFactor.Secret)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	step := matchTOTP(secret, code, time.Now())
+	if step < 0 {
+		twoFactorChecks.With("invalid").Inc()
+		return nil, ErrInvalidCode
+	}
+
+	twoFactor.Enabled, twoFactor.LastStep = true, step
+	codes, err := service.replaceRecoveryCodes(ctx, twoFactor)
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("two_factor").Inc()
+		return nil, err
+	}
+	twoFactorChecks.With("enabled").Inc()
+	return codes, nil
+}
+
+// replaceRecoveryCodes saves twoFactor with a new set of recovery codes.
+func (service *UserService) replaceRecoveryCodes(ctx context.Context, twoFactor *TwoFactor) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		var err error
+		codes[i], err = newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := service.store.WithTx(ctx, nil, func(tx Store) error {
+		err := tx.SaveTwoFactor(ctx, twoFactor)
+		if err == nil {
+			err = tx.RemoveTokens(ctx, TokenRecoveryCode, twoFactor.Username)
+		}
+		expires := time.Now().Add(recoveryCodeTTL)
+		for _, code := range codes {
+			if err != nil {
+				break
+			}
+			err = tx.AddToken(ctx, &Token{Kind: TokenRecoveryCode, Hash: hashToken(normalizeRecoveryCode(code)), Username: twoFactor.Username, Expires: expires})
+		}
+		return err
+	})
+	return codes, err
+}
+
+// NewRecoveryCodes replaces the recovery codes of username, who must have
+// two-factor authentication on, and returns the new ones.
+func (service *UserService) NewRecoveryCodes(ctx context.Context, username string) ([]string, error) {
+	twoFactor, err := service.store.FindTwoFactor(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if twoFactor == nil || !twoFactor.Enabled {
+		return nil, errors.New("two-factor authentication is not on")
+	}
+	return service.replaceRecoveryCodes(ctx, twoFactor)
+}
+
+// DisableTwoFactor turns off two-factor authentication for username and
+// removes their recovery codes.
+func (service *UserService) DisableTwoFactor(ctx context.Context, username string) error {
+	ctx, span := tracing.Start(ctx, "UserService.DisableTwoFactor")
+	defer span.End()
+
+	err := service.store.RemoveTwoFactor(ctx, username)
+	if err == nil {
+		err = service.store.RemoveTokens(ctx, TokenRecoveryCode, username)
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("two_factor").Inc()
+		return err
+	}
+	twoFactorChecks.With("disabled").Inc()
+	return nil
+}
+
+// CheckTwoFactor returns nil if code is a current code from the app of
+// username, not used before, or one of their recovery codes, which it uses
+// up. It returns ErrInvalidCode otherwise.
+func (service *UserService) CheckTwoFactor(ctx context.Context, username string, code string) error {
+	twoFactor, err := service.store.FindTwoFactor(ctx, username)
+	if err != nil {
+		return err
+	}
+	if twoFactor == nil || !twoFactor.Enabled {
+		return ErrInvalidCode
+	}
+	secret, err := openSecret(twoFactor.Secret)
+	if err != nil {
+		return err
+	}
+
+	if step := matchTOTP(secret, code, time.Now()); step >= 0 {
+		used, err := service.store.UseTwoFactorStep(ctx, username, step)
+		if err != nil {
+			return err
+		}
+		if used {
+			twoFactorChecks.With("code").Inc()
+			return nil
+		}
+		twoFactorChecks.With("invalid").Inc()
+		return ErrInvalidCode
+	}
+
+	token, err := service.store.TakeToken(ctx, TokenRecoveryCode, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if token == nil || token.Username != username {
+		twoFactorChecks.With("invalid").Inc()
+		return ErrInvalidCode
+	}
+	twoFactorChecks.With("recovery_code").Inc()
+	return nil
+}
+
+// twoFactorRequired reports whether role must log in with two-factor
+// authentication.
+func twoFactorRequired(role Role) bool {
+	for _, required := range config.GetConfig().TwoFactor.RequiredRoles {
+		if Role(required) == role {
+			return true
+		}
+	}
+	return false
+}
+
+// ChallengeSetup returns the secret to set up for the login challenge
+// identifies, for a user whose role requires two-factor authentication.
+// It returns ErrInvalidToken for a challenge that is unknown or expired.
+func (service *UserService) ChallengeSetup(ctx context.Context, challenge string) (*TwoFactorSetup, error) {
+	token, err := service.store.FindToken(ctx, TokenLoginChallenge, hashToken(challenge))
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, ErrInvalidToken
+	}
+	return service.StartTwoFactor(ctx, token.Username)
+}
+
+// CompleteLogin finishes the login challenge identifies with a two-factor
+// code, starting a session whose secret it returns. For a user setting up
+// two-factor authentication as they log in, code confirms the setup and
+// their new recovery codes are returned too. It returns ErrInvalidToken for
+// a challenge that is unknown or expired and ErrInvalidCode for a wrong
+// code, after which the challenge can be tried again. Wrong codes count
+// towards a lockout like wrong passwords, see LockedError.
+func (service *UserService) CompleteLogin(ctx context.Context, challenge string, code string) (secret string, recoveryCodes []string, err error) {
+	ctx, span := tracing.Start(ctx, "UserService.CompleteLogin")
+	defer span.End()
+
+	ip := ClientIPFromContext(ctx)
+	token, err := service.store.FindToken(ctx, TokenLoginChallenge, hashToken(challenge))
+	if err == nil && token == nil {
+		err = ErrInvalidToken
+	}
+	if err == nil {
+		err = service.checkLockout(ctx, token.Username, ip)
+	}
+	var enabled bool
+	if err == nil {
+		enabled, err = service.TwoFactorEnabled(ctx, token.Username)
+	}
+	if err == nil && enabled {
+		err = service.CheckTwoFactor(ctx, token.Username, code)
+	} else if err == nil {
+		recoveryCodes, err = service.EnableTwoFactor(ctx, token.Username, code)
+	}
+	if err == ErrInvalidCode {
+		if locked := service.loginFailed(ctx, token.Username, ip); locked != nil {
+			err = locked
+		}
+	}
+	var locked *LockedError
+	if err == ErrInvalidCode || err == ErrInvalidToken || errors.As(err, &locked) {
+		loginFailures.Inc()
+		if token != nil {
+			service.audit(ctx, AuditLoginFailed, "", token.Username, nil)
+		}
+		return "", nil, err
+	}
+
+	if err == nil {
+		token, err = service.store.TakeToken(ctx, TokenLoginChallenge, hashToken(challenge))
+		if err == nil && token == nil {
+			return "", nil, ErrInvalidToken
+		}
+	}
+	if err == nil {
+		secret, err = service.startSession(ctx, token.Username)
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("login").Inc()
+		return "", nil, err
+	}
+	return secret, recoveryCodes, nil
+}
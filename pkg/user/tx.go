@@ -0,0 +1,100 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// WithTx runs fn with a Store whose methods all run in one transaction. It
+// is committed if fn returns nil and rolled back if fn returns an error or
+// panics. Called on a Store that is already in a transaction, it nests a
+// savepoint instead, so only fn's changes are undone and options are
+// ignored.
+func (repository *userRepository) WithTx(ctx context.Context, options *sql.TxOptions, fn func(tx Store) error) (err error) {
+	if repository.tx != nil {
+		return repository.savepoint(ctx, fn)
+	}
+
+	tx, err := repository.database.BeginTx(ctx, options)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			tx.Rollback()
+			panic(recovered)
+		}
+	}()
+
+	err = fn(repository.bind(tx, 0))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// savepoint runs fn in a savepoint of the repository's transaction, rolling
+// back to it if fn returns an error or panics.
+func (repository *userRepository) savepoint(ctx context.Context, fn func(tx Store) error) (err error) {
+	depth := repository.depth + 1
+	name := fmt.Sprintf("savepoint_%d", depth)
+	_, err = repository.tx.ExecContext(ctx, "SAVEPOINT "+name)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			repository.tx.ExecContext(context.Background(), "ROLLBACK TO SAVEPOINT "+name)
+			panic(recovered)
+		}
+	}()
+
+	err = fn(repository.bind(repository.tx, depth))
+	if err != nil {
+		repository.tx.ExecContext(context.Background(), "ROLLBACK TO SAVEPOINT "+name)
+		return err
+	}
+	_, err = repository.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// bind returns a repository that runs every statement in tx, on the primary
+// and without retries.
+func (repository *userRepository) bind(tx *sql.Tx, depth int) *userRepository {
+	return &userRepository{
+		database:   repository.database,
+		statements: repository.statements,
+		writes:     repository.writes,
+		audits:     repository.audits,
+		tx:         tx,
+		depth:      depth,
+	}
+}
+
+var isolationLevels = map[string]sql.IsolationLevel{
+	"default":          sql.LevelDefault,
+	"read-uncommitted": sql.LevelReadUncommitted,
+	"read-committed":   sql.LevelReadCommitted,
+	"repeatable-read":  sql.LevelRepeatableRead,
+	"serializable":     sql.LevelSerializable,
+}
+
+// ParseIsolationLevel returns the isolation level named in config, e.g.
+// "read-committed".
+func ParseIsolationLevel(name string) (sql.IsolationLevel, error) {
+	level, ok := isolationLevels[strings.ToLower(name)]
+	if !ok {
+		return sql.LevelDefault, fmt.Errorf("unknown isolation level %q", name)
+	}
+	return level, nil
+}
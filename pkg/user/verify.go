@@ -0,0 +1,213 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/letitloose/user-app/cmd/config"
+	"github.com/letitloose/user-app/pkg/logging"
+	"github.com/letitloose/user-app/pkg/mail"
+	"github.com/letitloose/user-app/pkg/tracing"
+)
+
+// prepareUpdate readies user, as sent by a client, to replace the stored
+// one. The password is hashed or, when empty, kept, and the role, status,
+// groups and verification are carried over. A new email address is not applied but
+// returned, to take effect once it is confirmed; clearing it is immediate.
+func prepareUpdate(ctx context.Context, store Store, user *User) (newEmail string, err error) {
+	if user.Password != "" {
+		err = setPassword(user)
+		if err != nil {
+			return "", err
+		}
+	}
+	existing, err := store.FindUser(ctx, user.Username)
+	if err != nil || existing.Username == "" {
+		return "", err
+	}
+
+	if user.Password == "" {
+		user.Password = existing.Password
+	}
+	user.Role, user.Status, user.EmailVerified = existing.Role, existing.Status, existing.EmailVerified
+	user.Groups = existing.Groups
+	if user.Email != "" && user.Email != existing.Email {
+		newEmail, user.Email = user.Email, existing.Email
+	}
+	if user.Email == "" {
+		user.EmailVerified = false
+	}
+	return newEmail, nil
+}
+
+// sendVerification emails user a single-use link confirming address, which
+// becomes their email address when it is opened. Any earlier link stops
+// working.
+func (service *UserService) sendVerification(ctx context.Context, user *User, address string) error {
+	if service.mailer == nil {
+		return errNoMailer
+	}
+	secret, hash, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	ttl := config.GetConfig().EmailVerification.TokenTTL
+	err = service.store.WithTx(ctx, nil, func(tx Store) error {
+		err := tx.RemoveTokens(ctx, TokenVerifyEmail, user.Username)
+		if err != nil {
+			return err
+		}
+		return tx.AddToken(ctx, &Token{Kind: TokenVerifyEmail, Hash: hash, Username: user.Username, Data: address, Expires: time.Now().Add(ttl)})
+	})
+	if err != nil {
+		return err
+	}
+
+	link := publicURL("/email/verify", url.Values{"token": {secret}})
+	err = service.mailer.Send(ctx, &mail.Message{
+		To:      []string{address},
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Please confirm %s is the email address for %s by opening this link within %s:\n\n%s\n\n"+
+			"If you didn't ask for this, you can ignore this email.\n",
+			address, user.Username, ttl, link),
+	})
+	if err != nil {
+		return err
+	}
+	emailVerifications.With("sent").Inc()
+	return nil
+}
+
+// verifyNewUser sends the verification link for a user that was just added
+// with an email address. The user exists either way, so failing to send is
+// only logged; the link can be sent again.
+func (service *UserService) verifyNewUser(ctx context.Context, user *User) {
+	if user.Email == "" || user.EmailVerified || service.mailer == nil {
+		return
+	}
+	err := service.sendVerification(ctx, user, user.Email)
+	if err != nil {
+		logging.Errorf("error sending verification email to %s: %s", user.Username, err)
+	}
+}
+
+// confirmEmailChange asks user to confirm newEmail and tells their current
+// address about the change, so someone who took over the account cannot
+// quietly move it to an address of theirs. Failures are only logged.
+func (service *UserService) confirmEmailChange(ctx context.Context, user *User, newEmail string) {
+	if newEmail == "" || service.mailer == nil {
+		return
+	}
+	err := service.sendVerification(ctx, user, newEmail)
+	if err != nil {
+		logging.Errorf("error sending verification email to %s: %s", user.Username, err)
+	}
+	service.notify(ctx, user, "Your email address is being changed",
+		fmt.Sprintf("Someone asked to change the email address for %s to %s. "+
+			"It changes once the link sent there is opened, until then this address stays in use.\n\n"+
+			"If it wasn't you, reset your password at %s.\n",
+			user.Username, newEmail, publicURL("/password/forgot", nil)))
+}
+
+// CheckVerifyToken reports whether secret is a verification link that can
+// still be used.
+func (service *UserService) CheckVerifyToken(ctx context.Context, secret string) (bool, error) {
+	token, err := service.store.FindToken(ctx, TokenVerifyEmail, hashToken(secret))
+	return token != nil, err
+}
+
+// ConfirmEmail makes the address the verification link secret was sent to
+// the verified email address of its user, and uses up the link. It returns
+// ErrInvalidToken for a link that is unknown, expired or already used.
+func (service *UserService) ConfirmEmail(ctx context.Context, secret string) (*User, error) {
+	ctx, span := tracing.Start(ctx, "UserService.ConfirmEmail")
+	defer span.End()
+
+	var user *User
+	var before User
+	err := service.store.WithTx(ctx, nil, func(tx Store) error {
+		token, err := tx.TakeToken(ctx, TokenVerifyEmail, hashToken(secret))
+		if err != nil {
+			return err
+		}
+		if token == nil {
+			return ErrInvalidToken
+		}
+		user, err = tx.FindUser(ctx, token.Username)
+		if err != nil {
+			return err
+		}
+		if user.Username == "" {
+			return ErrInvalidToken
+		}
+
+		before = *user
+		user.Email, user.EmailVerified = token.Data, true
+		err = tx.UpdateUser(ctx, user)
+		if err != nil {
+			return err
+		}
+		return tx.RemoveTokens(ctx, TokenVerifyEmail, user.Username)
+	})
+	if err == ErrInvalidToken {
+		emailVerifications.With("invalid").Inc()
+		return nil, err
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("verify_email").Inc()
+		return nil, err
+	}
+	emailVerifications.With("confirmed").Inc()
+	service.auditChange(ctx, &before, user)
+	return user, nil
+}
+
+// ResendVerification sends the user whose username or email address is
+// login a new link for the address waiting to be confirmed, the new one
+// after a change or else their unverified one. Nothing is sent if there is
+// none, or if a link went out less than email-verification.resend-interval
+// ago, and callers must not tell the difference.
+func (service *UserService) ResendVerification(ctx context.Context, login string) error {
+	ctx, span := tracing.Start(ctx, "UserService.ResendVerification")
+	defer span.End()
+
+	users, err := service.findLogin(ctx, login)
+	if err == nil && len(users) > 0 && service.mailer == nil {
+		err = errNoMailer
+	}
+	for _, user := range users {
+		if err != nil {
+			break
+		}
+		err = service.resendTo(ctx, user)
+	}
+	if err != nil {
+		span.RecordError(err)
+		userErrors.With("verify_email").Inc()
+	}
+	return err
+}
+
+func (service *UserService) resendTo(ctx context.Context, user *User) error {
+	token, err := service.store.LastToken(ctx, TokenVerifyEmail, user.Username)
+	if err != nil {
+		return err
+	}
+
+	address := user.Email
+	if token != nil {
+		interval := config.GetConfig().EmailVerification.ResendInterval
+		if time.Since(token.Created) < interval {
+			emailVerifications.With("throttled").Inc()
+			return nil
+		}
+		address = token.Data
+	} else if user.Email == "" || user.EmailVerified {
+		return nil
+	}
+	return service.sendVerification(ctx, user, address)
+}
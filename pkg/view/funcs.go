@@ -0,0 +1,69 @@
+package view
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultFuncs are available to every template. Callers may override them,
+// e.g. to point "static" at content-hashed asset URLs.
+func DefaultFuncs() Funcs {
+	return Funcs{
+		"static": func(name string) string {
+			return "/static/" + name
+		},
+		"formatDate": formatDate,
+		"initials":   initials,
+		"pluralize":  pluralize,
+	}
+}
+
+const dateLayout = "2 Jan 2006 15:04"
+
+// formatDate renders a time for display. An optional layout overrides the
+// default, and the zero time renders as an empty string.
+func formatDate(value time.Time, layout ...string) string {
+	if value.IsZero() {
+		return ""
+	}
+	if len(layout) > 0 {
+		return value.Format(layout[0])
+	}
+	return value.Format(dateLayout)
+}
+
+// initials returns up to two upper case letters for an avatar, taken from
+// the first letter of each non-empty name.
+func initials(names ...string) string {
+	var letters strings.Builder
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		first, _ := utf8.DecodeRuneInString(name)
+		letters.WriteRune(unicode.ToUpper(first))
+		if utf8.RuneCountInString(letters.String()) == 2 {
+			break
+		}
+	}
+	if letters.Len() == 0 {
+		return "?"
+	}
+	return letters.String()
+}
+
+// pluralize formats count with the singular or plural noun, e.g.
+// pluralize 1 "user" "users" is "1 user". The plural defaults to singular+"s".
+func pluralize(count int, singular string, plural ...string) string {
+	if count == 1 {
+		return fmt.Sprintf("%d %s", count, singular)
+	}
+	if len(plural) > 0 {
+		return fmt.Sprintf("%d %s", count, plural[0])
+	}
+	return fmt.Sprintf("%d %ss", count, singular)
+}
@@ -0,0 +1,92 @@
+package view
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+// Page is what every template is executed with. Data is whatever the
+// handler is rendering; the rest is used by the layout and partials.
+type Page struct {
+	Data    any
+	Nonce   string
+	Flashes []Flash
+}
+
+type Flash struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// NewPage wraps data for rendering, taking the request's CSP nonce and any
+// flash messages left by a previous response. Reading the flashes clears
+// them, so NewPage must be called before the response header is written.
+func NewPage(writer http.ResponseWriter, request *http.Request, data any) *Page {
+	return &Page{
+		Data:    data,
+		Nonce:   NonceFromContext(request.Context()),
+		Flashes: popFlashes(writer, request),
+	}
+}
+
+const flashCookie = "flash"
+
+// AddFlash queues a message to be shown on the next page the browser
+// renders, which is usually the one it is redirected to.
+func AddFlash(writer http.ResponseWriter, request *http.Request, kind string, message string) {
+	flashes := readFlashes(request)
+	flashes = append(flashes, Flash{Kind: kind, Message: message})
+
+	encoded, _ := json.Marshal(flashes)
+	http.SetCookie(writer, &http.Cookie{
+		Name:     flashCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(encoded),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func readFlashes(request *http.Request) []Flash {
+	cookie, err := request.Cookie(flashCookie)
+	if err != nil {
+		return nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil
+	}
+
+	var flashes []Flash
+	json.Unmarshal(decoded, &flashes)
+	return flashes
+}
+
+func popFlashes(writer http.ResponseWriter, request *http.Request) []Flash {
+	flashes := readFlashes(request)
+	if flashes != nil {
+		http.SetCookie(writer, &http.Cookie{Name: flashCookie, Path: "/", MaxAge: -1})
+	}
+	return flashes
+}
+
+type nonceKey struct{}
+
+// NewNonce returns a random value for a Content-Security-Policy nonce.
+func NewNonce() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(nonce)
+}
+
+func WithNonce(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, nonceKey{}, nonce)
+}
+
+func NonceFromContext(ctx context.Context) string {
+	nonce, _ := ctx.Value(nonceKey{}).(string)
+	return nonce
+}
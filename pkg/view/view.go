@@ -0,0 +1,110 @@
+package view
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+)
+
+//go:embed templates
+var embedded embed.FS
+
+const layoutName = "layout.html"
+
+// Renderer executes page templates inside the shared layout and partials.
+// Pages define "title", "content" and optionally "scripts" blocks and are
+// executed with a *Page. Templates are parsed once up front, or on every
+// render in dev mode so edits show up without a restart.
+type Renderer struct {
+	layout fs.FS
+	pages  fs.FS
+	funcs  Funcs
+	dev    bool
+
+	templates map[string]*template.Template
+}
+
+// Layout returns the layout and partial templates, from pkg/view/templates on
+// disk in dev mode or from the binary otherwise.
+func Layout(dev bool) fs.FS {
+	if dev {
+		return os.DirFS("pkg/view/templates")
+	}
+	templates, _ := fs.Sub(embedded, "templates")
+	return templates
+}
+
+type Funcs = template.FuncMap
+
+func NewRenderer(layout fs.FS, pages fs.FS, funcs Funcs, dev bool) (*Renderer, error) {
+	merged := DefaultFuncs()
+	for name, function := range funcs {
+		merged[name] = function
+	}
+
+	renderer := &Renderer{layout: layout, pages: pages, funcs: merged, dev: dev, templates: map[string]*template.Template{}}
+	if dev {
+		return renderer, nil
+	}
+
+	names, err := fs.Glob(pages, "*.html")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		tmpl, err := renderer.parse(name)
+		if err != nil {
+			return nil, err
+		}
+		renderer.templates[name] = tmpl
+	}
+
+	return renderer, nil
+}
+
+func (renderer *Renderer) parse(name string) (*template.Template, error) {
+	tmpl, err := template.New(layoutName).Funcs(renderer.funcs).ParseFS(renderer.layout, layoutName)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing layout: %s", err)
+	}
+
+	partials, err := fs.Glob(renderer.layout, "partials/*.html")
+	if err != nil {
+		return nil, err
+	}
+	if len(partials) > 0 {
+		tmpl, err = tmpl.ParseFS(renderer.layout, partials...)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing partials: %s", err)
+		}
+	}
+
+	tmpl, err = tmpl.ParseFS(renderer.pages, name)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template %s: %s", name, err)
+	}
+	return tmpl, nil
+}
+
+func (renderer *Renderer) Template(name string) (*template.Template, error) {
+	if renderer.dev {
+		return renderer.parse(name)
+	}
+
+	tmpl, ok := renderer.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("template not found: %s", name)
+	}
+	return tmpl, nil
+}
+
+func (renderer *Renderer) Render(writer io.Writer, name string, page *Page) error {
+	tmpl, err := renderer.Template(name)
+	if err != nil {
+		return err
+	}
+	return tmpl.ExecuteTemplate(writer, layoutName, page)
+}
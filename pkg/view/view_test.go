@@ -0,0 +1,147 @@
+package view
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestView(t *testing.T) {
+
+	layout := fstest.MapFS{"layout.html": {Data: []byte(`<title>{{template "title" .}}</title>{{template "content" .}}{{block "scripts" .}}{{end}}`)}}
+
+	t.Run("Render executes a page inside the layout", func(t *testing.T) {
+		pages := fstest.MapFS{"page.html": {Data: []byte(`{{define "title"}}Hi{{end}}{{define "content"}}<p>{{.Data}}</p>{{end}}`)}}
+		renderer, err := NewRenderer(layout, pages, nil, false)
+		if err != nil {
+			t.Fatalf("error parsing templates: %s", err)
+		}
+
+		var output bytes.Buffer
+		err = renderer.Render(&output, "page.html", &Page{Data: "lou"})
+		if err != nil {
+			t.Fatalf("error rendering: %s", err)
+		}
+		if output.String() != "<title>Hi</title><p>lou</p>" {
+			t.Errorf("unexpected output: %s", output.String())
+		}
+	})
+
+	t.Run("NewRenderer fails fast on a broken page", func(t *testing.T) {
+		pages := fstest.MapFS{"broken.html": {Data: []byte(`{{define "content"}}{{.Missing`)}}
+		_, err := NewRenderer(layout, pages, nil, false)
+		if err == nil {
+			t.Fatal("expected a parse error")
+		}
+	})
+
+	t.Run("funcs override the defaults", func(t *testing.T) {
+		pages := fstest.MapFS{"page.html": {Data: []byte(`{{define "title"}}{{end}}{{define "content"}}{{static "a.css"}}{{end}}`)}}
+		renderer, err := NewRenderer(layout, pages, Funcs{"static": func(name string) string { return "/hashed/" + name }}, false)
+		if err != nil {
+			t.Fatalf("error parsing templates: %s", err)
+		}
+
+		var output bytes.Buffer
+		renderer.Render(&output, "page.html", &Page{})
+		if output.String() != "<title></title>/hashed/a.css" {
+			t.Errorf("unexpected output: %s", output.String())
+		}
+	})
+
+	t.Run("dev mode picks up template changes", func(t *testing.T) {
+		pages := fstest.MapFS{"page.html": {Data: []byte(`{{define "title"}}{{end}}{{define "content"}}v1{{end}}`)}}
+		renderer, err := NewRenderer(layout, pages, nil, true)
+		if err != nil {
+			t.Fatalf("error creating renderer: %s", err)
+		}
+		pages["page.html"] = &fstest.MapFile{Data: []byte(`{{define "title"}}{{end}}{{define "content"}}v2{{end}}`)}
+
+		var output bytes.Buffer
+		renderer.Render(&output, "page.html", &Page{})
+		if output.String() != "<title></title>v2" {
+			t.Errorf("template was not reloaded: %s", output.String())
+		}
+	})
+
+	t.Run("Render escapes data for HTML", func(t *testing.T) {
+		pages := fstest.MapFS{"page.html": {Data: []byte(`{{define "title"}}{{end}}{{define "content"}}<p>{{.Data}}</p>{{end}}`)}}
+		renderer, err := NewRenderer(layout, pages, nil, false)
+		if err != nil {
+			t.Fatalf("error parsing templates: %s", err)
+		}
+
+		var output bytes.Buffer
+		renderer.Render(&output, "page.html", &Page{Data: "<script>"})
+		if output.String() != "<title></title><p>&lt;script&gt;</p>" {
+			t.Errorf("data was not escaped: %s", output.String())
+		}
+	})
+
+	t.Run("the embedded layout renders flashes and partials", func(t *testing.T) {
+		pages := fstest.MapFS{"page.html": {Data: []byte(`{{define "title"}}Page{{end}}{{define "content"}}body{{end}}`)}}
+		renderer, err := NewRenderer(Layout(false), pages, nil, false)
+		if err != nil {
+			t.Fatalf("error parsing templates: %s", err)
+		}
+
+		var output bytes.Buffer
+		err = renderer.Render(&output, "page.html", &Page{Flashes: []Flash{{Kind: "success", Message: "saved"}}})
+		if err != nil {
+			t.Fatalf("error rendering: %s", err)
+		}
+		for _, expected := range []string{`<nav class="navbar">`, `<div class="flash flash-success" role="status">saved</div>`, "body"} {
+			if !bytes.Contains(output.Bytes(), []byte(expected)) {
+				t.Errorf("missing %q in %s", expected, output.String())
+			}
+		}
+	})
+
+	t.Run("funcs format dates, initials and plurals", func(t *testing.T) {
+		date := time.Date(2023, time.May, 23, 14, 5, 0, 0, time.UTC)
+		if formatDate(date) != "23 May 2023 14:05" || formatDate(date, "2006") != "2023" || formatDate(time.Time{}) != "" {
+			t.Errorf("unexpected formatDate output: %s", formatDate(date))
+		}
+		if initials("lou", "garwood") != "LG" || initials("ádison", "") != "Á" || initials("", " ") != "?" {
+			t.Errorf("unexpected initials: %s", initials("lou", "garwood"))
+		}
+		if pluralize(1, "user") != "1 user" || pluralize(0, "user") != "0 users" || pluralize(2, "person", "people") != "2 people" {
+			t.Errorf("unexpected pluralize output: %s", pluralize(2, "user"))
+		}
+	})
+
+	t.Run("flashes survive one redirect and are then cleared", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		AddFlash(recorder, httptest.NewRequest("POST", "/users", nil), "success", "saved")
+
+		request := httptest.NewRequest("GET", "/users", nil)
+		for _, cookie := range recorder.Result().Cookies() {
+			request.AddCookie(cookie)
+		}
+		recorder = httptest.NewRecorder()
+		page := NewPage(recorder, request, nil)
+
+		if len(page.Flashes) != 1 || page.Flashes[0].Message != "saved" {
+			t.Fatalf("flash not read: %v", page.Flashes)
+		}
+		cleared := recorder.Result().Cookies()
+		if len(cleared) != 1 || cleared[0].MaxAge >= 0 {
+			t.Errorf("flash cookie not cleared: %v", cleared)
+		}
+	})
+
+	t.Run("NewPage reads the nonce from the request context", func(t *testing.T) {
+		request := httptest.NewRequest("GET", "/users", nil)
+		request = request.WithContext(WithNonce(request.Context(), "nonce"))
+
+		page := NewPage(httptest.NewRecorder(), request, nil)
+		if page.Nonce != "nonce" {
+			t.Errorf("wrong nonce: %s", page.Nonce)
+		}
+		if NewNonce() == NewNonce() {
+			t.Error("nonces are not random")
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// maxDepth limits how deeply CBOR items may nest, so a hostile response
+// cannot exhaust the stack.
+const maxDepth = 16
+
+var errTruncated = errors.New("cbor: truncated")
+
+// decodeCBOR decodes the CBOR item at the start of data, returning it and
+// whatever follows. It handles the subset WebAuthn uses: integers, which
+// come back as int64, byte and text strings, arrays, maps with integer or
+// text keys, booleans and null. Indefinite lengths, tags and floats are
+// refused.
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeItem(data, 0)
+}
+
+func decodeItem(data []byte, depth int) (any, []byte, error) {
+	if depth > maxDepth {
+		return nil, nil, errors.New("cbor: nested too deeply")
+	}
+	if len(data) == 0 {
+		return nil, nil, errTruncated
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22:
+			return nil, data, nil
+		}
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value or float %d", info)
+	}
+
+	var argument uint64
+	switch {
+	case info < 24:
+		argument = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, errTruncated
+		}
+		for _, b := range data[:size] {
+			argument = argument<<8 | uint64(b)
+		}
+		data = data[size:]
+	default:
+		return nil, nil, fmt.Errorf("cbor: unsupported additional information %d", info)
+	}
+
+	switch major {
+	case 0:
+		if argument > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflows int64")
+		}
+		return int64(argument), data, nil
+	case 1:
+		if argument > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflows int64")
+		}
+		return -1 - int64(argument), data, nil
+	case 2, 3:
+		if argument > uint64(len(data)) {
+			return nil, nil, errTruncated
+		}
+		value := data[:argument]
+		if major == 3 {
+			return string(value), data[argument:], nil
+		}
+		return append([]byte{}, value...), data[argument:], nil
+	case 4:
+		// Every item takes at least a byte, so longer arrays cannot fit.
+		if argument > uint64(len(data)) {
+			return nil, nil, errTruncated
+		}
+		array := make([]any, 0, argument)
+		for i := uint64(0); i < argument; i++ {
+			var item any
+			var err error
+			item, data, err = decodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			array = append(array, item)
+		}
+		return array, data, nil
+	case 5:
+		if argument > uint64(len(data)) {
+			return nil, nil, errTruncated
+		}
+		object := make(map[any]any, argument)
+		for i := uint64(0); i < argument; i++ {
+			var key, value any
+			var err error
+			key, data, err = decodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key %T", key)
+			}
+			if _, found := object[key]; found {
+				return nil, nil, fmt.Errorf("cbor: duplicate map key %v", key)
+			}
+			value, data, err = decodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			object[key] = value
+		}
+		return object, data, nil
+	}
+	return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+// uint32At reads the big-endian uint32 at the start of data.
+func uint32At(data []byte) uint32 {
+	return binary.BigEndian.Uint32(data)
+}
@@ -0,0 +1,91 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers for the signatures this package verifies.
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// Algorithms lists the supported algorithms, most preferred first.
+var Algorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// publicKey is a credential public key decoded from its COSE_Key form.
+type publicKey struct {
+	algorithm int
+	key       crypto.PublicKey
+}
+
+// parsePublicKey decodes a COSE_Key, returning it and the bytes after it.
+func parsePublicKey(data []byte) (*publicKey, []byte, error) {
+	value, rest, err := decodeCBOR(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	object, ok := value.(map[any]any)
+	if !ok {
+		return nil, nil, errors.New("public key is not a map")
+	}
+	keyType, _ := object[int64(1)].(int64)
+	algorithm, _ := object[int64(3)].(int64)
+	curve, _ := object[int64(-1)].(int64)
+
+	switch {
+	case keyType == 2 && algorithm == AlgES256 && curve == 1:
+		x, xOK := object[int64(-2)].([]byte)
+		y, yOK := object[int64(-3)].([]byte)
+		if !xOK || !yOK || len(x) != 32 || len(y) != 32 {
+			return nil, nil, errors.New("bad P-256 coordinates")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, nil, errors.New("P-256 point is not on the curve")
+		}
+		return &publicKey{algorithm: AlgES256, key: key}, rest, nil
+	case keyType == 1 && algorithm == AlgEdDSA && curve == 6:
+		x, ok := object[int64(-2)].([]byte)
+		if !ok || len(x) != ed25519.PublicKeySize {
+			return nil, nil, errors.New("bad Ed25519 key")
+		}
+		return &publicKey{algorithm: AlgEdDSA, key: ed25519.PublicKey(x)}, rest, nil
+	case keyType == 3 && algorithm == AlgRS256:
+		n, nOK := object[int64(-1)].([]byte)
+		e, eOK := object[int64(-2)].([]byte)
+		if !nOK || !eOK || len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, nil, errors.New("bad RSA key")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &publicKey{algorithm: AlgRS256, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}}, rest, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported key type %d with algorithm %d", keyType, algorithm)
+}
+
+// verify checks signature over data with the key.
+func (key *publicKey) verify(data, signature []byte) bool {
+	switch public := key.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(public, digest[:], signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(public, data, signature)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
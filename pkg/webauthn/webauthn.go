@@ -0,0 +1,488 @@
+// Package webauthn implements the relying party side of the WebAuthn
+// registration and authentication ceremonies, enough to let people log in
+// with passkeys and security keys.
+//
+// Options and responses use the JSON forms browsers produce with
+// PublicKeyCredential.parseCreationOptionsFromJSON, parseRequestOptionsFromJSON
+// and toJSON, so binary fields are unpadded base64url strings.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrInvalid is wrapped by every error for a response that fails
+	// verification.
+	ErrInvalid = errors.New("webauthn: invalid response")
+	// ErrSignCount is returned when an authenticator reports a signature
+	// counter that did not go up, which suggests it has been cloned.
+	ErrSignCount = errors.New("webauthn: signature counter went backwards")
+)
+
+// Authenticator data flags.
+const (
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagAttestedData     = 0x40
+	flagExtensionData    = 0x80
+	authDataHeaderLength = 37
+)
+
+// User verification requirements.
+const (
+	VerificationRequired    = "required"
+	VerificationPreferred   = "preferred"
+	VerificationDiscouraged = "discouraged"
+)
+
+// RelyingParty is the site credentials are registered with.
+type RelyingParty struct {
+	// ID is the domain credentials are scoped to, like "example.com".
+	ID   string
+	Name string
+	// Origins are the origins responses may come from, like
+	// "https://example.com".
+	Origins []string
+	// UserVerification is one of the Verification constants. Responses
+	// must show the user was verified only when it is required.
+	UserVerification string
+}
+
+// Credential is a registered public key credential.
+type Credential struct {
+	ID []byte
+	// PublicKey is the COSE_Key the authenticator returned.
+	PublicKey []byte
+	SignCount uint32
+}
+
+// User describes the account a credential is being registered for. ID is
+// an opaque handle of at most 64 bytes that should not identify the user
+// on its own.
+type User struct {
+	ID          []byte
+	Name        string
+	DisplayName string
+}
+
+// NewChallenge returns a random challenge for a ceremony.
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// Encode returns data as unpadded base64url, the form WebAuthn JSON uses.
+func Encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decode reverses Encode, also accepting padding.
+func Decode(text string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(text, "="))
+}
+
+type RelyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type Parameter struct {
+	Type      string `json:"type"`
+	Algorithm int    `json:"alg"`
+}
+
+type Descriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are the options for navigator.credentials.create.
+type CreationOptions struct {
+	RelyingParty           RelyingPartyEntity     `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	Challenge              string                 `json:"challenge"`
+	Parameters             []Parameter            `json:"pubKeyCredParams"`
+	Timeout                int                    `json:"timeout"`
+	Exclude                []Descriptor           `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the options for navigator.credentials.get.
+type RequestOptions struct {
+	Challenge        string       `json:"challenge"`
+	Timeout          int          `json:"timeout"`
+	RelyingPartyID   string       `json:"rpId"`
+	Allow            []Descriptor `json:"allowCredentials"`
+	UserVerification string       `json:"userVerification"`
+}
+
+// timeout is how long browsers are asked to wait for the user, in
+// milliseconds.
+const timeout = 5 * 60 * 1000
+
+func descriptors(credentials []Credential) []Descriptor {
+	list := []Descriptor{}
+	for _, credential := range credentials {
+		list = append(list, Descriptor{Type: "public-key", ID: Encode(credential.ID)})
+	}
+	return list
+}
+
+func (rp *RelyingParty) userVerification() string {
+	if rp.UserVerification == "" {
+		return VerificationPreferred
+	}
+	return rp.UserVerification
+}
+
+// CreationOptions returns the options to register a new credential for the
+// user. The user's existing credentials are excluded so the same
+// authenticator isn't registered twice. Credentials are made discoverable
+// where the authenticator allows, so they work as passkeys.
+func (rp *RelyingParty) CreationOptions(user User, challenge []byte, exclude []Credential) *CreationOptions {
+	options := &CreationOptions{
+		RelyingParty: RelyingPartyEntity{ID: rp.ID, Name: rp.Name},
+		User:         UserEntity{ID: Encode(user.ID), Name: user.Name, DisplayName: user.DisplayName},
+		Challenge:    Encode(challenge),
+		Timeout:      timeout,
+		Exclude:      descriptors(exclude),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: rp.userVerification(),
+		},
+		Attestation: "none",
+	}
+	for _, algorithm := range Algorithms {
+		options.Parameters = append(options.Parameters, Parameter{Type: "public-key", Algorithm: algorithm})
+	}
+	return options
+}
+
+// RequestOptions returns the options to authenticate with one of allow, or
+// with any discoverable credential when allow is empty.
+func (rp *RelyingParty) RequestOptions(challenge []byte, allow []Credential) *RequestOptions {
+	return &RequestOptions{
+		Challenge:        Encode(challenge),
+		Timeout:          timeout,
+		RelyingPartyID:   rp.ID,
+		Allow:            descriptors(allow),
+		UserVerification: rp.userVerification(),
+	}
+}
+
+// RegistrationResponse is the JSON form of the credential
+// navigator.credentials.create returns.
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the JSON form of the credential
+// navigator.credentials.get returns.
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func invalid(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, a...))
+}
+
+func parseClientData(encoded string) (*clientData, []byte, error) {
+	raw, err := Decode(encoded)
+	if err != nil {
+		return nil, nil, invalid("client data is not base64url")
+	}
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, nil, invalid("client data is not JSON")
+	}
+	return &data, raw, nil
+}
+
+// challengeOf returns the challenge the client data was signed for, so the
+// caller can find the ceremony the response belongs to.
+func challengeOf(encoded string) ([]byte, error) {
+	data, _, err := parseClientData(encoded)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := Decode(data.Challenge)
+	if err != nil || len(challenge) == 0 {
+		return nil, invalid("bad challenge")
+	}
+	return challenge, nil
+}
+
+// Challenge returns the challenge the response answers.
+func (response *RegistrationResponse) Challenge() ([]byte, error) {
+	return challengeOf(response.Response.ClientDataJSON)
+}
+
+// Challenge returns the challenge the response answers.
+func (response *AssertionResponse) Challenge() ([]byte, error) {
+	return challengeOf(response.Response.ClientDataJSON)
+}
+
+// CredentialID returns the ID of the credential that signed the response.
+func (response *AssertionResponse) CredentialID() ([]byte, error) {
+	id, err := Decode(response.RawID)
+	if err != nil || len(id) == 0 {
+		return nil, invalid("bad credential ID")
+	}
+	return id, nil
+}
+
+// checkClientData checks the client data is for the ceremony, challenge
+// and one of the relying party's origins, returning its hash.
+func (rp *RelyingParty) checkClientData(encoded, ceremony string, challenge []byte) ([]byte, error) {
+	data, raw, err := parseClientData(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if data.Type != ceremony {
+		return nil, invalid("got client data for %q want %q", data.Type, ceremony)
+	}
+	got, err := Decode(data.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return nil, invalid("challenge does not match")
+	}
+	allowed := false
+	for _, origin := range rp.Origins {
+		if data.Origin == origin {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, invalid("origin %q is not allowed", data.Origin)
+	}
+	hash := sha256.Sum256(raw)
+	return hash[:], nil
+}
+
+type authenticatorData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthenticatorData checks the authenticator data is for the relying
+// party and has the flags it needs, and pulls out the attested credential
+// when there is one.
+func (rp *RelyingParty) parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < authDataHeaderLength {
+		return nil, invalid("authenticator data is too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(raw[:32], rpIDHash[:]) != 1 {
+		return nil, invalid("authenticator data is for another relying party")
+	}
+	data := &authenticatorData{flags: raw[32], signCount: uint32At(raw[33:])}
+	if data.flags&flagUserPresent == 0 {
+		return nil, invalid("user was not present")
+	}
+	if rp.UserVerification == VerificationRequired && data.flags&flagUserVerified == 0 {
+		return nil, invalid("user was not verified")
+	}
+
+	rest := raw[authDataHeaderLength:]
+	if data.flags&flagAttestedData != 0 {
+		// The AAGUID comes first, then the credential ID's length.
+		if len(rest) < 18 {
+			return nil, invalid("attested credential data is too short")
+		}
+		length := int(rest[16])<<8 | int(rest[17])
+		rest = rest[18:]
+		if length == 0 || length > 1023 || len(rest) < length {
+			return nil, invalid("bad credential ID length")
+		}
+		data.credentialID = rest[:length]
+		rest = rest[length:]
+		_, after, err := parsePublicKey(rest)
+		if err != nil {
+			return nil, invalid("%s", err)
+		}
+		data.publicKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+	if data.flags&flagExtensionData != 0 {
+		var err error
+		if _, rest, err = decodeCBOR(rest); err != nil {
+			return nil, invalid("bad extension data: %s", err)
+		}
+	}
+	if len(rest) != 0 {
+		return nil, invalid("trailing bytes after authenticator data")
+	}
+	return data, nil
+}
+
+// VerifyRegistration checks response answers challenge and returns the new
+// credential. Attestation is only checked to be well formed and signed:
+// "none" and "packed" statements are accepted, and attestation
+// certificates are not traced back to a manufacturer.
+func (rp *RelyingParty) VerifyRegistration(response *RegistrationResponse, challenge []byte) (*Credential, error) {
+	if response.Type != "public-key" {
+		return nil, invalid("got credential type %q", response.Type)
+	}
+	clientDataHash, err := rp.checkClientData(response.Response.ClientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := Decode(response.Response.AttestationObject)
+	if err != nil {
+		return nil, invalid("attestation object is not base64url")
+	}
+	value, rest, err := decodeCBOR(raw)
+	if err != nil || len(rest) != 0 {
+		return nil, invalid("attestation object is not CBOR")
+	}
+	object, _ := value.(map[any]any)
+	format, _ := object["fmt"].(string)
+	statement, _ := object["attStmt"].(map[any]any)
+	authData, _ := object["authData"].([]byte)
+	if statement == nil || authData == nil {
+		return nil, invalid("attestation object is missing fields")
+	}
+
+	data, err := rp.parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if data.credentialID == nil {
+		return nil, invalid("no attested credential")
+	}
+	if id, err := Decode(response.RawID); err != nil || !bytes.Equal(id, data.credentialID) {
+		return nil, invalid("credential ID does not match the attested credential")
+	}
+	key, _, err := parsePublicKey(data.publicKey)
+	if err != nil {
+		return nil, invalid("%s", err)
+	}
+
+	switch format {
+	case "none":
+		if len(statement) != 0 {
+			return nil, invalid("attestation statement of format none is not empty")
+		}
+	case "packed":
+		if err := verifyPacked(statement, key, append(authData, clientDataHash...)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, invalid("unsupported attestation format %q", format)
+	}
+
+	return &Credential{ID: data.credentialID, PublicKey: data.publicKey, SignCount: data.signCount}, nil
+}
+
+// verifyPacked checks a packed attestation statement's signature, made
+// either with the credential itself or with the first certificate in x5c.
+func verifyPacked(statement map[any]any, key *publicKey, signed []byte) error {
+	algorithm, _ := statement["alg"].(int64)
+	signature, _ := statement["sig"].([]byte)
+	if signature == nil {
+		return invalid("packed attestation has no signature")
+	}
+	if chain, found := statement["x5c"].([]any); found {
+		if len(chain) == 0 {
+			return invalid("packed attestation has an empty certificate chain")
+		}
+		der, _ := chain[0].([]byte)
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return invalid("bad attestation certificate: %s", err)
+		}
+		key = &publicKey{algorithm: int(algorithm), key: certificate.PublicKey}
+	} else if int(algorithm) != key.algorithm {
+		return invalid("self attestation algorithm %d does not match the credential", algorithm)
+	}
+	if !key.verify(signed, signature) {
+		return invalid("bad attestation signature")
+	}
+	return nil
+}
+
+// VerifyAssertion checks response answers challenge and is signed by
+// credential, returning the authenticator's new signature counter. An
+// authenticator that keeps a counter must report more than last time, or
+// ErrSignCount is returned.
+func (rp *RelyingParty) VerifyAssertion(response *AssertionResponse, challenge []byte, credential *Credential) (uint32, error) {
+	if response.Type != "public-key" {
+		return 0, invalid("got credential type %q", response.Type)
+	}
+	if id, err := response.CredentialID(); err != nil || !bytes.Equal(id, credential.ID) {
+		return 0, invalid("response is for another credential")
+	}
+	clientDataHash, err := rp.checkClientData(response.Response.ClientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+	authData, err := Decode(response.Response.AuthenticatorData)
+	if err != nil {
+		return 0, invalid("authenticator data is not base64url")
+	}
+	data, err := rp.parseAuthenticatorData(authData)
+	if err != nil {
+		return 0, err
+	}
+	signature, err := Decode(response.Response.Signature)
+	if err != nil {
+		return 0, invalid("signature is not base64url")
+	}
+	key, _, err := parsePublicKey(credential.PublicKey)
+	if err != nil {
+		return 0, invalid("stored key: %s", err)
+	}
+	if !key.verify(append(authData, clientDataHash...), signature) {
+		return 0, invalid("bad signature")
+	}
+	if (data.signCount != 0 || credential.SignCount != 0) && data.signCount <= credential.SignCount {
+		return 0, ErrSignCount
+	}
+	return data.signCount, nil
+}
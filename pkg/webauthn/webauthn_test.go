@@ -0,0 +1,191 @@
+package webauthn_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/letitloose/user-app/pkg/webauthn"
+	"github.com/letitloose/user-app/pkg/webauthn/webauthntest"
+)
+
+func TestWebAuthn(t *testing.T) {
+	rp := &webauthn.RelyingParty{ID: "example.com", Name: "Example", Origins: []string{"https://example.com"}}
+	user := webauthn.User{ID: []byte{1, 2, 3}, Name: "lou", DisplayName: "Lou"}
+
+	register := func(t *testing.T, authenticator *webauthntest.Authenticator) *webauthn.Credential {
+		t.Helper()
+		challenge, _ := webauthn.NewChallenge()
+		response, err := authenticator.Create(rp.CreationOptions(user, challenge, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		credential, err := rp.VerifyRegistration(response, challenge)
+		if err != nil {
+			t.Fatalf("got %s registering", err)
+		}
+		return credential
+	}
+
+	// rewrite decodes the client data, lets change edit it and encodes it again.
+	rewrite := func(encoded *string, change func(map[string]any)) {
+		raw, _ := webauthn.Decode(*encoded)
+		var data map[string]any
+		json.Unmarshal(raw, &data)
+		change(data)
+		raw, _ = json.Marshal(data)
+		*encoded = webauthn.Encode(raw)
+	}
+
+	t.Run("a registered credential can authenticate and its counter goes up", func(t *testing.T) {
+		authenticator := webauthntest.New("https://example.com")
+		credential := register(t, authenticator)
+
+		for want := uint32(1); want <= 2; want++ {
+			challenge, _ := webauthn.NewChallenge()
+			response, err := authenticator.Get(rp.RequestOptions(challenge, []webauthn.Credential{*credential}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := response.Challenge(); err != nil || !bytes.Equal(got, challenge) {
+				t.Errorf("got challenge %v, %v want %v", got, err, challenge)
+			}
+			count, err := rp.VerifyAssertion(response, challenge, credential)
+			if err != nil || count != want {
+				t.Fatalf("got %d, %v want %d", count, err, want)
+			}
+			credential.SignCount = count
+		}
+	})
+
+	t.Run("discoverable credentials are found without an allow list", func(t *testing.T) {
+		authenticator := webauthntest.New("https://example.com")
+		credential := register(t, authenticator)
+		challenge, _ := webauthn.NewChallenge()
+		response, err := authenticator.Get(rp.RequestOptions(challenge, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, _ := response.CredentialID(); !bytes.Equal(id, credential.ID) {
+			t.Errorf("got credential %v want %v", id, credential.ID)
+		}
+	})
+
+	t.Run("existing credentials are excluded from registration", func(t *testing.T) {
+		authenticator := webauthntest.New("https://example.com")
+		credential := register(t, authenticator)
+		challenge, _ := webauthn.NewChallenge()
+		_, err := authenticator.Create(rp.CreationOptions(user, challenge, []webauthn.Credential{*credential}))
+		if !errors.Is(err, webauthntest.ErrExcluded) {
+			t.Errorf("got %v want %v", err, webauthntest.ErrExcluded)
+		}
+	})
+
+	t.Run("a cloned authenticator is caught by its counter", func(t *testing.T) {
+		authenticator := webauthntest.New("https://example.com")
+		credential := register(t, authenticator)
+		clone := authenticator.Clone()
+
+		challenge, _ := webauthn.NewChallenge()
+		response, _ := authenticator.Get(rp.RequestOptions(challenge, nil))
+		count, err := rp.VerifyAssertion(response, challenge, credential)
+		if err != nil {
+			t.Fatal(err)
+		}
+		credential.SignCount = count
+
+		challenge, _ = webauthn.NewChallenge()
+		response, _ = clone.Get(rp.RequestOptions(challenge, nil))
+		if _, err := rp.VerifyAssertion(response, challenge, credential); !errors.Is(err, webauthn.ErrSignCount) {
+			t.Errorf("got %v want %v", err, webauthn.ErrSignCount)
+		}
+	})
+
+	t.Run("registration responses are checked", func(t *testing.T) {
+		tests := map[string]func(*webauthn.RegistrationResponse, *webauthn.RelyingParty){
+			"wrong origin": func(response *webauthn.RegistrationResponse, _ *webauthn.RelyingParty) {
+				rewrite(&response.Response.ClientDataJSON, func(data map[string]any) { data["origin"] = "https://evil.example" })
+			},
+			"wrong ceremony": func(response *webauthn.RegistrationResponse, _ *webauthn.RelyingParty) {
+				rewrite(&response.Response.ClientDataJSON, func(data map[string]any) { data["type"] = "webauthn.get" })
+			},
+			"wrong challenge": func(response *webauthn.RegistrationResponse, _ *webauthn.RelyingParty) {
+				rewrite(&response.Response.ClientDataJSON, func(data map[string]any) { data["challenge"] = "AAAA" })
+			},
+			"wrong relying party": func(_ *webauthn.RegistrationResponse, rp *webauthn.RelyingParty) {
+				rp.ID = "other.example"
+			},
+			"wrong credential ID": func(response *webauthn.RegistrationResponse, _ *webauthn.RelyingParty) {
+				response.RawID = "AAAA"
+			},
+			"truncated attestation": func(response *webauthn.RegistrationResponse, _ *webauthn.RelyingParty) {
+				response.Response.AttestationObject = response.Response.AttestationObject[:len(response.Response.AttestationObject)-10]
+			},
+			"garbage attestation": func(response *webauthn.RegistrationResponse, _ *webauthn.RelyingParty) {
+				response.Response.AttestationObject = webauthn.Encode([]byte{0x9f, 0xff})
+			},
+		}
+		for name, tamper := range tests {
+			authenticator := webauthntest.New("https://example.com")
+			challenge, _ := webauthn.NewChallenge()
+			response, _ := authenticator.Create(rp.CreationOptions(user, challenge, nil))
+			verifier := *rp
+			tamper(response, &verifier)
+			if _, err := verifier.VerifyRegistration(response, challenge); !errors.Is(err, webauthn.ErrInvalid) {
+				t.Errorf("got %v for %s want %v", err, name, webauthn.ErrInvalid)
+			}
+		}
+	})
+
+	t.Run("assertions are checked", func(t *testing.T) {
+		authenticator := webauthntest.New("https://example.com")
+		credential := register(t, authenticator)
+		other := register(t, webauthntest.New("https://example.com"))
+
+		tests := map[string]func(*webauthn.AssertionResponse) *webauthn.Credential{
+			"wrong origin": func(response *webauthn.AssertionResponse) *webauthn.Credential {
+				rewrite(&response.Response.ClientDataJSON, func(data map[string]any) { data["origin"] = "https://evil.example" })
+				return credential
+			},
+			"changed client data": func(response *webauthn.AssertionResponse) *webauthn.Credential {
+				rewrite(&response.Response.ClientDataJSON, func(data map[string]any) { data["extra"] = true })
+				return credential
+			},
+			"bad signature": func(response *webauthn.AssertionResponse) *webauthn.Credential {
+				response.Response.Signature = webauthn.Encode([]byte("nope"))
+				return credential
+			},
+			"another credential's key": func(response *webauthn.AssertionResponse) *webauthn.Credential {
+				return &webauthn.Credential{ID: credential.ID, PublicKey: other.PublicKey}
+			},
+			"another credential's ID": func(response *webauthn.AssertionResponse) *webauthn.Credential {
+				return other
+			},
+		}
+		for name, tamper := range tests {
+			challenge, _ := webauthn.NewChallenge()
+			response, _ := authenticator.Get(rp.RequestOptions(challenge, nil))
+			if _, err := rp.VerifyAssertion(response, challenge, tamper(response)); !errors.Is(err, webauthn.ErrInvalid) {
+				t.Errorf("got %v for %s want %v", err, name, webauthn.ErrInvalid)
+			}
+		}
+	})
+
+	t.Run("user verification is enforced only when required", func(t *testing.T) {
+		authenticator := webauthntest.New("https://example.com")
+		authenticator.UserVerified = false
+		challenge, _ := webauthn.NewChallenge()
+		response, _ := authenticator.Create(rp.CreationOptions(user, challenge, nil))
+		if _, err := rp.VerifyRegistration(response, challenge); err != nil {
+			t.Errorf("got %s with verification preferred", err)
+		}
+
+		strict := *rp
+		strict.UserVerification = webauthn.VerificationRequired
+		if _, err := strict.VerifyRegistration(response, challenge); err == nil || !strings.Contains(err.Error(), "not verified") {
+			t.Errorf("got %v with verification required want an error", err)
+		}
+	})
+}
@@ -0,0 +1,238 @@
+// Package webauthntest provides a software authenticator that stands in for
+// the browser and security key in WebAuthn tests.
+package webauthntest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/letitloose/user-app/pkg/webauthn"
+)
+
+var (
+	// ErrExcluded is returned by Create when the authenticator already
+	// holds one of the excluded credentials.
+	ErrExcluded = errors.New("webauthntest: authenticator is already registered")
+	// ErrNoCredential is returned by Get when no credential fits.
+	ErrNoCredential = errors.New("webauthntest: no matching credential")
+)
+
+// Authenticator makes ES256 credentials and signs with them, producing the
+// same JSON a browser would. Each assertion bumps the credential's
+// signature counter.
+type Authenticator struct {
+	// Origin is reported in the client data, as a browser would.
+	Origin string
+	// UserVerified sets the user verified flag on responses.
+	UserVerified bool
+	credentials  []*credential
+}
+
+type credential struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+// New returns an authenticator with no credentials that verifies its user.
+func New(origin string) *Authenticator {
+	return &Authenticator{Origin: origin, UserVerified: true}
+}
+
+// Clone returns a copy holding the same keys and counters, as an attacker
+// who extracted them would.
+func (authenticator *Authenticator) Clone() *Authenticator {
+	clone := *authenticator
+	clone.credentials = nil
+	for _, original := range authenticator.credentials {
+		copied := *original
+		clone.credentials = append(clone.credentials, &copied)
+	}
+	return &clone
+}
+
+// Create answers navigator.credentials.create.
+func (authenticator *Authenticator) Create(options *webauthn.CreationOptions) (*webauthn.RegistrationResponse, error) {
+	for _, excluded := range options.Exclude {
+		if authenticator.find(options.RelyingParty.ID, excluded.ID) != nil {
+			return nil, ErrExcluded
+		}
+	}
+	userHandle, err := webauthn.Decode(options.User.ID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	created := &credential{id: id, rpID: options.RelyingParty.ID, userHandle: userHandle, key: key}
+
+	clientData, err := authenticator.clientData("webauthn.create", options.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	authData := authenticator.authData(created.rpID, 0x40, 0)
+	authData = append(authData, make([]byte, 16)...)
+	authData = append(authData, byte(len(id)>>8), byte(len(id)))
+	authData = append(authData, id...)
+	authData = append(authData, coseKey(&key.PublicKey)...)
+	attestation := encode(map[string]any{"fmt": "none", "attStmt": map[string]any{}, "authData": authData})
+	authenticator.credentials = append(authenticator.credentials, created)
+
+	response := &webauthn.RegistrationResponse{ID: webauthn.Encode(id), RawID: webauthn.Encode(id), Type: "public-key"}
+	response.Response.ClientDataJSON = webauthn.Encode(clientData)
+	response.Response.AttestationObject = webauthn.Encode(attestation)
+	return response, nil
+}
+
+// Get answers navigator.credentials.get, signing with the first allowed
+// credential, or any credential for the relying party when none are listed.
+func (authenticator *Authenticator) Get(options *webauthn.RequestOptions) (*webauthn.AssertionResponse, error) {
+	var chosen *credential
+	if len(options.Allow) == 0 {
+		for _, candidate := range authenticator.credentials {
+			if candidate.rpID == options.RelyingPartyID {
+				chosen = candidate
+				break
+			}
+		}
+	}
+	for _, allowed := range options.Allow {
+		if chosen = authenticator.find(options.RelyingPartyID, allowed.ID); chosen != nil {
+			break
+		}
+	}
+	if chosen == nil {
+		return nil, ErrNoCredential
+	}
+
+	clientData, err := authenticator.clientData("webauthn.get", options.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	chosen.signCount++
+	authData := authenticator.authData(chosen.rpID, 0, chosen.signCount)
+	hash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), hash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, chosen.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	response := &webauthn.AssertionResponse{ID: webauthn.Encode(chosen.id), RawID: webauthn.Encode(chosen.id), Type: "public-key"}
+	response.Response.ClientDataJSON = webauthn.Encode(clientData)
+	response.Response.AuthenticatorData = webauthn.Encode(authData)
+	response.Response.Signature = webauthn.Encode(signature)
+	response.Response.UserHandle = webauthn.Encode(chosen.userHandle)
+	return response, nil
+}
+
+func (authenticator *Authenticator) find(rpID, encodedID string) *credential {
+	id, err := webauthn.Decode(encodedID)
+	if err != nil {
+		return nil
+	}
+	for _, candidate := range authenticator.credentials {
+		if candidate.rpID == rpID && bytes.Equal(candidate.id, id) {
+			return candidate
+		}
+	}
+	return nil
+}
+
+func (authenticator *Authenticator) clientData(ceremony, challenge string) ([]byte, error) {
+	return json.Marshal(map[string]any{"type": ceremony, "challenge": challenge, "origin": authenticator.Origin, "crossOrigin": false})
+}
+
+func (authenticator *Authenticator) authData(rpID string, flags byte, signCount uint32) []byte {
+	hash := sha256.Sum256([]byte(rpID))
+	flags |= 0x01
+	if authenticator.UserVerified {
+		flags |= 0x04
+	}
+	data := append(hash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], signCount)
+	return data
+}
+
+// coseKey encodes an ES256 public key as a COSE_Key.
+func coseKey(key *ecdsa.PublicKey) []byte {
+	x, y := make([]byte, 32), make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return encode(map[int]any{1: 2, 3: webauthn.AlgES256, -1: 1, -2: x, -3: y})
+}
+
+// encode writes the CBOR for the few kinds of value responses need.
+func encode(value any) []byte {
+	switch value := value.(type) {
+	case int:
+		if value < 0 {
+			return head(1, uint64(-1-value))
+		}
+		return head(0, uint64(value))
+	case []byte:
+		return append(head(2, uint64(len(value))), value...)
+	case string:
+		return append(head(3, uint64(len(value))), value...)
+	case map[int]any:
+		keys := make([]int, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Ints(keys)
+		data := head(5, uint64(len(value)))
+		for _, key := range keys {
+			data = append(data, encode(key)...)
+			data = append(data, encode(value[key])...)
+		}
+		return data
+	case map[string]any:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		data := head(5, uint64(len(value)))
+		for _, key := range keys {
+			data = append(data, encode(key)...)
+			data = append(data, encode(value[key])...)
+		}
+		return data
+	}
+	panic("webauthntest: cannot encode value")
+}
+
+func head(major byte, argument uint64) []byte {
+	switch {
+	case argument < 24:
+		return []byte{major<<5 | byte(argument)}
+	case argument <= 0xff:
+		return []byte{major<<5 | 24, byte(argument)}
+	case argument <= 0xffff:
+		data := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(data[1:], uint16(argument))
+		return data
+	case argument <= 0xffffffff:
+		data := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(data[1:], uint32(argument))
+		return data
+	}
+	data := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(data[1:], argument)
+	return data
+}